@@ -18,30 +18,317 @@ func RegisterRoutes(mux *http.ServeMux, ctx *middlewares.AppContext) {
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
+	limits := ctx.Config.RateLimits
+
 	// API routes
 	mux.HandleFunc("GET /health", middlewares.Wrap(handlers.HandleHealthGET))
 
 	mux.HandleFunc("GET /api/jwks.json", middlewares.Wrap(handlers.HandleJWKSPublicKeyGET))
+	mux.HandleFunc("GET /.well-known/openid-configuration", middlewares.Wrap(handlers.HandleOpenIDConfigurationGET))
 
 	// Authentication routes
-	mux.HandleFunc("POST /api/login", middlewares.Wrap(handlers.HandleUserLoginPost))
-	mux.HandleFunc("POST /api/refresh", middlewares.Wrap(handlers.HandleRefreshTokenPost))
+	mux.HandleFunc("POST /api/login", middlewares.Wrap(middlewares.RateLimit(limits.Login, middlewares.KeyByIP, handlers.HandleUserLoginPost)))
+	mux.HandleFunc("POST /api/login/magic", middlewares.Wrap(middlewares.RateLimit(limits.Login, middlewares.KeyByIP, handlers.HandleMagicLinkPOST)))
+	mux.HandleFunc("POST /api/login/magic/verify", middlewares.Wrap(middlewares.RateLimit(limits.Login, middlewares.KeyByIP, handlers.HandleMagicLinkVerifyPOST)))
+	mux.HandleFunc("POST /api/login/mfa", middlewares.Wrap(middlewares.RateLimit(limits.Login, middlewares.KeyByIP, handlers.HandleMFAVerifyPOST)))
+	mux.HandleFunc("POST /api/login/mfa/webauthn/begin", middlewares.Wrap(middlewares.RateLimit(limits.Login, middlewares.KeyByIP, handlers.HandleWebAuthnMFABeginPOST)))
+	mux.HandleFunc("POST /api/login/mfa/webauthn/finish", middlewares.Wrap(middlewares.RateLimit(limits.Login, middlewares.KeyByIP, handlers.HandleWebAuthnMFAFinishPOST)))
+	mux.HandleFunc("POST /api/login/webauthn/begin", middlewares.Wrap(middlewares.RateLimit(limits.Login, middlewares.KeyByIP, handlers.HandleWebAuthnLoginBeginPOST)))
+	mux.HandleFunc("POST /api/login/webauthn/finish", middlewares.Wrap(middlewares.RateLimit(limits.Login, middlewares.KeyByIP, handlers.HandleWebAuthnLoginFinishPOST)))
+	mux.HandleFunc("POST /api/refresh", middlewares.Wrap(middlewares.RateLimit(limits.Refresh, middlewares.KeyByIP, handlers.HandleRefreshTokenPost)))
+
+	// OAuth 2.0 authorization and token endpoints
+	mux.HandleFunc("GET /oauth/authorize", middlewares.Wrap(middlewares.RateLimit(limits.Protected, middlewares.KeyByIP, handlers.HandleOAuthAuthorizeGET)))
+	mux.HandleFunc("POST /oauth/authorize", middlewares.Wrap(middlewares.RateLimit(limits.Login, middlewares.KeyByIP, handlers.HandleOAuthAuthorizePOST)))
+	mux.HandleFunc("POST /oauth/device_authorization", middlewares.Wrap(middlewares.RateLimit(limits.Refresh, middlewares.KeyByIP, handlers.HandleDeviceAuthorizationPOST)))
+	mux.HandleFunc("GET /oauth/device", middlewares.Wrap(middlewares.RateLimit(limits.Protected, middlewares.KeyByIP, handlers.HandleDeviceVerificationGET)))
+	mux.HandleFunc("POST /oauth/device", middlewares.Wrap(middlewares.RateLimit(limits.Login, middlewares.KeyByIP, handlers.HandleDeviceVerificationPOST)))
+	mux.HandleFunc("POST /oauth/token", middlewares.Wrap(middlewares.RateLimit(limits.Refresh, middlewares.KeyByIP, handlers.HandleOAuthTokenPOST)))
+
+	// OpenID Connect UserInfo (requires an access token with the openid scope)
+	mux.HandleFunc("GET /userinfo", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequireScope("openid", middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandleUserInfoGET)))))
+	mux.HandleFunc("POST /userinfo", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequireScope("openid", middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandleUserInfoGET)))))
 
-	// User management routes
-	mux.HandleFunc("GET /api/users", middlewares.Wrap(handlers.HandleUsersGET))
-	mux.HandleFunc("POST /api/users", middlewares.Wrap(handlers.HandleUsersPOST))
+	// Self-service registration (disabled unless REGISTRATION_ENABLED is set)
+	mux.HandleFunc("POST /api/register", middlewares.Wrap(middlewares.RateLimit(limits.Login, middlewares.KeyByIP, handlers.HandleRegisterPOST)))
+
+	// User management routes (require admin permissions, personal access tokens accepted)
+	mux.HandleFunc("GET /api/users", middlewares.Wrap(middlewares.RequireJWTOrPAT(middlewares.RequirePermission("users:read", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleUsersGET)))))
+	mux.HandleFunc("POST /api/users", middlewares.Wrap(middlewares.RequireJWTOrPAT(middlewares.RequirePermission("users:write", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleUsersPOST)))))
 	mux.HandleFunc("GET /api/users/{id}", func(w http.ResponseWriter, r *http.Request) {
 		// These don't use Wrap due to issues with path variables.
 		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
-		handlers.HandleUserGET(appCtx)
+		middlewares.RequireJWTOrPAT(middlewares.RequirePermission("users:read", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleUserGET)))(appCtx)
 	})
 	mux.HandleFunc("DELETE /api/users/{id}", func(w http.ResponseWriter, r *http.Request) {
 		// These don't use Wrap due to issues with path variables.
 		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
-		handlers.HandleUserDELETE(appCtx)
+		middlewares.RequireJWTOrPAT(middlewares.RequirePermission("users:delete", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleUserDELETE)))(appCtx)
+	})
+	mux.HandleFunc("POST /api/users/{id}/unlock", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWTOrPAT(middlewares.RequirePermission("users:write", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleUserUnlockPOST)))(appCtx)
+	})
+	mux.HandleFunc("PUT /api/users/{id}/status", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWTOrPAT(middlewares.RequirePermission("users:write", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleUserStatusPUT)))(appCtx)
+	})
+	mux.HandleFunc("POST /api/users/{id}/restore", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWTOrPAT(middlewares.RequirePermission("users:write", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleUserRestorePOST)))(appCtx)
+	})
+	mux.HandleFunc("POST /api/users/{id}/purge", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWTOrPAT(middlewares.RequirePermission("users:delete", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleUserPurgePOST)))(appCtx)
+	})
+	mux.HandleFunc("GET /api/audit-log", middlewares.Wrap(middlewares.RequireJWTOrPAT(middlewares.RequirePermission("audit:read", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleAuditLogGET)))))
+
+	// Role and permission administration (require the roles:manage permission)
+	mux.HandleFunc("GET /api/roles", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequirePermission("roles:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleRolesGET)))))
+	mux.HandleFunc("POST /api/roles", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequirePermission("roles:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleRolesPOST)))))
+	mux.HandleFunc("GET /api/roles/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequirePermission("roles:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleRoleGET)))(appCtx)
+	})
+	mux.HandleFunc("DELETE /api/roles/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequirePermission("roles:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleRoleDELETE)))(appCtx)
+	})
+	mux.HandleFunc("POST /api/roles/{id}/permissions", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequirePermission("roles:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleRolePermissionsPOST)))(appCtx)
+	})
+	mux.HandleFunc("DELETE /api/roles/{id}/permissions/{permission}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequirePermission("roles:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleRolePermissionDELETE)))(appCtx)
+	})
+	mux.HandleFunc("GET /api/permissions", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequirePermission("roles:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandlePermissionsGET)))))
+	mux.HandleFunc("POST /api/permissions", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequirePermission("roles:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandlePermissionsPOST)))))
+	mux.HandleFunc("DELETE /api/permissions/{name}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequirePermission("roles:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandlePermissionDELETE)))(appCtx)
+	})
+	mux.HandleFunc("GET /api/users/{id}/roles", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequirePermission("roles:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleUserRolesGET)))(appCtx)
+	})
+	mux.HandleFunc("POST /api/users/{id}/roles", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequirePermission("roles:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleUserRolesPOST)))(appCtx)
+	})
+	mux.HandleFunc("DELETE /api/users/{id}/roles/{role}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequirePermission("roles:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleUserRoleDELETE)))(appCtx)
+	})
+
+	// Group administration (require the groups:manage permission, personal access tokens accepted)
+	mux.HandleFunc("GET /api/groups", middlewares.Wrap(middlewares.RequireJWTOrPAT(middlewares.RequirePermission("groups:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleGroupsGET)))))
+	mux.HandleFunc("POST /api/groups", middlewares.Wrap(middlewares.RequireJWTOrPAT(middlewares.RequirePermission("groups:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleGroupsPOST)))))
+	mux.HandleFunc("GET /api/groups/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWTOrPAT(middlewares.RequirePermission("groups:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleGroupGET)))(appCtx)
+	})
+	mux.HandleFunc("PUT /api/groups/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWTOrPAT(middlewares.RequirePermission("groups:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleGroupPUT)))(appCtx)
+	})
+	mux.HandleFunc("DELETE /api/groups/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWTOrPAT(middlewares.RequirePermission("groups:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleGroupDELETE)))(appCtx)
+	})
+	mux.HandleFunc("GET /api/groups/{id}/members", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWTOrPAT(middlewares.RequirePermission("groups:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleGroupMembersGET)))(appCtx)
+	})
+	mux.HandleFunc("POST /api/groups/{id}/members", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWTOrPAT(middlewares.RequirePermission("groups:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleGroupMembersPOST)))(appCtx)
+	})
+	mux.HandleFunc("DELETE /api/groups/{id}/members/{user_id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWTOrPAT(middlewares.RequirePermission("groups:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleGroupMemberDELETE)))(appCtx)
+	})
+	mux.HandleFunc("POST /api/groups/{id}/subgroups", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWTOrPAT(middlewares.RequirePermission("groups:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleSubgroupsPOST)))(appCtx)
+	})
+	mux.HandleFunc("DELETE /api/groups/{id}/subgroups/{group_id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWTOrPAT(middlewares.RequirePermission("groups:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleSubgroupDELETE)))(appCtx)
+	})
+	mux.HandleFunc("GET /api/users/{id}/groups", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWTOrPAT(middlewares.RequirePermission("groups:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleUserGroupsGET)))(appCtx)
+	})
+
+	// Organization administration (default organization only, require the organizations:manage permission)
+	mux.HandleFunc("GET /api/organizations", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequirePermission("organizations:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleOrganizationsGET)))))
+	mux.HandleFunc("POST /api/organizations", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequirePermission("organizations:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleOrganizationsPOST)))))
+	mux.HandleFunc("GET /api/organizations/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequirePermission("organizations:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleOrganizationGET)))(appCtx)
+	})
+
+	// OAuth client administration (require the clients:manage permission)
+	mux.HandleFunc("GET /api/oauth/clients", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequirePermission("clients:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleOAuthClientsGET)))))
+	mux.HandleFunc("POST /api/oauth/clients", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequirePermission("clients:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleOAuthClientsPOST)))))
+	mux.HandleFunc("GET /api/oauth/clients/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequirePermission("clients:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleOAuthClientGET)))(appCtx)
+	})
+	mux.HandleFunc("PUT /api/oauth/clients/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequirePermission("clients:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleOAuthClientPUT)))(appCtx)
+	})
+	mux.HandleFunc("DELETE /api/oauth/clients/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequirePermission("clients:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleOAuthClientDELETE)))(appCtx)
+	})
+	mux.HandleFunc("POST /api/oauth/clients/{id}/secret", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequirePermission("clients:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleOAuthClientSecretPOST)))(appCtx)
+	})
+	mux.HandleFunc("GET /api/oauth/initial-access-tokens", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequirePermission("clients:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleInitialAccessTokensGET)))))
+	mux.HandleFunc("POST /api/oauth/initial-access-tokens", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequirePermission("clients:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleInitialAccessTokensPOST)))))
+	mux.HandleFunc("DELETE /api/oauth/initial-access-tokens/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequirePermission("clients:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleInitialAccessTokenDELETE)))(appCtx)
+	})
+
+	// Dynamic client registration (RFC 7591) and client configuration (RFC 7592)
+	mux.HandleFunc("POST /oauth/register", middlewares.Wrap(middlewares.RequireInitialAccessToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleClientRegistrationPOST))))
+	mux.HandleFunc("GET /oauth/register/{client_id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireRegistrationToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleClientConfigurationGET))(appCtx)
+	})
+	mux.HandleFunc("PUT /oauth/register/{client_id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireRegistrationToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleClientConfigurationPUT))(appCtx)
+	})
+	mux.HandleFunc("DELETE /oauth/register/{client_id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireRegistrationToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleClientConfigurationDELETE))(appCtx)
+	})
+
+	// SCIM token administration (require the scim:manage permission)
+	mux.HandleFunc("GET /api/scim/tokens", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequirePermission("scim:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleSCIMTokensGET)))))
+	mux.HandleFunc("POST /api/scim/tokens", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequirePermission("scim:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleSCIMTokensPOST)))))
+	mux.HandleFunc("DELETE /api/scim/tokens/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequirePermission("scim:manage", middlewares.RateLimit(limits.Users, middlewares.KeyBySubject, handlers.HandleSCIMTokenDELETE)))(appCtx)
+	})
+
+	// SCIM 2.0 provisioning (require a SCIM bearer token)
+	mux.HandleFunc("GET /scim/v2/ServiceProviderConfig", middlewares.Wrap(middlewares.RequireSCIMToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleSCIMServiceProviderConfigGET))))
+	mux.HandleFunc("GET /scim/v2/ResourceTypes", middlewares.Wrap(middlewares.RequireSCIMToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleSCIMResourceTypesGET))))
+	mux.HandleFunc("GET /scim/v2/Schemas", middlewares.Wrap(middlewares.RequireSCIMToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleSCIMSchemasGET))))
+	mux.HandleFunc("GET /scim/v2/Users", middlewares.Wrap(middlewares.RequireSCIMToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleSCIMUsersGET))))
+	mux.HandleFunc("POST /scim/v2/Users", middlewares.Wrap(middlewares.RequireSCIMToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleSCIMUsersPOST))))
+	mux.HandleFunc("GET /scim/v2/Users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireSCIMToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleSCIMUserGET))(appCtx)
+	})
+	mux.HandleFunc("PUT /scim/v2/Users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireSCIMToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleSCIMUserPUT))(appCtx)
+	})
+	mux.HandleFunc("PATCH /scim/v2/Users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireSCIMToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleSCIMUserPATCH))(appCtx)
+	})
+	mux.HandleFunc("DELETE /scim/v2/Users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireSCIMToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleSCIMUserDELETE))(appCtx)
+	})
+	mux.HandleFunc("GET /scim/v2/Groups", middlewares.Wrap(middlewares.RequireSCIMToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleSCIMGroupsGET))))
+	mux.HandleFunc("POST /scim/v2/Groups", middlewares.Wrap(middlewares.RequireSCIMToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleSCIMGroupsPOST))))
+	mux.HandleFunc("GET /scim/v2/Groups/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireSCIMToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleSCIMGroupGET))(appCtx)
+	})
+	mux.HandleFunc("PUT /scim/v2/Groups/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireSCIMToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleSCIMGroupPUT))(appCtx)
+	})
+	mux.HandleFunc("PATCH /scim/v2/Groups/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireSCIMToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleSCIMGroupPATCH))(appCtx)
+	})
+	mux.HandleFunc("DELETE /scim/v2/Groups/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireSCIMToken(middlewares.RateLimit(limits.Users, middlewares.KeyByIP, handlers.HandleSCIMGroupDELETE))(appCtx)
+	})
+
+	// Account self-service routes (require JWT authentication; credential management only from first-party sign-ins)
+	mux.HandleFunc("GET /api/account/tokens", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequireFirstParty(middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandlePersonalAccessTokensGET)))))
+	mux.HandleFunc("POST /api/account/tokens", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequireFirstParty(middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandlePersonalAccessTokensPOST)))))
+	mux.HandleFunc("DELETE /api/account/tokens/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequireFirstParty(middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandlePersonalAccessTokenDELETE)))(appCtx)
+	})
+	mux.HandleFunc("GET /api/account/apps", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequireFirstParty(middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandleConnectedAppsGET)))))
+	mux.HandleFunc("DELETE /api/account/apps/{client_id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequireFirstParty(middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandleConnectedAppDELETE)))(appCtx)
+	})
+	mux.HandleFunc("GET /api/account/groups", middlewares.Wrap(middlewares.RequireJWT(middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandleAccountGroupsGET))))
+	mux.HandleFunc("PUT /api/account/magic-link", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequireFirstParty(middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandleMagicLinkSettingsPUT)))))
+	mux.HandleFunc("POST /api/account/totp", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequireFirstParty(middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandleTOTPEnrollPOST)))))
+	mux.HandleFunc("GET /api/account/totp/qr.png", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequireFirstParty(middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandleTOTPQRCodeGET)))))
+	mux.HandleFunc("POST /api/account/totp/confirm", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequireFirstParty(middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandleTOTPConfirmPOST)))))
+	mux.HandleFunc("POST /api/account/totp/disable", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequireFirstParty(middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandleTOTPDisablePOST)))))
+	mux.HandleFunc("POST /api/account/recovery-codes", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequireFirstParty(middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandleRecoveryCodesPOST)))))
+	mux.HandleFunc("POST /api/account/webauthn/register/begin", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequireFirstParty(middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandleWebAuthnRegisterBeginPOST)))))
+	mux.HandleFunc("POST /api/account/webauthn/register/finish", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequireFirstParty(middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandleWebAuthnRegisterFinishPOST)))))
+	mux.HandleFunc("GET /api/account/webauthn/credentials", middlewares.Wrap(middlewares.RequireJWT(middlewares.RequireFirstParty(middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandleWebAuthnCredentialsGET)))))
+	mux.HandleFunc("DELETE /api/account/webauthn/credentials/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// These don't use Wrap due to issues with path variables.
+		appCtx := middlewares.GetOrCreateAppContext(r, w, ctx)
+		middlewares.RequireJWT(middlewares.RequireFirstParty(middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandleWebAuthnCredentialDELETE)))(appCtx)
 	})
 
-	// Protected routes (require JWT authentication)
-	mux.HandleFunc("GET /api/protected/data", middlewares.Wrap(middlewares.RequireJWT(handlers.HandleProtectedDataGET)))
-	mux.HandleFunc("GET /api/protected/stats", middlewares.Wrap(middlewares.RequireJWT(handlers.HandleProtectedStatsGET)))
+	// Protected routes (require JWT or personal access token authentication and the matching scope)
+	mux.HandleFunc("GET /api/protected/data", middlewares.Wrap(middlewares.RequireJWTOrPAT(middlewares.RequireScope("data:read", middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandleProtectedDataGET)))))
+	mux.HandleFunc("GET /api/protected/stats", middlewares.Wrap(middlewares.RequireJWTOrPAT(middlewares.RequireScope("stats:read", middlewares.RateLimit(limits.Protected, middlewares.KeyBySubject, handlers.HandleProtectedStatsGET)))))
 }
@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"net/http"
 	"time"
@@ -9,41 +10,71 @@ import (
 	"jwt-auth-poc/middlewares"
 )
 
+// StartServer serves the API over plain HTTP and, when TLS_CERT_FILE is set, over HTTPS as well. The HTTPS listener
+// asks clients for a certificate without requiring or verifying one; client authentication at the token endpoint and
+// RequireJWT decide what a certificate is trusted for.
 func StartServer(ctx *middlewares.AppContext) error {
 	mux := http.NewServeMux()
 
 	RegisterRoutes(mux, ctx)
 
-	handler := middlewares.AppContextMiddleware(ctx)(mux)
+	handler := middlewares.TenantMiddleware(ctx)(middlewares.AppContextMiddleware(ctx)(mux))
 
 	address := "localhost:8080"
 
-	server := &http.Server{
+	servers := []*http.Server{{
 		Addr:    address,
 		Handler: handler,
-	}
+	}}
+	done := make(chan error, 2)
 
 	ctx.Logger.Info("Listening on address", "addr", address)
-
-	done := make(chan error, 1)
-
 	go func() {
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if err := servers[0].ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			done <- err
+			return
 		}
 		done <- nil
 	}()
 
-	<-ctx.Done()
+	if cfg := ctx.Config.TLS; cfg.Enabled() {
+		server := &http.Server{
+			Addr:    cfg.Address,
+			Handler: handler,
+			TLSConfig: &tls.Config{
+				MinVersion: tls.VersionTLS12,
+				ClientAuth: tls.RequestClientCert,
+			},
+		}
+		servers = append(servers, server)
+
+		ctx.Logger.Info("Listening on TLS address", "addr", cfg.Address)
+		go func() {
+			if err := server.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				done <- err
+				return
+			}
+			done <- nil
+		}()
+	}
+
+	var listenErr error
+	select {
+	case <-ctx.Done():
+	case listenErr = <-done:
+		// A listener that fails to start takes the other one down with it
+	}
 	ctx.Logger.Info("Shutting down server")
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		ctx.Logger.Error("graceful shutdown failed", "err", err)
-		return err
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			ctx.Logger.Error("graceful shutdown failed", "err", err)
+			return err
+		}
 	}
 
-	return <-done
+	return listenErr
 }
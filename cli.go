@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"jwt-auth-poc/config"
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/utils"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// runCommand dispatches administrative subcommands, e.g. `server create-admin -email admin@example.com`
+func runCommand(name string, args []string, database *db.DB, cfg *config.Config) error {
+	switch name {
+	case "create-admin":
+		return runCreateAdmin(args, database, cfg)
+	}
+
+	return fmt.Errorf("unknown command %q (available: create-admin, certificate-jwks)", name)
+}
+
+// standaloneCommands are subcommands that need neither the configuration nor the database. They run before either is
+// set up, so their output is not mixed with log lines.
+var standaloneCommands = map[string]func(args []string) error{
+	"certificate-jwks": runCertificateJWKS,
+}
+
+// runCertificateJWKS prints the JWK Set registering a PEM certificate as the jwks of a self_signed_tls_client_auth
+// client, e.g. `server certificate-jwks -cert certs/self-signed.pem`
+func runCertificateJWKS(args []string) error {
+	flags := flag.NewFlagSet("certificate-jwks", flag.ContinueOnError)
+	certFile := flags.String("cert", "", "PEM encoded client certificate")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *certFile == "" {
+		return fmt.Errorf("-cert is required")
+	}
+
+	data, err := os.ReadFile(*certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read certificate: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("%s does not contain a PEM certificate", *certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	jwks, err := crypt_utils.CertificateJWKS(cert)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(jwks))
+	return nil
+}
+
+// runCreateAdmin creates an administrator account, or grants the admin role to an existing account and replaces its
+// password. The password is taken from BOOTSTRAP_ADMIN_PASSWORD, or read from standard input. -organization selects
+// the organization by slug.
+func runCreateAdmin(args []string, database *db.DB, cfg *config.Config) error {
+	flags := flag.NewFlagSet("create-admin", flag.ContinueOnError)
+	email := flags.String("email", cfg.Bootstrap.AdminEmail, "email address of the administrator")
+	name := flags.String("name", cfg.Bootstrap.AdminName, "display name used when creating the account")
+	slug := flags.String("organization", "default", "slug of the organization the administrator belongs to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *email == "" {
+		return fmt.Errorf("-email is required")
+	}
+
+	organization, err := db.NewOrganizationQueries(database).GetBySlug(*slug)
+	if err != nil {
+		return err
+	}
+
+	password := cfg.Bootstrap.AdminPassword
+	if password == "" {
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("failed to read password: %w", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	user, created, err := utils.BootstrapAdmin(database, organization.ID, *email, *name, password)
+	if err != nil {
+		return err
+	}
+
+	if created {
+		fmt.Printf("Created administrator %s (id %d) in %s\n", user.Email, user.ID, organization.Slug)
+	} else {
+		fmt.Printf("Granted admin role to %s (id %d) in %s and reset its sign-in\n", user.Email, user.ID, organization.Slug)
+	}
+	return nil
+}
+
+// bootstrapAdmin promotes the configured account of the default organization when the service has no administrator yet
+func bootstrapAdmin(database *db.DB, cfg *config.Config, logger *slog.Logger) error {
+	if cfg.Bootstrap.AdminEmail == "" {
+		return nil
+	}
+
+	admins, err := db.NewRoleQueries(database).CountUsersWithRole(db.DefaultOrganizationID, db.AdminRoleName)
+	if err != nil {
+		return err
+	}
+	if admins > 0 {
+		return nil
+	}
+
+	user, created, err := utils.BootstrapAdmin(database, db.DefaultOrganizationID, cfg.Bootstrap.AdminEmail, cfg.Bootstrap.AdminName, cfg.Bootstrap.AdminPassword)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Bootstrapped administrator", "user_id", user.ID, "email", user.Email, "created", created)
+	return nil
+}
@@ -0,0 +1,357 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds runtime settings read from the environment
+type Config struct {
+	IssuerURL    string // issuer of the default organization; other organizations append /t/<slug>
+	RateLimits   RateLimitConfig
+	WebAuthn     WebAuthnConfig
+	Mail         MailConfig
+	MagicLink    MagicLinkConfig
+	Bootstrap    BootstrapConfig
+	Registration RegistrationConfig
+	Groups       GroupsConfig
+	Users        UsersConfig
+	Tokens       TokensConfig
+	DPoP         DPoPConfig
+	TLS          TLSConfig
+}
+
+// BootstrapConfig names the account promoted to administrator when no administrator exists yet
+type BootstrapConfig struct {
+	AdminEmail    string
+	AdminName     string
+	AdminPassword string // replaces the password when the account already exists
+}
+
+// RegistrationConfig controls the self-service registration endpoint
+type RegistrationConfig struct {
+	Enabled           bool
+	MinPasswordLength int
+}
+
+// UsersConfig controls account lifecycle
+type UsersConfig struct {
+	DeletedRetention time.Duration // how long soft deleted users can be restored before they are purged
+	PurgeInterval    time.Duration
+}
+
+// TokensConfig limits the lifetime of personal access tokens
+type TokensConfig struct {
+	DefaultLifetime time.Duration // used when a token is created without an expiry
+	MaxLifetime     time.Duration
+}
+
+// DPoPConfig controls DPoP proofs of possession (RFC 9449)
+type DPoPConfig struct {
+	RequireNonce bool   // proofs must carry a nonce issued by the server
+	NonceKey     string // key authenticating nonces, which every instance must share; random per process when unset
+}
+
+// TLSConfig enables the HTTPS listener, which accepts client certificates for mutual-TLS client authentication and
+// certificate-bound tokens (RFC 8705)
+type TLSConfig struct {
+	Address      string
+	CertFile     string // server certificate; the listener is only started when set
+	KeyFile      string
+	ClientCAFile string         // CAs that issue the certificates of tls_client_auth clients
+	ClientCAs    *x509.CertPool // loaded from ClientCAFile, nil when unset
+}
+
+// Enabled reports whether the HTTPS listener is configured
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// GroupsConfig controls the group membership claim in access tokens
+type GroupsConfig struct {
+	ClaimEnabled bool
+	ClaimName    string
+	ClaimLimit   int // above this many groups the claim is replaced by a reference to the groups endpoint
+}
+
+// MailConfig selects and configures the outgoing mail transport
+type MailConfig struct {
+	Driver       string // "smtp", "log" for development, or empty to send nothing
+	LogBody      bool   // the log driver also writes message bodies, sign-in links included, at debug level
+	From         string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+}
+
+// MagicLinkConfig configures passwordless email login
+type MagicLinkConfig struct {
+	URL      string // page that receives the token as the "token" query parameter
+	Validity time.Duration
+}
+
+// WebAuthnConfig identifies this service as a WebAuthn relying party
+type WebAuthnConfig struct {
+	RPID    string
+	RPName  string
+	Origins []string
+}
+
+// RateLimitPolicy describes a token bucket: Requests tokens refilled evenly over Period
+type RateLimitPolicy struct {
+	Name     string
+	Requests int
+	Period   time.Duration
+}
+
+// RateLimitConfig holds the per-route rate limit policies
+type RateLimitConfig struct {
+	Enabled   bool
+	Login     RateLimitPolicy
+	Refresh   RateLimitPolicy
+	Users     RateLimitPolicy
+	Protected RateLimitPolicy
+}
+
+// Load reads the configuration from environment variables, falling back to defaults
+func Load() (*Config, error) {
+	var err error
+	cfg := &Config{
+		IssuerURL: strings.TrimRight(getString("ISSUER_URL", "http://localhost"), "/"),
+		RateLimits: RateLimitConfig{
+			Enabled:   true,
+			Login:     RateLimitPolicy{Name: "login", Requests: 10, Period: time.Minute},
+			Refresh:   RateLimitPolicy{Name: "refresh", Requests: 30, Period: time.Minute},
+			Users:     RateLimitPolicy{Name: "users", Requests: 60, Period: time.Minute},
+			Protected: RateLimitPolicy{Name: "protected", Requests: 120, Period: time.Minute},
+		},
+		WebAuthn: WebAuthnConfig{
+			RPID:    getString("WEBAUTHN_RP_ID", "localhost"),
+			RPName:  getString("WEBAUTHN_RP_NAME", "jwt-auth-poc"),
+			Origins: getList("WEBAUTHN_ORIGINS", []string{"http://localhost:8080"}),
+		},
+		Mail: MailConfig{
+			Driver:       getString("MAIL_DRIVER", ""),
+			From:         getString("MAIL_FROM", ""),
+			SMTPHost:     getString("MAIL_SMTP_HOST", ""),
+			SMTPUsername: getString("MAIL_SMTP_USERNAME", ""),
+			SMTPPassword: getString("MAIL_SMTP_PASSWORD", ""),
+		},
+		MagicLink: MagicLinkConfig{
+			URL: getString("MAGIC_LINK_URL", "http://localhost:8080/login/magic"),
+		},
+		Bootstrap: BootstrapConfig{
+			AdminEmail:    getString("BOOTSTRAP_ADMIN_EMAIL", ""),
+			AdminName:     getString("BOOTSTRAP_ADMIN_NAME", "Administrator"),
+			AdminPassword: getString("BOOTSTRAP_ADMIN_PASSWORD", ""),
+		},
+		Groups: GroupsConfig{
+			ClaimName: getString("GROUPS_CLAIM_NAME", "groups"),
+		},
+		DPoP: DPoPConfig{
+			NonceKey: getString("DPOP_NONCE_KEY", ""),
+		},
+		TLS: TLSConfig{
+			Address:      getString("TLS_ADDRESS", "localhost:8443"),
+			CertFile:     getString("TLS_CERT_FILE", ""),
+			KeyFile:      getString("TLS_KEY_FILE", ""),
+			ClientCAFile: getString("TLS_CLIENT_CA_FILE", ""),
+		},
+	}
+
+	if cfg.Users.DeletedRetention, err = getDuration("USER_DELETED_RETENTION", 30*24*time.Hour); err != nil {
+		return nil, err
+	}
+
+	if cfg.Users.PurgeInterval, err = getDuration("USER_PURGE_INTERVAL", time.Hour); err != nil {
+		return nil, err
+	}
+
+	if cfg.Tokens.DefaultLifetime, err = getDuration("PAT_DEFAULT_LIFETIME", 30*24*time.Hour); err != nil {
+		return nil, err
+	}
+
+	if cfg.Tokens.MaxLifetime, err = getDuration("PAT_MAX_LIFETIME", 365*24*time.Hour); err != nil {
+		return nil, err
+	}
+
+	if cfg.Tokens.DefaultLifetime > cfg.Tokens.MaxLifetime {
+		return nil, fmt.Errorf("invalid value for PAT_DEFAULT_LIFETIME: must not exceed PAT_MAX_LIFETIME")
+	}
+
+	if cfg.Groups.ClaimEnabled, err = getBool("GROUPS_CLAIM_ENABLED", true); err != nil {
+		return nil, err
+	}
+
+	if cfg.Groups.ClaimLimit, err = getInt("GROUPS_CLAIM_LIMIT", 100); err != nil {
+		return nil, err
+	}
+	if cfg.Groups.ClaimLimit <= 0 {
+		return nil, fmt.Errorf("invalid value for GROUPS_CLAIM_LIMIT: must be positive")
+	}
+
+	switch cfg.Groups.ClaimName {
+	case "iss", "sub", "aud", "exp", "nbf", "iat", "jti", "tenant", "amr", "scope", "roles", "permissions", "client_id", "token_use", "act", "cnf", "_claim_names", "_claim_sources":
+		return nil, fmt.Errorf("invalid value for GROUPS_CLAIM_NAME: %q is already used by access tokens", cfg.Groups.ClaimName)
+	}
+
+	if cfg.DPoP.RequireNonce, err = getBool("DPOP_REQUIRE_NONCE", false); err != nil {
+		return nil, err
+	}
+
+	if cfg.DPoP.NonceKey == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate dpop nonce key: %w", err)
+		}
+		cfg.DPoP.NonceKey = string(key)
+	}
+
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	if cfg.TLS.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLS.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS_CLIENT_CA_FILE: %w", err)
+		}
+		cfg.TLS.ClientCAs = x509.NewCertPool()
+		if !cfg.TLS.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid value for TLS_CLIENT_CA_FILE: no PEM certificates found")
+		}
+	}
+
+	if cfg.Registration.Enabled, err = getBool("REGISTRATION_ENABLED", false); err != nil {
+		return nil, err
+	}
+
+	if cfg.Registration.MinPasswordLength, err = getInt("REGISTRATION_MIN_PASSWORD_LENGTH", 8); err != nil {
+		return nil, err
+	}
+
+	if cfg.Mail.SMTPPort, err = getInt("MAIL_SMTP_PORT", 587); err != nil {
+		return nil, err
+	}
+
+	if cfg.Mail.LogBody, err = getBool("MAIL_LOG_BODY", false); err != nil {
+		return nil, err
+	}
+
+	if cfg.MagicLink.Validity, err = getDuration("MAGIC_LINK_VALIDITY", 15*time.Minute); err != nil {
+		return nil, err
+	}
+
+	if cfg.RateLimits.Enabled, err = getBool("RATE_LIMIT_ENABLED", cfg.RateLimits.Enabled); err != nil {
+		return nil, err
+	}
+
+	policies := map[string]*RateLimitPolicy{
+		"RATE_LIMIT_LOGIN":     &cfg.RateLimits.Login,
+		"RATE_LIMIT_REFRESH":   &cfg.RateLimits.Refresh,
+		"RATE_LIMIT_USERS":     &cfg.RateLimits.Users,
+		"RATE_LIMIT_PROTECTED": &cfg.RateLimits.Protected,
+	}
+	for key, policy := range policies {
+		if err := getRateLimitPolicy(key, policy); err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+func getString(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getList reads a comma separated list
+func getList(key string, fallback []string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getInt(key string, fallback int) (int, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return parsed, nil
+}
+
+func getDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("invalid value for %s: %q", key, value)
+	}
+	return parsed, nil
+}
+
+func getBool(key string, fallback bool) (bool, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return parsed, nil
+}
+
+// getRateLimitPolicy parses a policy in the form "<requests>/<period>", for example "10/1m"
+func getRateLimitPolicy(key string, policy *RateLimitPolicy) error {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return nil
+	}
+
+	requestsStr, periodStr, found := strings.Cut(value, "/")
+	if !found {
+		return fmt.Errorf("invalid value for %s: expected <requests>/<period>", key)
+	}
+
+	requests, err := strconv.Atoi(strings.TrimSpace(requestsStr))
+	if err != nil || requests <= 0 {
+		return fmt.Errorf("invalid request count for %s: %q", key, requestsStr)
+	}
+
+	period, err := time.ParseDuration(strings.TrimSpace(periodStr))
+	if err != nil || period <= 0 {
+		return fmt.Errorf("invalid period for %s: %q", key, periodStr)
+	}
+
+	policy.Requests = requests
+	policy.Period = period
+	return nil
+}
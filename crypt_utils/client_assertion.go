@@ -0,0 +1,74 @@
+package crypt_utils
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// ClientAssertionType is the client_assertion_type of private_key_jwt client authentication (RFC 7523 §2.2)
+const ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// ClientAssertionAlgorithms are the signature algorithms accepted for client assertions, the same asymmetric
+// algorithms as for DPoP proofs. Symmetric algorithms would need a shared secret, which private_key_jwt avoids.
+var ClientAssertionAlgorithms = DPoPAlgorithms
+
+// ClientAssertion is a JWT signed by an OAuth client, used to authenticate the client or as a JWT bearer grant
+// (RFC 7523). Claims are not trusted until Verify succeeds.
+type ClientAssertion struct {
+	token  *jwt.JSONWebToken
+	Claims jwt.Claims
+}
+
+// ParseClientAssertion parses a client assertion and reads its claims without verifying them, so the caller can
+// look up the client named by iss
+func ParseClientAssertion(raw string) (*ClientAssertion, error) {
+	token, err := jwt.ParseSigned(raw, ClientAssertionAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse assertion: %w", err)
+	}
+
+	assertion := &ClientAssertion{token: token}
+	if err := token.UnsafeClaimsWithoutVerification(&assertion.Claims); err != nil {
+		return nil, fmt.Errorf("failed to parse assertion claims: %w", err)
+	}
+
+	return assertion, nil
+}
+
+// Verify checks the assertion's signature against the client's keys, and that it names one of the audiences, carries
+// a jti and an exp no later than ConstAssertionMaxLifetime from now, and is valid at this time (RFC 7523 §3). Checking
+// iss and sub is left to the caller.
+func (a *ClientAssertion) Verify(keys *jose.JSONWebKeySet, audiences []string) error {
+	candidates := keys.Keys
+	if kid := a.token.Headers[0].KeyID; kid != "" {
+		candidates = keys.Key(kid)
+	}
+
+	verified := false
+	for _, key := range candidates {
+		if err := a.token.Claims(key.Key); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return fmt.Errorf("assertion is not signed by a registered key")
+	}
+
+	if a.Claims.ID == "" || a.Claims.Expiry == nil {
+		return fmt.Errorf("assertion must carry jti and exp")
+	}
+	now := time.Now()
+	if a.Claims.Expiry.Time().After(now.Add(ConstAssertionMaxLifetime)) {
+		return fmt.Errorf("assertion expires too far in the future")
+	}
+
+	if err := a.Claims.ValidateWithLeeway(jwt.Expected{AnyAudience: audiences, Time: now}, ConstAssertionClockSkew); err != nil {
+		return fmt.Errorf("invalid assertion: %w", err)
+	}
+
+	return nil
+}
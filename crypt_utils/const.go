@@ -20,4 +20,37 @@ const (
 const (
 	ConstRefreshTokenValidityPeriod = 30 * 24 * time.Hour //30 days
 	ConstAccessTokenValidityPeriod  = 24 * time.Hour      //24 hours
+	ConstIDTokenValidityPeriod      = time.Hour
+)
+
+const (
+	ConstMFAChallengeValidityPeriod = 5 * time.Minute
+	ConstMFAChallengeMaxAttempts    = 5
+	ConstRecoveryCodeCount          = 10
+	ConstWebAuthnCeremonyTimeout    = 5 * time.Minute
+)
+
+const (
+	ConstAuthorizationCodeValidityPeriod = time.Minute
+	ConstConsentRequestValidityPeriod    = 10 * time.Minute
+	ConstDeviceCodeValidityPeriod        = 10 * time.Minute
+	ConstDevicePollInterval              = 5 * time.Second // minimum time between token requests of a device (RFC 8628 §3.2)
+)
+
+const (
+	ConstDPoPProofMaxAge         = 5 * time.Minute  // how long after its iat a DPoP proof is accepted
+	ConstDPoPClockSkew           = 30 * time.Second // how far in the future a DPoP proof's iat may be
+	ConstDPoPNonceValidityPeriod = 5 * time.Minute  // a server nonce is accepted for up to twice this long
+)
+
+const (
+	ConstAssertionMaxLifetime = time.Hour        // latest exp accepted on a client assertion, counted from now
+	ConstAssertionClockSkew   = 30 * time.Second // leeway for the exp, nbf and iat of client assertions
+)
+
+const (
+	ConstTOTPIssuer = "jwt-auth-poc"
+	ConstTOTPDigits = 6
+	ConstTOTPPeriod = 30 * time.Second
+	ConstTOTPSkew   = 1 // steps accepted either side of the current one
 )
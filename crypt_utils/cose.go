@@ -0,0 +1,163 @@
+package crypt_utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// COSE algorithm identifiers (RFC 9053) supported for WebAuthn credentials
+const (
+	COSEAlgES256 int64 = -7
+	COSEAlgEdDSA int64 = -8
+	COSEAlgRS256 int64 = -257
+)
+
+// COSE key parameters (RFC 9052 and RFC 9053)
+const (
+	coseKeyKty = 1
+	coseKeyAlg = 3
+	coseKeyCrv = -1 // EC2 and OKP curve
+	coseKeyX   = -2 // EC2 and OKP x coordinate
+	coseKeyY   = -3 // EC2 y coordinate
+	coseKeyN   = -1 // RSA modulus
+	coseKeyE   = -2 // RSA exponent
+
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+)
+
+// ParseCOSEPublicKey decodes a COSE_Key into a Go public key and its declared algorithm
+func ParseCOSEPublicKey(data []byte) (crypto.PublicKey, int64, error) {
+	var raw map[int]cbor.RawMessage
+	if err := cbor.Unmarshal(data, &raw); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode cose key: %w", err)
+	}
+
+	var kty, alg int64
+	if err := decodeCOSEParam(raw, coseKeyKty, &kty); err != nil {
+		return nil, 0, err
+	}
+	if err := decodeCOSEParam(raw, coseKeyAlg, &alg); err != nil {
+		return nil, 0, err
+	}
+
+	switch kty {
+	case coseKtyEC2:
+		var crv int64
+		var x, y []byte
+		if err := decodeCOSEParam(raw, coseKeyCrv, &crv); err != nil {
+			return nil, 0, err
+		}
+		if err := decodeCOSEParam(raw, coseKeyX, &x); err != nil {
+			return nil, 0, err
+		}
+		if err := decodeCOSEParam(raw, coseKeyY, &y); err != nil {
+			return nil, 0, err
+		}
+		if crv != coseCrvP256 || alg != COSEAlgES256 {
+			return nil, 0, fmt.Errorf("unsupported ec2 key: crv %d alg %d", crv, alg)
+		}
+
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, 0, fmt.Errorf("ec2 key is not on curve")
+		}
+		return key, alg, nil
+
+	case coseKtyOKP:
+		var crv int64
+		var x []byte
+		if err := decodeCOSEParam(raw, coseKeyCrv, &crv); err != nil {
+			return nil, 0, err
+		}
+		if err := decodeCOSEParam(raw, coseKeyX, &x); err != nil {
+			return nil, 0, err
+		}
+		if crv != coseCrvEd25519 || alg != COSEAlgEdDSA || len(x) != ed25519.PublicKeySize {
+			return nil, 0, fmt.Errorf("unsupported okp key: crv %d alg %d", crv, alg)
+		}
+		return ed25519.PublicKey(x), alg, nil
+
+	case coseKtyRSA:
+		var n, e []byte
+		if err := decodeCOSEParam(raw, coseKeyN, &n); err != nil {
+			return nil, 0, err
+		}
+		if err := decodeCOSEParam(raw, coseKeyE, &e); err != nil {
+			return nil, 0, err
+		}
+		if alg != COSEAlgRS256 {
+			return nil, 0, fmt.Errorf("unsupported rsa alg %d", alg)
+		}
+
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, 0, fmt.Errorf("rsa exponent out of range")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, alg, nil
+	}
+
+	return nil, 0, fmt.Errorf("unsupported cose key type %d", kty)
+}
+
+// VerifyCOSESignature checks a WebAuthn signature made with the given COSE algorithm
+func VerifyCOSESignature(alg int64, key crypto.PublicKey, data, signature []byte) error {
+	switch alg {
+	case COSEAlgES256:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key does not match algorithm %d", alg)
+		}
+		digest := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(pub, digest[:], signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+
+	case COSEAlgRS256:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key does not match algorithm %d", alg)
+		}
+		digest := sha256.Sum256(data)
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("invalid signature: %w", err)
+		}
+		return nil
+
+	case COSEAlgEdDSA:
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("key does not match algorithm %d", alg)
+		}
+		if !ed25519.Verify(pub, data, signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported algorithm %d", alg)
+}
+
+func decodeCOSEParam(raw map[int]cbor.RawMessage, label int, dst interface{}) error {
+	value, ok := raw[label]
+	if !ok {
+		return fmt.Errorf("cose key is missing parameter %d", label)
+	}
+	if err := cbor.Unmarshal(value, dst); err != nil {
+		return fmt.Errorf("invalid cose key parameter %d: %w", label, err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package crypt_utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestParseCOSEPublicKeyRejects(t *testing.T) {
+	point := make([]byte, 32)
+	point[31] = 1
+
+	tests := []struct {
+		name    string
+		key     map[int]interface{}
+		wantErr string
+	}{
+		{
+			name:    "missing key type",
+			key:     map[int]interface{}{coseKeyAlg: COSEAlgES256},
+			wantErr: "missing parameter 1",
+		},
+		{
+			name:    "unsupported key type",
+			key:     map[int]interface{}{coseKeyKty: 4, coseKeyAlg: COSEAlgES256},
+			wantErr: "unsupported cose key type",
+		},
+		{
+			name:    "ec2 point not on curve",
+			key:     map[int]interface{}{coseKeyKty: coseKtyEC2, coseKeyAlg: COSEAlgES256, coseKeyCrv: coseCrvP256, coseKeyX: point, coseKeyY: point},
+			wantErr: "not on curve",
+		},
+		{
+			name:    "ec2 unsupported curve",
+			key:     map[int]interface{}{coseKeyKty: coseKtyEC2, coseKeyAlg: COSEAlgES256, coseKeyCrv: 2, coseKeyX: point, coseKeyY: point},
+			wantErr: "unsupported ec2 key",
+		},
+		{
+			name:    "ec2 algorithm mismatch",
+			key:     map[int]interface{}{coseKeyKty: coseKtyEC2, coseKeyAlg: COSEAlgRS256, coseKeyCrv: coseCrvP256, coseKeyX: point, coseKeyY: point},
+			wantErr: "unsupported ec2 key",
+		},
+		{
+			name:    "okp short key",
+			key:     map[int]interface{}{coseKeyKty: coseKtyOKP, coseKeyAlg: COSEAlgEdDSA, coseKeyCrv: coseCrvEd25519, coseKeyX: point[:16]},
+			wantErr: "unsupported okp key",
+		},
+		{
+			name:    "rsa unsupported algorithm",
+			key:     map[int]interface{}{coseKeyKty: coseKtyRSA, coseKeyAlg: -37, coseKeyN: point, coseKeyE: []byte{1, 0, 1}},
+			wantErr: "unsupported rsa alg",
+		},
+		{
+			name:    "wrong parameter type",
+			key:     map[int]interface{}{coseKeyKty: "EC2", coseKeyAlg: COSEAlgES256},
+			wantErr: "invalid cose key parameter 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := cbor.Marshal(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = ParseCOSEPublicKey(encoded)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ParseCOSEPublicKey error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, _, err := ParseCOSEPublicKey([]byte{0xa1}); err == nil {
+		t.Fatal("ParseCOSEPublicKey accepted truncated cbor")
+	}
+}
+
+func TestVerifyCOSESignatureKeyMismatch(t *testing.T) {
+	authenticator := newSoftAuthenticator(t, COSEAlgEdDSA)
+	if err := VerifyCOSESignature(COSEAlgES256, authenticator.signer.Public(), []byte("data"), []byte("sig")); err == nil {
+		t.Fatal("VerifyCOSESignature accepted a key of another algorithm")
+	}
+	if err := VerifyCOSESignature(-36, authenticator.signer.Public(), []byte("data"), []byte("sig")); err == nil {
+		t.Fatal("VerifyCOSESignature accepted an unsupported algorithm")
+	}
+}
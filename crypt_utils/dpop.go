@@ -0,0 +1,105 @@
+package crypt_utils
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// DPoPAlgorithms are the signature algorithms accepted for DPoP proofs
+var DPoPAlgorithms = []jose.SignatureAlgorithm{jose.ES256, jose.ES384, jose.ES512, jose.RS256, jose.PS256, jose.EdDSA}
+
+// DPoPAlgorithmNames returns the names of DPoPAlgorithms, as advertised in metadata and challenges
+func DPoPAlgorithmNames() []string {
+	names := make([]string, len(DPoPAlgorithms))
+	for i, alg := range DPoPAlgorithms {
+		names[i] = string(alg)
+	}
+	return names
+}
+
+// DPoPProof is a DPoP proof JWT (RFC 9449 §4.2) whose signature was verified with the public key in its header
+type DPoPProof struct {
+	JTI             string `json:"jti"`
+	HTM             string `json:"htm"`
+	HTU             string `json:"htu"`
+	IssuedAt        int64  `json:"iat"`
+	AccessTokenHash string `json:"ath,omitempty"`
+	Nonce           string `json:"nonce,omitempty"`
+	Thumbprint      string `json:"-"` // JWK thumbprint (RFC 7638) of the proof's key, as in the cnf.jkt claim
+}
+
+// ParseDPoPProof parses a DPoP proof and verifies its signature with the public key in its jwk header. Checking the
+// claims against the request is left to the caller.
+func ParseDPoPProof(proof string) (*DPoPProof, error) {
+	jws, err := jose.ParseSignedCompact(proof, DPoPAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse proof: %w", err)
+	}
+
+	header := jws.Signatures[0].Protected
+	if header.ExtraHeaders[jose.HeaderType] != "dpop+jwt" {
+		return nil, fmt.Errorf("proof must have the typ dpop+jwt")
+	}
+
+	key := header.JSONWebKey
+	if key == nil || !key.Valid() || !key.IsPublic() {
+		return nil, fmt.Errorf("proof must carry a public key in its jwk header")
+	}
+
+	payload, err := jws.Verify(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify proof: %w", err)
+	}
+
+	var parsed DPoPProof
+	if err := json.Unmarshal(payload, &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse proof claims: %w", err)
+	}
+	if parsed.JTI == "" || parsed.HTM == "" || parsed.HTU == "" || parsed.IssuedAt == 0 {
+		return nil, fmt.Errorf("proof must carry jti, htm, htu and iat")
+	}
+
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute key thumbprint: %w", err)
+	}
+	parsed.Thumbprint = base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	return &parsed, nil
+}
+
+// DPoPAccessTokenHash computes the ath claim binding a proof to an access token: the base64url encoded SHA-256 hash of
+// the token
+func DPoPAccessTokenHash(accessToken string) string {
+	hash := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// DPoPNonce returns the server nonce (RFC 9449 §8) of the period containing t. Nonces are a MAC of the period number,
+// so instances sharing the key accept each other's nonces without storing them.
+func DPoPNonce(key []byte, t time.Time) string {
+	period := make([]byte, 8)
+	binary.BigEndian.PutUint64(period, uint64(t.Unix()/int64(ConstDPoPNonceValidityPeriod.Seconds())))
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(period)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ValidDPoPNonce reports whether a nonce was issued for the current or the previous period
+func ValidDPoPNonce(key []byte, nonce string, now time.Time) bool {
+	for _, t := range []time.Time{now, now.Add(-ConstDPoPNonceValidityPeriod)} {
+		if hmac.Equal([]byte(nonce), []byte(DPoPNonce(key, t))) {
+			return true
+		}
+	}
+	return false
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"os"
 )
@@ -41,5 +42,20 @@ func CreateSigningKeys() (*ecdsa.PrivateKey, error) {
 		return nil, fmt.Errorf("error writing crypt_utils public key file: %v", err)
 	}
 
-	return nil, nil
+	return jwtSigningKey, nil
+}
+
+// GenerateSigningKeyPEM generates an ecdsa private key and returns it PEM encoded, for keys kept in the database
+func GenerateSigningKeyPEM() (string, error) {
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("error generating signing key: %v", err)
+	}
+
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(signingKey)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling private key: %v", err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: constPrivateKeyHeader, Bytes: keyBytes})), nil
 }
@@ -1,7 +1,9 @@
 package crypt_utils
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"encoding/base64"
 	"fmt"
 	"time"
 
@@ -10,21 +12,30 @@ import (
 )
 
 type JWTProvider interface {
-	Sign(claims jwt.Claims) (string, error)
+	Sign(claims jwt.Claims, extra ...interface{}) (string, error)
 	Validate(token string) (*jwt.Claims, error)
 	ValidateToken(token string) (map[string]interface{}, error)
+	PublicKey() crypto.PublicKey
+	KeyID() string
 }
 
 type ecdsaJWTProvider struct {
 	signer    jose.Signer
 	publicKey *ecdsa.PublicKey
+	keyID     string
 }
 
 func NewECDSAJWTProvider(privateKey *ecdsa.PrivateKey) (JWTProvider, error) {
+	thumbprint, err := (&jose.JSONWebKey{Key: &privateKey.PublicKey}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute key thumbprint: %w", err)
+	}
+	keyID := base64.RawURLEncoding.EncodeToString(thumbprint)
+
 	signer, err := jose.NewSigner(
 		jose.SigningKey{
 			Algorithm: jose.ES256,
-			Key:       privateKey,
+			Key:       jose.JSONWebKey{Key: privateKey, KeyID: keyID},
 		},
 		&jose.SignerOptions{},
 	)
@@ -35,11 +46,28 @@ func NewECDSAJWTProvider(privateKey *ecdsa.PrivateKey) (JWTProvider, error) {
 	return &ecdsaJWTProvider{
 		signer:    signer,
 		publicKey: &privateKey.PublicKey,
+		keyID:     keyID,
 	}, nil
 }
 
-func (p *ecdsaJWTProvider) Sign(claims jwt.Claims) (string, error) {
-	token, err := jwt.Signed(p.signer).Claims(claims).Serialize()
+// PublicKey returns the verification key published in the JWKS
+func (p *ecdsaJWTProvider) PublicKey() crypto.PublicKey {
+	return p.publicKey
+}
+
+// KeyID returns the RFC 7638 thumbprint used as the "kid" of signed tokens
+func (p *ecdsaJWTProvider) KeyID() string {
+	return p.keyID
+}
+
+// Sign serializes the registered claims together with any extra claim sets (structs or maps) into a signed JWT
+func (p *ecdsaJWTProvider) Sign(claims jwt.Claims, extra ...interface{}) (string, error) {
+	builder := jwt.Signed(p.signer).Claims(claims)
+	for _, e := range extra {
+		builder = builder.Claims(e)
+	}
+
+	token, err := builder.Serialize()
 	if err != nil {
 		return "", fmt.Errorf("failed to sign token: %w", err)
 	}
@@ -0,0 +1,58 @@
+package crypt_utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// CertificateThumbprint computes the x5t#S256 confirmation of a certificate-bound token (RFC 8705 §3.1): the base64url
+// encoded SHA-256 hash of the certificate's DER encoding
+func CertificateThumbprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// ParseClientJWKS parses the JWK Set a client registers. It must hold at least one key and no private key material.
+func ParseClientJWKS(raw []byte) (*jose.JSONWebKeySet, error) {
+	var set jose.JSONWebKeySet
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse jwks: %w", err)
+	}
+	if len(set.Keys) == 0 {
+		return nil, fmt.Errorf("jwks must contain at least one key")
+	}
+	for _, key := range set.Keys {
+		if !key.Valid() || !key.IsPublic() {
+			return nil, fmt.Errorf("jwks must only contain public keys")
+		}
+	}
+
+	return &set, nil
+}
+
+// JWKSContainsCertificate reports whether a certificate is the first entry of the x5c chain of one of the keys, which
+// is how self_signed_tls_client_auth clients register their certificates (RFC 8705 §2.2.2)
+func JWKSContainsCertificate(set *jose.JSONWebKeySet, cert *x509.Certificate) bool {
+	for _, key := range set.Keys {
+		if len(key.Certificates) > 0 && bytes.Equal(key.Certificates[0].Raw, cert.Raw) {
+			return true
+		}
+	}
+	return false
+}
+
+// CertificateJWKS builds the JWK Set registering a certificate for self_signed_tls_client_auth
+func CertificateJWKS(cert *x509.Certificate) ([]byte, error) {
+	key := jose.JSONWebKey{Key: cert.PublicKey, Certificates: []*x509.Certificate{cert}, Use: "sig"}
+	if !key.Valid() {
+		return nil, fmt.Errorf("unsupported certificate public key type %T", cert.PublicKey)
+	}
+
+	return json.MarshalIndent(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key}}, "", "  ")
+}
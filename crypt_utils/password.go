@@ -1,10 +1,19 @@
 package crypt_utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
 	"github.com/go-crypt/crypt/algorithm"
 	"github.com/go-crypt/crypt/algorithm/argon2"
 )
 
+var (
+	dummyPasswordHashOnce sync.Once
+	dummyPasswordHash     string
+)
+
 func HashPassword(password string) (string, error) {
 	var (
 		hasher *argon2.Hasher
@@ -26,3 +35,17 @@ func HashPassword(password string) (string, error) {
 
 	return digest.Encode(), nil
 }
+
+// DummyPasswordHash returns a hash of a random password. Checking a password against it costs the
+// same as a real check, which keeps login timing identical for unknown accounts.
+func DummyPasswordHash() string {
+	dummyPasswordHashOnce.Do(func() {
+		b := make([]byte, 32)
+		_, _ = rand.Read(b)
+		hash, err := HashPassword(hex.EncodeToString(b))
+		if err == nil {
+			dummyPasswordHash = hash
+		}
+	})
+	return dummyPasswordHash
+}
@@ -26,6 +26,12 @@ func LoadECDSAPrivateKeyFromPEM() (*ecdsa.PrivateKey, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read private key: %v", err)
 	}
+
+	return ParseECDSAPrivateKeyPEM(keyData)
+}
+
+// ParseECDSAPrivateKeyPEM decodes a PKCS8 or SEC1 encoded ecdsa private key
+func ParseECDSAPrivateKeyPEM(keyData []byte) (*ecdsa.PrivateKey, error) {
 	block, _ := pem.Decode(keyData)
 	if block == nil {
 		return nil, fmt.Errorf("failed to parse PEM block")
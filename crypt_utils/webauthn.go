@@ -0,0 +1,322 @@
+package crypt_utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Authenticator data flags (WebAuthn §6.1)
+const (
+	authDataFlagUserPresent    = 0x01
+	authDataFlagUserVerified   = 0x04
+	authDataFlagBackupEligible = 0x08
+	authDataFlagBackupState    = 0x10
+	authDataFlagAttestedData   = 0x40
+)
+
+// WebAuthnRelyingParty holds the relying party identity that ceremonies are verified against
+type WebAuthnRelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+}
+
+// CollectedClientData is the parsed clientDataJSON passed from the browser
+type CollectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin,omitempty"`
+}
+
+// AuthenticatorData is the parsed authenticatorData structure
+type AuthenticatorData struct {
+	RPIDHash            []byte
+	Flags               byte
+	SignCount           uint32
+	AAGUID              []byte
+	CredentialID        []byte
+	CredentialPublicKey []byte
+}
+
+func (d *AuthenticatorData) UserPresent() bool    { return d.Flags&authDataFlagUserPresent != 0 }
+func (d *AuthenticatorData) UserVerified() bool   { return d.Flags&authDataFlagUserVerified != 0 }
+func (d *AuthenticatorData) BackupEligible() bool { return d.Flags&authDataFlagBackupEligible != 0 }
+func (d *AuthenticatorData) BackupState() bool    { return d.Flags&authDataFlagBackupState != 0 }
+
+// WebAuthnCredential is a newly registered credential extracted from an attestation
+type WebAuthnCredential struct {
+	ID             []byte
+	PublicKey      []byte // COSE_Key encoding
+	SignCount      uint32
+	AAGUID         string
+	UserVerified   bool
+	BackupEligible bool
+	BackupState    bool
+}
+
+// WebAuthnAssertion is the verified result of an authentication ceremony
+type WebAuthnAssertion struct {
+	SignCount    uint32
+	UserVerified bool
+	BackupState  bool
+}
+
+type attestationObject struct {
+	Format   string                     `cbor:"fmt"`
+	AttStmt  map[string]cbor.RawMessage `cbor:"attStmt"`
+	AuthData []byte                     `cbor:"authData"`
+}
+
+// GenerateWebAuthnChallenge returns a random base64url encoded challenge
+func GenerateWebAuthnChallenge() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate webauthn challenge: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// DecodeWebAuthnBase64 decodes base64url with or without padding, as sent by WebAuthn JSON serializations
+func DecodeWebAuthnBase64(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// ParseClientData decodes clientDataJSON
+func ParseClientData(clientDataJSON []byte) (*CollectedClientData, error) {
+	var clientData CollectedClientData
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return nil, fmt.Errorf("failed to parse client data: %w", err)
+	}
+	return &clientData, nil
+}
+
+// ParseAuthenticatorData decodes the binary authenticatorData structure
+func ParseAuthenticatorData(data []byte) (*AuthenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("authenticator data too short")
+	}
+
+	authData := &AuthenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	if authData.Flags&authDataFlagAttestedData == 0 {
+		return authData, nil
+	}
+
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("attested credential data too short")
+	}
+
+	authData.AAGUID = rest[:16]
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLength {
+		return nil, fmt.Errorf("credential id truncated")
+	}
+	authData.CredentialID = rest[:idLength]
+	rest = rest[idLength:]
+
+	// The public key is followed by optional extensions, so decode only the first CBOR item.
+	var key cbor.RawMessage
+	if _, err := cbor.UnmarshalFirst(rest, &key); err != nil {
+		return nil, fmt.Errorf("failed to decode credential public key: %w", err)
+	}
+	authData.CredentialPublicKey = key
+
+	return authData, nil
+}
+
+// VerifyRegistration validates a registration ceremony response (WebAuthn §7.1) and returns the new credential.
+// Only the "none" and "packed" attestation formats are accepted; attestation certificates are not chained to a trust anchor.
+func (rp *WebAuthnRelyingParty) VerifyRegistration(challenge string, clientDataJSON, attestationObjectBytes []byte, requireUserVerification bool) (*WebAuthnCredential, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	var attestation attestationObject
+	if err := cbor.Unmarshal(attestationObjectBytes, &attestation); err != nil {
+		return nil, fmt.Errorf("failed to decode attestation object: %w", err)
+	}
+
+	authData, err := ParseAuthenticatorData(attestation.AuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := rp.verifyAuthenticatorData(authData, requireUserVerification); err != nil {
+		return nil, err
+	}
+
+	if authData.CredentialID == nil {
+		return nil, fmt.Errorf("attested credential data missing")
+	}
+
+	publicKey, alg, err := ParseCOSEPublicKey(authData.CredentialPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signedData := append(append([]byte{}, attestation.AuthData...), clientDataHash[:]...)
+
+	switch attestation.Format {
+	case "none":
+		if len(attestation.AttStmt) != 0 {
+			return nil, fmt.Errorf("none attestation must have an empty statement")
+		}
+
+	case "packed":
+		var stmtAlg int64
+		var sig []byte
+		if err := decodeAttStmt(attestation.AttStmt, "alg", &stmtAlg); err != nil {
+			return nil, err
+		}
+		if err := decodeAttStmt(attestation.AttStmt, "sig", &sig); err != nil {
+			return nil, err
+		}
+
+		if _, ok := attestation.AttStmt["x5c"]; ok {
+			var x5c [][]byte
+			if err := decodeAttStmt(attestation.AttStmt, "x5c", &x5c); err != nil || len(x5c) == 0 {
+				return nil, fmt.Errorf("invalid packed attestation certificate chain")
+			}
+			cert, err := x509.ParseCertificate(x5c[0])
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse attestation certificate: %w", err)
+			}
+			if err := VerifyCOSESignature(stmtAlg, cert.PublicKey, signedData, sig); err != nil {
+				return nil, fmt.Errorf("packed attestation signature: %w", err)
+			}
+		} else {
+			// Self attestation is signed by the credential key itself.
+			if stmtAlg != alg {
+				return nil, fmt.Errorf("self attestation algorithm does not match credential key")
+			}
+			if err := VerifyCOSESignature(alg, publicKey, signedData, sig); err != nil {
+				return nil, fmt.Errorf("packed self attestation signature: %w", err)
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported attestation format %q", attestation.Format)
+	}
+
+	return &WebAuthnCredential{
+		ID:             authData.CredentialID,
+		PublicKey:      authData.CredentialPublicKey,
+		SignCount:      authData.SignCount,
+		AAGUID:         hex.EncodeToString(authData.AAGUID),
+		UserVerified:   authData.UserVerified(),
+		BackupEligible: authData.BackupEligible(),
+		BackupState:    authData.BackupState(),
+	}, nil
+}
+
+// VerifyAssertion validates an authentication ceremony response (WebAuthn §7.2) against a stored credential
+func (rp *WebAuthnRelyingParty) VerifyAssertion(challenge string, clientDataJSON, authenticatorData, signature, publicKey []byte, storedSignCount uint32, requireUserVerification bool) (*WebAuthnAssertion, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return nil, err
+	}
+
+	authData, err := ParseAuthenticatorData(authenticatorData)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := rp.verifyAuthenticatorData(authData, requireUserVerification); err != nil {
+		return nil, err
+	}
+
+	key, alg, err := ParseCOSEPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signedData := append(append([]byte{}, authenticatorData...), clientDataHash[:]...)
+	if err := VerifyCOSESignature(alg, key, signedData, signature); err != nil {
+		return nil, fmt.Errorf("assertion signature: %w", err)
+	}
+
+	// A counter that does not move forward suggests a cloned authenticator. Authenticators that do not
+	// implement counters always report zero.
+	if (authData.SignCount != 0 || storedSignCount != 0) && authData.SignCount <= storedSignCount {
+		return nil, fmt.Errorf("signature counter did not increase")
+	}
+
+	return &WebAuthnAssertion{
+		SignCount:    authData.SignCount,
+		UserVerified: authData.UserVerified(),
+		BackupState:  authData.BackupState(),
+	}, nil
+}
+
+func (rp *WebAuthnRelyingParty) verifyClientData(clientDataJSON []byte, ceremony, challenge string) error {
+	clientData, err := ParseClientData(clientDataJSON)
+	if err != nil {
+		return err
+	}
+
+	if clientData.Type != ceremony {
+		return fmt.Errorf("unexpected client data type %q", clientData.Type)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(strings.TrimRight(clientData.Challenge, "=")), []byte(challenge)) != 1 {
+		return fmt.Errorf("challenge mismatch")
+	}
+
+	if !slices.Contains(rp.Origins, clientData.Origin) {
+		return fmt.Errorf("unexpected origin %q", clientData.Origin)
+	}
+
+	if clientData.CrossOrigin {
+		return fmt.Errorf("cross origin ceremonies are not allowed")
+	}
+
+	return nil
+}
+
+func (rp *WebAuthnRelyingParty) verifyAuthenticatorData(authData *AuthenticatorData, requireUserVerification bool) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return fmt.Errorf("rp id hash mismatch")
+	}
+
+	if !authData.UserPresent() {
+		return fmt.Errorf("user presence flag not set")
+	}
+
+	if requireUserVerification && !authData.UserVerified() {
+		return fmt.Errorf("user verification required")
+	}
+
+	return nil
+}
+
+func decodeAttStmt(stmt map[string]cbor.RawMessage, key string, dst interface{}) error {
+	value, ok := stmt[key]
+	if !ok {
+		return fmt.Errorf("attestation statement is missing %q", key)
+	}
+	if err := cbor.Unmarshal(value, dst); err != nil {
+		return fmt.Errorf("invalid attestation statement field %q: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,428 @@
+package crypt_utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	testRPID   = "localhost"
+	testOrigin = "http://localhost:8080"
+)
+
+func testRelyingParty() *WebAuthnRelyingParty {
+	return &WebAuthnRelyingParty{ID: testRPID, Name: "Test", Origins: []string{testOrigin}}
+}
+
+// softAuthenticator is a software WebAuthn authenticator holding one credential
+type softAuthenticator struct {
+	t            *testing.T
+	alg          int64
+	signer       crypto.Signer
+	credentialID []byte
+	signCount    uint32
+	rpID         string
+}
+
+func newSoftAuthenticator(t *testing.T, alg int64) *softAuthenticator {
+	t.Helper()
+
+	a := &softAuthenticator{t: t, alg: alg, credentialID: make([]byte, 16), rpID: testRPID}
+	if _, err := rand.Read(a.credentialID); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	switch alg {
+	case COSEAlgES256:
+		a.signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case COSEAlgEdDSA:
+		_, a.signer, err = ed25519.GenerateKey(rand.Reader)
+	case COSEAlgRS256:
+		a.signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		t.Fatalf("unsupported algorithm %d", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+// coseKey encodes the credential's public key as a COSE_Key
+func (a *softAuthenticator) coseKey() []byte {
+	var key map[int]interface{}
+	switch pub := a.signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		key = map[int]interface{}{
+			coseKeyKty: coseKtyEC2, coseKeyAlg: a.alg, coseKeyCrv: coseCrvP256,
+			coseKeyX: pub.X.FillBytes(make([]byte, 32)), coseKeyY: pub.Y.FillBytes(make([]byte, 32)),
+		}
+	case ed25519.PublicKey:
+		key = map[int]interface{}{coseKeyKty: coseKtyOKP, coseKeyAlg: a.alg, coseKeyCrv: coseCrvEd25519, coseKeyX: []byte(pub)}
+	case *rsa.PublicKey:
+		key = map[int]interface{}{coseKeyKty: coseKtyRSA, coseKeyAlg: a.alg, coseKeyN: pub.N.Bytes(), coseKeyE: []byte{1, 0, 1}}
+	}
+
+	encoded, err := cbor.Marshal(key)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return encoded
+}
+
+// authenticatorData builds authenticator data with the given flags, attesting the credential when attested is set
+func (a *softAuthenticator) authenticatorData(flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+
+	if attested {
+		data[32] |= authDataFlagAttestedData
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+
+	return data
+}
+
+// sign signs authenticator data and the client data hash as an authenticator does (WebAuthn §6.3.3)
+func (a *softAuthenticator) sign(authenticatorData, clientDataJSON []byte) []byte {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authenticatorData...), clientDataHash[:]...)
+
+	var (
+		signature []byte
+		err       error
+	)
+	switch a.alg {
+	case COSEAlgEdDSA:
+		signature, err = a.signer.Sign(rand.Reader, signed, crypto.Hash(0))
+	default:
+		digest := sha256.Sum256(signed)
+		signature, err = a.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return signature
+}
+
+func testClientData(t *testing.T, ceremony, challenge, origin string) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(CollectedClientData{Type: ceremony, Challenge: challenge, Origin: origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// register returns the client data and a packed self attestation object for a registration ceremony
+func (a *softAuthenticator) register(challenge, origin string) ([]byte, []byte) {
+	clientDataJSON := testClientData(a.t, "webauthn.create", challenge, origin)
+	authData := a.authenticatorData(authDataFlagUserPresent|authDataFlagUserVerified, true)
+
+	attestation, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "packed",
+		"attStmt":  map[string]interface{}{"alg": a.alg, "sig": a.sign(authData, clientDataJSON)},
+		"authData": authData,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return clientDataJSON, attestation
+}
+
+// assert returns the client data, authenticator data and signature of an authentication ceremony, advancing the
+// sign counter
+func (a *softAuthenticator) assert(challenge, origin string, flags byte) ([]byte, []byte, []byte) {
+	a.signCount++
+	clientDataJSON := testClientData(a.t, "webauthn.get", challenge, origin)
+	authData := a.authenticatorData(flags, false)
+	return clientDataJSON, authData, a.sign(authData, clientDataJSON)
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	for _, alg := range []int64{COSEAlgES256, COSEAlgEdDSA, COSEAlgRS256} {
+		authenticator := newSoftAuthenticator(t, alg)
+		challenge, err := GenerateWebAuthnChallenge()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		clientDataJSON, attestation := authenticator.register(challenge, testOrigin)
+		credential, err := testRelyingParty().VerifyRegistration(challenge, clientDataJSON, attestation, true)
+		if err != nil {
+			t.Fatalf("alg %d: VerifyRegistration failed: %v", alg, err)
+		}
+		if string(credential.ID) != string(authenticator.credentialID) {
+			t.Errorf("alg %d: credential id = %x, want %x", alg, credential.ID, authenticator.credentialID)
+		}
+		if !credential.UserVerified {
+			t.Errorf("alg %d: user verification flag not reported", alg)
+		}
+
+		key, keyAlg, err := ParseCOSEPublicKey(credential.PublicKey)
+		if err != nil {
+			t.Fatalf("alg %d: stored public key does not parse: %v", alg, err)
+		}
+		if keyAlg != alg {
+			t.Errorf("alg %d: stored key algorithm = %d", alg, keyAlg)
+		}
+		if equal, ok := key.(interface{ Equal(crypto.PublicKey) bool }); !ok || !equal.Equal(authenticator.signer.Public()) {
+			t.Errorf("alg %d: stored key does not match the authenticator's key", alg)
+		}
+	}
+}
+
+func TestVerifyRegistrationNoneAttestation(t *testing.T) {
+	authenticator := newSoftAuthenticator(t, COSEAlgES256)
+	clientDataJSON := testClientData(t, "webauthn.create", "challenge", testOrigin)
+	authData := authenticator.authenticatorData(authDataFlagUserPresent, true)
+
+	attestation, err := cbor.Marshal(map[string]interface{}{"fmt": "none", "attStmt": map[string]interface{}{}, "authData": authData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testRelyingParty().VerifyRegistration("challenge", clientDataJSON, attestation, false); err != nil {
+		t.Fatalf("VerifyRegistration failed: %v", err)
+	}
+}
+
+func TestVerifyRegistrationRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		build   func(a *softAuthenticator) ([]byte, []byte)
+		wantErr string
+	}{
+		{
+			name: "wrong origin",
+			build: func(a *softAuthenticator) ([]byte, []byte) {
+				return a.register("challenge", "https://evil.example")
+			},
+			wantErr: "unexpected origin",
+		},
+		{
+			name: "wrong challenge",
+			build: func(a *softAuthenticator) ([]byte, []byte) {
+				return a.register("other", testOrigin)
+			},
+			wantErr: "challenge mismatch",
+		},
+		{
+			name: "rp id hash mismatch",
+			build: func(a *softAuthenticator) ([]byte, []byte) {
+				a.rpID = "evil.example"
+				return a.register("challenge", testOrigin)
+			},
+			wantErr: "rp id hash mismatch",
+		},
+		{
+			name: "wrong ceremony",
+			build: func(a *softAuthenticator) ([]byte, []byte) {
+				_, attestation := a.register("challenge", testOrigin)
+				return testClientData(a.t, "webauthn.get", "challenge", testOrigin), attestation
+			},
+			wantErr: "unexpected client data type",
+		},
+		{
+			name: "self attestation signed by another key",
+			build: func(a *softAuthenticator) ([]byte, []byte) {
+				clientDataJSON := testClientData(a.t, "webauthn.create", "challenge", testOrigin)
+				authData := a.authenticatorData(authDataFlagUserPresent, true)
+				other := newSoftAuthenticator(a.t, COSEAlgES256)
+				attestation, _ := cbor.Marshal(map[string]interface{}{
+					"fmt":      "packed",
+					"attStmt":  map[string]interface{}{"alg": COSEAlgES256, "sig": other.sign(authData, clientDataJSON)},
+					"authData": authData,
+				})
+				return clientDataJSON, attestation
+			},
+			wantErr: "packed self attestation signature",
+		},
+		{
+			name: "unsupported format",
+			build: func(a *softAuthenticator) ([]byte, []byte) {
+				clientDataJSON := testClientData(a.t, "webauthn.create", "challenge", testOrigin)
+				attestation, _ := cbor.Marshal(map[string]interface{}{
+					"fmt":      "fido-u2f",
+					"attStmt":  map[string]interface{}{},
+					"authData": a.authenticatorData(authDataFlagUserPresent, true),
+				})
+				return clientDataJSON, attestation
+			},
+			wantErr: "unsupported attestation format",
+		},
+		{
+			name: "malformed attestation object",
+			build: func(a *softAuthenticator) ([]byte, []byte) {
+				return testClientData(a.t, "webauthn.create", "challenge", testOrigin), []byte{0xff, 0x00}
+			},
+			wantErr: "failed to decode attestation object",
+		},
+		{
+			name: "missing attested credential data",
+			build: func(a *softAuthenticator) ([]byte, []byte) {
+				clientDataJSON := testClientData(a.t, "webauthn.create", "challenge", testOrigin)
+				authData := a.authenticatorData(authDataFlagUserPresent, false)
+				attestation, _ := cbor.Marshal(map[string]interface{}{"fmt": "none", "attStmt": map[string]interface{}{}, "authData": authData})
+				return clientDataJSON, attestation
+			},
+			wantErr: "attested credential data missing",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientDataJSON, attestation := tt.build(newSoftAuthenticator(t, COSEAlgES256))
+			_, err := testRelyingParty().VerifyRegistration("challenge", clientDataJSON, attestation, false)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("VerifyRegistration error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	for _, alg := range []int64{COSEAlgES256, COSEAlgEdDSA, COSEAlgRS256} {
+		authenticator := newSoftAuthenticator(t, alg)
+		publicKey := authenticator.coseKey()
+
+		clientDataJSON, authData, signature := authenticator.assert("challenge", testOrigin, authDataFlagUserPresent|authDataFlagUserVerified)
+		assertion, err := testRelyingParty().VerifyAssertion("challenge", clientDataJSON, authData, signature, publicKey, 0, true)
+		if err != nil {
+			t.Fatalf("alg %d: VerifyAssertion failed: %v", alg, err)
+		}
+		if assertion.SignCount != 1 || !assertion.UserVerified {
+			t.Errorf("alg %d: assertion = %+v, want sign count 1 and user verified", alg, assertion)
+		}
+	}
+}
+
+func TestVerifyAssertionZeroCounter(t *testing.T) {
+	authenticator := newSoftAuthenticator(t, COSEAlgES256)
+	clientDataJSON := testClientData(t, "webauthn.get", "challenge", testOrigin)
+	authData := authenticator.authenticatorData(authDataFlagUserPresent, false)
+
+	// Authenticators without a counter always report zero
+	_, err := testRelyingParty().VerifyAssertion("challenge", clientDataJSON, authData, authenticator.sign(authData, clientDataJSON), authenticator.coseKey(), 0, false)
+	if err != nil {
+		t.Fatalf("VerifyAssertion failed: %v", err)
+	}
+}
+
+func TestVerifyAssertionRejects(t *testing.T) {
+	tests := []struct {
+		name            string
+		storedSignCount uint32
+		requireUV       bool
+		build           func(a *softAuthenticator) ([]byte, []byte, []byte)
+		wantErr         string
+	}{
+		{
+			name:            "sign counter regression",
+			storedSignCount: 5,
+			build: func(a *softAuthenticator) ([]byte, []byte, []byte) {
+				return a.assert("challenge", testOrigin, authDataFlagUserPresent)
+			},
+			wantErr: "signature counter did not increase",
+		},
+		{
+			name:            "sign counter repeated",
+			storedSignCount: 1,
+			build: func(a *softAuthenticator) ([]byte, []byte, []byte) {
+				return a.assert("challenge", testOrigin, authDataFlagUserPresent)
+			},
+			wantErr: "signature counter did not increase",
+		},
+		{
+			name: "wrong origin",
+			build: func(a *softAuthenticator) ([]byte, []byte, []byte) {
+				return a.assert("challenge", "https://evil.example", authDataFlagUserPresent)
+			},
+			wantErr: "unexpected origin",
+		},
+		{
+			name: "rp id hash mismatch",
+			build: func(a *softAuthenticator) ([]byte, []byte, []byte) {
+				a.rpID = "evil.example"
+				return a.assert("challenge", testOrigin, authDataFlagUserPresent)
+			},
+			wantErr: "rp id hash mismatch",
+		},
+		{
+			name: "wrong challenge",
+			build: func(a *softAuthenticator) ([]byte, []byte, []byte) {
+				return a.assert("other", testOrigin, authDataFlagUserPresent)
+			},
+			wantErr: "challenge mismatch",
+		},
+		{
+			name: "tampered authenticator data",
+			build: func(a *softAuthenticator) ([]byte, []byte, []byte) {
+				clientDataJSON, authData, signature := a.assert("challenge", testOrigin, authDataFlagUserPresent)
+				authData[32] |= authDataFlagUserVerified
+				return clientDataJSON, authData, signature
+			},
+			wantErr: "assertion signature",
+		},
+		{
+			name: "signed by another key",
+			build: func(a *softAuthenticator) ([]byte, []byte, []byte) {
+				clientDataJSON, authData, _ := a.assert("challenge", testOrigin, authDataFlagUserPresent)
+				return clientDataJSON, authData, newSoftAuthenticator(a.t, COSEAlgES256).sign(authData, clientDataJSON)
+			},
+			wantErr: "assertion signature",
+		},
+		{
+			name: "user not present",
+			build: func(a *softAuthenticator) ([]byte, []byte, []byte) {
+				return a.assert("challenge", testOrigin, 0)
+			},
+			wantErr: "user presence flag not set",
+		},
+		{
+			name:      "user verification required",
+			requireUV: true,
+			build: func(a *softAuthenticator) ([]byte, []byte, []byte) {
+				return a.assert("challenge", testOrigin, authDataFlagUserPresent)
+			},
+			wantErr: "user verification required",
+		},
+		{
+			name: "truncated authenticator data",
+			build: func(a *softAuthenticator) ([]byte, []byte, []byte) {
+				clientDataJSON, authData, signature := a.assert("challenge", testOrigin, authDataFlagUserPresent)
+				return clientDataJSON, authData[:20], signature
+			},
+			wantErr: "authenticator data too short",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := newSoftAuthenticator(t, COSEAlgES256)
+			clientDataJSON, authData, signature := tt.build(authenticator)
+			_, err := testRelyingParty().VerifyAssertion("challenge", clientDataJSON, authData, signature, authenticator.coseKey(), tt.storedSignCount, tt.requireUV)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("VerifyAssertion error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
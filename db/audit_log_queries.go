@@ -0,0 +1,98 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// AuditEntry records an administrative action
+type AuditEntry struct {
+	ID             int                    `json:"id"`
+	OrganizationID int                    `json:"organization_id"`
+	Actor          string                 `json:"actor"` // subject of the caller, or "system" for bootstrap and CLI actions
+	Action         string                 `json:"action"`
+	TargetType     string                 `json:"target_type,omitempty"`
+	TargetID       string                 `json:"target_id,omitempty"`
+	Details        map[string]interface{} `json:"details,omitempty"`
+	IPAddress      string                 `json:"ip_address,omitempty"`
+	CreatedAt      time.Time              `json:"created_at"`
+}
+
+// AuditLogQueries provides database operations for the audit log
+type AuditLogQueries struct {
+	db *DB
+}
+
+// NewAuditLogQueries creates a new AuditLogQueries instance
+func NewAuditLogQueries(db *DB) *AuditLogQueries {
+	return &AuditLogQueries{db: db}
+}
+
+// Create appends an entry to the audit log
+func (q *AuditLogQueries) Create(entry *AuditEntry) error {
+	details, err := json.Marshal(entry.Details)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit details: %w", err)
+	}
+	if entry.Details == nil {
+		details = []byte("{}")
+	}
+
+	query := `
+		INSERT INTO audit_log (organization_id, actor, action, target_type, target_id, details, ip_address)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+
+	if _, err := q.db.Exec(query, entry.OrganizationID, entry.Actor, entry.Action, entry.TargetType, entry.TargetID, string(details), entry.IPAddress); err != nil {
+		return fmt.Errorf("failed to write audit entry: %w", err)
+	}
+
+	return nil
+}
+
+// List retrieves the audit entries of an organization, newest first
+func (q *AuditLogQueries) List(organizationID, limit, offset int) ([]AuditEntry, error) {
+	query := `
+		SELECT id, organization_id, actor, action, target_type, target_id, details, ip_address, created_at
+		FROM audit_log
+		WHERE organization_id = ?
+		ORDER BY id DESC
+		LIMIT ? OFFSET ?
+	`
+
+	rows, err := q.db.Query(query, organizationID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit log: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var details string
+		if err := rows.Scan(
+			&entry.ID,
+			&entry.OrganizationID,
+			&entry.Actor,
+			&entry.Action,
+			&entry.TargetType,
+			&entry.TargetID,
+			&details,
+			&entry.IPAddress,
+			&entry.CreatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		if err := json.Unmarshal([]byte(details), &entry.Details); err != nil {
+			return nil, fmt.Errorf("failed to decode audit details: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,172 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// AuthorizationCode is a single-use code issued by the authorization endpoint and redeemed at the token endpoint
+type AuthorizationCode struct {
+	ID            int        `json:"id"`
+	CodeHash      string     `json:"-"`
+	ClientID      string     `json:"client_id"`
+	UserID        int        `json:"user_id"`
+	RedirectURI   string     `json:"redirect_uri"` // as sent in the authorization request, empty when it was omitted
+	Scope         []string   `json:"scope"`
+	AMR           []string   `json:"amr"`
+	Nonce         string     `json:"nonce"`
+	CodeChallenge string     `json:"code_challenge"` // S256 PKCE challenge, empty when the client did not use PKCE
+	AuthTime      time.Time  `json:"auth_time"`      // when the user signed in, reported in the ID token
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	UsedAt        *time.Time `json:"used_at,omitempty"`
+}
+
+// AuthorizationCodeQueries provides database operations for authorization codes
+type AuthorizationCodeQueries struct {
+	db *DB
+}
+
+// NewAuthorizationCodeQueries creates a new AuthorizationCodeQueries instance
+func NewAuthorizationCodeQueries(db *DB) *AuthorizationCodeQueries {
+	return &AuthorizationCodeQueries{db: db}
+}
+
+// Create stores a new authorization code by its hash
+func (q *AuthorizationCodeQueries) Create(code *AuthorizationCode, validFor time.Duration) error {
+	query := `
+		INSERT INTO authorization_codes (code_hash, client_id, user_id, redirect_uri, scope, amr, nonce, code_challenge, auth_time, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, datetime('now', ?))
+	`
+
+	_, err := q.db.Exec(query, code.CodeHash, code.ClientID, code.UserID, code.RedirectURI, joinList(code.Scope),
+		joinList(code.AMR), code.Nonce, code.CodeChallenge, code.AuthTime.UTC().Format(sqliteTimeFormat), sqliteOffset(validFor))
+	if err != nil {
+		return fmt.Errorf("failed to save authorization code for user '%d': %w", code.UserID, err)
+	}
+
+	return nil
+}
+
+// DeleteByUserAndClient removes the codes issued to a client for a user, redeemed or not
+func (q *AuthorizationCodeQueries) DeleteByUserAndClient(userID int, clientID string) error {
+	if _, err := q.db.Exec("DELETE FROM authorization_codes WHERE user_id = ? AND client_id = ?", userID, clientID); err != nil {
+		return fmt.Errorf("failed to delete authorization codes: %w", err)
+	}
+
+	return nil
+}
+
+// Consume retrieves an unused, unexpired code by its hash and marks it used. It fails if the code was already
+// redeemed, so a code can only be exchanged once even by concurrent requests.
+func (q *AuthorizationCodeQueries) Consume(codeHash string) (*AuthorizationCode, error) {
+	query := `
+		SELECT id, code_hash, client_id, user_id, redirect_uri, scope, amr, nonce, code_challenge, auth_time, created_at, expires_at
+		FROM authorization_codes
+		WHERE code_hash = ? AND used_at IS NULL AND expires_at > datetime('now')
+	`
+
+	var code AuthorizationCode
+	var scope, amr string
+	var authTime sql.NullTime
+	err := q.db.QueryRow(query, codeHash).Scan(
+		&code.ID,
+		&code.CodeHash,
+		&code.ClientID,
+		&code.UserID,
+		&code.RedirectURI,
+		&scope,
+		&amr,
+		&code.Nonce,
+		&code.CodeChallenge,
+		&authTime,
+		&code.CreatedAt,
+		&code.ExpiresAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("invalid or expired authorization code")
+		}
+		return nil, fmt.Errorf("failed to get authorization code: %w", err)
+	}
+
+	result, err := q.db.Exec("UPDATE authorization_codes SET used_at = CURRENT_TIMESTAMP WHERE id = ? AND used_at IS NULL", code.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark authorization code used: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return nil, fmt.Errorf("authorization code already used")
+	}
+
+	code.Scope = splitList(scope)
+	code.AMR = splitList(amr)
+	code.AuthTime = code.CreatedAt
+	if authTime.Valid {
+		code.AuthTime = authTime.Time
+	}
+	return &code, nil
+}
+
+// RecordRefreshToken links a redeemed code to the refresh token issued for it. It fails if the code was presented
+// again in the meantime, in which case the caller must revoke the token itself.
+func (q *AuthorizationCodeQueries) RecordRefreshToken(id, refreshTokenID int) error {
+	result, err := q.db.Exec("UPDATE authorization_codes SET refresh_token_id = ? WHERE id = ? AND reused_at IS NULL", refreshTokenID, id)
+	if err != nil {
+		return fmt.Errorf("failed to record refresh token: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("authorization code reused")
+	}
+
+	return nil
+}
+
+// RevokeReused handles a redeemed code that is presented again: the code is marked reused and the refresh token issued
+// from it is deleted. It reports whether the hash belonged to a redeemed code.
+func (q *AuthorizationCodeQueries) RevokeReused(codeHash string) (bool, error) {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE authorization_codes SET reused_at = COALESCE(reused_at, CURRENT_TIMESTAMP)
+		WHERE code_hash = ? AND used_at IS NOT NULL
+		RETURNING refresh_token_id
+	`
+
+	var refreshTokenID sql.NullInt64
+	if err := tx.QueryRow(query, codeHash).Scan(&refreshTokenID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to mark authorization code reused: %w", err)
+	}
+
+	if refreshTokenID.Valid {
+		if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE id = ?", refreshTokenID.Int64); err != nil {
+			return false, fmt.Errorf("failed to revoke refresh token: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ConsentGrant records the scopes a user has approved for an OAuth client
+type ConsentGrant struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	ClientID   string    `json:"client_id"`
+	ClientName string    `json:"client_name"`
+	Scope      []string  `json:"scope"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// ConsentGrantQueries provides database operations for consent grants
+type ConsentGrantQueries struct {
+	db *DB
+}
+
+// NewConsentGrantQueries creates a new ConsentGrantQueries instance
+func NewConsentGrantQueries(db *DB) *ConsentGrantQueries {
+	return &ConsentGrantQueries{db: db}
+}
+
+const consentGrantSelect = `
+	SELECT consent_grants.id, consent_grants.user_id, consent_grants.client_id, oauth_clients.name, consent_grants.scope,
+		consent_grants.created_at, consent_grants.updated_at
+	FROM consent_grants
+	JOIN oauth_clients ON oauth_clients.client_id = consent_grants.client_id
+`
+
+// Get retrieves the grant of a user to a client
+func (q *ConsentGrantQueries) Get(userID int, clientID string) (*ConsentGrant, error) {
+	grant, err := scanConsentGrant(q.db.QueryRow(consentGrantSelect+"WHERE consent_grants.user_id = ? AND consent_grants.client_id = ?", userID, clientID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("consent grant not found")
+		}
+		return nil, fmt.Errorf("failed to get consent grant: %w", err)
+	}
+
+	return grant, nil
+}
+
+// Save stores the scopes a user has approved for a client, replacing any earlier grant
+func (q *ConsentGrantQueries) Save(userID int, clientID string, scope []string) error {
+	query := `
+		INSERT INTO consent_grants (user_id, client_id, scope)
+		VALUES (?, ?, ?)
+		ON CONFLICT(user_id, client_id) DO UPDATE SET scope = excluded.scope, updated_at = CURRENT_TIMESTAMP
+	`
+
+	if _, err := q.db.Exec(query, userID, clientID, joinList(scope)); err != nil {
+		return fmt.Errorf("failed to save consent grant: %w", err)
+	}
+
+	return nil
+}
+
+// ListByUserID retrieves the grants of a user, i.e. their connected apps
+func (q *ConsentGrantQueries) ListByUserID(userID int) ([]ConsentGrant, error) {
+	rows, err := q.db.Query(consentGrantSelect+"WHERE consent_grants.user_id = ? ORDER BY oauth_clients.name, consent_grants.id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list consent grants: %w", err)
+	}
+	defer rows.Close()
+
+	grants := []ConsentGrant{}
+	for rows.Next() {
+		grant, err := scanConsentGrant(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan consent grant: %w", err)
+		}
+		grants = append(grants, *grant)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return grants, nil
+}
+
+// Delete withdraws the grant of a user to a client
+func (q *ConsentGrantQueries) Delete(userID int, clientID string) error {
+	result, err := q.db.Exec("DELETE FROM consent_grants WHERE user_id = ? AND client_id = ?", userID, clientID)
+	if err != nil {
+		return fmt.Errorf("failed to delete consent grant: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("consent grant not found")
+	}
+
+	return nil
+}
+
+func scanConsentGrant(row rowScanner) (*ConsentGrant, error) {
+	var grant ConsentGrant
+	var scope string
+	err := row.Scan(&grant.ID, &grant.UserID, &grant.ClientID, &grant.ClientName, &scope, &grant.CreatedAt, &grant.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	grant.Scope = splitList(scope)
+	return &grant, nil
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ConsentRequest is a sign-in at the authorization endpoint waiting for the user to approve the client's scopes
+type ConsentRequest struct {
+	ID        int       `json:"id"`
+	Hash      string    `json:"-"`
+	UserID    int       `json:"user_id"`
+	ClientID  string    `json:"client_id"`
+	Scope     []string  `json:"scope"`
+	AMR       []string  `json:"amr"`
+	AuthTime  time.Time `json:"auth_time"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ConsentRequestQueries provides database operations for consent requests
+type ConsentRequestQueries struct {
+	db *DB
+}
+
+// NewConsentRequestQueries creates a new ConsentRequestQueries instance
+func NewConsentRequestQueries(db *DB) *ConsentRequestQueries {
+	return &ConsentRequestQueries{db: db}
+}
+
+// Create stores a new consent request by its hash
+func (q *ConsentRequestQueries) Create(request *ConsentRequest, validFor time.Duration) error {
+	query := `
+		INSERT INTO consent_requests (hash, user_id, client_id, scope, amr, auth_time, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, datetime('now', ?))
+	`
+
+	_, err := q.db.Exec(query, request.Hash, request.UserID, request.ClientID, joinList(request.Scope), joinList(request.AMR),
+		request.AuthTime.UTC().Format(sqliteTimeFormat), sqliteOffset(validFor))
+	if err != nil {
+		return fmt.Errorf("failed to save consent request for user '%d': %w", request.UserID, err)
+	}
+
+	return nil
+}
+
+// Consume retrieves an unexpired request by its hash and deletes it, so each request is answered once
+func (q *ConsentRequestQueries) Consume(hash string) (*ConsentRequest, error) {
+	query := `
+		SELECT id, hash, user_id, client_id, scope, amr, auth_time, expires_at
+		FROM consent_requests
+		WHERE hash = ? AND expires_at > datetime('now')
+	`
+
+	var request ConsentRequest
+	var scope, amr string
+	err := q.db.QueryRow(query, hash).Scan(
+		&request.ID,
+		&request.Hash,
+		&request.UserID,
+		&request.ClientID,
+		&scope,
+		&amr,
+		&request.AuthTime,
+		&request.ExpiresAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("invalid or expired consent request")
+		}
+		return nil, fmt.Errorf("failed to get consent request: %w", err)
+	}
+
+	result, err := q.db.Exec("DELETE FROM consent_requests WHERE id = ?", request.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete consent request: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return nil, fmt.Errorf("consent request already answered")
+	}
+
+	request.Scope = splitList(scope)
+	request.AMR = splitList(amr)
+	return &request, nil
+}
@@ -6,6 +6,8 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -21,7 +23,13 @@ func New(dataSourceName string, logger *slog.Logger) (*DB, error) {
 		return nil, fmt.Errorf("failed to create database directory: %w", err)
 	}
 
-	sqlDB, err := sql.Open("sqlite3", dataSourceName)
+	// PRAGMA foreign_keys only reaches the pooled connection that runs it, so enforcement (and with it ON DELETE
+	// CASCADE) is switched on for every connection through the DSN
+	separator := "?"
+	if strings.Contains(dataSourceName, "?") {
+		separator = "&"
+	}
+	sqlDB, err := sql.Open("sqlite3", dataSourceName+separator+"_foreign_keys=on")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -58,3 +66,18 @@ func (db *DB) Close() error {
 func (db *DB) Health() error {
 	return db.Ping()
 }
+
+// joinList encodes a list of tokens (amr values, scopes) as a space separated column value
+func joinList(values []string) string {
+	return strings.Join(values, " ")
+}
+
+// splitList decodes a space separated column value
+func splitList(value string) []string {
+	return strings.Fields(value)
+}
+
+// sqliteOffset formats a duration as a modifier for SQLite's datetime function
+func sqliteOffset(d time.Duration) string {
+	return fmt.Sprintf("%+d seconds", int(d.Seconds()))
+}
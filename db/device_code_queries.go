@@ -0,0 +1,181 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Device code states. A pending code waits for the user to approve or deny it on the verification page.
+const (
+	DeviceCodePending  = "pending"
+	DeviceCodeApproved = "approved"
+	DeviceCodeDenied   = "denied"
+)
+
+// DeviceCode is a device authorization request (RFC 8628 §3.1). The device polls the token endpoint with the
+// device code while the user enters the user code on the verification page.
+type DeviceCode struct {
+	ID             int        `json:"id"`
+	DeviceCodeHash string     `json:"-"`
+	UserCodeHash   string     `json:"-"`
+	ClientID       string     `json:"client_id"`
+	Scope          []string   `json:"scope"`
+	Status         string     `json:"status"`
+	UserID         *int       `json:"user_id,omitempty"`   // set when the user approves
+	AMR            []string   `json:"amr"`                 // how the approving user signed in
+	AuthTime       *time.Time `json:"auth_time,omitempty"` // when the approving user signed in
+	PollInterval   int        `json:"poll_interval"`       // seconds the device must wait between token requests
+	LastPolledAt   *time.Time `json:"last_polled_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+}
+
+// IsExpired reports whether the code can no longer be approved or redeemed
+func (c *DeviceCode) IsExpired() bool {
+	return !time.Now().Before(c.ExpiresAt)
+}
+
+// DeviceCodeQueries provides database operations for device codes
+type DeviceCodeQueries struct {
+	db *DB
+}
+
+// NewDeviceCodeQueries creates a new DeviceCodeQueries instance
+func NewDeviceCodeQueries(db *DB) *DeviceCodeQueries {
+	return &DeviceCodeQueries{db: db}
+}
+
+const deviceCodeColumns = `id, device_code_hash, user_code_hash, client_id, scope, status, user_id, amr, auth_time, poll_interval,
+	last_polled_at, created_at, expires_at`
+
+// Create stores a new device authorization request by the hashes of its codes. Expired requests are removed first,
+// so their user codes can be handed out again.
+func (q *DeviceCodeQueries) Create(code *DeviceCode, validFor time.Duration) error {
+	if _, err := q.db.Exec("DELETE FROM device_codes WHERE expires_at <= datetime('now')"); err != nil {
+		return fmt.Errorf("failed to delete expired device codes: %w", err)
+	}
+
+	query := `
+		INSERT INTO device_codes (device_code_hash, user_code_hash, client_id, scope, poll_interval, expires_at)
+		VALUES (?, ?, ?, ?, ?, datetime('now', ?))
+	`
+
+	_, err := q.db.Exec(query, code.DeviceCodeHash, code.UserCodeHash, code.ClientID, joinList(code.Scope), code.PollInterval,
+		sqliteOffset(validFor))
+	if err != nil {
+		return fmt.Errorf("failed to save device code for client '%s': %w", code.ClientID, err)
+	}
+
+	return nil
+}
+
+// GetPendingByUserCode retrieves an unexpired request waiting for the user by the hash of its user code
+func (q *DeviceCodeQueries) GetPendingByUserCode(userCodeHash string) (*DeviceCode, error) {
+	return q.getOne("WHERE user_code_hash = ? AND status = ? AND expires_at > datetime('now')", userCodeHash, DeviceCodePending)
+}
+
+// GetByDeviceCode retrieves a request by the hash of its device code, whatever its state, so the token endpoint can
+// tell an expired code from an unknown one
+func (q *DeviceCodeQueries) GetByDeviceCode(deviceCodeHash string) (*DeviceCode, error) {
+	return q.getOne("WHERE device_code_hash = ?", deviceCodeHash)
+}
+
+// Approve records the user's approval of a pending request. It fails if the request was answered or expired in the
+// meantime.
+func (q *DeviceCodeQueries) Approve(id, userID int, amr, scope []string, authTime time.Time) error {
+	result, err := q.db.Exec(`
+		UPDATE device_codes
+		SET status = ?, user_id = ?, amr = ?, scope = ?, auth_time = ?
+		WHERE id = ? AND status = ? AND expires_at > datetime('now')
+	`, DeviceCodeApproved, userID, joinList(amr), joinList(scope), authTime.UTC().Format(sqliteTimeFormat), id, DeviceCodePending)
+	if err != nil {
+		return fmt.Errorf("failed to approve device code: %w", err)
+	}
+
+	return requireDeviceCodeRow(result)
+}
+
+// Deny records that the user refused a pending request
+func (q *DeviceCodeQueries) Deny(id int) error {
+	result, err := q.db.Exec("UPDATE device_codes SET status = ? WHERE id = ? AND status = ?", DeviceCodeDenied, id, DeviceCodePending)
+	if err != nil {
+		return fmt.Errorf("failed to deny device code: %w", err)
+	}
+
+	return requireDeviceCodeRow(result)
+}
+
+// RecordPoll notes a token request for a pending code. slowDown adds 5 seconds to the interval the device must keep
+// from then on (RFC 8628 §3.5).
+func (q *DeviceCodeQueries) RecordPoll(id int, slowDown bool) error {
+	increase := 0
+	if slowDown {
+		increase = 5
+	}
+
+	_, err := q.db.Exec(`
+		UPDATE device_codes
+		SET last_polled_at = strftime('%Y-%m-%d %H:%M:%f', 'now'), poll_interval = poll_interval + ?
+		WHERE id = ?
+	`, increase, id)
+	if err != nil {
+		return fmt.Errorf("failed to record device code poll: %w", err)
+	}
+
+	return nil
+}
+
+// Redeem deletes an approved code once tokens are issued for it. It fails if another request redeemed it first.
+func (q *DeviceCodeQueries) Redeem(id int) error {
+	result, err := q.db.Exec("DELETE FROM device_codes WHERE id = ? AND status = ?", id, DeviceCodeApproved)
+	if err != nil {
+		return fmt.Errorf("failed to redeem device code: %w", err)
+	}
+
+	return requireDeviceCodeRow(result)
+}
+
+func requireDeviceCodeRow(result sql.Result) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("device code no longer pending")
+	}
+
+	return nil
+}
+
+func (q *DeviceCodeQueries) getOne(where string, args ...interface{}) (*DeviceCode, error) {
+	var code DeviceCode
+	var scope, amr string
+	err := q.db.QueryRow("SELECT "+deviceCodeColumns+" FROM device_codes "+where, args...).Scan(
+		&code.ID,
+		&code.DeviceCodeHash,
+		&code.UserCodeHash,
+		&code.ClientID,
+		&scope,
+		&code.Status,
+		&code.UserID,
+		&amr,
+		&code.AuthTime,
+		&code.PollInterval,
+		&code.LastPolledAt,
+		&code.CreatedAt,
+		&code.ExpiresAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("device code not found")
+		}
+		return nil, fmt.Errorf("failed to get device code: %w", err)
+	}
+
+	code.Scope = splitList(scope)
+	code.AMR = splitList(amr)
+	return &code, nil
+}
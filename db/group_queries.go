@@ -0,0 +1,408 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Group represents a named set of users within an organization. Groups can be nested: the members of a subgroup
+// are members of every group it is nested in.
+type Group struct {
+	ID             int       `json:"id"`
+	OrganizationID int       `json:"organization_id"`
+	Name           string    `json:"name"`
+	Description    string    `json:"description"`
+	ExternalID     string    `json:"external_id,omitempty"` // identifier assigned by a SCIM provisioning client
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// GroupQueries provides database operations for groups, their members and their nesting
+type GroupQueries struct {
+	db *DB
+}
+
+// NewGroupQueries creates a new GroupQueries instance
+func NewGroupQueries(db *DB) *GroupQueries {
+	return &GroupQueries{db: db}
+}
+
+// ancestorsCTE expands the groups a user belongs to directly into every group reachable through nesting.
+// UNION rather than UNION ALL drops groups already visited, so the recursion ends even on a cyclic graph.
+const ancestorsCTE = `
+	WITH RECURSIVE member_of(id) AS (
+		SELECT group_id FROM group_members WHERE user_id = ?
+		UNION
+		SELECT gn.parent_id FROM group_nesting gn JOIN member_of m ON gn.child_id = m.id
+	)
+`
+
+// descendantsCTE expands a group into itself and every group nested in it, at any depth
+const descendantsCTE = `
+	WITH RECURSIVE descendants(id) AS (
+		SELECT ?
+		UNION
+		SELECT gn.child_id FROM group_nesting gn JOIN descendants d ON gn.parent_id = d.id
+	)
+`
+
+// Create inserts a new group into an organization
+func (q *GroupQueries) Create(organizationID int, name, description string) (*Group, error) {
+	query := "INSERT INTO groups (organization_id, name, description) VALUES (?, ?, ?)"
+
+	result, err := q.db.Exec(query, organizationID, name, description)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create group: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+
+	return q.GetByID(int(id))
+}
+
+// GetByID retrieves a group by ID
+func (q *GroupQueries) GetByID(id int) (*Group, error) {
+	query := `
+		SELECT id, organization_id, name, description, external_id, created_at
+		FROM groups
+		WHERE id = ?
+	`
+
+	group, err := scanGroup(q.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("group not found")
+		}
+		return nil, fmt.Errorf("failed to get group by id: %w", err)
+	}
+
+	return group, nil
+}
+
+// List retrieves the groups of an organization
+func (q *GroupQueries) List(organizationID int) ([]Group, error) {
+	query := `
+		SELECT id, organization_id, name, description, external_id, created_at
+		FROM groups
+		WHERE organization_id = ?
+		ORDER BY name
+	`
+
+	return q.queryGroups(query, organizationID)
+}
+
+// Update renames a group and replaces its description
+func (q *GroupQueries) Update(id int, name, description string) (*Group, error) {
+	result, err := q.db.Exec("UPDATE groups SET name = ?, description = ? WHERE id = ?", name, description, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update group: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return nil, fmt.Errorf("group not found")
+	}
+
+	return q.GetByID(id)
+}
+
+// Delete removes a group together with its memberships and nesting
+func (q *GroupQueries) Delete(id int) error {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM groups WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete group: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("group not found")
+	}
+
+	// A nesting row left behind would still make the deleted group's members members of its parents
+	if _, err := tx.Exec("DELETE FROM group_members WHERE group_id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete group members: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM group_nesting WHERE parent_id = ? OR child_id = ?", id, id); err != nil {
+		return fmt.Errorf("failed to delete group nesting: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// SetExternalID records the identifier a provisioning client uses for a group
+func (q *GroupQueries) SetExternalID(id int, externalID string) error {
+	if _, err := q.db.Exec("UPDATE groups SET external_id = ? WHERE id = ?", externalID, id); err != nil {
+		return fmt.Errorf("failed to set external id: %w", err)
+	}
+
+	return nil
+}
+
+// GetByName retrieves a group of an organization by name
+func (q *GroupQueries) GetByName(organizationID int, name string) (*Group, error) {
+	query := `
+		SELECT id, organization_id, name, description, external_id, created_at
+		FROM groups
+		WHERE organization_id = ? AND name = ?
+	`
+
+	group, err := scanGroup(q.db.QueryRow(query, organizationID, name))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("group not found")
+		}
+		return nil, fmt.Errorf("failed to get group by name: %w", err)
+	}
+
+	return group, nil
+}
+
+// ReplaceMembers makes userIDs the exact set of direct members of a group
+func (q *GroupQueries) ReplaceMembers(groupID int, userIDs []int) error {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM group_members WHERE group_id = ?", groupID); err != nil {
+		return fmt.Errorf("failed to clear group members: %w", err)
+	}
+
+	for _, userID := range userIDs {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO group_members (group_id, user_id) VALUES (?, ?)", groupID, userID); err != nil {
+			return fmt.Errorf("failed to add group member: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// AddMember adds a user to a group. Adding an existing member is not an error.
+func (q *GroupQueries) AddMember(groupID, userID int) error {
+	_, err := q.db.Exec("INSERT OR IGNORE INTO group_members (group_id, user_id) VALUES (?, ?)", groupID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to add group member: %w", err)
+	}
+
+	return nil
+}
+
+// RemoveMember removes a user from a group
+func (q *GroupQueries) RemoveMember(groupID, userID int) error {
+	result, err := q.db.Exec("DELETE FROM group_members WHERE group_id = ? AND user_id = ?", groupID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to remove group member: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("group member not found")
+	}
+
+	return nil
+}
+
+// ListMembers returns the users of a group. With transitive set, members of nested groups are included.
+func (q *GroupQueries) ListMembers(groupID int, transitive bool) ([]User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE deleted_at IS NULL AND id IN (SELECT user_id FROM group_members WHERE group_id = ?)
+		ORDER BY email
+	`
+	if transitive {
+		query = descendantsCTE + `
+			SELECT ` + userColumns + `
+			FROM users
+			WHERE deleted_at IS NULL AND id IN (SELECT gm.user_id FROM group_members gm JOIN descendants d ON gm.group_id = d.id)
+			ORDER BY email
+		`
+	}
+
+	rows, err := q.db.Query(query, groupID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list group members: %w", err)
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, *user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return users, nil
+}
+
+// AddSubgroup nests a group inside another. Nesting that would make a group a member of itself, directly or through
+// other groups, is refused.
+func (q *GroupQueries) AddSubgroup(parentID, childID int) error {
+	if parentID == childID {
+		return fmt.Errorf("group nesting would create a cycle")
+	}
+
+	tx, err := q.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The new edge closes a cycle exactly when the parent is already nested somewhere below the child.
+	var cycles int
+	err = tx.QueryRow(descendantsCTE+"SELECT COUNT(*) FROM descendants WHERE id = ?", childID, parentID).Scan(&cycles)
+	if err != nil {
+		return fmt.Errorf("failed to check group nesting: %w", err)
+	}
+	if cycles > 0 {
+		return fmt.Errorf("group nesting would create a cycle")
+	}
+
+	if _, err := tx.Exec("INSERT OR IGNORE INTO group_nesting (parent_id, child_id) VALUES (?, ?)", parentID, childID); err != nil {
+		return fmt.Errorf("failed to nest group: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// RemoveSubgroup removes a group from another group
+func (q *GroupQueries) RemoveSubgroup(parentID, childID int) error {
+	result, err := q.db.Exec("DELETE FROM group_nesting WHERE parent_id = ? AND child_id = ?", parentID, childID)
+	if err != nil {
+		return fmt.Errorf("failed to remove subgroup: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("subgroup not found")
+	}
+
+	return nil
+}
+
+// ListSubgroups returns the groups nested directly in a group
+func (q *GroupQueries) ListSubgroups(groupID int) ([]Group, error) {
+	query := `
+		SELECT g.id, g.organization_id, g.name, g.description, g.external_id, g.created_at
+		FROM groups g
+		JOIN group_nesting gn ON gn.child_id = g.id
+		WHERE gn.parent_id = ?
+		ORDER BY g.name
+	`
+
+	return q.queryGroups(query, groupID)
+}
+
+// ListForUser returns the groups a user belongs to. With transitive set, the groups those groups are nested in are
+// included, at any depth.
+func (q *GroupQueries) ListForUser(userID int, transitive bool) ([]Group, error) {
+	query := `
+		SELECT g.id, g.organization_id, g.name, g.description, g.external_id, g.created_at
+		FROM groups g
+		JOIN group_members gm ON gm.group_id = g.id
+		WHERE gm.user_id = ?
+		ORDER BY g.name
+	`
+	if transitive {
+		query = ancestorsCTE + `
+			SELECT g.id, g.organization_id, g.name, g.description, g.external_id, g.created_at
+			FROM groups g
+			JOIN member_of m ON m.id = g.id
+			ORDER BY g.name
+		`
+	}
+
+	return q.queryGroups(query, userID)
+}
+
+// ListNamesForUser returns the names of every group a user belongs to, directly or through nesting
+func (q *GroupQueries) ListNamesForUser(userID int) ([]string, error) {
+	groups, err := q.ListForUser(userID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(groups))
+	for i, group := range groups {
+		names[i] = group.Name
+	}
+
+	return names, nil
+}
+
+func (q *GroupQueries) queryGroups(query string, args ...interface{}) ([]Group, error) {
+	rows, err := q.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list groups: %w", err)
+	}
+	defer rows.Close()
+
+	groups := []Group{}
+	for rows.Next() {
+		group, err := scanGroup(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan group: %w", err)
+		}
+		groups = append(groups, *group)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return groups, nil
+}
+
+func scanGroup(row rowScanner) (*Group, error) {
+	var group Group
+	err := row.Scan(&group.ID, &group.OrganizationID, &group.Name, &group.Description, &group.ExternalID, &group.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// InitialAccessToken authorizes dynamic client registration (RFC 7591 §3) in an organization. Clients registered
+// with it may only be given scopes and grant types within the token's.
+type InitialAccessToken struct {
+	ID             int        `json:"id"`
+	OrganizationID int        `json:"organization_id"`
+	Name           string     `json:"name"`
+	TokenHash      string     `json:"-"`
+	Scope          []string   `json:"scope"`
+	GrantTypes     []string   `json:"grant_types"`
+	MaxUses        *int       `json:"max_uses,omitempty"` // registrations allowed with the token, unlimited when nil
+	UseCount       int        `json:"use_count"`
+	CreatedBy      *int       `json:"created_by,omitempty"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+}
+
+// IsUsable reports whether the token is unexpired and has registrations left
+func (t *InitialAccessToken) IsUsable() bool {
+	return time.Now().Before(t.ExpiresAt) && (t.MaxUses == nil || t.UseCount < *t.MaxUses)
+}
+
+// InitialAccessTokenQueries provides database operations for initial access tokens
+type InitialAccessTokenQueries struct {
+	db *DB
+}
+
+// NewInitialAccessTokenQueries creates a new InitialAccessTokenQueries instance
+func NewInitialAccessTokenQueries(db *DB) *InitialAccessTokenQueries {
+	return &InitialAccessTokenQueries{db: db}
+}
+
+const initialAccessTokenColumns = "id, organization_id, name, token_hash, scope, grant_types, max_uses, use_count, created_by, expires_at, created_at, last_used_at"
+
+// Create stores a new token by its hash
+func (q *InitialAccessTokenQueries) Create(token *InitialAccessToken, validFor time.Duration) (*InitialAccessToken, error) {
+	query := `
+		INSERT INTO initial_access_tokens (organization_id, name, token_hash, scope, grant_types, max_uses, created_by, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, datetime('now', ?))
+	`
+
+	result, err := q.db.Exec(query, token.OrganizationID, token.Name, token.TokenHash, joinList(token.Scope), joinList(token.GrantTypes), token.MaxUses,
+		token.CreatedBy, sqliteOffset(validFor))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create initial access token: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+
+	return q.getOne("WHERE id = ?", id)
+}
+
+// GetByHash retrieves a token by the hash of its value
+func (q *InitialAccessTokenQueries) GetByHash(tokenHash string) (*InitialAccessToken, error) {
+	return q.getOne("WHERE token_hash = ?", tokenHash)
+}
+
+// List retrieves the tokens of an organization
+func (q *InitialAccessTokenQueries) List(organizationID int) ([]InitialAccessToken, error) {
+	rows, err := q.db.Query("SELECT "+initialAccessTokenColumns+" FROM initial_access_tokens WHERE organization_id = ? ORDER BY created_at DESC", organizationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list initial access tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []InitialAccessToken{}
+	for rows.Next() {
+		token, err := scanInitialAccessToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan initial access token: %w", err)
+		}
+		tokens = append(tokens, *token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// Use counts a registration against a token. It fails if the token expired or ran out of uses in the meantime, so
+// concurrent registrations cannot exceed max_uses.
+func (q *InitialAccessTokenQueries) Use(id int) error {
+	result, err := q.db.Exec(`
+		UPDATE initial_access_tokens
+		SET use_count = use_count + 1, last_used_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND expires_at > datetime('now') AND (max_uses IS NULL OR use_count < max_uses)
+	`, id)
+	if err != nil {
+		return fmt.Errorf("failed to update initial access token: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("initial access token expired or used up")
+	}
+
+	return nil
+}
+
+// Delete revokes a token of an organization. Clients already registered with it are kept.
+func (q *InitialAccessTokenQueries) Delete(organizationID, id int) error {
+	result, err := q.db.Exec("DELETE FROM initial_access_tokens WHERE id = ? AND organization_id = ?", id, organizationID)
+	if err != nil {
+		return fmt.Errorf("failed to delete initial access token: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("initial access token not found")
+	}
+
+	return nil
+}
+
+func (q *InitialAccessTokenQueries) getOne(where string, arg interface{}) (*InitialAccessToken, error) {
+	token, err := scanInitialAccessToken(q.db.QueryRow("SELECT "+initialAccessTokenColumns+" FROM initial_access_tokens "+where, arg))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("initial access token not found")
+		}
+		return nil, fmt.Errorf("failed to get initial access token: %w", err)
+	}
+
+	return token, nil
+}
+
+func scanInitialAccessToken(row rowScanner) (*InitialAccessToken, error) {
+	var token InitialAccessToken
+	var scope, grantTypes string
+	err := row.Scan(&token.ID, &token.OrganizationID, &token.Name, &token.TokenHash, &scope, &grantTypes, &token.MaxUses, &token.UseCount,
+		&token.CreatedBy, &token.ExpiresAt, &token.CreatedAt, &token.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Scope = splitList(scope)
+	token.GrantTypes = splitList(grantTypes)
+	return &token, nil
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// LoginAttempt tracks failed login attempts for a throttling key (an account or a source IP)
+type LoginAttempt struct {
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+}
+
+// LoginAttemptQueries provides database operations for login attempts
+type LoginAttemptQueries struct {
+	db *DB
+}
+
+// NewLoginAttemptQueries creates a new LoginAttemptQueries instance
+func NewLoginAttemptQueries(db *DB) *LoginAttemptQueries {
+	return &LoginAttemptQueries{db: db}
+}
+
+// GetByKey retrieves the attempt record for a key, returning an empty record when none exists
+func (q *LoginAttemptQueries) GetByKey(key string) (*LoginAttempt, error) {
+	query := `
+		SELECT key, failures, last_failure_at, locked_until
+		FROM login_attempts
+		WHERE key = ?
+	`
+
+	var attempt LoginAttempt
+	var lockedUntil sql.NullTime
+	err := q.db.QueryRow(query, key).Scan(
+		&attempt.Key,
+		&attempt.Failures,
+		&attempt.LastFailureAt,
+		&lockedUntil,
+	)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &LoginAttempt{Key: key}, nil
+		}
+		return nil, fmt.Errorf("failed to get login attempts for '%s': %w", key, err)
+	}
+
+	if lockedUntil.Valid {
+		attempt.LockedUntil = &lockedUntil.Time
+	}
+
+	return &attempt, nil
+}
+
+// RecordFailure atomically counts a failure for a key and returns the key's consecutive failures. Failures older than
+// window are forgotten, so the count starts again at one.
+func (q *LoginAttemptQueries) RecordFailure(key string, now time.Time, window time.Duration) (int, error) {
+	query := `
+		INSERT INTO login_attempts (key, failures, last_failure_at, locked_until)
+		VALUES (?, 1, ?, NULL)
+		ON CONFLICT(key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure_at < ? THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure_at = excluded.last_failure_at
+		RETURNING failures
+	`
+
+	var failures int
+	if err := q.db.QueryRow(query, key, now.UTC(), now.Add(-window).UTC()).Scan(&failures); err != nil {
+		return 0, fmt.Errorf("failed to record login failure for '%s': %w", key, err)
+	}
+
+	return failures, nil
+}
+
+// SetLockedUntil sets the lockout of a key decided for its failures-th failure. The update only applies while the
+// count is unchanged, so a concurrent later failure keeps the lockout it decided.
+func (q *LoginAttemptQueries) SetLockedUntil(key string, failures int, lockedUntil *time.Time) error {
+	query := `UPDATE login_attempts SET locked_until = ? WHERE key = ? AND failures = ?`
+
+	var until sql.NullTime
+	if lockedUntil != nil {
+		until = sql.NullTime{Time: lockedUntil.UTC(), Valid: true}
+	}
+
+	if _, err := q.db.Exec(query, until, key, failures); err != nil {
+		return fmt.Errorf("failed to lock '%s': %w", key, err)
+	}
+
+	return nil
+}
+
+// DeleteByKey clears the attempt record for a key
+func (q *LoginAttemptQueries) DeleteByKey(key string) error {
+	query := `DELETE FROM login_attempts WHERE key = ?`
+
+	if _, err := q.db.Exec(query, key); err != nil {
+		return fmt.Errorf("failed to delete login attempts for '%s': %w", key, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MagicLink is a single-use passwordless sign-in token sent by email
+type MagicLink struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"user_id"`
+	Hash        string     `json:"-"`
+	BindingHash string     `json:"-"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	UsedAt      *time.Time `json:"used_at,omitempty"`
+}
+
+// MagicLinkQueries provides database operations for magic links
+type MagicLinkQueries struct {
+	db *DB
+}
+
+// NewMagicLinkQueries creates a new MagicLinkQueries instance
+func NewMagicLinkQueries(db *DB) *MagicLinkQueries {
+	return &MagicLinkQueries{db: db}
+}
+
+// Create stores a new magic link. bindingHash is empty when the link is not bound to a browser.
+func (q *MagicLinkQueries) Create(userID int, tokenHash, bindingHash string, validFor time.Duration) error {
+	query := `
+		INSERT INTO magic_links (user_id, hash, binding_hash, expires_at)
+		VALUES (?, ?, ?, datetime('now', ?))
+	`
+
+	if _, err := q.db.Exec(query, userID, tokenHash, bindingHash, sqliteOffset(validFor)); err != nil {
+		return fmt.Errorf("failed to save magic link for user '%d': %w", userID, err)
+	}
+
+	return nil
+}
+
+// CountRecentByUserID returns how many links were issued to a user within the given window
+func (q *MagicLinkQueries) CountRecentByUserID(userID int, window time.Duration) (int, error) {
+	query := `
+		SELECT COUNT(*) FROM magic_links
+		WHERE user_id = ? AND created_at > datetime('now', ?)
+	`
+
+	var count int
+	if err := q.db.QueryRow(query, userID, fmt.Sprintf("-%d seconds", int(window.Seconds()))).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count magic links: %w", err)
+	}
+
+	return count, nil
+}
+
+// GetValidByHash retrieves an unused, unexpired link by its hash
+func (q *MagicLinkQueries) GetValidByHash(tokenHash string) (*MagicLink, error) {
+	query := `
+		SELECT id, user_id, hash, binding_hash, created_at, expires_at
+		FROM magic_links
+		WHERE hash = ? AND used_at IS NULL AND expires_at > datetime('now')
+	`
+
+	var link MagicLink
+	err := q.db.QueryRow(query, tokenHash).Scan(
+		&link.ID,
+		&link.UserID,
+		&link.Hash,
+		&link.BindingHash,
+		&link.CreatedAt,
+		&link.ExpiresAt,
+	)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("invalid or expired magic link")
+		}
+		return nil, fmt.Errorf("failed to get magic link: %w", err)
+	}
+
+	return &link, nil
+}
+
+// MarkUsed consumes a link. It fails if the link was already used, so a link can only be redeemed once.
+func (q *MagicLinkQueries) MarkUsed(id int) error {
+	result, err := q.db.Exec("UPDATE magic_links SET used_at = CURRENT_TIMESTAMP WHERE id = ? AND used_at IS NULL", id)
+	if err != nil {
+		return fmt.Errorf("failed to mark magic link used: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("magic link already used")
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MFAChallenge is issued after a successful first factor and exchanged for tokens once the second factor is verified
+type MFAChallenge struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Hash      string    `json:"-"`
+	AMR       []string  `json:"amr"`
+	Scope     []string  `json:"scope"` // scope requested at login, carried through to the issued tokens
+	Binding   string    `json:"-"`     // identifies the authorization or device request of a sign-in page, empty for /api/login
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// MFAChallengeQueries provides database operations for MFA challenges
+type MFAChallengeQueries struct {
+	db *DB
+}
+
+// NewMFAChallengeQueries creates a new MFAChallengeQueries instance
+func NewMFAChallengeQueries(db *DB) *MFAChallengeQueries {
+	return &MFAChallengeQueries{db: db}
+}
+
+// Create stores a new challenge that expires after validFor
+func (q *MFAChallengeQueries) Create(userID int, tokenHash string, amr, scope []string, validFor time.Duration) (*MFAChallenge, error) {
+	return q.CreateForRequest(userID, tokenHash, amr, scope, "", validFor)
+}
+
+// CreateForRequest stores a new challenge that can only be completed for the request identified by binding
+func (q *MFAChallengeQueries) CreateForRequest(userID int, tokenHash string, amr, scope []string, binding string, validFor time.Duration) (*MFAChallenge, error) {
+	query := `
+		INSERT INTO mfa_challenges (user_id, hash, amr, scope, request_binding, expires_at)
+		VALUES (?, ?, ?, ?, ?, datetime('now', ?))
+	`
+
+	result, err := q.db.Exec(query, userID, tokenHash, joinList(amr), joinList(scope), binding, sqliteOffset(validFor))
+	if err != nil {
+		return nil, fmt.Errorf("failed to save mfa challenge for user '%d': %w", userID, err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+
+	return q.getByColumn("id", id)
+}
+
+// GetValidByHash retrieves an unexpired challenge by its hash
+func (q *MFAChallengeQueries) GetValidByHash(tokenHash string) (*MFAChallenge, error) {
+	return q.getByColumn("hash", tokenHash)
+}
+
+func (q *MFAChallengeQueries) getByColumn(column string, value interface{}) (*MFAChallenge, error) {
+	query := fmt.Sprintf(`
+		SELECT id, user_id, hash, amr, scope, request_binding, attempts, created_at, expires_at
+		FROM mfa_challenges
+		WHERE %s = ? AND expires_at > datetime('now')
+	`, column)
+
+	var challenge MFAChallenge
+	var amr, scope string
+	err := q.db.QueryRow(query, value).Scan(
+		&challenge.ID,
+		&challenge.UserID,
+		&challenge.Hash,
+		&amr,
+		&scope,
+		&challenge.Binding,
+		&challenge.Attempts,
+		&challenge.CreatedAt,
+		&challenge.ExpiresAt,
+	)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("invalid or expired mfa challenge")
+		}
+		return nil, fmt.Errorf("failed to get mfa challenge: %w", err)
+	}
+
+	challenge.AMR = splitList(amr)
+	challenge.Scope = splitList(scope)
+	return &challenge, nil
+}
+
+// IncrementAttempts records a failed verification and returns the new attempt count
+func (q *MFAChallengeQueries) IncrementAttempts(id int) (int, error) {
+	query := "UPDATE mfa_challenges SET attempts = attempts + 1 WHERE id = ? RETURNING attempts"
+
+	var attempts int
+	if err := q.db.QueryRow(query, id).Scan(&attempts); err != nil {
+		return 0, fmt.Errorf("failed to update mfa challenge attempts: %w", err)
+	}
+
+	return attempts, nil
+}
+
+// DeleteByID removes a challenge, making it unusable
+func (q *MFAChallengeQueries) DeleteByID(id int) error {
+	result, err := q.db.Exec("DELETE FROM mfa_challenges WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete mfa challenge: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("mfa challenge not found")
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"embed"
 	"fmt"
 	"path/filepath"
@@ -117,8 +118,24 @@ func (db *DB) getCurrentVersion() (int, error) {
 	return version, err
 }
 
+// executeMigration applies one migration on a dedicated connection with foreign key enforcement switched off,
+// following SQLite's procedure for rebuilding tables: dropping a parent table would otherwise cascade deletes
+// into its children.
 func (db *DB) executeMigration(migration Migration) error {
-	tx, err := db.Begin()
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return fmt.Errorf("failed to disable foreign keys: %w", err)
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+
+	tx, err := conn.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
@@ -0,0 +1,284 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Client types (RFC 6749 §2.1). Public clients, such as single-page and native apps, cannot keep a secret.
+const (
+	ClientTypeConfidential = "confidential"
+	ClientTypePublic       = "public"
+)
+
+// Token endpoint authentication methods (RFC 7591 §2, RFC 8705 §2, RFC 7523 §2.2). Confidential clients registered
+// with either secret method may use the other; public clients use none. The TLS methods authenticate with a client
+// certificate and private_key_jwt with an assertion signed by the client's key, instead of a secret.
+const (
+	AuthMethodClientSecretBasic       = "client_secret_basic"
+	AuthMethodClientSecretPost        = "client_secret_post"
+	AuthMethodNone                    = "none"
+	AuthMethodTLSClientAuth           = "tls_client_auth"
+	AuthMethodSelfSignedTLSClientAuth = "self_signed_tls_client_auth"
+	AuthMethodPrivateKeyJWT           = "private_key_jwt"
+)
+
+// TLSClientAuthMetadata names the certificate of a tls_client_auth client (RFC 8705 §2.1.2). Exactly one field is
+// set, and the certificate must carry that subject or subject alternative name.
+type TLSClientAuthMetadata struct {
+	SubjectDN string `json:"tls_client_auth_subject_dn,omitempty"` // as formatted by Go, e.g. CN=billing,O=Example
+	SANDNS    string `json:"tls_client_auth_san_dns,omitempty"`
+	SANURI    string `json:"tls_client_auth_san_uri,omitempty"`
+	SANIP     string `json:"tls_client_auth_san_ip,omitempty"`
+	SANEmail  string `json:"tls_client_auth_san_email,omitempty"`
+}
+
+// OAuthClient is an application registered to obtain tokens from the OAuth token endpoint
+type OAuthClient struct {
+	ID                      int        `json:"id"`
+	OrganizationID          int        `json:"organization_id"`
+	ClientID                string     `json:"client_id"`
+	ClientType              string     `json:"client_type"`
+	SecretHash              string     `json:"-"` // empty for public clients
+	PreviousSecretHash      string     `json:"-"` // replaced secret, still accepted until PreviousSecretExpiresAt
+	PreviousSecretExpiresAt *time.Time `json:"previous_secret_expires_at,omitempty"`
+	Name                    string     `json:"name"`
+	OwnerID                 *int       `json:"owner_id,omitempty"` // user responsible for the client; cleared if that user is purged
+	Scope                   []string   `json:"scope"`              // scopes the client may be granted
+	RedirectURIs            []string   `json:"redirect_uris"`      // exact redirect URIs allowed at the authorization endpoint
+	GrantTypes              []string   `json:"grant_types"`        // grants the client may use at the token endpoint
+	TokenEndpointAuthMethod string     `json:"token_endpoint_auth_method"`
+	LogoURI                 string     `json:"logo_uri,omitempty"`
+	PolicyURI               string     `json:"policy_uri,omitempty"`
+	RegistrationTokenHash   string     `json:"-"`                        // registration access token (RFC 7592), empty for clients registered by an administrator
+	TokenExchangeAudiences  []string   `json:"token_exchange_audiences"` // audiences the client may ask for when exchanging tokens
+	TokenLifetime           int        `json:"token_lifetime"`           // access token lifetime in seconds
+	TLSClientAuthMetadata
+	JWKS      json.RawMessage `json:"jwks,omitempty"`     // the client's public keys as a JWK Set, with certificates for self_signed_tls_client_auth
+	JWKSURI   string          `json:"jwks_uri,omitempty"` // where the client publishes its public keys, instead of jwks
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// IsPublic reports whether the client has no secret and is identified by its client_id alone
+func (c *OAuthClient) IsPublic() bool {
+	return c.ClientType == ClientTypePublic
+}
+
+// UsesSecret reports whether the client authenticates with a client secret
+func (c *OAuthClient) UsesSecret() bool {
+	return c.TokenEndpointAuthMethod == AuthMethodClientSecretBasic || c.TokenEndpointAuthMethod == AuthMethodClientSecretPost
+}
+
+// UsesCertificate reports whether the client authenticates with a TLS client certificate
+func (c *OAuthClient) UsesCertificate() bool {
+	return c.TokenEndpointAuthMethod == AuthMethodTLSClientAuth || c.TokenEndpointAuthMethod == AuthMethodSelfSignedTLSClientAuth
+}
+
+// AllowsGrantType reports whether the client is registered for a grant type
+func (c *OAuthClient) AllowsGrantType(grantType string) bool {
+	return slices.Contains(c.GrantTypes, grantType)
+}
+
+// PreviousSecretValid reports whether the client's previous secret is still inside its overlap window
+func (c *OAuthClient) PreviousSecretValid() bool {
+	return c.PreviousSecretHash != "" && c.PreviousSecretExpiresAt != nil && time.Now().Before(*c.PreviousSecretExpiresAt)
+}
+
+// TokenLifetimeDuration returns the lifetime of the client's access tokens
+func (c *OAuthClient) TokenLifetimeDuration() time.Duration {
+	return time.Duration(c.TokenLifetime) * time.Second
+}
+
+// OAuthClientQueries provides database operations for OAuth clients
+type OAuthClientQueries struct {
+	db *DB
+}
+
+// NewOAuthClientQueries creates a new OAuthClientQueries instance
+func NewOAuthClientQueries(db *DB) *OAuthClientQueries {
+	return &OAuthClientQueries{db: db}
+}
+
+const oauthClientColumns = `id, organization_id, client_id, client_type, secret_hash, previous_secret_hash, previous_secret_expires_at, name,
+	owner_id, scope, redirect_uris, grant_types, token_endpoint_auth_method, logo_uri, policy_uri, registration_token_hash,
+	token_exchange_audiences, token_lifetime, tls_client_auth_subject_dn, tls_client_auth_san_dns, tls_client_auth_san_uri,
+	tls_client_auth_san_ip, tls_client_auth_san_email, jwks, jwks_uri, created_at`
+
+// Create registers a client
+func (q *OAuthClientQueries) Create(client *OAuthClient) (*OAuthClient, error) {
+	query := `
+		INSERT INTO oauth_clients (organization_id, client_id, client_type, secret_hash, name, owner_id, scope, redirect_uris, grant_types,
+			token_endpoint_auth_method, logo_uri, policy_uri, registration_token_hash, token_exchange_audiences, token_lifetime,
+			tls_client_auth_subject_dn, tls_client_auth_san_dns, tls_client_auth_san_uri, tls_client_auth_san_ip, tls_client_auth_san_email, jwks,
+			jwks_uri)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	tls := client.TLSClientAuthMetadata
+	result, err := q.db.Exec(query, client.OrganizationID, client.ClientID, client.ClientType, client.SecretHash, client.Name,
+		client.OwnerID, joinList(client.Scope), joinList(client.RedirectURIs), joinList(client.GrantTypes), client.TokenEndpointAuthMethod,
+		client.LogoURI, client.PolicyURI, client.RegistrationTokenHash, joinList(client.TokenExchangeAudiences), client.TokenLifetime,
+		tls.SubjectDN, tls.SANDNS, tls.SANURI, tls.SANIP, tls.SANEmail, string(client.JWKS), client.JWKSURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create oauth client: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+
+	return q.getOne("WHERE id = ?", id)
+}
+
+// GetByID retrieves a client by its row ID
+func (q *OAuthClientQueries) GetByID(id int) (*OAuthClient, error) {
+	return q.getOne("WHERE id = ?", id)
+}
+
+// GetByClientID retrieves a client by its public client_id
+func (q *OAuthClientQueries) GetByClientID(clientID string) (*OAuthClient, error) {
+	return q.getOne("WHERE client_id = ?", clientID)
+}
+
+// List retrieves the clients of an organization
+func (q *OAuthClientQueries) List(organizationID int) ([]OAuthClient, error) {
+	rows, err := q.db.Query("SELECT "+oauthClientColumns+" FROM oauth_clients WHERE organization_id = ? ORDER BY name, id", organizationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list oauth clients: %w", err)
+	}
+	defer rows.Close()
+
+	clients := []OAuthClient{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan oauth client: %w", err)
+		}
+		clients = append(clients, *client)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return clients, nil
+}
+
+// Update saves a client's metadata. The client ID, type, secrets and owner are left unchanged.
+func (q *OAuthClientQueries) Update(client *OAuthClient) (*OAuthClient, error) {
+	// A client switched to an authentication method without a secret loses its secrets, so they cannot come back to
+	// life if it is switched back.
+	query := `
+		UPDATE oauth_clients
+		SET name = ?, scope = ?, redirect_uris = ?, grant_types = ?, token_endpoint_auth_method = ?, logo_uri = ?, policy_uri = ?,
+			token_exchange_audiences = ?, token_lifetime = ?, tls_client_auth_subject_dn = ?, tls_client_auth_san_dns = ?,
+			tls_client_auth_san_uri = ?, tls_client_auth_san_ip = ?, tls_client_auth_san_email = ?, jwks = ?, jwks_uri = ?,
+			secret_hash = CASE WHEN ? THEN secret_hash ELSE '' END,
+			previous_secret_hash = CASE WHEN ? THEN previous_secret_hash ELSE '' END,
+			previous_secret_expires_at = CASE WHEN ? THEN previous_secret_expires_at ELSE NULL END
+		WHERE id = ?
+	`
+
+	tls := client.TLSClientAuthMetadata
+	usesSecret := client.UsesSecret()
+	_, err := q.db.Exec(query, client.Name, joinList(client.Scope), joinList(client.RedirectURIs), joinList(client.GrantTypes),
+		client.TokenEndpointAuthMethod, client.LogoURI, client.PolicyURI, joinList(client.TokenExchangeAudiences), client.TokenLifetime,
+		tls.SubjectDN, tls.SANDNS, tls.SANURI, tls.SANIP, tls.SANEmail, string(client.JWKS), client.JWKSURI, usesSecret, usesSecret, usesSecret, client.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update oauth client: %w", err)
+	}
+
+	return q.getOne("WHERE id = ?", client.ID)
+}
+
+// RotateSecret replaces a client's secret. With a positive overlap the current secret stays valid for that long, so
+// deployments can switch over without downtime; otherwise it stops working at once. Any earlier previous secret is
+// dropped.
+func (q *OAuthClientQueries) RotateSecret(id int, secretHash string, overlap time.Duration) (*OAuthClient, error) {
+	var err error
+	if overlap > 0 {
+		_, err = q.db.Exec(`
+			UPDATE oauth_clients
+			SET previous_secret_hash = secret_hash, previous_secret_expires_at = datetime('now', ?), secret_hash = ?
+			WHERE id = ?
+		`, sqliteOffset(overlap), secretHash, id)
+	} else {
+		_, err = q.db.Exec(`
+			UPDATE oauth_clients
+			SET previous_secret_hash = '', previous_secret_expires_at = NULL, secret_hash = ?
+			WHERE id = ?
+		`, secretHash, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate oauth client secret: %w", err)
+	}
+
+	return q.getOne("WHERE id = ?", id)
+}
+
+// SetRegistrationToken replaces the hash of a client's registration access token
+func (q *OAuthClientQueries) SetRegistrationToken(id int, tokenHash string) error {
+	if _, err := q.db.Exec("UPDATE oauth_clients SET registration_token_hash = ? WHERE id = ?", tokenHash, id); err != nil {
+		return fmt.Errorf("failed to update registration token: %w", err)
+	}
+
+	return nil
+}
+
+// Delete removes a client of an organization
+func (q *OAuthClientQueries) Delete(organizationID, id int) error {
+	result, err := q.db.Exec("DELETE FROM oauth_clients WHERE id = ? AND organization_id = ?", id, organizationID)
+	if err != nil {
+		return fmt.Errorf("failed to delete oauth client: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("oauth client not found")
+	}
+
+	return nil
+}
+
+func (q *OAuthClientQueries) getOne(where string, arg interface{}) (*OAuthClient, error) {
+	client, err := scanOAuthClient(q.db.QueryRow("SELECT "+oauthClientColumns+" FROM oauth_clients "+where, arg))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("oauth client not found")
+		}
+		return nil, fmt.Errorf("failed to get oauth client: %w", err)
+	}
+
+	return client, nil
+}
+
+func scanOAuthClient(row rowScanner) (*OAuthClient, error) {
+	var client OAuthClient
+	var scope, redirectURIs, grantTypes, audiences, jwks string
+	tls := &client.TLSClientAuthMetadata
+	err := row.Scan(&client.ID, &client.OrganizationID, &client.ClientID, &client.ClientType, &client.SecretHash,
+		&client.PreviousSecretHash, &client.PreviousSecretExpiresAt, &client.Name, &client.OwnerID, &scope, &redirectURIs, &grantTypes,
+		&client.TokenEndpointAuthMethod, &client.LogoURI, &client.PolicyURI, &client.RegistrationTokenHash, &audiences, &client.TokenLifetime,
+		&tls.SubjectDN, &tls.SANDNS, &tls.SANURI, &tls.SANIP, &tls.SANEmail, &jwks, &client.JWKSURI, &client.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Scope = splitList(scope)
+	client.RedirectURIs = splitList(redirectURIs)
+	client.GrantTypes = splitList(grantTypes)
+	client.TokenExchangeAudiences = splitList(audiences)
+	if jwks != "" {
+		client.JWKS = json.RawMessage(jwks)
+	}
+	return &client, nil
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultOrganizationID is the organization that existing users and unqualified requests belong to
+const DefaultOrganizationID = 1
+
+// Organization is a tenant with its own user base, issuer and signing key
+type Organization struct {
+	ID         int       `json:"id"`
+	Slug       string    `json:"slug"`
+	Name       string    `json:"name"`
+	Domain     string    `json:"domain,omitempty"` // host name that resolves to this organization
+	Issuer     string    `json:"issuer,omitempty"` // overrides the issuer derived from ISSUER_URL
+	SigningKey string    `json:"-"`                // PEM encoded private key, empty for the default organization
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// OrganizationQueries provides database operations for organizations
+type OrganizationQueries struct {
+	db *DB
+}
+
+// NewOrganizationQueries creates a new OrganizationQueries instance
+func NewOrganizationQueries(db *DB) *OrganizationQueries {
+	return &OrganizationQueries{db: db}
+}
+
+// Create inserts a new organization
+func (q *OrganizationQueries) Create(slug, name, domain, issuer, signingKey string) (*Organization, error) {
+	query := `
+		INSERT INTO organizations (slug, name, domain, issuer, signing_key)
+		VALUES (?, ?, ?, ?, ?)
+	`
+
+	result, err := q.db.Exec(query, slug, name, nullString(domain), issuer, signingKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create organization: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+
+	return q.GetByID(int(id))
+}
+
+// GetByID retrieves an organization by ID
+func (q *OrganizationQueries) GetByID(id int) (*Organization, error) {
+	return q.getByColumn("id", id)
+}
+
+// GetBySlug retrieves an organization by its URL slug
+func (q *OrganizationQueries) GetBySlug(slug string) (*Organization, error) {
+	return q.getByColumn("slug", slug)
+}
+
+// GetByDomain retrieves the organization bound to a host name
+func (q *OrganizationQueries) GetByDomain(domain string) (*Organization, error) {
+	return q.getByColumn("domain", domain)
+}
+
+// List retrieves all organizations
+func (q *OrganizationQueries) List() ([]Organization, error) {
+	rows, err := q.db.Query("SELECT id, slug, name, domain, issuer, signing_key, created_at FROM organizations ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list organizations: %w", err)
+	}
+	defer rows.Close()
+
+	organizations := []Organization{}
+	for rows.Next() {
+		organization, err := scanOrganization(rows)
+		if err != nil {
+			return nil, err
+		}
+		organizations = append(organizations, *organization)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return organizations, nil
+}
+
+func (q *OrganizationQueries) getByColumn(column string, value interface{}) (*Organization, error) {
+	query := fmt.Sprintf(`
+		SELECT id, slug, name, domain, issuer, signing_key, created_at
+		FROM organizations
+		WHERE %s = ?
+	`, column)
+
+	organization, err := scanOrganization(q.db.QueryRow(query, value))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("organization not found")
+		}
+		return nil, err
+	}
+
+	return organization, nil
+}
+
+func scanOrganization(row rowScanner) (*Organization, error) {
+	var organization Organization
+	var domain sql.NullString
+	err := row.Scan(
+		&organization.ID,
+		&organization.Slug,
+		&organization.Name,
+		&domain,
+		&organization.Issuer,
+		&organization.SigningKey,
+		&organization.CreatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to scan organization: %w", err)
+	}
+
+	organization.Domain = domain.String
+	return &organization, nil
+}
+
+// nullString stores empty strings as NULL so that optional UNIQUE columns do not collide
+func nullString(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// Permission represents a named capability that roles can grant
+type Permission struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// PermissionQueries provides database operations for permissions
+type PermissionQueries struct {
+	db *DB
+}
+
+// NewPermissionQueries creates a new PermissionQueries instance
+func NewPermissionQueries(db *DB) *PermissionQueries {
+	return &PermissionQueries{db: db}
+}
+
+// Create inserts a new permission
+func (q *PermissionQueries) Create(name, description string) (*Permission, error) {
+	query := `
+		INSERT INTO permissions (name, description) VALUES (?, ?)
+		RETURNING id
+	`
+
+	var id int
+	if err := q.db.QueryRow(query, name, description).Scan(&id); err != nil {
+		return nil, fmt.Errorf("failed to create permission: %w", err)
+	}
+
+	var permission Permission
+	err := q.db.QueryRow("SELECT id, name, description, created_at FROM permissions WHERE id = ?", id).Scan(
+		&permission.ID,
+		&permission.Name,
+		&permission.Description,
+		&permission.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get permission: %w", err)
+	}
+
+	return &permission, nil
+}
+
+// List retrieves all permissions
+func (q *PermissionQueries) List() ([]Permission, error) {
+	rows, err := q.db.Query("SELECT id, name, description, created_at FROM permissions ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list permissions: %w", err)
+	}
+	defer rows.Close()
+
+	permissions := []Permission{}
+	for rows.Next() {
+		var permission Permission
+		if err := rows.Scan(&permission.ID, &permission.Name, &permission.Description, &permission.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan permission: %w", err)
+		}
+		permissions = append(permissions, permission)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return permissions, nil
+}
+
+// DeleteByName removes a permission, revoking it from every role
+func (q *PermissionQueries) DeleteByName(name string) error {
+	result, err := q.db.Exec("DELETE FROM permissions WHERE name = ?", name)
+	if err != nil {
+		return fmt.Errorf("failed to delete permission: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("permission not found")
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PersonalAccessToken is a long-lived, scoped bearer token a user creates for scripts and CI jobs
+type PersonalAccessToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	TokenHash  string     `json:"-"`
+	TokenHint  string     `json:"token_hint"` // last characters of the token, to recognize it in listings
+	Scope      []string   `json:"scope"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+}
+
+// IsExpired reports whether the token can no longer be used
+func (t *PersonalAccessToken) IsExpired() bool {
+	return !time.Now().Before(t.ExpiresAt)
+}
+
+// PersonalAccessTokenQueries provides database operations for personal access tokens
+type PersonalAccessTokenQueries struct {
+	db *DB
+}
+
+// NewPersonalAccessTokenQueries creates a new PersonalAccessTokenQueries instance
+func NewPersonalAccessTokenQueries(db *DB) *PersonalAccessTokenQueries {
+	return &PersonalAccessTokenQueries{db: db}
+}
+
+const personalAccessTokenColumns = "id, user_id, name, token_hash, token_hint, scope, expires_at, created_at, last_used_at, last_used_ip"
+
+// Create stores a new token by its hash
+func (q *PersonalAccessTokenQueries) Create(userID int, name, tokenHash, tokenHint string, scope []string, expiresAt time.Time) (*PersonalAccessToken, error) {
+	query := `
+		INSERT INTO personal_access_tokens (user_id, name, token_hash, token_hint, scope, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+
+	result, err := q.db.Exec(query, userID, name, tokenHash, tokenHint, joinList(scope), expiresAt.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create personal access token: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+
+	return q.getOne("WHERE id = ?", id)
+}
+
+// GetByHash retrieves a token by the hash of its value. Expired tokens are returned too; callers check IsExpired.
+func (q *PersonalAccessTokenQueries) GetByHash(tokenHash string) (*PersonalAccessToken, error) {
+	return q.getOne("WHERE token_hash = ?", tokenHash)
+}
+
+// ListByUserID retrieves the tokens of a user, newest first
+func (q *PersonalAccessTokenQueries) ListByUserID(userID int) ([]PersonalAccessToken, error) {
+	rows, err := q.db.Query("SELECT "+personalAccessTokenColumns+" FROM personal_access_tokens WHERE user_id = ? ORDER BY created_at DESC, id DESC", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list personal access tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []PersonalAccessToken{}
+	for rows.Next() {
+		token, err := scanPersonalAccessToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan personal access token: %w", err)
+		}
+		tokens = append(tokens, *token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// Delete revokes a token of a user
+func (q *PersonalAccessTokenQueries) Delete(userID, id int) error {
+	result, err := q.db.Exec("DELETE FROM personal_access_tokens WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete personal access token: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("personal access token not found")
+	}
+
+	return nil
+}
+
+// MarkUsed records when and from where a token was last used
+func (q *PersonalAccessTokenQueries) MarkUsed(id int, ip string) error {
+	if _, err := q.db.Exec("UPDATE personal_access_tokens SET last_used_at = CURRENT_TIMESTAMP, last_used_ip = ? WHERE id = ?", ip, id); err != nil {
+		return fmt.Errorf("failed to update personal access token: %w", err)
+	}
+
+	return nil
+}
+
+func (q *PersonalAccessTokenQueries) getOne(where string, arg interface{}) (*PersonalAccessToken, error) {
+	token, err := scanPersonalAccessToken(q.db.QueryRow("SELECT "+personalAccessTokenColumns+" FROM personal_access_tokens "+where, arg))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("personal access token not found")
+		}
+		return nil, fmt.Errorf("failed to get personal access token: %w", err)
+	}
+
+	return token, nil
+}
+
+func scanPersonalAccessToken(row rowScanner) (*PersonalAccessToken, error) {
+	var token PersonalAccessToken
+	var scope string
+	err := row.Scan(&token.ID, &token.UserID, &token.Name, &token.TokenHash, &token.TokenHint, &scope,
+		&token.ExpiresAt, &token.CreatedAt, &token.LastUsedAt, &token.LastUsedIP)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Scope = splitList(scope)
+	return &token, nil
+}
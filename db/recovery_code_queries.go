@@ -0,0 +1,82 @@
+package db
+
+import (
+	"fmt"
+)
+
+// RecoveryCodeQueries provides database operations for MFA recovery codes
+type RecoveryCodeQueries struct {
+	db *DB
+}
+
+// NewRecoveryCodeQueries creates a new RecoveryCodeQueries instance
+func NewRecoveryCodeQueries(db *DB) *RecoveryCodeQueries {
+	return &RecoveryCodeQueries{db: db}
+}
+
+// Replace deletes a user's existing recovery codes and stores the given hashes in their place
+func (q *RecoveryCodeQueries) Replace(userID int, hashes []string) error {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes for user '%d': %w", userID, err)
+	}
+
+	for _, hash := range hashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, hash) VALUES (?, ?)", userID, hash); err != nil {
+			return fmt.Errorf("failed to save recovery code for user '%d': %w", userID, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Consume marks an unused recovery code as used. It returns an error if no matching unused code exists.
+func (q *RecoveryCodeQueries) Consume(userID int, hash string) error {
+	query := `
+		UPDATE recovery_codes
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND hash = ? AND used_at IS NULL
+	`
+
+	result, err := q.db.Exec(query, userID, hash)
+	if err != nil {
+		return fmt.Errorf("failed to consume recovery code: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("recovery code not found")
+	}
+
+	return nil
+}
+
+// CountUnused returns the number of recovery codes a user has left
+func (q *RecoveryCodeQueries) CountUnused(userID int) (int, error) {
+	query := "SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL"
+
+	var count int
+	if err := q.db.QueryRow(query, userID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count recovery codes: %w", err)
+	}
+
+	return count, nil
+}
+
+// DeleteByUserID removes all recovery codes for a user
+func (q *RecoveryCodeQueries) DeleteByUserID(userID int) error {
+	if _, err := q.db.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes for user '%d': %w", userID, err)
+	}
+
+	return nil
+}
@@ -14,6 +14,10 @@ type RefreshToken struct {
 	Hash      string    `json:"hash"`
 	IssuedAt  time.Time `json:"issued_at"`
 	ExpiresAt time.Time `json:"expires_at"`
+	AMR       []string  `json:"amr"`
+	Scope     []string  `json:"scope"`               // empty when the session was granted the user's full permissions
+	ClientID  string    `json:"client_id,omitempty"` // OAuth client the token was issued to, empty for first-party logins
+	DPoPJKT   string    `json:"dpop_jkt,omitempty"`  // thumbprint of the DPoP key the token is bound to, empty when unbound
 }
 
 // RefreshTokenQueries provides database operations for refresh tokens
@@ -26,11 +30,17 @@ func NewRefreshTokenQueries(db *DB) *RefreshTokenQueries {
 	return &RefreshTokenQueries{db: db}
 }
 
-// Create inserts a new user
-func (q *RefreshTokenQueries) Create(ownerId, tokenHash string) (*RefreshToken, error) {
+// Create inserts a new refresh token, recording the authentication methods and requested scope of the session it belongs to
+func (q *RefreshTokenQueries) Create(ownerId, tokenHash string, amr, scope []string) (*RefreshToken, error) {
+	return q.CreateForClient("", "", ownerId, tokenHash, amr, scope)
+}
+
+// CreateForClient inserts a new refresh token issued to an OAuth client. Only that client may redeem it, and only with
+// a proof of the DPoP key with thumbprint dpopJKT when that is not empty.
+func (q *RefreshTokenQueries) CreateForClient(clientID, dpopJKT, ownerId, tokenHash string, amr, scope []string) (*RefreshToken, error) {
 	query := `
-		INSERT INTO refresh_tokens (owner_id, hash, expires_at)
-		VALUES (?, ?, datetime('now', '+30 days'))
+		INSERT INTO refresh_tokens (owner_id, hash, amr, scope, client_id, dpop_jkt, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, datetime('now', '+30 days'))
 	`
 
 	if ownerId == "" {
@@ -41,7 +51,7 @@ func (q *RefreshTokenQueries) Create(ownerId, tokenHash string) (*RefreshToken,
 		return nil, fmt.Errorf("token_hash cannot be empty")
 	}
 
-	result, err := q.db.Exec(query, ownerId, tokenHash)
+	result, err := q.db.Exec(query, ownerId, tokenHash, joinList(amr), joinList(scope), clientID, dpopJKT)
 	if err != nil {
 		return nil, fmt.Errorf("failed to save refresh token for user '%s': %s", ownerId, err)
 	}
@@ -54,21 +64,26 @@ func (q *RefreshTokenQueries) Create(ownerId, tokenHash string) (*RefreshToken,
 	return q.GetByID(int(id))
 }
 
-// GetByID retrieves valid refresh tokens for a specific user
+// GetByID retrieves a refresh token by its ID
 func (q *RefreshTokenQueries) GetByID(tokenId int) (*RefreshToken, error) {
 	query := `
-		SELECT id, owner_id, hash, issued_at, expires_at
+		SELECT id, owner_id, hash, issued_at, expires_at, amr, scope, client_id, dpop_jkt
 		FROM refresh_tokens
-		WHERE owner_id = ?
+		WHERE id = ?
 	`
 
 	var token RefreshToken
+	var amr, scope string
 	err := q.db.QueryRow(query, tokenId).Scan(
 		&token.Id,
 		&token.OwnerId,
 		&token.Hash,
 		&token.IssuedAt,
 		&token.ExpiresAt,
+		&amr,
+		&scope,
+		&token.ClientID,
+		&token.DPoPJKT,
 	)
 
 	if err != nil {
@@ -79,13 +94,15 @@ func (q *RefreshTokenQueries) GetByID(tokenId int) (*RefreshToken, error) {
 		return nil, fmt.Errorf("failed to get refresh token with id '%d': %w", tokenId, err)
 	}
 
+	token.AMR = splitList(amr)
+	token.Scope = splitList(scope)
 	return &token, nil
 }
 
 // GetValidByUserID retrieves valid refresh tokens for a specific user
 func (q *RefreshTokenQueries) GetValidByUserID(userId int) ([]RefreshToken, error) {
 	query := `
-		SELECT id, owner_id, hash, issued_at, expires_at
+		SELECT id, owner_id, hash, issued_at, expires_at, amr, scope, client_id, dpop_jkt
 		FROM refresh_tokens
 		WHERE owner_id = ? AND expires_at > datetime('now')
 	`
@@ -100,10 +117,13 @@ func (q *RefreshTokenQueries) GetValidByUserID(userId int) ([]RefreshToken, erro
 
 	for rows.Next() {
 		token := RefreshToken{}
-		err = rows.Scan(&token.Id, &token.OwnerId, &token.Hash, &token.IssuedAt, &token.ExpiresAt)
+		var amr, scope string
+		err = rows.Scan(&token.Id, &token.OwnerId, &token.Hash, &token.IssuedAt, &token.ExpiresAt, &amr, &scope, &token.ClientID, &token.DPoPJKT)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan refresh token: %w", err)
 		}
+		token.AMR = splitList(amr)
+		token.Scope = splitList(scope)
 		tokens = append(tokens, token)
 	}
 	return tokens, nil
@@ -112,18 +132,23 @@ func (q *RefreshTokenQueries) GetValidByUserID(userId int) ([]RefreshToken, erro
 // GetByHashAndValidate retrieves a refresh token by its hash and validates it
 func (q *RefreshTokenQueries) GetByHashAndValidate(tokenHash string) (*RefreshToken, error) {
 	query := `
-		SELECT id, owner_id, hash, issued_at, expires_at
+		SELECT id, owner_id, hash, issued_at, expires_at, amr, scope, client_id, dpop_jkt
 		FROM refresh_tokens
 		WHERE hash = ? AND expires_at > datetime('now')
 	`
 
 	var token RefreshToken
+	var amr, scope string
 	err := q.db.QueryRow(query, tokenHash).Scan(
 		&token.Id,
 		&token.OwnerId,
 		&token.Hash,
 		&token.IssuedAt,
 		&token.ExpiresAt,
+		&amr,
+		&scope,
+		&token.ClientID,
+		&token.DPoPJKT,
 	)
 
 	if err != nil {
@@ -134,6 +159,8 @@ func (q *RefreshTokenQueries) GetByHashAndValidate(tokenHash string) (*RefreshTo
 		return nil, fmt.Errorf("failed to get refresh token: %w", err)
 	}
 
+	token.AMR = splitList(amr)
+	token.Scope = splitList(scope)
 	return &token, nil
 }
 
@@ -158,6 +185,30 @@ func (q *RefreshTokenQueries) DeleteByID(tokenId int) error {
 	return nil
 }
 
+// DeleteByOwner revokes every refresh token of an owner
+func (q *RefreshTokenQueries) DeleteByOwner(ownerId string) error {
+	if _, err := q.db.Exec("DELETE FROM refresh_tokens WHERE owner_id = ?", ownerId); err != nil {
+		return fmt.Errorf("failed to delete refresh tokens: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteByOwnerAndClient revokes the refresh tokens an owner was issued through an OAuth client
+func (q *RefreshTokenQueries) DeleteByOwnerAndClient(ownerId, clientID string) (int, error) {
+	result, err := q.db.Exec("DELETE FROM refresh_tokens WHERE owner_id = ? AND client_id = ?", ownerId, clientID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete refresh tokens: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	return int(rowsAffected), nil
+}
+
 // Count returns the total number of refresh tokens
 func (q *RefreshTokenQueries) Count() (int, error) {
 	query := "SELECT COUNT(*) FROM refresh_tokens"
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Replay cache purposes
+const (
+	ReplayPurposeDPoP            = "dpop"
+	ReplayPurposeClientAssertion = "client_assertion" // private_key_jwt client authentication (RFC 7523 §2.2)
+	ReplayPurposeJWTBearer       = "jwt_bearer"       // assertions of the JWT bearer grant (RFC 7523 §2.1)
+)
+
+// ReplayCacheQueries records the identifiers of single-use JWTs, so each is only accepted once
+type ReplayCacheQueries struct {
+	db *DB
+}
+
+// NewReplayCacheQueries creates a new ReplayCacheQueries instance
+func NewReplayCacheQueries(db *DB) *ReplayCacheQueries {
+	return &ReplayCacheQueries{db: db}
+}
+
+// Record notes the first use of an identifier, which is kept until expiresAt, when the JWT it belongs to is no longer
+// accepted anyway. It fails with "already used" if the identifier was recorded before. Expired entries are removed
+// first.
+func (q *ReplayCacheQueries) Record(purpose, keyHash string, expiresAt time.Time) error {
+	if _, err := q.db.Exec("DELETE FROM replay_cache WHERE expires_at <= datetime('now')"); err != nil {
+		return fmt.Errorf("failed to delete expired replay cache entries: %w", err)
+	}
+
+	_, err := q.db.Exec("INSERT INTO replay_cache (purpose, key_hash, expires_at) VALUES (?, ?, ?)",
+		purpose, keyHash, expiresAt.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return fmt.Errorf("already used")
+		}
+		return fmt.Errorf("failed to record %s token identifier: %w", purpose, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,355 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+const (
+	DefaultRoleName = "user"  // assigned to every new user
+	AdminRoleName   = "admin" // holds every built-in permission
+)
+
+// Role represents a named set of permissions
+type Role struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// RoleQueries provides database operations for roles and role assignments
+type RoleQueries struct {
+	db *DB
+}
+
+// NewRoleQueries creates a new RoleQueries instance
+func NewRoleQueries(db *DB) *RoleQueries {
+	return &RoleQueries{db: db}
+}
+
+// Create inserts a new role granting the given permissions. The role is not created when a permission does not
+// exist.
+func (q *RoleQueries) Create(name, description string, permissions []string) (*Role, error) {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO roles (name, description) VALUES (?, ?)", name, description)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create role: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+
+	query := `
+		INSERT OR IGNORE INTO role_permissions (role_id, permission_id)
+		SELECT ?, id FROM permissions WHERE name = ?
+	`
+	for _, permission := range permissions {
+		if _, err := tx.Exec(query, id, permission); err != nil {
+			return nil, fmt.Errorf("failed to add permission to role: %w", err)
+		}
+
+		var exists int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM permissions WHERE name = ?", permission).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("failed to check permission: %w", err)
+		}
+		if exists == 0 {
+			return nil, fmt.Errorf("permission not found: %s", permission)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return q.GetByID(int(id))
+}
+
+// GetByID retrieves a role and its permissions by ID
+func (q *RoleQueries) GetByID(id int) (*Role, error) {
+	query := `
+		SELECT id, name, description, created_at
+		FROM roles
+		WHERE id = ?
+	`
+
+	var role Role
+	err := q.db.QueryRow(query, id).Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("role not found")
+		}
+		return nil, fmt.Errorf("failed to get role by id: %w", err)
+	}
+
+	role.Permissions, err = q.ListPermissions(role.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+// GetByName retrieves a role by name
+func (q *RoleQueries) GetByName(name string) (*Role, error) {
+	var id int
+	err := q.db.QueryRow("SELECT id FROM roles WHERE name = ?", name).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("role not found")
+		}
+		return nil, fmt.Errorf("failed to get role by name: %w", err)
+	}
+
+	return q.GetByID(id)
+}
+
+// List retrieves all roles with their permissions
+func (q *RoleQueries) List() ([]Role, error) {
+	rows, err := q.db.Query("SELECT id, name, description, created_at FROM roles ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list roles: %w", err)
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan role: %w", err)
+		}
+		roles = append(roles, role)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	for i := range roles {
+		if roles[i].Permissions, err = q.ListPermissions(roles[i].ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return roles, nil
+}
+
+// Delete removes a role and its assignments
+func (q *RoleQueries) Delete(id int) error {
+	result, err := q.db.Exec("DELETE FROM roles WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete role: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("role not found")
+	}
+
+	return nil
+}
+
+// ListPermissions returns the names of the permissions granted by a role
+func (q *RoleQueries) ListPermissions(roleID int) ([]string, error) {
+	query := `
+		SELECT p.name
+		FROM permissions p
+		JOIN role_permissions rp ON rp.permission_id = p.id
+		WHERE rp.role_id = ?
+		ORDER BY p.name
+	`
+
+	return q.queryNames(query, roleID)
+}
+
+// AddPermission grants a permission to a role
+func (q *RoleQueries) AddPermission(roleID int, permission string) error {
+	query := `
+		INSERT OR IGNORE INTO role_permissions (role_id, permission_id)
+		SELECT ?, id FROM permissions WHERE name = ?
+	`
+
+	result, err := q.db.Exec(query, roleID, permission)
+	if err != nil {
+		return fmt.Errorf("failed to add permission to role: %w", err)
+	}
+
+	return q.requireExisting(result, "SELECT COUNT(*) FROM permissions WHERE name = ?", permission, "permission not found")
+}
+
+// RemovePermission revokes a permission from a role
+func (q *RoleQueries) RemovePermission(roleID int, permission string) error {
+	query := `
+		DELETE FROM role_permissions
+		WHERE role_id = ? AND permission_id = (SELECT id FROM permissions WHERE name = ?)
+	`
+
+	result, err := q.db.Exec(query, roleID, permission)
+	if err != nil {
+		return fmt.Errorf("failed to remove permission from role: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("role permission not found")
+	}
+
+	return nil
+}
+
+// AssignToUser grants a role to a user
+func (q *RoleQueries) AssignToUser(userID int, role string) error {
+	query := `
+		INSERT OR IGNORE INTO user_roles (user_id, role_id)
+		SELECT ?, id FROM roles WHERE name = ?
+	`
+
+	result, err := q.db.Exec(query, userID, role)
+	if err != nil {
+		return fmt.Errorf("failed to assign role to user: %w", err)
+	}
+
+	return q.requireExisting(result, "SELECT COUNT(*) FROM roles WHERE name = ?", role, "role not found")
+}
+
+// RemoveFromUser revokes a role from a user
+func (q *RoleQueries) RemoveFromUser(userID int, role string) error {
+	query := `
+		DELETE FROM user_roles
+		WHERE user_id = ? AND role_id = (SELECT id FROM roles WHERE name = ?)
+	`
+
+	result, err := q.db.Exec(query, userID, role)
+	if err != nil {
+		return fmt.Errorf("failed to remove role from user: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("user role not found")
+	}
+
+	return nil
+}
+
+// ListForUser returns the names of the roles assigned to a user
+func (q *RoleQueries) ListForUser(userID int) ([]string, error) {
+	query := `
+		SELECT r.name
+		FROM roles r
+		JOIN user_roles ur ON ur.role_id = r.id
+		WHERE ur.user_id = ?
+		ORDER BY r.name
+	`
+
+	return q.queryNames(query, userID)
+}
+
+// ListPermissionsForUser returns the distinct permissions granted to a user through their roles
+func (q *RoleQueries) ListPermissionsForUser(userID int) ([]string, error) {
+	query := `
+		SELECT DISTINCT p.name
+		FROM permissions p
+		JOIN role_permissions rp ON rp.permission_id = p.id
+		JOIN user_roles ur ON ur.role_id = rp.role_id
+		WHERE ur.user_id = ?
+		ORDER BY p.name
+	`
+
+	return q.queryNames(query, userID)
+}
+
+// CountUsersWithRole returns the number of active users of an organization holding a role
+func (q *RoleQueries) CountUsersWithRole(organizationID int, role string) (int, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM user_roles ur
+		JOIN roles r ON r.id = ur.role_id
+		JOIN users u ON u.id = ur.user_id
+		WHERE u.organization_id = ? AND r.name = ? AND u.status = 'active' AND u.deleted_at IS NULL
+	`
+
+	var count int
+	if err := q.db.QueryRow(query, organizationID, role).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count users with role: %w", err)
+	}
+
+	return count, nil
+}
+
+// UserHasRole reports whether a user holds a role
+func (q *RoleQueries) UserHasRole(userID int, role string) (bool, error) {
+	roles, err := q.ListForUser(userID)
+	if err != nil {
+		return false, err
+	}
+
+	return slices.Contains(roles, role), nil
+}
+
+func (q *RoleQueries) queryNames(query string, args ...interface{}) ([]string, error) {
+	rows, err := q.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query names: %w", err)
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan name: %w", err)
+		}
+		names = append(names, name)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return names, nil
+}
+
+// requireExisting distinguishes "already present" from "referenced row does not exist" after an INSERT OR IGNORE
+func (q *RoleQueries) requireExisting(result sql.Result, countQuery string, arg interface{}, notFound string) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected > 0 {
+		return nil
+	}
+
+	var count int
+	if err := q.db.QueryRow(countQuery, arg).Scan(&count); err != nil {
+		return fmt.Errorf("failed to check existence: %w", err)
+	}
+	if count == 0 {
+		return errors.New(notFound)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SCIMToken is a bearer token that lets a provisioning client manage the users and groups of an organization
+type SCIMToken struct {
+	ID             int        `json:"id"`
+	OrganizationID int        `json:"organization_id"`
+	Name           string     `json:"name"`
+	TokenHash      string     `json:"-"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+}
+
+// SCIMTokenQueries provides database operations for SCIM provisioning tokens
+type SCIMTokenQueries struct {
+	db *DB
+}
+
+// NewSCIMTokenQueries creates a new SCIMTokenQueries instance
+func NewSCIMTokenQueries(db *DB) *SCIMTokenQueries {
+	return &SCIMTokenQueries{db: db}
+}
+
+// Create stores a new token by its hash
+func (q *SCIMTokenQueries) Create(organizationID int, name, tokenHash string) (*SCIMToken, error) {
+	result, err := q.db.Exec("INSERT INTO scim_tokens (organization_id, name, token_hash) VALUES (?, ?, ?)", organizationID, name, tokenHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scim token: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+
+	return q.getOne("WHERE id = ?", id)
+}
+
+// GetByHash retrieves a token by the hash of its value
+func (q *SCIMTokenQueries) GetByHash(tokenHash string) (*SCIMToken, error) {
+	return q.getOne("WHERE token_hash = ?", tokenHash)
+}
+
+// List retrieves the tokens of an organization
+func (q *SCIMTokenQueries) List(organizationID int) ([]SCIMToken, error) {
+	rows, err := q.db.Query(`
+		SELECT id, organization_id, name, token_hash, created_at, last_used_at
+		FROM scim_tokens
+		WHERE organization_id = ?
+		ORDER BY created_at DESC
+	`, organizationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list scim tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []SCIMToken{}
+	for rows.Next() {
+		var token SCIMToken
+		if err := rows.Scan(&token.ID, &token.OrganizationID, &token.Name, &token.TokenHash, &token.CreatedAt, &token.LastUsedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan scim token: %w", err)
+		}
+		tokens = append(tokens, token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// Delete revokes a token of an organization
+func (q *SCIMTokenQueries) Delete(organizationID, id int) error {
+	result, err := q.db.Exec("DELETE FROM scim_tokens WHERE id = ? AND organization_id = ?", id, organizationID)
+	if err != nil {
+		return fmt.Errorf("failed to delete scim token: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("scim token not found")
+	}
+
+	return nil
+}
+
+// MarkUsed records that a token was just used
+func (q *SCIMTokenQueries) MarkUsed(id int) error {
+	if _, err := q.db.Exec("UPDATE scim_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to update scim token: %w", err)
+	}
+
+	return nil
+}
+
+func (q *SCIMTokenQueries) getOne(where string, arg interface{}) (*SCIMToken, error) {
+	query := "SELECT id, organization_id, name, token_hash, created_at, last_used_at FROM scim_tokens " + where
+
+	var token SCIMToken
+	err := q.db.QueryRow(query, arg).Scan(&token.ID, &token.OrganizationID, &token.Name, &token.TokenHash, &token.CreatedAt, &token.LastUsedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("scim token not found")
+		}
+		return nil, fmt.Errorf("failed to get scim token: %w", err)
+	}
+
+	return &token, nil
+}
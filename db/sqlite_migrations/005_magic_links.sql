@@ -0,0 +1,14 @@
+ALTER TABLE users ADD COLUMN magic_link_enabled INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE magic_links (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    hash TEXT NOT NULL UNIQUE,
+    binding_hash TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_magic_links_user ON magic_links(user_id);
@@ -0,0 +1,3 @@
+ALTER TABLE refresh_tokens ADD COLUMN scope TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE mfa_challenges ADD COLUMN scope TEXT NOT NULL DEFAULT '';
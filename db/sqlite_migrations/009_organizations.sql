@@ -0,0 +1,52 @@
+CREATE TABLE organizations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    slug TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    domain TEXT UNIQUE,
+    issuer TEXT NOT NULL DEFAULT '',
+    signing_key TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- The default organization keeps using the signing key file, so its signing_key stays empty.
+INSERT INTO organizations (id, slug, name) VALUES (1, 'default', 'Default');
+
+-- SQLite cannot drop a column constraint, so the users table is rebuilt to make email unique per organization.
+CREATE TABLE users_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    organization_id INTEGER NOT NULL DEFAULT 1,
+    email TEXT NOT NULL,
+    name TEXT NOT NULL,
+    password_hash TEXT NOT NULL,
+    magic_link_enabled INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(organization_id) REFERENCES organizations(id) ON DELETE CASCADE
+);
+
+INSERT INTO users_new (id, organization_id, email, name, password_hash, magic_link_enabled, created_at, updated_at)
+SELECT id, 1, email, name, password_hash, magic_link_enabled, created_at, updated_at FROM users;
+
+DROP TABLE users;
+ALTER TABLE users_new RENAME TO users;
+
+CREATE UNIQUE INDEX idx_users_organization_email ON users(organization_id, email);
+
+CREATE TRIGGER update_users_timestamp
+AFTER UPDATE ON users
+FOR EACH ROW
+    WHEN NEW.updated_at = OLD.updated_at
+BEGIN
+    UPDATE users SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+
+ALTER TABLE audit_log ADD COLUMN organization_id INTEGER NOT NULL DEFAULT 1;
+
+CREATE INDEX idx_audit_log_organization ON audit_log(organization_id);
+
+INSERT INTO permissions (name, description) VALUES
+    ('organizations:manage', 'Create and manage organizations (default organization only)');
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.name = 'organizations:manage';
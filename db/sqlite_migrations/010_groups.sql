@@ -0,0 +1,41 @@
+CREATE TABLE groups (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    organization_id INTEGER NOT NULL DEFAULT 1,
+    name TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(organization_id) REFERENCES organizations(id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX idx_groups_organization_name ON groups(organization_id, name);
+
+CREATE TABLE group_members (
+    group_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (group_id, user_id),
+    FOREIGN KEY(group_id) REFERENCES groups(id) ON DELETE CASCADE,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_group_members_user ON group_members(user_id);
+
+-- A row makes every member of child_id a member of parent_id as well
+CREATE TABLE group_nesting (
+    parent_id INTEGER NOT NULL,
+    child_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (parent_id, child_id),
+    CHECK (parent_id <> child_id),
+    FOREIGN KEY(parent_id) REFERENCES groups(id) ON DELETE CASCADE,
+    FOREIGN KEY(child_id) REFERENCES groups(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_group_nesting_child ON group_nesting(child_id);
+
+INSERT INTO permissions (name, description) VALUES
+    ('groups:manage', 'Create groups and manage their members');
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.name = 'groups:manage';
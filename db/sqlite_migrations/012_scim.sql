@@ -0,0 +1,20 @@
+CREATE TABLE scim_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    organization_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME,
+    FOREIGN KEY(organization_id) REFERENCES organizations(id) ON DELETE CASCADE
+);
+
+-- The identifier the provisioning client uses for the resource (SCIM externalId)
+ALTER TABLE users ADD COLUMN external_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE groups ADD COLUMN external_id TEXT NOT NULL DEFAULT '';
+
+INSERT INTO permissions (name, description) VALUES
+    ('scim:manage', 'Issue and revoke SCIM provisioning tokens');
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.name = 'scim:manage';
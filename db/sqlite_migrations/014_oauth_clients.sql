@@ -0,0 +1,22 @@
+CREATE TABLE oauth_clients (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    organization_id INTEGER NOT NULL,
+    client_id TEXT NOT NULL UNIQUE,
+    secret_hash TEXT NOT NULL,
+    name TEXT NOT NULL,
+    owner_id INTEGER,
+    scope TEXT NOT NULL DEFAULT '',
+    token_lifetime INTEGER NOT NULL DEFAULT 3600,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(organization_id) REFERENCES organizations(id) ON DELETE CASCADE,
+    FOREIGN KEY(owner_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX idx_oauth_clients_organization ON oauth_clients(organization_id);
+
+INSERT INTO permissions (name, description) VALUES
+    ('clients:manage', 'Register and remove OAuth clients');
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.name = 'clients:manage';
@@ -0,0 +1,2 @@
+-- The OAuth client a refresh token was issued to; empty for sessions started through /api/login
+ALTER TABLE refresh_tokens ADD COLUMN client_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,32 @@
+ALTER TABLE oauth_clients ADD COLUMN grant_types TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_clients ADD COLUMN token_endpoint_auth_method TEXT NOT NULL DEFAULT 'client_secret_basic';
+ALTER TABLE oauth_clients ADD COLUMN logo_uri TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_clients ADD COLUMN policy_uri TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_clients ADD COLUMN previous_secret_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_clients ADD COLUMN previous_secret_expires_at DATETIME;
+ALTER TABLE oauth_clients ADD COLUMN registration_token_hash TEXT NOT NULL DEFAULT '';
+
+-- Existing clients keep every grant they could use before grant types were recorded
+UPDATE oauth_clients SET grant_types = 'refresh_token password client_credentials';
+UPDATE oauth_clients SET token_endpoint_auth_method = 'none', grant_types = 'refresh_token password'
+WHERE client_type = 'public';
+UPDATE oauth_clients SET grant_types = 'authorization_code ' || grant_types
+WHERE redirect_uris != '';
+
+CREATE TABLE initial_access_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    organization_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    scope TEXT NOT NULL DEFAULT '',
+    max_uses INTEGER,
+    use_count INTEGER NOT NULL DEFAULT 0,
+    created_by INTEGER,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME,
+    FOREIGN KEY(organization_id) REFERENCES organizations(id) ON DELETE CASCADE,
+    FOREIGN KEY(created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX idx_initial_access_tokens_organization ON initial_access_tokens(organization_id);
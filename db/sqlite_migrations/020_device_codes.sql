@@ -0,0 +1,17 @@
+CREATE TABLE device_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    device_code_hash TEXT NOT NULL UNIQUE,
+    user_code_hash TEXT NOT NULL UNIQUE,
+    client_id TEXT NOT NULL,
+    scope TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'pending',
+    user_id INTEGER,
+    amr TEXT NOT NULL DEFAULT '',
+    auth_time DATETIME,
+    poll_interval INTEGER NOT NULL DEFAULT 5,
+    last_polled_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    expires_at DATETIME NOT NULL,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY(client_id) REFERENCES oauth_clients(client_id) ON DELETE CASCADE
+);
@@ -0,0 +1,9 @@
+-- Audiences a client may ask for when exchanging tokens (RFC 8693 §2.1)
+ALTER TABLE oauth_clients ADD COLUMN token_exchange_audiences TEXT NOT NULL DEFAULT '';
+
+INSERT INTO permissions (name, description) VALUES
+    ('users:impersonate', 'Act as another user through token exchange');
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.name = 'users:impersonate';
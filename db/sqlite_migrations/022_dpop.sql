@@ -0,0 +1,12 @@
+-- Refresh tokens of public clients are bound to the DPoP key they were issued to (RFC 9449 §5)
+ALTER TABLE refresh_tokens ADD COLUMN dpop_jkt TEXT NOT NULL DEFAULT '';
+
+-- Identifiers of single-use JWTs, such as DPoP proofs, kept until the JWTs expire
+CREATE TABLE replay_cache (
+    purpose TEXT NOT NULL,
+    key_hash TEXT NOT NULL,
+    expires_at DATETIME NOT NULL,
+    PRIMARY KEY (purpose, key_hash)
+);
+
+CREATE INDEX idx_replay_cache_expires ON replay_cache(expires_at);
@@ -0,0 +1,9 @@
+-- Mutual-TLS client authentication (RFC 8705 §2). A tls_client_auth client names the one certificate subject or
+-- subject alternative name it authenticates with; a self_signed_tls_client_auth client registers its certificates in
+-- jwks.
+ALTER TABLE oauth_clients ADD COLUMN tls_client_auth_subject_dn TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_clients ADD COLUMN tls_client_auth_san_dns TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_clients ADD COLUMN tls_client_auth_san_uri TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_clients ADD COLUMN tls_client_auth_san_ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_clients ADD COLUMN tls_client_auth_san_email TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_clients ADD COLUMN jwks TEXT NOT NULL DEFAULT '';
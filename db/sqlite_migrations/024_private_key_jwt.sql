@@ -0,0 +1,2 @@
+-- private_key_jwt clients (RFC 7523 §2.2) register their public keys inline in jwks or by reference in jwks_uri
+ALTER TABLE oauth_clients ADD COLUMN jwks_uri TEXT NOT NULL DEFAULT '';
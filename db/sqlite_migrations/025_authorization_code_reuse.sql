@@ -0,0 +1,3 @@
+-- The refresh token issued when a code was redeemed, revoked if the code is presented again (RFC 6749 §4.1.2)
+ALTER TABLE authorization_codes ADD COLUMN refresh_token_id INTEGER;
+ALTER TABLE authorization_codes ADD COLUMN reused_at DATETIME;
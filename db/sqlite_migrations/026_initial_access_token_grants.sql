@@ -0,0 +1,2 @@
+-- Grant types clients registered with the token may use. Existing tokens keep to the RFC 7591 default and refresh tokens.
+ALTER TABLE initial_access_tokens ADD COLUMN grant_types TEXT NOT NULL DEFAULT 'authorization_code refresh_token';
@@ -0,0 +1,2 @@
+-- The authorization or device request a challenge from a sign-in page belongs to; empty for challenges from /api/login
+ALTER TABLE mfa_challenges ADD COLUMN request_binding TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TOTPCredential represents a user's TOTP secret. It is pending until confirmed with a valid code.
+type TOTPCredential struct {
+	UserID       int        `json:"user_id"`
+	Secret       string     `json:"-"`
+	Enabled      bool       `json:"enabled"`
+	LastUsedStep int64      `json:"-"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ConfirmedAt  *time.Time `json:"confirmed_at,omitempty"`
+}
+
+// TOTPQueries provides database operations for TOTP credentials
+type TOTPQueries struct {
+	db *DB
+}
+
+// NewTOTPQueries creates a new TOTPQueries instance
+func NewTOTPQueries(db *DB) *TOTPQueries {
+	return &TOTPQueries{db: db}
+}
+
+// CreatePending stores a new unconfirmed secret for a user, replacing any previous pending secret
+func (q *TOTPQueries) CreatePending(userID int, secret string) error {
+	query := `
+		INSERT INTO totp_credentials (user_id, secret, enabled, last_used_step, created_at, confirmed_at)
+		VALUES (?, ?, 0, 0, CURRENT_TIMESTAMP, NULL)
+		ON CONFLICT(user_id) DO UPDATE SET
+			secret = excluded.secret,
+			last_used_step = 0,
+			created_at = CURRENT_TIMESTAMP
+		WHERE totp_credentials.enabled = 0
+	`
+
+	result, err := q.db.Exec(query, userID, secret)
+	if err != nil {
+		return fmt.Errorf("failed to save totp secret for user '%d': %w", userID, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("totp already enabled for user '%d'", userID)
+	}
+
+	return nil
+}
+
+// GetByUserID retrieves the TOTP credential for a user
+func (q *TOTPQueries) GetByUserID(userID int) (*TOTPCredential, error) {
+	query := `
+		SELECT user_id, secret, enabled, last_used_step, created_at, confirmed_at
+		FROM totp_credentials
+		WHERE user_id = ?
+	`
+
+	var credential TOTPCredential
+	var confirmedAt sql.NullTime
+	err := q.db.QueryRow(query, userID).Scan(
+		&credential.UserID,
+		&credential.Secret,
+		&credential.Enabled,
+		&credential.LastUsedStep,
+		&credential.CreatedAt,
+		&confirmedAt,
+	)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("totp credential not found")
+		}
+		return nil, fmt.Errorf("failed to get totp credential for user '%d': %w", userID, err)
+	}
+
+	if confirmedAt.Valid {
+		credential.ConfirmedAt = &confirmedAt.Time
+	}
+
+	return &credential, nil
+}
+
+// IsEnabled reports whether a user has a confirmed TOTP credential
+func (q *TOTPQueries) IsEnabled(userID int) (bool, error) {
+	query := "SELECT COUNT(*) FROM totp_credentials WHERE user_id = ? AND enabled = 1"
+
+	var count int
+	if err := q.db.QueryRow(query, userID).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to check totp status for user '%d': %w", userID, err)
+	}
+
+	return count > 0, nil
+}
+
+// Confirm enables a pending credential and records the step used to confirm it
+func (q *TOTPQueries) Confirm(userID int, step int64) error {
+	query := `
+		UPDATE totp_credentials
+		SET enabled = 1, last_used_step = ?, confirmed_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND enabled = 0
+	`
+
+	result, err := q.db.Exec(query, step, userID)
+	if err != nil {
+		return fmt.Errorf("failed to confirm totp for user '%d': %w", userID, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("pending totp credential not found")
+	}
+
+	return nil
+}
+
+// MarkStepUsed records a step as consumed. It fails if the step is not newer than the last one,
+// which prevents a code from being accepted twice by concurrent requests.
+func (q *TOTPQueries) MarkStepUsed(userID int, step int64) error {
+	query := `
+		UPDATE totp_credentials
+		SET last_used_step = ?
+		WHERE user_id = ? AND last_used_step < ?
+	`
+
+	result, err := q.db.Exec(query, step, userID, step)
+	if err != nil {
+		return fmt.Errorf("failed to record totp step for user '%d': %w", userID, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("totp code already used")
+	}
+
+	return nil
+}
+
+// Delete removes a user's TOTP credential
+func (q *TOTPQueries) Delete(userID int) error {
+	query := "DELETE FROM totp_credentials WHERE user_id = ?"
+
+	if _, err := q.db.Exec(query, userID); err != nil {
+		return fmt.Errorf("failed to delete totp credential for user '%d': %w", userID, err)
+	}
+
+	return nil
+}
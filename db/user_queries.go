@@ -4,19 +4,60 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 )
 
+const (
+	// sqliteTimeFormat is the layout SQLite's CURRENT_TIMESTAMP writes, in UTC
+	sqliteTimeFormat = "2006-01-02 15:04:05"
+
+	// createdAtText normalizes created_at to sqliteTimeFormat so it compares as text, and can be carried in a cursor
+	createdAtText = "strftime('%Y-%m-%d %H:%M:%S', created_at)"
+)
+
+// Account statuses. Only active users can sign in or use their tokens.
+const (
+	UserStatusActive      = "active"
+	UserStatusSuspended   = "suspended"   // temporarily blocked, e.g. pending an investigation
+	UserStatusDeactivated = "deactivated" // closed, e.g. the person left the organization
+	UserStatusPending     = "pending"     // created but not yet allowed to sign in
+)
+
 // User represents a user in the database
 type User struct {
-	ID           int       `json:"id"`
-	Email        string    `json:"email"`
-	Name         string    `json:"name"`
-	PasswordHash string    `json:"password_hash,omitempty"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID               int        `json:"id"`
+	OrganizationID   int        `json:"organization_id"`
+	Email            string     `json:"email"`
+	Name             string     `json:"name"`
+	PasswordHash     string     `json:"password_hash,omitempty"`
+	MagicLinkEnabled bool       `json:"magic_link_enabled"`
+	Status           string     `json:"status"`
+	StatusReason     string     `json:"status_reason,omitempty"`
+	StatusChangedAt  *time.Time `json:"status_changed_at,omitempty"`
+	DeletedAt        *time.Time `json:"deleted_at,omitempty"`  // set while soft deleted, until purged
+	ExternalID       string     `json:"external_id,omitempty"` // identifier assigned by a SCIM provisioning client
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+// IsActive reports whether the user may sign in and use their tokens
+func (u *User) IsActive() bool {
+	return u.Status == UserStatusActive && u.DeletedAt == nil
 }
 
+// IsValidUserStatus reports whether status is one of the account statuses
+func IsValidUserStatus(status string) bool {
+	switch status {
+	case UserStatusActive, UserStatusSuspended, UserStatusDeactivated, UserStatusPending:
+		return true
+	}
+	return false
+}
+
+// userColumns are the columns read by scanUser, in order
+const userColumns = "id, organization_id, email, name, magic_link_enabled, status, status_reason, status_changed_at, deleted_at, external_id, created_at, updated_at"
+
 // UserQueries provides database operations for users
 type UserQueries struct {
 	db *DB
@@ -27,43 +68,93 @@ func NewUserQueries(db *DB) *UserQueries {
 	return &UserQueries{db: db}
 }
 
-// Create inserts a new user
-func (q *UserQueries) Create(email, name, passwordHash string) (*User, error) {
+// Create inserts a new user into an organization
+func (q *UserQueries) Create(organizationID int, email, name, passwordHash string) (*User, error) {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	id, err := insertUser(tx, organizationID, email, name, passwordHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return q.GetByID(int(id))
+}
+
+// CreateProvisioned inserts a user created by a provisioning client together with its external ID and, when it is
+// not active, its status. Either the whole user is created or nothing is.
+func (q *UserQueries) CreateProvisioned(organizationID int, email, name, passwordHash, externalID, status, reason string) (*User, error) {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	id, err := insertUser(tx, organizationID, email, name, passwordHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("UPDATE users SET external_id = ? WHERE id = ?", externalID, id); err != nil {
+		return nil, fmt.Errorf("failed to set external id: %w", err)
+	}
+
+	if status != UserStatusActive {
+		query := "UPDATE users SET status = ?, status_reason = ?, status_changed_at = CURRENT_TIMESTAMP WHERE id = ?"
+		if _, err := tx.Exec(query, status, reason, id); err != nil {
+			return nil, fmt.Errorf("failed to set user status: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return q.GetByID(int(id))
+}
+
+// insertUser inserts a user with the default role inside a transaction
+func insertUser(tx *sql.Tx, organizationID int, email, name, passwordHash string) (int64, error) {
 	query := `
-		INSERT INTO users (email, name, password_hash, created_at, updated_at)
-		VALUES (?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+		INSERT INTO users (organization_id, email, name, password_hash, created_at, updated_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
 	`
 
-	result, err := q.db.Exec(query, email, name, passwordHash)
+	result, err := tx.Exec(query, organizationID, email, name, passwordHash)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create user: %w", err)
+		return 0, fmt.Errorf("failed to create user: %w", err)
 	}
 
 	id, err := result.LastInsertId()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+		return 0, fmt.Errorf("failed to get last insert id: %w", err)
 	}
 
-	return q.GetByID(int(id))
+	// Every account starts with the default role so it receives the baseline permissions.
+	_, err = tx.Exec("INSERT INTO user_roles (user_id, role_id) SELECT ?, id FROM roles WHERE name = ?", id, DefaultRoleName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to assign default role: %w", err)
+	}
+
+	return id, nil
 }
 
 // GetByID retrieves a user by ID
 func (q *UserQueries) GetByID(id int) (*User, error) {
 	query := `
-		SELECT id, email, name, created_at, updated_at
+		SELECT ` + userColumns + `
 		FROM users
 		WHERE id = ?
 	`
 
-	var user User
-	err := q.db.QueryRow(query, id).Scan(
-		&user.ID,
-		&user.Email,
-		&user.Name,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
-
+	user, err := scanUser(q.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, fmt.Errorf("user not found")
@@ -71,26 +162,18 @@ func (q *UserQueries) GetByID(id int) (*User, error) {
 		return nil, fmt.Errorf("failed to get user by id: %w", err)
 	}
 
-	return &user, nil
+	return user, nil
 }
 
-// GetByEmail retrieves a user by email
-func (q *UserQueries) GetByEmail(email string) (*User, error) {
+// GetByEmail retrieves a user of an organization by email. Soft deleted users are not found.
+func (q *UserQueries) GetByEmail(organizationID int, email string) (*User, error) {
 	query := `
-		SELECT id, email, name, created_at, updated_at
+		SELECT ` + userColumns + `
 		FROM users
-		WHERE email = ?
+		WHERE organization_id = ? AND email = ? AND deleted_at IS NULL
 	`
 
-	var user User
-	err := q.db.QueryRow(query, email).Scan(
-		&user.ID,
-		&user.Email,
-		&user.Name,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
-
+	user, err := scanUser(q.db.QueryRow(query, organizationID, email))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, fmt.Errorf("user not found")
@@ -98,70 +181,131 @@ func (q *UserQueries) GetByEmail(email string) (*User, error) {
 		return nil, fmt.Errorf("failed to get user by email: %w", err)
 	}
 
-	return &user, nil
+	return user, nil
 }
 
-// GetUserDetailsByEmail retrieves a user's password by email
-func (q *UserQueries) GetUserDetailsByEmail(email string) (*User, error) {
+// GetUserDetailsByEmail retrieves the login details of a user of an organization by email. Soft deleted users are
+// not found.
+func (q *UserQueries) GetUserDetailsByEmail(organizationID int, email string) (*User, error) {
 	query := `
-		SELECT id, email, password_hash
+		SELECT ` + userColumns + `, password_hash
 		FROM users
-		WHERE email = ?
+		WHERE organization_id = ? AND email = ? AND deleted_at IS NULL
 	`
 
-	var user User
-	err := q.db.QueryRow(query, email).Scan(
-		&user.ID,
-		&user.Email,
-		&user.PasswordHash,
-	)
-
+	var passwordHash string
+	user, err := scanUser(q.db.QueryRow(query, organizationID, email), &passwordHash)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, fmt.Errorf("user not found")
 		}
 		return nil, fmt.Errorf("failed to get user by email: %w", err)
 	}
+	user.PasswordHash = passwordHash
 
-	return &user, nil
+	return user, nil
 }
 
-// List retrieves all users with optional limit and offset
-func (q *UserQueries) List(limit, offset int) ([]User, error) {
-	query := `
-		SELECT id, email, name, created_at, updated_at
+// UserSortFields maps the sort keys accepted by List to the expressions they order by
+var UserSortFields = map[string]string{
+	"created_at": createdAtText,
+	"email":      "email",
+	"name":       "name",
+}
+
+// UserFilter narrows a user listing. Zero values match everything.
+type UserFilter struct {
+	OrganizationID int
+	EmailDomain    string    // matches the part after "@", case-insensitively
+	CreatedAfter   time.Time // inclusive
+	CreatedBefore  time.Time // exclusive
+	Role           string
+	Status         string
+	Search         string // prefix of the email or name
+	Email          string // exact email, case-insensitive
+	EmailContains  string // substring of the email, case-insensitive
+	ExternalID     string
+	Deleted        bool // list soft deleted users instead of current ones
+}
+
+// UserCursor marks the last row of a page: the value of the sort column and the ID that breaks ties
+type UserCursor struct {
+	Value string
+	ID    int
+}
+
+// UserListOptions selects, orders and pages a user listing
+type UserListOptions struct {
+	Filter     UserFilter
+	SortBy     string // a key of UserSortFields
+	Descending bool
+	Limit      int
+	After      *UserCursor // start after this row; nil for the first page
+	Offset     int         // rows to skip, for clients that page by index; ignored when After is set
+}
+
+// List retrieves a page of users using keyset pagination. It returns the cursor of the last row when more rows follow.
+func (q *UserQueries) List(opts UserListOptions) ([]User, *UserCursor, error) {
+	column, ok := UserSortFields[opts.SortBy]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown sort field %q", opts.SortBy)
+	}
+
+	where, args := opts.Filter.where()
+
+	direction, comparison := "ASC", ">"
+	if opts.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	if opts.After != nil {
+		where += fmt.Sprintf(" AND (%s, id) %s (?, ?)", column, comparison)
+		args = append(args, opts.After.Value, opts.After.ID)
+	}
+
+	// One extra row tells whether another page follows.
+	query := fmt.Sprintf(`
+		SELECT `+userColumns+`, %s
 		FROM users
-		ORDER BY created_at DESC
+		WHERE %s
+		ORDER BY %s %s, id %s
 		LIMIT ? OFFSET ?
-	`
+	`, column, where, column, direction, direction)
+	offset := opts.Offset
+	if opts.After != nil {
+		offset = 0
+	}
+	args = append(args, opts.Limit+1, offset)
 
-	rows, err := q.db.Query(query, limit, offset)
+	rows, err := q.db.Query(query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list users: %w", err)
+		return nil, nil, fmt.Errorf("failed to list users: %w", err)
 	}
 	defer rows.Close()
 
-	var users []User
+	users := []User{}
+	var sortValues []string
 	for rows.Next() {
-		var user User
-		err := rows.Scan(
-			&user.ID,
-			&user.Email,
-			&user.Name,
-			&user.CreatedAt,
-			&user.UpdatedAt,
-		)
+		var sortValue string
+		user, err := scanUser(rows, &sortValue)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan user: %w", err)
+			return nil, nil, fmt.Errorf("failed to scan user: %w", err)
 		}
-		users = append(users, user)
+		users = append(users, *user)
+		sortValues = append(sortValues, sortValue)
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("rows iteration error: %w", err)
+		return nil, nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	if len(users) <= opts.Limit {
+		return users, nil, nil
 	}
 
-	return users, nil
+	users = users[:opts.Limit]
+	last := len(users) - 1
+	return users, &UserCursor{Value: sortValues[last], ID: users[last].ID}, nil
 }
 
 // Update modifies an existing user
@@ -189,7 +333,151 @@ func (q *UserQueries) Update(id int, email, name string) (*User, error) {
 	return q.GetByID(id)
 }
 
-// Delete removes a user by ID
+// SetPassword replaces the password hash of a user
+func (q *UserQueries) SetPassword(id int, passwordHash string) error {
+	result, err := q.db.Exec("UPDATE users SET password_hash = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", passwordHash, id)
+	if err != nil {
+		return fmt.Errorf("failed to set password: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	return nil
+}
+
+// SetExternalID records the identifier a provisioning client uses for a user
+func (q *UserQueries) SetExternalID(id int, externalID string) error {
+	result, err := q.db.Exec("UPDATE users SET external_id = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", externalID, id)
+	if err != nil {
+		return fmt.Errorf("failed to set external id: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	return nil
+}
+
+// SetMagicLinkEnabled turns passwordless email login on or off for a user
+func (q *UserQueries) SetMagicLinkEnabled(id int, enabled bool) error {
+	query := "UPDATE users SET magic_link_enabled = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?"
+
+	result, err := q.db.Exec(query, enabled, id)
+	if err != nil {
+		return fmt.Errorf("failed to update magic link setting: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	return nil
+}
+
+// SetStatus changes the status of a user and records why and when
+func (q *UserQueries) SetStatus(id int, status, reason string) (*User, error) {
+	query := `
+		UPDATE users
+		SET status = ?, status_reason = ?, status_changed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+
+	result, err := q.db.Exec(query, status, reason, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set user status: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	return q.GetByID(id)
+}
+
+// SoftDelete marks a user as deleted. The row, and everything that refers to it, is kept until PurgeDeleted removes
+// it, so the user can be restored in the meantime.
+func (q *UserQueries) SoftDelete(id int) error {
+	query := "UPDATE users SET deleted_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND deleted_at IS NULL"
+
+	result, err := q.db.Exec(query, id)
+	if err != nil {
+		return fmt.Errorf("failed to soft delete user: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	return nil
+}
+
+// Restore undoes a soft delete
+func (q *UserQueries) Restore(id int) (*User, error) {
+	query := "UPDATE users SET deleted_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND deleted_at IS NOT NULL"
+
+	result, err := q.db.Exec(query, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore user: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return nil, fmt.Errorf("deleted user not found")
+	}
+
+	return q.GetByID(id)
+}
+
+// PurgeDeleted permanently removes users that were soft deleted longer ago than the retention period
+func (q *UserQueries) PurgeDeleted(retention time.Duration) (int64, error) {
+	query := "DELETE FROM users WHERE deleted_at IS NOT NULL AND deleted_at <= datetime('now', ?)"
+
+	result, err := q.db.Exec(query, sqliteOffset(-retention))
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge deleted users: %w", err)
+	}
+
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	return purged, nil
+}
+
+// Delete permanently removes a user by ID
 func (q *UserQueries) Delete(id int) error {
 	query := "DELETE FROM users WHERE id = ?"
 
@@ -210,15 +498,94 @@ func (q *UserQueries) Delete(id int) error {
 	return nil
 }
 
-// Count returns the total number of users
-func (q *UserQueries) Count() (int, error) {
-	query := "SELECT COUNT(*) FROM users"
+// Count returns the number of users matching a filter
+func (q *UserQueries) Count(filter UserFilter) (int, error) {
+	where, args := filter.where()
 
 	var count int
-	err := q.db.QueryRow(query).Scan(&count)
+	err := q.db.QueryRow("SELECT COUNT(*) FROM users WHERE "+where, args...).Scan(&count)
 	if err != nil {
 		return 0, fmt.Errorf("failed to count users: %w", err)
 	}
 
 	return count, nil
 }
+
+// where builds the SQL condition and arguments for a filter
+func (f UserFilter) where() (string, []interface{}) {
+	conditions := []string{"organization_id = ?", "deleted_at IS NULL"}
+	args := []interface{}{f.OrganizationID}
+	if f.Deleted {
+		conditions[1] = "deleted_at IS NOT NULL"
+	}
+
+	if f.EmailDomain != "" {
+		conditions = append(conditions, "lower(substr(email, instr(email, '@') + 1)) = lower(?)")
+		args = append(args, f.EmailDomain)
+	}
+	if !f.CreatedAfter.IsZero() {
+		conditions = append(conditions, createdAtText+" >= ?")
+		args = append(args, f.CreatedAfter.UTC().Format(sqliteTimeFormat))
+	}
+	if !f.CreatedBefore.IsZero() {
+		conditions = append(conditions, createdAtText+" < ?")
+		args = append(args, f.CreatedBefore.UTC().Format(sqliteTimeFormat))
+	}
+	if f.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, f.Status)
+	}
+	if f.Email != "" {
+		conditions = append(conditions, "lower(email) = lower(?)")
+		args = append(args, f.Email)
+	}
+	if f.EmailContains != "" {
+		conditions = append(conditions, `email LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(f.EmailContains)+"%")
+	}
+	if f.ExternalID != "" {
+		conditions = append(conditions, "external_id = ?")
+		args = append(args, f.ExternalID)
+	}
+	if f.Role != "" {
+		conditions = append(conditions, "id IN (SELECT ur.user_id FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE r.name = ?)")
+		args = append(args, f.Role)
+	}
+	if f.Search != "" {
+		prefix := escapeLike(f.Search) + "%"
+		conditions = append(conditions, `(email LIKE ? ESCAPE '\' OR name LIKE ? ESCAPE '\')`)
+		args = append(args, prefix, prefix)
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// escapeLike escapes the LIKE wildcards in a literal, for use with ESCAPE '\'
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
+// scanUser reads the userColumns of a row, followed by any extra columns into extra
+func scanUser(row rowScanner, extra ...interface{}) (*User, error) {
+	var user User
+	dest := []interface{}{
+		&user.ID,
+		&user.OrganizationID,
+		&user.Email,
+		&user.Name,
+		&user.MagicLinkEnabled,
+		&user.Status,
+		&user.StatusReason,
+		&user.StatusChangedAt,
+		&user.DeletedAt,
+		&user.ExternalID,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	}
+
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,201 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// WebAuthnCredential represents a registered passkey or security key
+type WebAuthnCredential struct {
+	ID             int        `json:"id"`
+	UserID         int        `json:"user_id"`
+	CredentialID   string     `json:"credential_id"`
+	PublicKey      []byte     `json:"-"`
+	SignCount      uint32     `json:"sign_count"`
+	AAGUID         string     `json:"aaguid"`
+	Transports     []string   `json:"transports"`
+	Name           string     `json:"name"`
+	BackupEligible bool       `json:"backup_eligible"`
+	BackupState    bool       `json:"backup_state"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+}
+
+// WebAuthnCredentialQueries provides database operations for WebAuthn credentials
+type WebAuthnCredentialQueries struct {
+	db *DB
+}
+
+// NewWebAuthnCredentialQueries creates a new WebAuthnCredentialQueries instance
+func NewWebAuthnCredentialQueries(db *DB) *WebAuthnCredentialQueries {
+	return &WebAuthnCredentialQueries{db: db}
+}
+
+const webAuthnCredentialColumns = `id, user_id, credential_id, public_key, sign_count, aaguid, transports, name,
+		backup_eligible, backup_state, created_at, last_used_at`
+
+// Create stores a newly registered credential
+func (q *WebAuthnCredentialQueries) Create(credential *WebAuthnCredential) (*WebAuthnCredential, error) {
+	query := `
+		INSERT INTO webauthn_credentials (user_id, credential_id, public_key, sign_count, aaguid, transports, name, backup_eligible, backup_state)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	result, err := q.db.Exec(query,
+		credential.UserID,
+		credential.CredentialID,
+		credential.PublicKey,
+		credential.SignCount,
+		credential.AAGUID,
+		joinList(credential.Transports),
+		credential.Name,
+		credential.BackupEligible,
+		credential.BackupState,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save webauthn credential for user '%d': %w", credential.UserID, err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+	}
+
+	return q.getOne("id = ?", id)
+}
+
+// GetByCredentialID retrieves a credential by its base64url credential id
+func (q *WebAuthnCredentialQueries) GetByCredentialID(credentialID string) (*WebAuthnCredential, error) {
+	return q.getOne("credential_id = ?", credentialID)
+}
+
+// ListByUserID retrieves all credentials registered by a user
+func (q *WebAuthnCredentialQueries) ListByUserID(userID int) ([]WebAuthnCredential, error) {
+	query := `SELECT ` + webAuthnCredentialColumns + ` FROM webauthn_credentials WHERE user_id = ? ORDER BY created_at`
+
+	rows, err := q.db.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webauthn credentials for user '%d': %w", userID, err)
+	}
+	defer rows.Close()
+
+	credentials := []WebAuthnCredential{}
+	for rows.Next() {
+		credential, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webauthn credential: %w", err)
+		}
+		credentials = append(credentials, *credential)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return credentials, nil
+}
+
+// CountByUserID returns the number of credentials registered by a user
+func (q *WebAuthnCredentialQueries) CountByUserID(userID int) (int, error) {
+	query := "SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = ?"
+
+	var count int
+	if err := q.db.QueryRow(query, userID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count webauthn credentials: %w", err)
+	}
+
+	return count, nil
+}
+
+// UpdateUsage records a successful assertion
+func (q *WebAuthnCredentialQueries) UpdateUsage(id int, signCount uint32, backupState bool) error {
+	query := `
+		UPDATE webauthn_credentials
+		SET sign_count = ?, backup_state = ?, last_used_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+
+	if _, err := q.db.Exec(query, signCount, backupState, id); err != nil {
+		return fmt.Errorf("failed to update webauthn credential usage: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteByUserID removes all credentials of a user
+func (q *WebAuthnCredentialQueries) DeleteByUserID(userID int) error {
+	if _, err := q.db.Exec("DELETE FROM webauthn_credentials WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to delete webauthn credentials: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteForUser removes a credential owned by the given user
+func (q *WebAuthnCredentialQueries) DeleteForUser(id, userID int) error {
+	result, err := q.db.Exec("DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete webauthn credential: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("webauthn credential not found")
+	}
+
+	return nil
+}
+
+func (q *WebAuthnCredentialQueries) getOne(where string, args ...interface{}) (*WebAuthnCredential, error) {
+	query := `SELECT ` + webAuthnCredentialColumns + ` FROM webauthn_credentials WHERE ` + where
+
+	credential, err := scanWebAuthnCredential(q.db.QueryRow(query, args...))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("webauthn credential not found")
+		}
+		return nil, fmt.Errorf("failed to get webauthn credential: %w", err)
+	}
+
+	return credential, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanWebAuthnCredential(row rowScanner) (*WebAuthnCredential, error) {
+	var credential WebAuthnCredential
+	var transports string
+	var lastUsedAt sql.NullTime
+	err := row.Scan(
+		&credential.ID,
+		&credential.UserID,
+		&credential.CredentialID,
+		&credential.PublicKey,
+		&credential.SignCount,
+		&credential.AAGUID,
+		&transports,
+		&credential.Name,
+		&credential.BackupEligible,
+		&credential.BackupState,
+		&credential.CreatedAt,
+		&lastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	credential.Transports = splitList(transports)
+	if lastUsedAt.Valid {
+		credential.LastUsedAt = &lastUsedAt.Time
+	}
+
+	return &credential, nil
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// WebAuthnSession holds the server side state of a registration or authentication ceremony
+type WebAuthnSession struct {
+	ID               int       `json:"id"`
+	Challenge        string    `json:"challenge"`
+	Ceremony         string    `json:"ceremony"`
+	UserID           *int      `json:"user_id,omitempty"`
+	UserVerification string    `json:"user_verification"`
+	CreatedAt        time.Time `json:"created_at"`
+	ExpiresAt        time.Time `json:"expires_at"`
+}
+
+// WebAuthnSessionQueries provides database operations for WebAuthn ceremony sessions
+type WebAuthnSessionQueries struct {
+	db *DB
+}
+
+// NewWebAuthnSessionQueries creates a new WebAuthnSessionQueries instance
+func NewWebAuthnSessionQueries(db *DB) *WebAuthnSessionQueries {
+	return &WebAuthnSessionQueries{db: db}
+}
+
+// Create stores a ceremony challenge. userID is nil for usernameless authentication.
+func (q *WebAuthnSessionQueries) Create(challenge, ceremony string, userID *int, userVerification string, validFor time.Duration) error {
+	query := `
+		INSERT INTO webauthn_sessions (challenge, ceremony, user_id, user_verification, expires_at)
+		VALUES (?, ?, ?, ?, datetime('now', ?))
+	`
+
+	if _, err := q.db.Exec(query, challenge, ceremony, userID, userVerification, sqliteOffset(validFor)); err != nil {
+		return fmt.Errorf("failed to save webauthn session: %w", err)
+	}
+
+	return nil
+}
+
+// Consume retrieves and deletes an unexpired session for a ceremony, so each challenge can be answered once
+func (q *WebAuthnSessionQueries) Consume(challenge, ceremony string) (*WebAuthnSession, error) {
+	query := `
+		SELECT id, challenge, ceremony, user_id, user_verification, created_at, expires_at
+		FROM webauthn_sessions
+		WHERE challenge = ? AND ceremony = ? AND expires_at > datetime('now')
+	`
+
+	var session WebAuthnSession
+	var userID sql.NullInt64
+	err := q.db.QueryRow(query, challenge, ceremony).Scan(
+		&session.ID,
+		&session.Challenge,
+		&session.Ceremony,
+		&userID,
+		&session.UserVerification,
+		&session.CreatedAt,
+		&session.ExpiresAt,
+	)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("invalid or expired webauthn session")
+		}
+		return nil, fmt.Errorf("failed to get webauthn session: %w", err)
+	}
+
+	// Only the request whose delete succeeds gets the session, which keeps concurrent answers single use.
+	result, err := q.db.Exec("DELETE FROM webauthn_sessions WHERE id = ?", session.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete webauthn session: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return nil, fmt.Errorf("invalid or expired webauthn session")
+	}
+
+	if userID.Valid {
+		id := int(userID.Int64)
+		session.UserID = &id
+	}
+
+	return &session, nil
+}
@@ -4,10 +4,15 @@ go 1.25
 
 require github.com/mattn/go-sqlite3 v1.14.32
 
-require github.com/go-jose/go-jose/v4 v4.1.3
+require (
+	github.com/fxamacker/cbor/v2 v2.9.4
+	github.com/go-crypt/crypt v0.4.7
+	github.com/go-jose/go-jose/v4 v4.1.3
+	rsc.io/qr v0.2.0
+)
 
 require (
-	github.com/go-crypt/crypt v0.4.7 // indirect
 	github.com/go-crypt/x v0.4.9 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/sys v0.38.0 // indirect
 )
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"net/http"
+	"strconv"
+)
+
+// HandleAuditLogGET lists administrative actions, newest first. Supports ?limit= (max 500) and ?offset=.
+func HandleAuditLogGET(ctx *middlewares.AppContext) {
+	limit := 100
+	offset := 0
+
+	if value := ctx.Request.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > 500 {
+			ctx.SetJSONError(http.StatusBadRequest, "limit must be between 1 and 500")
+			return
+		}
+		limit = parsed
+	}
+
+	if value := ctx.Request.URL.Query().Get("offset"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			ctx.SetJSONError(http.StatusBadRequest, "offset must be a non-negative integer")
+			return
+		}
+		offset = parsed
+	}
+
+	entries, err := db.NewAuditLogQueries(ctx.DB).List(ctx.Tenant.ID, limit, offset)
+	if err != nil {
+		ctx.Logger.Error("failed to list audit log", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve audit log")
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"entries": entries,
+		"count":   len(entries),
+	})
+}
@@ -0,0 +1,341 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// clientRegistrationRequest is the client metadata of a registration or update request (RFC 7591 §2)
+type clientRegistrationRequest struct {
+	ClientID                string   `json:"client_id"`     // only in update requests, where it must match (RFC 7592 §2.2)
+	ClientSecret            string   `json:"client_secret"` // only in update requests, where it must match when sent
+	ClientName              string   `json:"client_name"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	Scope                   string   `json:"scope"`
+	LogoURI                 string   `json:"logo_uri"`
+	PolicyURI               string   `json:"policy_uri"`
+	db.TLSClientAuthMetadata
+	JWKS    json.RawMessage `json:"jwks"`
+	JWKSURI string          `json:"jwks_uri"`
+}
+
+// clientInformationResponse describes a registered client (RFC 7591 §3.2.1, RFC 7592 §3)
+type clientInformationResponse struct {
+	ClientID                string   `json:"client_id"`
+	ClientSecret            string   `json:"client_secret,omitempty"`
+	ClientIDIssuedAt        int64    `json:"client_id_issued_at"`
+	ClientSecretExpiresAt   *int64   `json:"client_secret_expires_at,omitempty"` // 0, secrets do not expire; only sent with a secret
+	RegistrationAccessToken string   `json:"registration_access_token"`
+	RegistrationClientURI   string   `json:"registration_client_uri"`
+	ClientName              string   `json:"client_name"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	Scope                   string   `json:"scope"`
+	LogoURI                 string   `json:"logo_uri,omitempty"`
+	PolicyURI               string   `json:"policy_uri,omitempty"`
+	db.TLSClientAuthMetadata
+	JWKS    json.RawMessage `json:"jwks,omitempty"`
+	JWKSURI string          `json:"jwks_uri,omitempty"`
+}
+
+// HandleClientRegistrationPOST is the dynamic client registration endpoint (RFC 7591 §3). It requires an initial
+// access token, whose scope is the default and the upper bound of the client's scope. As the RFC specifies, clients
+// default to the authorization_code grant and client_secret_basic. The response carries the client's secret and a
+// registration access token for the client configuration endpoint.
+func HandleClientRegistrationPOST(ctx *middlewares.AppContext) {
+	ctx.Response.Header().Set("Cache-Control", "no-store")
+
+	token := middlewares.GetInitialAccessToken(ctx)
+
+	var request clientRegistrationRequest
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_client_metadata", "The request body must be a JSON object")
+		return
+	}
+	if request.ClientID != "" || request.ClientSecret != "" {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_client_metadata", "client_id and client_secret are assigned by the server")
+		return
+	}
+
+	client := &db.OAuthClient{
+		OrganizationID:          ctx.Tenant.ID,
+		OwnerID:                 token.CreatedBy,
+		TokenEndpointAuthMethod: db.AuthMethodClientSecretBasic,
+		GrantTypes:              []string{"authorization_code"},
+		Scope:                   token.Scope,
+	}
+	if metadataErr := applyRegistrationRequest(client, &request); metadataErr != nil {
+		writeOAuthError(ctx, http.StatusBadRequest, metadataErr.Code, metadataErr.Message)
+		return
+	}
+	if !utils.IsScopeSubset(client.Scope, token.Scope) {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_client_metadata", "scope exceeds the scope of the initial access token")
+		return
+	}
+	if grantType, ok := unapprovedGrantType(client.GrantTypes, token.GrantTypes); ok {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_client_metadata", "The initial access token does not allow the "+grantType+" grant")
+		return
+	}
+
+	secret, err := assignClientCredentials(client)
+	if err != nil {
+		writeOAuthError(ctx, http.StatusInternalServerError, "server_error", "Internal server error")
+		return
+	}
+
+	registrationToken, registrationTokenHash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		writeOAuthError(ctx, http.StatusInternalServerError, "server_error", "Internal server error")
+		return
+	}
+	client.RegistrationTokenHash = registrationTokenHash
+
+	if err := db.NewInitialAccessTokenQueries(ctx.DB).Use(token.ID); err != nil {
+		if strings.HasPrefix(err.Error(), "failed to") {
+			ctx.Logger.Error("failed to use initial access token", "err", err)
+			writeOAuthError(ctx, http.StatusInternalServerError, "server_error", "Internal server error")
+			return
+		}
+		ctx.Response.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOAuthError(ctx, http.StatusUnauthorized, "invalid_token", "Invalid, expired or used up initial access token")
+		return
+	}
+
+	client, err = db.NewOAuthClientQueries(ctx.DB).Create(client)
+	if err != nil {
+		ctx.Logger.Error("failed to create oauth client", "err", err)
+		writeOAuthError(ctx, http.StatusInternalServerError, "server_error", "Failed to register client")
+		return
+	}
+
+	utils.RecordAudit(ctx, "oauth_client.register", "oauth_client", strconv.Itoa(client.ID), map[string]interface{}{
+		"client_id":   client.ClientID,
+		"client_type": client.ClientType,
+		"name":        client.Name,
+		"scope":       utils.FormatScope(client.Scope),
+		"grant_types": client.GrantTypes,
+	})
+
+	ctx.WriteJSON(http.StatusCreated, clientInformation(ctx, client, secret, registrationToken))
+}
+
+// HandleClientConfigurationGET returns a client's registration (RFC 7592 §2.1). The secret is not returned again,
+// because only its hash is stored. The registration access token is only stored as a hash as well, so every response
+// carries a new one and the presented token stops working (RFC 7592 §3).
+func HandleClientConfigurationGET(ctx *middlewares.AppContext) {
+	ctx.Response.Header().Set("Cache-Control", "no-store")
+
+	client := middlewares.GetRegisteredClient(ctx)
+
+	registrationToken, ok := rotateRegistrationToken(ctx, client)
+	if !ok {
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, clientInformation(ctx, client, "", registrationToken))
+}
+
+// HandleClientConfigurationPUT replaces a client's registration (RFC 7592 §2.2). Omitted fields return to their
+// defaults, except the scope, which defaults to the client's current scope and cannot be widened. Neither can the
+// grant types, which the initial access token or an administrator approved. A client cannot switch between
+// confidential and public.
+func HandleClientConfigurationPUT(ctx *middlewares.AppContext) {
+	ctx.Response.Header().Set("Cache-Control", "no-store")
+
+	client := middlewares.GetRegisteredClient(ctx)
+
+	var request clientRegistrationRequest
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_client_metadata", "The request body must be a JSON object")
+		return
+	}
+	if request.ClientID != client.ClientID {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_client_metadata", "client_id does not match the registered client")
+		return
+	}
+	if request.ClientSecret != "" && subtle.ConstantTimeCompare([]byte(utils.HashToken(request.ClientSecret)), []byte(client.SecretHash)) != 1 {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_client_metadata", "client_secret does not match the registered client")
+		return
+	}
+
+	updated := *client
+	updated.TokenEndpointAuthMethod = db.AuthMethodClientSecretBasic
+	updated.GrantTypes = []string{"authorization_code"}
+	updated.RedirectURIs, updated.LogoURI, updated.PolicyURI, updated.JWKS, updated.JWKSURI = nil, "", "", nil, ""
+	if metadataErr := applyRegistrationRequest(&updated, &request); metadataErr != nil {
+		writeOAuthError(ctx, http.StatusBadRequest, metadataErr.Code, metadataErr.Message)
+		return
+	}
+	if updated.ClientType != client.ClientType {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_client_metadata", "A client cannot be switched between confidential and public")
+		return
+	}
+	if !utils.IsScopeSubset(updated.Scope, client.Scope) {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_client_metadata", "scope exceeds the client's registered scope")
+		return
+	}
+	if grantType, ok := unapprovedGrantType(updated.GrantTypes, client.GrantTypes); ok {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_client_metadata", "The client is not registered for the "+grantType+" grant")
+		return
+	}
+
+	saved, err := db.NewOAuthClientQueries(ctx.DB).Update(&updated)
+	if err != nil {
+		ctx.Logger.Error("failed to update oauth client", "err", err, "id", client.ID)
+		writeOAuthError(ctx, http.StatusInternalServerError, "server_error", "Failed to update client")
+		return
+	}
+
+	utils.RecordAudit(ctx, "oauth_client.update", "oauth_client", strconv.Itoa(saved.ID), map[string]interface{}{
+		"client_id":   saved.ClientID,
+		"name":        saved.Name,
+		"scope":       utils.FormatScope(saved.Scope),
+		"grant_types": saved.GrantTypes,
+	})
+
+	registrationToken, ok := rotateRegistrationToken(ctx, saved)
+	if !ok {
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, clientInformation(ctx, saved, "", registrationToken))
+}
+
+// HandleClientConfigurationDELETE removes a client at its own request (RFC 7592 §2.3). Its tokens and grants go with
+// it.
+func HandleClientConfigurationDELETE(ctx *middlewares.AppContext) {
+	client := middlewares.GetRegisteredClient(ctx)
+
+	if err := db.NewOAuthClientQueries(ctx.DB).Delete(ctx.Tenant.ID, client.ID); err != nil {
+		ctx.Logger.Error("failed to delete oauth client", "err", err, "id", client.ID)
+		writeOAuthError(ctx, http.StatusInternalServerError, "server_error", "Failed to delete client")
+		return
+	}
+
+	utils.RecordAudit(ctx, "oauth_client.delete", "oauth_client", strconv.Itoa(client.ID), map[string]interface{}{
+		"client_id": client.ClientID,
+		"name":      client.Name,
+	})
+
+	ctx.Response.WriteHeader(http.StatusNoContent)
+}
+
+// unapprovedGrantType returns the first requested grant type that is not approved
+func unapprovedGrantType(requested, approved []string) (string, bool) {
+	for _, grantType := range requested {
+		if !slices.Contains(approved, grantType) {
+			return grantType, true
+		}
+	}
+	return "", false
+}
+
+// applyRegistrationRequest copies the metadata of a registration request onto a client and validates it.
+// response_types must agree with grant_types: code is registered exactly when the authorization_code grant is.
+func applyRegistrationRequest(client *db.OAuthClient, request *clientRegistrationRequest) *clientMetadataError {
+	client.Name = strings.TrimSpace(request.ClientName)
+	if client.Name == "" {
+		return &clientMetadataError{Code: "invalid_client_metadata", Message: "client_name is required"}
+	}
+	if request.RedirectURIs != nil {
+		client.RedirectURIs = request.RedirectURIs
+	}
+	if len(request.GrantTypes) > 0 {
+		client.GrantTypes = request.GrantTypes
+	}
+	if request.TokenEndpointAuthMethod != "" {
+		client.TokenEndpointAuthMethod = request.TokenEndpointAuthMethod
+	}
+	if scope := utils.ParseScope(request.Scope); len(scope) > 0 {
+		client.Scope = scope
+	}
+	if request.LogoURI != "" {
+		client.LogoURI = request.LogoURI
+	}
+	if request.PolicyURI != "" {
+		client.PolicyURI = request.PolicyURI
+	}
+	client.TLSClientAuthMetadata = request.TLSClientAuthMetadata
+	if len(request.JWKS) > 0 {
+		client.JWKS = request.JWKS
+	}
+	if request.JWKSURI != "" {
+		client.JWKSURI = request.JWKSURI
+	}
+
+	if metadataErr := validateClientMetadata(client); metadataErr != nil {
+		return metadataErr
+	}
+
+	if request.ResponseTypes != nil && !slices.Equal(request.ResponseTypes, responseTypes(client)) {
+		return &clientMetadataError{Code: "invalid_client_metadata", Message: `response_types must be ["code"] with the authorization_code grant and empty without it`}
+	}
+
+	return nil
+}
+
+// rotateRegistrationToken gives a client a new registration access token and returns it, writing an error response
+// on failure
+func rotateRegistrationToken(ctx *middlewares.AppContext, client *db.OAuthClient) (string, bool) {
+	token, hash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		writeOAuthError(ctx, http.StatusInternalServerError, "server_error", "Internal server error")
+		return "", false
+	}
+
+	if err := db.NewOAuthClientQueries(ctx.DB).SetRegistrationToken(client.ID, hash); err != nil {
+		ctx.Logger.Error("failed to rotate registration token", "err", err, "id", client.ID)
+		writeOAuthError(ctx, http.StatusInternalServerError, "server_error", "Internal server error")
+		return "", false
+	}
+
+	return token, true
+}
+
+// clientInformation builds the client information response. secret is empty except at registration.
+func clientInformation(ctx *middlewares.AppContext, client *db.OAuthClient, secret, registrationToken string) clientInformationResponse {
+	response := clientInformationResponse{
+		ClientID:                client.ClientID,
+		ClientSecret:            secret,
+		ClientIDIssuedAt:        client.CreatedAt.Unix(),
+		RegistrationAccessToken: registrationToken,
+		RegistrationClientURI:   ctx.Issuer() + "/oauth/register/" + client.ClientID,
+		ClientName:              client.Name,
+		RedirectURIs:            client.RedirectURIs,
+		GrantTypes:              client.GrantTypes,
+		ResponseTypes:           responseTypes(client),
+		TokenEndpointAuthMethod: client.TokenEndpointAuthMethod,
+		Scope:                   utils.FormatScope(client.Scope),
+		LogoURI:                 client.LogoURI,
+		PolicyURI:               client.PolicyURI,
+		TLSClientAuthMetadata:   client.TLSClientAuthMetadata,
+		JWKS:                    client.JWKS,
+		JWKSURI:                 client.JWKSURI,
+	}
+	if secret != "" {
+		var never int64
+		response.ClientSecretExpiresAt = &never
+	}
+
+	return response
+}
+
+// responseTypes returns the response types a client can use at the authorization endpoint
+func responseTypes(client *db.OAuthClient) []string {
+	if client.AllowsGrantType("authorization_code") {
+		return []string{"code"}
+	}
+	return []string{}
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HandleConnectedAppsGET lists the clients the authenticated user has granted access to, with the approved scopes
+func HandleConnectedAppsGET(ctx *middlewares.AppContext) {
+	user, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	grants, err := db.NewConsentGrantQueries(ctx.DB).ListByUserID(user.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to list consent grants", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve connected apps")
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"apps":  grants,
+		"count": len(grants),
+	})
+}
+
+// HandleConnectedAppDELETE revokes the authenticated user's grant to a client. The client's refresh tokens and
+// outstanding authorization codes for the user are deleted with it, and the next authorization request shows the
+// consent page again. Access tokens already issued stay valid until they expire.
+func HandleConnectedAppDELETE(ctx *middlewares.AppContext) {
+	user, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	clientID := ctx.Request.PathValue("client_id")
+
+	if err := db.NewConsentGrantQueries(ctx.DB).Delete(user.ID, clientID); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "Connected app not found")
+			return
+		}
+		ctx.Logger.Error("failed to delete consent grant", "err", err, "client_id", clientID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to revoke access")
+		return
+	}
+
+	revoked, err := db.NewRefreshTokenQueries(ctx.DB).DeleteByOwnerAndClient(strconv.Itoa(user.ID), clientID)
+	if err != nil {
+		ctx.Logger.Error("failed to revoke refresh tokens", "err", err, "client_id", clientID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to revoke access")
+		return
+	}
+
+	if err := db.NewAuthorizationCodeQueries(ctx.DB).DeleteByUserAndClient(user.ID, clientID); err != nil {
+		ctx.Logger.Error("failed to delete authorization codes", "err", err, "client_id", clientID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to revoke access")
+		return
+	}
+
+	ctx.Logger.Info("Connected app revoked", "user_id", user.ID, "client_id", clientID, "refresh_tokens_revoked", revoked)
+
+	ctx.SetJSONStatus(http.StatusOK, "Access revoked")
+}
@@ -0,0 +1,386 @@
+package handlers
+
+import (
+	"encoding/json"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HandleGroupsGET lists the groups of the organization
+func HandleGroupsGET(ctx *middlewares.AppContext) {
+	groups, err := db.NewGroupQueries(ctx.DB).List(ctx.Tenant.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to list groups", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve groups")
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"groups": groups,
+		"count":  len(groups),
+	})
+}
+
+// HandleGroupsPOST creates a new group
+func HandleGroupsPOST(ctx *middlewares.AppContext) {
+	var request struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		ctx.SetJSONError(http.StatusBadRequest, "name is required")
+		return
+	}
+
+	group, err := db.NewGroupQueries(ctx.DB).Create(ctx.Tenant.ID, name, request.Description)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			ctx.SetJSONError(http.StatusConflict, "Group already exists")
+			return
+		}
+		ctx.Logger.Error("failed to create group", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to create group")
+		return
+	}
+
+	utils.RecordAudit(ctx, "group.create", "group", strconv.Itoa(group.ID), map[string]interface{}{"name": group.Name})
+
+	ctx.WriteJSON(http.StatusCreated, group)
+}
+
+// HandleGroupGET retrieves a group with its direct members and subgroups
+func HandleGroupGET(ctx *middlewares.AppContext) {
+	group, ok := groupFromPath(ctx, "id")
+	if !ok {
+		return
+	}
+
+	groupQueries := db.NewGroupQueries(ctx.DB)
+	members, err := groupQueries.ListMembers(group.ID, false)
+	if err != nil {
+		ctx.Logger.Error("failed to list group members", "err", err, "id", group.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve group")
+		return
+	}
+
+	subgroups, err := groupQueries.ListSubgroups(group.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to list subgroups", "err", err, "id", group.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve group")
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"group":     group,
+		"members":   members,
+		"subgroups": subgroups,
+	})
+}
+
+// HandleGroupPUT renames a group or changes its description
+func HandleGroupPUT(ctx *middlewares.AppContext) {
+	group, ok := groupFromPath(ctx, "id")
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	name, description := group.Name, group.Description
+	if request.Name != nil {
+		name = strings.TrimSpace(*request.Name)
+	}
+	if request.Description != nil {
+		description = *request.Description
+	}
+
+	if name == "" {
+		ctx.SetJSONError(http.StatusBadRequest, "name must not be empty")
+		return
+	}
+
+	updated, err := db.NewGroupQueries(ctx.DB).Update(group.ID, name, description)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			ctx.SetJSONError(http.StatusConflict, "Group already exists")
+			return
+		}
+		ctx.Logger.Error("failed to update group", "err", err, "id", group.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to update group")
+		return
+	}
+
+	utils.RecordAudit(ctx, "group.update", "group", strconv.Itoa(group.ID), map[string]interface{}{
+		"previous_name": group.Name,
+		"name":          updated.Name,
+	})
+
+	ctx.WriteJSON(http.StatusOK, updated)
+}
+
+// HandleGroupDELETE removes a group. Its members keep their other memberships.
+func HandleGroupDELETE(ctx *middlewares.AppContext) {
+	group, ok := groupFromPath(ctx, "id")
+	if !ok {
+		return
+	}
+
+	if err := db.NewGroupQueries(ctx.DB).Delete(group.ID); err != nil {
+		ctx.Logger.Error("failed to delete group", "err", err, "id", group.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to delete group")
+		return
+	}
+
+	utils.RecordAudit(ctx, "group.delete", "group", strconv.Itoa(group.ID), map[string]interface{}{"name": group.Name})
+
+	ctx.SetJSONStatus(http.StatusOK, "Group deleted successfully")
+}
+
+// HandleGroupMembersGET lists the members of a group. ?transitive=true includes members of nested groups.
+func HandleGroupMembersGET(ctx *middlewares.AppContext) {
+	group, ok := groupFromPath(ctx, "id")
+	if !ok {
+		return
+	}
+
+	transitive := ctx.Request.URL.Query().Get("transitive") == "true"
+	members, err := db.NewGroupQueries(ctx.DB).ListMembers(group.ID, transitive)
+	if err != nil {
+		ctx.Logger.Error("failed to list group members", "err", err, "id", group.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve group members")
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"members":    members,
+		"count":      len(members),
+		"transitive": transitive,
+	})
+}
+
+// HandleGroupMembersPOST adds a user to a group. The change is reflected in the user's next access token.
+func HandleGroupMembersPOST(ctx *middlewares.AppContext) {
+	group, ok := groupFromPath(ctx, "id")
+	if !ok {
+		return
+	}
+
+	var request struct {
+		UserID int `json:"user_id"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	user, err := db.NewUserQueries(ctx.DB).GetByID(request.UserID)
+	if err != nil || user.OrganizationID != ctx.Tenant.ID {
+		if err == nil || strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "User not found")
+			return
+		}
+		ctx.Logger.Error("failed to get user", "err", err, "id", request.UserID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to add group member")
+		return
+	}
+
+	if err := db.NewGroupQueries(ctx.DB).AddMember(group.ID, user.ID); err != nil {
+		ctx.Logger.Error("failed to add group member", "err", err, "id", group.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to add group member")
+		return
+	}
+
+	utils.RecordAudit(ctx, "group.member.add", "group", strconv.Itoa(group.ID), map[string]interface{}{"user_id": user.ID})
+
+	ctx.SetJSONStatus(http.StatusOK, "Member added")
+}
+
+// HandleGroupMemberDELETE removes a user from a group
+func HandleGroupMemberDELETE(ctx *middlewares.AppContext) {
+	group, ok := groupFromPath(ctx, "id")
+	if !ok {
+		return
+	}
+
+	userID, err := strconv.Atoi(ctx.Request.PathValue("user_id"))
+	if err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	if err := db.NewGroupQueries(ctx.DB).RemoveMember(group.ID, userID); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "Group member not found")
+			return
+		}
+		ctx.Logger.Error("failed to remove group member", "err", err, "id", group.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to remove group member")
+		return
+	}
+
+	utils.RecordAudit(ctx, "group.member.remove", "group", strconv.Itoa(group.ID), map[string]interface{}{"user_id": userID})
+
+	ctx.SetJSONStatus(http.StatusOK, "Member removed")
+}
+
+// HandleSubgroupsPOST nests a group inside the group in the path, making its members members of this group as well
+func HandleSubgroupsPOST(ctx *middlewares.AppContext) {
+	group, ok := groupFromPath(ctx, "id")
+	if !ok {
+		return
+	}
+
+	var request struct {
+		GroupID int `json:"group_id"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	groupQueries := db.NewGroupQueries(ctx.DB)
+	child, err := groupQueries.GetByID(request.GroupID)
+	if err != nil || child.OrganizationID != ctx.Tenant.ID {
+		if err == nil || strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "Subgroup not found")
+			return
+		}
+		ctx.Logger.Error("failed to get group", "err", err, "id", request.GroupID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to add subgroup")
+		return
+	}
+
+	if err := groupQueries.AddSubgroup(group.ID, child.ID); err != nil {
+		if strings.Contains(err.Error(), "cycle") {
+			ctx.SetJSONError(http.StatusConflict, "A group cannot be nested inside itself or one of its subgroups")
+			return
+		}
+		ctx.Logger.Error("failed to add subgroup", "err", err, "id", group.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to add subgroup")
+		return
+	}
+
+	utils.RecordAudit(ctx, "group.subgroup.add", "group", strconv.Itoa(group.ID), map[string]interface{}{"group_id": child.ID})
+
+	ctx.SetJSONStatus(http.StatusOK, "Subgroup added")
+}
+
+// HandleSubgroupDELETE removes a nested group from the group in the path
+func HandleSubgroupDELETE(ctx *middlewares.AppContext) {
+	group, ok := groupFromPath(ctx, "id")
+	if !ok {
+		return
+	}
+
+	childID, err := strconv.Atoi(ctx.Request.PathValue("group_id"))
+	if err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	if err := db.NewGroupQueries(ctx.DB).RemoveSubgroup(group.ID, childID); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "Subgroup not found")
+			return
+		}
+		ctx.Logger.Error("failed to remove subgroup", "err", err, "id", group.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to remove subgroup")
+		return
+	}
+
+	utils.RecordAudit(ctx, "group.subgroup.remove", "group", strconv.Itoa(group.ID), map[string]interface{}{"group_id": childID})
+
+	ctx.SetJSONStatus(http.StatusOK, "Subgroup removed")
+}
+
+// HandleUserGroupsGET lists the groups a user belongs to, directly and through nesting
+func HandleUserGroupsGET(ctx *middlewares.AppContext) {
+	user, ok := userFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	writeUserGroups(ctx, user.ID)
+}
+
+// HandleAccountGroupsGET lists the authenticated user's groups. Access tokens refer here when the user is in too
+// many groups to list in the token.
+func HandleAccountGroupsGET(ctx *middlewares.AppContext) {
+	user, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	writeUserGroups(ctx, user.ID)
+}
+
+func writeUserGroups(ctx *middlewares.AppContext, userID int) {
+	groupQueries := db.NewGroupQueries(ctx.DB)
+	direct, err := groupQueries.ListForUser(userID, false)
+	if err != nil {
+		ctx.Logger.Error("failed to list user groups", "err", err, "id", userID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve groups")
+		return
+	}
+
+	groups, err := groupQueries.ListNamesForUser(userID)
+	if err != nil {
+		ctx.Logger.Error("failed to list user groups", "err", err, "id", userID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve groups")
+		return
+	}
+
+	directNames := make([]string, len(direct))
+	for i, group := range direct {
+		directNames[i] = group.Name
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"user_id": userID,
+		"direct":  directNames,
+		"groups":  groups,
+	})
+}
+
+// groupFromPath loads the group named by a path variable, answering 404 for groups of other organizations
+func groupFromPath(ctx *middlewares.AppContext, name string) (*db.Group, bool) {
+	id, err := strconv.Atoi(ctx.Request.PathValue(name))
+	if err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid group ID")
+		return nil, false
+	}
+
+	group, err := db.NewGroupQueries(ctx.DB).GetByID(id)
+	if err != nil || group.OrganizationID != ctx.Tenant.ID {
+		if err == nil || strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "Group not found")
+			return nil, false
+		}
+		ctx.Logger.Error("failed to get group", "err", err, "id", id)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve group")
+		return nil, false
+	}
+
+	return group, true
+}
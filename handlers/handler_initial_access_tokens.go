@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"encoding/json"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultInitialAccessTokenLifetime = 7 * 24 * 60 * 60
+	maxInitialAccessTokenLifetime     = 90 * 24 * 60 * 60
+)
+
+// HandleInitialAccessTokensGET lists the organization's initial access tokens for dynamic client registration
+func HandleInitialAccessTokensGET(ctx *middlewares.AppContext) {
+	tokens, err := db.NewInitialAccessTokenQueries(ctx.DB).List(ctx.Tenant.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to list initial access tokens", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve initial access tokens")
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"tokens": tokens,
+		"count":  len(tokens),
+	})
+}
+
+// HandleInitialAccessTokensPOST issues an initial access token for dynamic client registration. Its scope bounds
+// the scope of the clients registered with it and may only hold scopes the caller's session holds, and the OpenID
+// Connect identity scopes. Its grant types, by default authorization_code and refresh_token, bound the grant types of
+// those clients. The token is only returned in this response.
+func HandleInitialAccessTokensPOST(ctx *middlewares.AppContext) {
+	creator, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Name       string   `json:"name"`
+		Scope      string   `json:"scope"`
+		GrantTypes []string `json:"grant_types"`
+		ExpiresIn  int      `json:"expires_in"`
+		MaxUses    *int     `json:"max_uses"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		ctx.SetJSONError(http.StatusBadRequest, "name is required")
+		return
+	}
+
+	scope := utils.ParseScope(request.Scope)
+	if len(scope) == 0 {
+		ctx.SetJSONError(http.StatusBadRequest, "scope is required")
+		return
+	}
+	if !utils.IsScopeSubset(scope, slices.Concat(middlewares.GetScopes(ctx), utils.IdentityScopes)) {
+		ctx.SetJSONError(http.StatusForbidden, "scope exceeds the scope of the current session")
+		return
+	}
+
+	grantTypes := request.GrantTypes
+	if len(grantTypes) == 0 {
+		grantTypes = defaultGrantTypes
+	}
+	for i, grantType := range grantTypes {
+		if !slices.Contains(supportedGrantTypes, grantType) {
+			ctx.SetJSONError(http.StatusBadRequest, "Unsupported grant type "+strconv.Quote(grantType)+", must be one of "+strings.Join(supportedGrantTypes, ", "))
+			return
+		}
+		if slices.Contains(grantTypes[:i], grantType) {
+			ctx.SetJSONError(http.StatusBadRequest, "Duplicate grant type "+strconv.Quote(grantType))
+			return
+		}
+	}
+
+	expiresIn := request.ExpiresIn
+	if expiresIn == 0 {
+		expiresIn = defaultInitialAccessTokenLifetime
+	}
+	if expiresIn < 0 || expiresIn > maxInitialAccessTokenLifetime {
+		ctx.SetJSONError(http.StatusBadRequest, "expires_in must be between 1 and "+strconv.Itoa(maxInitialAccessTokenLifetime)+" seconds")
+		return
+	}
+
+	if request.MaxUses != nil && *request.MaxUses < 1 {
+		ctx.SetJSONError(http.StatusBadRequest, "max_uses must be at least 1")
+		return
+	}
+
+	value, hash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	token, err := db.NewInitialAccessTokenQueries(ctx.DB).Create(&db.InitialAccessToken{
+		OrganizationID: ctx.Tenant.ID,
+		Name:           name,
+		TokenHash:      hash,
+		Scope:          scope,
+		GrantTypes:     grantTypes,
+		MaxUses:        request.MaxUses,
+		CreatedBy:      &creator.ID,
+	}, time.Duration(expiresIn)*time.Second)
+	if err != nil {
+		ctx.Logger.Error("failed to create initial access token", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to create initial access token")
+		return
+	}
+
+	utils.RecordAudit(ctx, "initial_access_token.create", "initial_access_token", strconv.Itoa(token.ID), map[string]interface{}{
+		"name":        token.Name,
+		"scope":       utils.FormatScope(token.Scope),
+		"grant_types": token.GrantTypes,
+	})
+
+	ctx.WriteJSON(http.StatusCreated, map[string]interface{}{
+		"id":          token.ID,
+		"name":        token.Name,
+		"token":       value,
+		"scope":       utils.FormatScope(token.Scope),
+		"grant_types": token.GrantTypes,
+		"max_uses":    token.MaxUses,
+		"expires_at":  token.ExpiresAt,
+		"created_at":  token.CreatedAt,
+	})
+}
+
+// HandleInitialAccessTokenDELETE revokes an initial access token. Clients already registered with it are kept.
+func HandleInitialAccessTokenDELETE(ctx *middlewares.AppContext) {
+	id, err := strconv.Atoi(ctx.Request.PathValue("id"))
+	if err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid token ID")
+		return
+	}
+
+	if err := db.NewInitialAccessTokenQueries(ctx.DB).Delete(ctx.Tenant.ID, id); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "Initial access token not found")
+			return
+		}
+		ctx.Logger.Error("failed to delete initial access token", "err", err, "id", id)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to revoke initial access token")
+		return
+	}
+
+	utils.RecordAudit(ctx, "initial_access_token.delete", "initial_access_token", strconv.Itoa(id), nil)
+
+	ctx.SetJSONStatus(http.StatusOK, "Initial access token revoked")
+}
@@ -5,105 +5,59 @@ import (
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/rsa"
-	"crypto/x509"
-	"encoding/base64"
-	"encoding/pem"
-	"log/slog"
+	"fmt"
 
-	"jwt-auth-poc/crypt_utils"
 	"jwt-auth-poc/middlewares"
 	"net/http"
-	"os"
 
 	"github.com/go-jose/go-jose/v4"
 )
 
-// HandleJWKSPublicKeyGET returns the JWKS with the JWT public key
+// HandleJWKSPublicKeyGET returns the JWKS with the public key of the request's organization
 func HandleJWKSPublicKeyGET(ctx *middlewares.AppContext) {
-	bytes, err := os.ReadFile(crypt_utils.GetJWTPublicKeyPath())
+	pubKey := ctx.JWTProvider.PublicKey()
+
+	alg, err := signingAlgorithm(pubKey)
 	if err != nil {
-		ctx.Logger.Error("failed to read crypt_utils public key", "err", err)
+		ctx.Logger.Error("failed to determine signing algorithm", "err", err)
 		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
 		return
 	}
 
-	block, _ := pem.Decode(bytes)
-	if block == nil {
-		ctx.Logger.Error("failed to decode crypt_utils public key")
-		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
-		return
+	jwk := jose.JSONWebKey{
+		Key:       pubKey,
+		KeyID:     ctx.JWTProvider.KeyID(),
+		Algorithm: alg,
+		Use:       "sig",
 	}
 
-	switch block.Type {
-	case "PRIVATE KEY", "EC PRIVATE KEY", "RSA PRIVATE KEY":
-		ctx.Logger.Error("decoded private key, canceling request")
-		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
-		return
-	case "PUBLIC KEY":
-	default:
-		ctx.Logger.Error("unknown crypt_utils public key type", "type", block.Type)
-		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
-		return
+	jwks := jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{jwk},
 	}
 
-	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
-	if err != nil {
-		ctx.Logger.Error("failed to parse crypt_utils public key", "err", err)
-		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
-		return
-	}
+	ctx.Response.Header().Set("Cache-Control", "public, max-age=3600")
+	ctx.WriteJSON(http.StatusOK, jwks)
+}
 
-	var alg string
+// signingAlgorithm returns the JWS algorithm tokens verified with the given public key are signed with
+func signingAlgorithm(pubKey crypto.PublicKey) (string, error) {
 	switch key := pubKey.(type) {
 	case *rsa.PublicKey:
-		alg = string(jose.RS256)
+		return string(jose.RS256), nil
 	case *ecdsa.PublicKey:
 		switch key.Params().BitSize {
 		case 256:
-			alg = string(jose.ES256)
+			return string(jose.ES256), nil
 		case 384:
-			alg = string(jose.ES384)
+			return string(jose.ES384), nil
 		case 521:
-			alg = string(jose.ES512)
+			return string(jose.ES512), nil
 		default:
-			ctx.Logger.Error("unsupported EC curve size", "bits", key.Params().BitSize)
-			ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
-			return
+			return "", fmt.Errorf("unsupported EC curve size %d", key.Params().BitSize)
 		}
 	case ed25519.PublicKey:
-		alg = string(jose.EdDSA)
+		return string(jose.EdDSA), nil
 	default:
-		ctx.Logger.Error("unsupported public key type")
-		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
-		return
+		return "", fmt.Errorf("unsupported public key type %T", pubKey)
 	}
-
-	keyID := generateKeyID(ctx.Logger, pubKey)
-
-	jwk := jose.JSONWebKey{
-		Key:       pubKey,
-		KeyID:     keyID,
-		Algorithm: alg,
-		Use:       "sig",
-	}
-
-	jwks := jose.JSONWebKeySet{
-		Keys: []jose.JSONWebKey{jwk},
-	}
-
-	ctx.Response.Header().Set("Cache-Control", "public, max-age=3600")
-	ctx.WriteJSON(http.StatusOK, jwks)
-}
-
-// generateKeyID creates a unique identifier for the key
-func generateKeyID(logger *slog.Logger, key interface{}) string {
-	jwk := jose.JSONWebKey{Key: key}
-	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
-
-	if err != nil {
-		logger.Warn("failed to generate key thumbprint, using default", "err", err)
-		return "default"
-	}
-
-	return base64.RawURLEncoding.EncodeToString(thumbprint)
 }
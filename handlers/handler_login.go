@@ -2,12 +2,14 @@ package handlers
 
 import (
 	"encoding/json"
+	"jwt-auth-poc/crypt_utils"
 	"jwt-auth-poc/db"
 	"jwt-auth-poc/middlewares"
 	"jwt-auth-poc/utils"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-crypt/crypt"
 )
@@ -16,6 +18,7 @@ func HandleUserLoginPost(ctx *middlewares.AppContext) {
 	var request struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Scope    string `json:"scope"`
 	}
 
 	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
@@ -28,50 +31,323 @@ func HandleUserLoginPost(ctx *middlewares.AppContext) {
 		return
 	}
 
+	userDetails, grantErr := checkPasswordLogin(ctx, strings.TrimSpace(request.Email), strings.TrimSpace(request.Password))
+	if grantErr != nil {
+		grantErr.write(ctx)
+		return
+	}
+
+	completeFirstFactor(ctx, userDetails, []string{"pwd"}, utils.ParseScope(request.Scope))
+}
+
+// grantError is a failed sign-in or token request. The JSON login endpoints answer with Status and Message, the
+// OAuth token endpoint with Code (RFC 6749 §5.2).
+type grantError struct {
+	Status     int
+	Code       string
+	Message    string
+	RetryAfter time.Duration // set when the request was throttled
+}
+
+// errGrantInternal reports an unexpected failure, which has already been logged
+var errGrantInternal = &grantError{Status: http.StatusInternalServerError, Code: "server_error", Message: "Internal server error"}
+
+// write answers with the error in the JSON shape of the login endpoints
+func (e *grantError) write(ctx *middlewares.AppContext) {
+	if e.RetryAfter > 0 {
+		ctx.SetTooManyRequests(e.RetryAfter, e.Message)
+		return
+	}
+	ctx.SetJSONError(e.Status, e.Message)
+}
+
+// checkPasswordLogin verifies an email and password for the request's organization, applying the login throttle
+func checkPasswordLogin(ctx *middlewares.AppContext, email, password string) (*db.User, *grantError) {
+	retryAfter, err := utils.LoginRetryAfter(ctx, email)
+	if err != nil {
+		ctx.Logger.Error("failed to check login throttle", "err", err)
+		return nil, errGrantInternal
+	}
+	if retryAfter > 0 {
+		return nil, &grantError{
+			Status:     http.StatusTooManyRequests,
+			Code:       "invalid_grant",
+			Message:    "Too many failed login attempts, try again later",
+			RetryAfter: retryAfter,
+		}
+	}
+
 	userQueries := db.NewUserQueries(ctx.DB)
-	userDetails, err := userQueries.GetUserDetailsByEmail(strings.TrimSpace(request.Email))
+	userDetails, err := userQueries.GetUserDetailsByEmail(ctx.Tenant.ID, email)
+	if err != nil && !strings.Contains(err.Error(), "not found") {
+		ctx.Logger.Error("failed to get user details", "err", err)
+		return nil, errGrantInternal
+	}
+
+	// Unknown accounts are checked against a dummy hash so the response time does not reveal which emails exist.
+	passwordHash := crypt_utils.DummyPasswordHash()
+	if userDetails != nil {
+		passwordHash = userDetails.PasswordHash
+	}
+
+	if valid, checkErr := crypt.CheckPassword(password, passwordHash); userDetails == nil || checkErr != nil || !valid {
+		ctx.Logger.Debug("Failed login attempt", "ip", ctx.ClientIP())
+		if err := utils.RecordLoginFailure(ctx, email); err != nil {
+			ctx.Logger.Error("failed to record login failure", "err", err)
+		}
+		return nil, &grantError{Status: http.StatusUnauthorized, Code: "invalid_grant", Message: "Invalid email or password"}
+	}
+
+	// The failures of a user with a second factor are only cleared once that factor is verified as well, otherwise
+	// anyone knowing the password could reset the throttle between guesses at the code.
+	methods, err := secondFactorMethods(ctx, userDetails.ID)
 	if err != nil {
-		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		ctx.Logger.Error("failed to check mfa status", "err", err)
+		return nil, errGrantInternal
+	}
+	if len(methods) == 0 {
+		if err := utils.ResetLoginFailures(ctx, email); err != nil {
+			ctx.Logger.Error("failed to reset login failures", "err", err)
+		}
+	}
+
+	return userDetails, nil
+}
+
+// completeFirstFactor finishes a login whose first factor has been verified. Users with a second factor
+// receive a short-lived MFA challenge token instead of access and refresh tokens.
+func completeFirstFactor(ctx *middlewares.AppContext, userDetails *db.User, amr, requestedScope []string) {
+	if !belongsToTenant(ctx, userDetails) || !isActiveAccount(ctx, userDetails) {
 		return
 	}
 
-	if valid, err := crypt.CheckPassword(strings.TrimSpace(request.Password), userDetails.PasswordHash); err != nil || !valid {
-		ctx.Logger.Debug("Failed login attempt", "email", userDetails.Email, "err", err)
-		ctx.SetJSONError(http.StatusUnauthorized, "Invalid email or password")
+	scope, ok := narrowLoginScope(ctx, userDetails.ID, requestedScope)
+	if !ok {
 		return
 	}
 
-	token, hash, err := utils.GenerateRefreshToken()
+	methods, err := secondFactorMethods(ctx, userDetails.ID)
 	if err != nil {
+		ctx.Logger.Error("failed to check mfa status", "err", err)
 		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
 		return
 	}
 
-	refreshTokenQueries := db.NewRefreshTokenQueries(ctx.DB)
-	newRefreshToken, err := refreshTokenQueries.Create(strconv.Itoa(userDetails.ID), hash)
+	if len(methods) == 0 {
+		writeLoginTokens(ctx, userDetails, amr, scope)
+		return
+	}
+
+	token, hash, err := utils.GenerateOpaqueToken()
 	if err != nil {
-		ctx.Logger.Error("failed to save new refresh token", "err", err)
 		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
 		return
 	}
 
-	newAccessToken, err := utils.GenerateAccessToken(ctx, userDetails)
+	challengeQueries := db.NewMFAChallengeQueries(ctx.DB)
+	challenge, err := challengeQueries.Create(userDetails.ID, hash, amr, scope, crypt_utils.ConstMFAChallengeValidityPeriod)
 	if err != nil {
-		ctx.Logger.Error("failed to generate access token", "err", err)
+		ctx.Logger.Error("failed to save mfa challenge", "err", err)
 		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
 		return
 	}
 
+	type Response struct {
+		MFARequired    bool     `json:"mfa_required"`
+		MFAToken       string   `json:"mfa_token"`
+		MFATokenExpiry int64    `json:"mfa_token_expiry"`
+		Methods        []string `json:"methods"`
+	}
+	var response = Response{
+		MFARequired:    true,
+		MFAToken:       token,
+		MFATokenExpiry: challenge.ExpiresAt.Unix(),
+		Methods:        methods,
+	}
+
+	ctx.WriteJSON(http.StatusOK, response)
+}
+
+// secondFactorMethods lists the second factors a user has set up
+func secondFactorMethods(ctx *middlewares.AppContext, userID int) ([]string, error) {
+	var methods []string
+
+	totpEnabled, err := db.NewTOTPQueries(ctx.DB).IsEnabled(userID)
+	if err != nil {
+		return nil, err
+	}
+	if totpEnabled {
+		methods = append(methods, "totp", "recovery_code")
+	}
+
+	webAuthnCount, err := db.NewWebAuthnCredentialQueries(ctx.DB).CountByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if webAuthnCount > 0 {
+		methods = append(methods, "webauthn")
+	}
+
+	return methods, nil
+}
+
+// belongsToTenant rejects logins for users of another organization, e.g. a passkey or magic link
+// registered with one organization presented to another
+func belongsToTenant(ctx *middlewares.AppContext, user *db.User) bool {
+	if user.OrganizationID != ctx.Tenant.ID {
+		ctx.Logger.Debug("Login for user of another organization", "user_id", user.ID, "organization_id", ctx.Tenant.ID)
+		ctx.SetJSONError(http.StatusUnauthorized, "Invalid credentials")
+		return false
+	}
+	return true
+}
+
+// isActiveAccount refuses logins to suspended, deactivated, pending and deleted accounts. It runs after the
+// credentials have been verified, so the status is only revealed to someone who could otherwise sign in.
+func isActiveAccount(ctx *middlewares.AppContext, user *db.User) bool {
+	if grantErr := accountStatusError(ctx, user); grantErr != nil {
+		grantErr.write(ctx)
+		return false
+	}
+	return true
+}
+
+// accountStatusError explains why an account may not sign in, or returns nil for active accounts
+func accountStatusError(ctx *middlewares.AppContext, user *db.User) *grantError {
+	if user.IsActive() {
+		return nil
+	}
+
+	ctx.Logger.Debug("Login for inactive account", "user_id", user.ID, "status", user.Status)
+	if user.DeletedAt != nil {
+		return &grantError{Status: http.StatusUnauthorized, Code: "invalid_grant", Message: "Invalid credentials"}
+	}
+
+	switch user.Status {
+	case db.UserStatusSuspended:
+		return &grantError{Status: http.StatusForbidden, Code: "invalid_grant", Message: "Account is suspended"}
+	case db.UserStatusPending:
+		return &grantError{Status: http.StatusForbidden, Code: "invalid_grant", Message: "Account is pending activation"}
+	default:
+		return &grantError{Status: http.StatusForbidden, Code: "invalid_grant", Message: "Account is deactivated"}
+	}
+}
+
+// narrowLoginScope reduces the scope requested at login to what the user is allowed, answering the request itself
+// when that fails
+func narrowLoginScope(ctx *middlewares.AppContext, userID int, requested []string) ([]string, bool) {
+	scope, grantErr := resolveLoginScope(ctx, userID, requested)
+	if grantErr != nil {
+		grantErr.write(ctx)
+		return nil, false
+	}
+	return scope, true
+}
+
+// resolveLoginScope reduces the scope requested at login to what the user is allowed. Requested scopes the user
+// does not hold are dropped; a request left with nothing is rejected. An empty request means no restriction.
+func resolveLoginScope(ctx *middlewares.AppContext, userID int, requested []string) ([]string, *grantError) {
+	if len(requested) == 0 {
+		return nil, nil
+	}
+
+	allowed, err := utils.AllowedScopes(ctx, userID)
+	if err != nil {
+		ctx.Logger.Error("failed to load allowed scopes", "err", err)
+		return nil, errGrantInternal
+	}
+
+	scope := utils.IntersectScope(requested, allowed)
+	if len(scope) == 0 {
+		return nil, &grantError{Status: http.StatusBadRequest, Code: "invalid_scope", Message: "None of the requested scopes are allowed"}
+	}
+
+	return scope, nil
+}
+
+// writeLoginTokens issues a refresh and access token pair for a fully authenticated user
+func writeLoginTokens(ctx *middlewares.AppContext, userDetails *db.User, amr, scope []string) {
+	if !belongsToTenant(ctx, userDetails) || !isActiveAccount(ctx, userDetails) {
+		return
+	}
+
+	session, grantErr := issueSession(ctx, userDetails, amr, scope, nil)
+	if grantErr != nil {
+		grantErr.write(ctx)
+		return
+	}
+
 	type Response struct {
 		RefreshToken       string `json:"refresh_token"`
 		RefreshTokenExpiry int64  `json:"refresh_token_expiry"`
 		AccessToken        string `json:"access_token"`
+		Scope              string `json:"scope"`
 	}
 	var response = Response{
-		RefreshToken:       token,
-		RefreshTokenExpiry: newRefreshToken.ExpiresAt.Unix(),
-		AccessToken:        newAccessToken,
+		RefreshToken:       session.RefreshToken,
+		RefreshTokenExpiry: session.RefreshTokenExpiry.Unix(),
+		AccessToken:        session.AccessToken,
+		Scope:              utils.FormatScope(session.Scope),
 	}
 
 	ctx.WriteJSON(http.StatusOK, response)
 }
+
+// loginSession is the token pair issued when a sign-in completes
+type loginSession struct {
+	AccessToken        string
+	RefreshToken       string // empty when the client is not registered for the refresh_token grant
+	RefreshTokenExpiry time.Time
+	RefreshTokenID     int      // zero when no refresh token was issued
+	Scope              []string // granted scope of the access token
+}
+
+// issueSession creates a refresh and access token pair for a fully authenticated user. The scope is recorded on the
+// refresh token and bounds every access token issued from it. A non-nil client binds the refresh token to that OAuth
+// client; clients not registered for the refresh_token grant only get an access token. When the request carried a DPoP
+// proof, the refresh token of a public client or first-party session is bound to the proof's key (RFC 9449 §5), as
+// these have no client secret to protect it.
+func issueSession(ctx *middlewares.AppContext, userDetails *db.User, amr, scope []string, client *db.OAuthClient) (*loginSession, *grantError) {
+	granted, err := utils.GrantedScope(ctx, userDetails.ID, scope)
+	if err != nil {
+		ctx.Logger.Error("failed to resolve scope", "err", err)
+		return nil, errGrantInternal
+	}
+
+	clientID := ""
+	if client != nil {
+		clientID = client.ClientID
+	}
+
+	session := &loginSession{Scope: granted}
+	if client == nil || client.AllowsGrantType("refresh_token") {
+		token, hash, err := utils.GenerateRefreshToken()
+		if err != nil {
+			return nil, errGrantInternal
+		}
+
+		dpopJKT := ""
+		if proof := middlewares.GetDPoPProof(ctx); proof != nil && (client == nil || client.IsPublic()) {
+			dpopJKT = proof.Thumbprint
+		}
+
+		refreshTokenQueries := db.NewRefreshTokenQueries(ctx.DB)
+		newRefreshToken, err := refreshTokenQueries.CreateForClient(clientID, dpopJKT, strconv.Itoa(userDetails.ID), hash, amr, scope)
+		if err != nil {
+			ctx.Logger.Error("failed to save new refresh token", "err", err)
+			return nil, errGrantInternal
+		}
+
+		session.RefreshToken = token
+		session.RefreshTokenExpiry = newRefreshToken.ExpiresAt
+		session.RefreshTokenID = newRefreshToken.Id
+	}
+
+	session.AccessToken, err = utils.GenerateAccessToken(ctx, userDetails, utils.AccessTokenOptions{AMR: amr, Scope: granted, ClientID: clientID})
+	if err != nil {
+		ctx.Logger.Error("failed to generate access token", "err", err)
+		return nil, errGrantInternal
+	}
+
+	return session, nil
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/mailer"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	magicLinkBindingCookie = "magic_link_binding"
+	magicLinkResendWindow  = time.Minute
+)
+
+// HandleMagicLinkPOST emails a single-use sign-in link to users that have passwordless login enabled.
+// The response is the same whether or not a link was sent, so it cannot be used to discover accounts.
+func HandleMagicLinkPOST(ctx *middlewares.AppContext) {
+	var request struct {
+		Email       string `json:"email"`
+		BindBrowser bool   `json:"bind_browser"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	email := strings.TrimSpace(request.Email)
+	if email == "" {
+		ctx.SetJSONError(http.StatusBadRequest, "Email is required")
+		return
+	}
+
+	respond := func() {
+		ctx.SetJSONStatus(http.StatusAccepted, "If the account exists and allows email sign-in, a link has been sent")
+	}
+
+	// The binding cookie is set whether or not a link is sent, so its presence does not reveal the account either.
+	var bindingHash string
+	if request.BindBrowser {
+		var err error
+		if bindingHash, err = setMagicLinkBinding(ctx); err != nil {
+			ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+			return
+		}
+	}
+
+	userQueries := db.NewUserQueries(ctx.DB)
+	user, err := userQueries.GetUserDetailsByEmail(ctx.Tenant.ID, email)
+	if err != nil {
+		if !strings.Contains(err.Error(), "not found") {
+			ctx.Logger.Error("failed to get user details", "err", err)
+		}
+		respond()
+		return
+	}
+
+	if !user.MagicLinkEnabled || !user.IsActive() {
+		respond()
+		return
+	}
+
+	linkQueries := db.NewMagicLinkQueries(ctx.DB)
+	recent, err := linkQueries.CountRecentByUserID(user.ID, magicLinkResendWindow)
+	if err != nil {
+		ctx.Logger.Error("failed to count magic links", "err", err)
+		respond()
+		return
+	}
+	if recent > 0 {
+		ctx.Logger.Debug("Magic link recently sent, skipping", "user_id", user.ID)
+		respond()
+		return
+	}
+
+	token, hash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	validity := ctx.Config.MagicLink.Validity
+	if err := linkQueries.Create(user.ID, hash, bindingHash, validity); err != nil {
+		ctx.Logger.Error("failed to save magic link", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	link, err := url.Parse(ctx.Config.MagicLink.URL)
+	if err != nil {
+		ctx.Logger.Error("invalid magic link url", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	query := link.Query()
+	query.Set("token", token)
+	if ctx.Tenant.ID != db.DefaultOrganizationID {
+		query.Set("organization", ctx.Tenant.Slug)
+	}
+	link.RawQuery = query.Encode()
+
+	message := mailer.Message{
+		To:      user.Email,
+		Subject: "Your sign-in link",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the link below to sign in. It expires in %d minutes and can only be used once.\n\n%s\n\nIf you did not request this, you can ignore this email.\n",
+			user.Name, int(validity.Minutes()), link.String()),
+	}
+	// Sent in the background so response timing does not reveal whether a link was issued.
+	go func(sendCtx context.Context, userID int) {
+		if err := ctx.Mailer.Send(sendCtx, message); err != nil {
+			ctx.Logger.Error("failed to send magic link", "user_id", userID, "err", err)
+		}
+	}(context.WithoutCancel(ctx), user.ID)
+
+	respond()
+}
+
+// setMagicLinkBinding sets the cookie binding a magic link to the browser that requested it and returns the hash of
+// its value. A binding the browser already holds is kept, so asking again does not invalidate a link sent moments ago.
+func setMagicLinkBinding(ctx *middlewares.AppContext) (string, error) {
+	binding := ""
+	if cookie, err := ctx.Request.Cookie(magicLinkBindingCookie); err == nil {
+		// Only a value shaped like one we issued, so a planted cookie cannot choose a guessable binding
+		if raw, err := hex.DecodeString(cookie.Value); err == nil && len(raw) == 64 {
+			binding = cookie.Value
+		}
+	}
+	if binding == "" {
+		var err error
+		if binding, _, err = utils.GenerateOpaqueToken(); err != nil {
+			return "", err
+		}
+	}
+
+	http.SetCookie(ctx.Response, &http.Cookie{
+		Name:     magicLinkBindingCookie,
+		Value:    binding,
+		Path:     ctx.TenantPath + "/api/login/magic",
+		MaxAge:   int(ctx.Config.MagicLink.Validity.Seconds()),
+		HttpOnly: true,
+		Secure:   ctx.Request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return utils.HashToken(binding), nil
+}
+
+// HandleMagicLinkVerifyPOST exchanges a magic link token for access and refresh tokens
+func HandleMagicLinkVerifyPOST(ctx *middlewares.AppContext) {
+	var request struct {
+		Token string `json:"token"`
+		Scope string `json:"scope"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	if strings.TrimSpace(request.Token) == "" {
+		ctx.SetJSONError(http.StatusBadRequest, "token is required")
+		return
+	}
+
+	linkQueries := db.NewMagicLinkQueries(ctx.DB)
+	link, err := linkQueries.GetValidByHash(utils.HashToken(strings.TrimSpace(request.Token)))
+	if err != nil {
+		ctx.Logger.Debug("Invalid magic link", "err", err)
+		ctx.SetJSONError(http.StatusUnauthorized, "Invalid or expired link")
+		return
+	}
+
+	if link.BindingHash != "" {
+		cookie, err := ctx.Request.Cookie(magicLinkBindingCookie)
+		if err != nil || subtle.ConstantTimeCompare([]byte(utils.HashToken(cookie.Value)), []byte(link.BindingHash)) != 1 {
+			ctx.Logger.Debug("Magic link opened in a different browser", "user_id", link.UserID)
+			ctx.SetJSONError(http.StatusUnauthorized, "This link must be opened in the browser that requested it")
+			return
+		}
+	}
+
+	if err := linkQueries.MarkUsed(link.ID); err != nil {
+		ctx.SetJSONError(http.StatusUnauthorized, "Invalid or expired link")
+		return
+	}
+
+	if link.BindingHash != "" {
+		http.SetCookie(ctx.Response, &http.Cookie{
+			Name:     magicLinkBindingCookie,
+			Value:    "",
+			Path:     ctx.TenantPath + "/api/login/magic",
+			MaxAge:   -1,
+			HttpOnly: true,
+		})
+	}
+
+	userQueries := db.NewUserQueries(ctx.DB)
+	user, err := userQueries.GetByID(link.UserID)
+	if err != nil {
+		ctx.Logger.Error("Failed to get user", "user_id", link.UserID, "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	// The setting may have been switched off after the link was sent.
+	if !user.MagicLinkEnabled {
+		ctx.SetJSONError(http.StatusUnauthorized, "Invalid or expired link")
+		return
+	}
+
+	completeFirstFactor(ctx, user, []string{"email"}, utils.ParseScope(request.Scope))
+}
+
+// HandleMagicLinkSettingsPUT enables or disables passwordless email login for the authenticated user
+func HandleMagicLinkSettingsPUT(ctx *middlewares.AppContext) {
+	user, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Enabled *bool `json:"enabled"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	if request.Enabled == nil {
+		ctx.SetJSONError(http.StatusBadRequest, "enabled is required")
+		return
+	}
+
+	if err := db.NewUserQueries(ctx.DB).SetMagicLinkEnabled(user.ID, *request.Enabled); err != nil {
+		ctx.Logger.Error("failed to update magic link setting", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]bool{
+		"magic_link_enabled": *request.Enabled,
+	})
+}
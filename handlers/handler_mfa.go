@@ -0,0 +1,437 @@
+package handlers
+
+import (
+	"encoding/json"
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HandleMFAVerifyPOST exchanges an MFA challenge token and a TOTP or recovery code for access and refresh tokens
+func HandleMFAVerifyPOST(ctx *middlewares.AppContext) {
+	var request struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	if strings.TrimSpace(request.MFAToken) == "" || (strings.TrimSpace(request.Code) == "" && strings.TrimSpace(request.RecoveryCode) == "") {
+		ctx.SetJSONError(http.StatusBadRequest, "mfa_token and code or recovery_code are required")
+		return
+	}
+
+	challengeQueries := db.NewMFAChallengeQueries(ctx.DB)
+	challenge, err := challengeQueries.GetValidByHash(utils.HashToken(strings.TrimSpace(request.MFAToken)))
+	if err != nil {
+		ctx.Logger.Debug("Invalid mfa challenge", "err", err)
+		ctx.SetJSONError(http.StatusUnauthorized, "Invalid or expired MFA token")
+		return
+	}
+
+	redeemed, err := redeemMFAChallenge(ctx, challenge, request.Code, request.RecoveryCode)
+	if err != nil {
+		ctx.Logger.Error("failed to verify second factor", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	switch redeemed {
+	case mfaChallengeInvalidCode:
+		ctx.SetJSONError(http.StatusUnauthorized, "Invalid code")
+		return
+	case mfaChallengeGone:
+		ctx.SetJSONError(http.StatusUnauthorized, "Invalid or expired MFA token")
+		return
+	}
+
+	userQueries := db.NewUserQueries(ctx.DB)
+	user, err := userQueries.GetByID(challenge.UserID)
+	if err != nil {
+		ctx.Logger.Error("Failed to get user", "user_id", challenge.UserID, "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	writeLoginTokens(ctx, user, secondFactorAMR(challenge, request.Code), challenge.Scope)
+}
+
+// HandleTOTPEnrollPOST generates a new pending TOTP secret for the authenticated user
+func HandleTOTPEnrollPOST(ctx *middlewares.AppContext) {
+	user, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	secret, err := crypt_utils.GenerateTOTPSecret()
+	if err != nil {
+		ctx.Logger.Error("failed to generate totp secret", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	totpQueries := db.NewTOTPQueries(ctx.DB)
+	if err := totpQueries.CreatePending(user.ID, secret); err != nil {
+		if strings.Contains(err.Error(), "already enabled") {
+			ctx.SetJSONError(http.StatusConflict, "TOTP is already enabled")
+			return
+		}
+		ctx.Logger.Error("failed to save totp secret", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	type Response struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+		QRCodeURL  string `json:"qr_code_url"`
+	}
+
+	ctx.WriteJSON(http.StatusOK, Response{
+		Secret:     secret,
+		OTPAuthURI: crypt_utils.TOTPURI(user.Email, secret),
+		QRCodeURL:  "/api/account/totp/qr.png",
+	})
+}
+
+// HandleTOTPQRCodeGET renders the pending TOTP secret of the authenticated user as a QR code PNG
+func HandleTOTPQRCodeGET(ctx *middlewares.AppContext) {
+	user, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	credential, err := db.NewTOTPQueries(ctx.DB).GetByUserID(user.ID)
+	if err != nil || credential.Enabled {
+		ctx.SetJSONError(http.StatusNotFound, "No pending TOTP enrollment")
+		return
+	}
+
+	png, err := crypt_utils.TOTPQRCodePNG(crypt_utils.TOTPURI(user.Email, credential.Secret))
+	if err != nil {
+		ctx.Logger.Error("failed to render totp qr code", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	ctx.Response.Header().Set("Cache-Control", "no-store")
+	ctx.WriteBytes(http.StatusOK, "image/png", png)
+}
+
+// HandleTOTPConfirmPOST enables a pending TOTP secret once the user proves they can generate codes, and
+// returns a fresh set of recovery codes
+func HandleTOTPConfirmPOST(ctx *middlewares.AppContext) {
+	user, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Code string `json:"code"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	totpQueries := db.NewTOTPQueries(ctx.DB)
+	credential, err := totpQueries.GetByUserID(user.ID)
+	if err != nil || credential.Enabled {
+		ctx.SetJSONError(http.StatusNotFound, "No pending TOTP enrollment")
+		return
+	}
+
+	step, valid := crypt_utils.ValidateTOTP(credential.Secret, request.Code, time.Now(), credential.LastUsedStep)
+	if !valid {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid code")
+		return
+	}
+
+	if err := totpQueries.Confirm(user.ID, step); err != nil {
+		ctx.Logger.Error("failed to confirm totp", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	codes, ok := replaceRecoveryCodes(ctx, user.ID)
+	if !ok {
+		return
+	}
+
+	ctx.Logger.Info("TOTP enabled", "user_id", user.ID)
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"status":         "TOTP enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// HandleTOTPDisablePOST removes the authenticated user's TOTP secret and recovery codes
+func HandleTOTPDisablePOST(ctx *middlewares.AppContext) {
+	user, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	valid, err := verifySecondFactor(ctx, user.ID, request.Code, request.RecoveryCode)
+	if err != nil {
+		ctx.Logger.Error("failed to verify second factor", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if !valid {
+		ctx.SetJSONError(http.StatusUnauthorized, "Invalid code")
+		return
+	}
+
+	if err := db.NewTOTPQueries(ctx.DB).Delete(user.ID); err != nil {
+		ctx.Logger.Error("failed to delete totp credential", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	if err := db.NewRecoveryCodeQueries(ctx.DB).DeleteByUserID(user.ID); err != nil {
+		ctx.Logger.Error("failed to delete recovery codes", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	ctx.Logger.Info("TOTP disabled", "user_id", user.ID)
+	ctx.SetJSONStatus(http.StatusOK, "TOTP disabled")
+}
+
+// HandleRecoveryCodesPOST replaces the authenticated user's recovery codes after verifying a TOTP code
+func HandleRecoveryCodesPOST(ctx *middlewares.AppContext) {
+	user, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Code string `json:"code"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	valid, err := verifySecondFactor(ctx, user.ID, request.Code, "")
+	if err != nil {
+		ctx.Logger.Error("failed to verify second factor", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if !valid {
+		ctx.SetJSONError(http.StatusUnauthorized, "Invalid code")
+		return
+	}
+
+	codes, ok := replaceRecoveryCodes(ctx, user.ID)
+	if !ok {
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
+
+// Outcomes of redeemMFAChallenge
+const (
+	mfaChallengeRedeemed    = iota
+	mfaChallengeInvalidCode // the code was wrong; the attempt has been counted
+	mfaChallengeGone        // a concurrent request redeemed the challenge first
+)
+
+// redeemMFAChallenge checks a TOTP or recovery code against a pending MFA challenge. A valid code consumes the
+// challenge; invalid codes count towards its attempt limit, after which the challenge is deleted. Invalid codes are
+// also login failures of the account, so opening new challenges with the password does not reset the throttle, and a
+// locked account's challenges are given up.
+func redeemMFAChallenge(ctx *middlewares.AppContext, challenge *db.MFAChallenge, code, recoveryCode string) (int, error) {
+	challengeQueries := db.NewMFAChallengeQueries(ctx.DB)
+
+	user, err := db.NewUserQueries(ctx.DB).GetByID(challenge.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	locked, err := mfaAccountLocked(ctx, challenge, user)
+	if err != nil || locked {
+		return mfaChallengeGone, err
+	}
+
+	valid, err := verifySecondFactor(ctx, challenge.UserID, code, recoveryCode)
+	if err != nil {
+		return 0, err
+	}
+
+	if !valid {
+		failMFAChallenge(ctx, challenge, user)
+		return mfaChallengeInvalidCode, nil
+	}
+
+	// Deleting the challenge is what makes it single use; a concurrent request that lost the race fails here.
+	if err := challengeQueries.DeleteByID(challenge.ID); err != nil {
+		return mfaChallengeGone, nil
+	}
+
+	if err := utils.ResetLoginFailures(ctx, user.Email); err != nil {
+		ctx.Logger.Error("failed to reset login failures", "err", err)
+	}
+
+	return mfaChallengeRedeemed, nil
+}
+
+// mfaAccountLocked reports whether the account of a challenge is locked out by the login throttle, deleting the
+// challenge if so. The user starts again at the password step, which reports the lockout.
+func mfaAccountLocked(ctx *middlewares.AppContext, challenge *db.MFAChallenge, user *db.User) (bool, error) {
+	retryAfter, err := utils.LoginRetryAfter(ctx, user.Email)
+	if err != nil {
+		return false, err
+	}
+	if retryAfter == 0 {
+		return false, nil
+	}
+
+	if err := db.NewMFAChallengeQueries(ctx.DB).DeleteByID(challenge.ID); err != nil {
+		ctx.Logger.Error("failed to delete mfa challenge", "err", err)
+	}
+	return true, nil
+}
+
+// failMFAChallenge counts a wrong second factor against the challenge and as a login failure of the account. The
+// challenge is deleted once its attempts are used up.
+func failMFAChallenge(ctx *middlewares.AppContext, challenge *db.MFAChallenge, user *db.User) {
+	if err := utils.RecordLoginFailure(ctx, user.Email); err != nil {
+		ctx.Logger.Error("failed to record login failure", "err", err)
+	}
+
+	challengeQueries := db.NewMFAChallengeQueries(ctx.DB)
+	attempts, err := challengeQueries.IncrementAttempts(challenge.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to record mfa attempt", "err", err)
+	}
+	if attempts >= crypt_utils.ConstMFAChallengeMaxAttempts {
+		ctx.Logger.Info("MFA challenge exhausted", "user_id", challenge.UserID)
+		if err := challengeQueries.DeleteByID(challenge.ID); err != nil {
+			ctx.Logger.Error("failed to delete mfa challenge", "err", err)
+		}
+	}
+}
+
+// secondFactorAMR returns the amr of a login completed with a TOTP code or, when code is empty, a recovery code. A
+// recovery code is not a one-time password, so it is recorded as "mfa" (RFC 8176 §2) rather than "otp".
+func secondFactorAMR(challenge *db.MFAChallenge, code string) []string {
+	if strings.TrimSpace(code) != "" {
+		return append(slices.Clone(challenge.AMR), "otp")
+	}
+	return append(slices.Clone(challenge.AMR), "mfa")
+}
+
+// verifySecondFactor checks a TOTP code, or failing that a recovery code, for a user with TOTP enabled.
+// Successful codes are consumed so they cannot be replayed.
+func verifySecondFactor(ctx *middlewares.AppContext, userID int, code, recoveryCode string) (bool, error) {
+	totpQueries := db.NewTOTPQueries(ctx.DB)
+	credential, err := totpQueries.GetByUserID(userID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return false, nil
+		}
+		return false, err
+	}
+	if !credential.Enabled {
+		return false, nil
+	}
+
+	if strings.TrimSpace(code) != "" {
+		step, valid := crypt_utils.ValidateTOTP(credential.Secret, code, time.Now(), credential.LastUsedStep)
+		if !valid {
+			return false, nil
+		}
+		if err := totpQueries.MarkStepUsed(userID, step); err != nil {
+			if strings.Contains(err.Error(), "already used") {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}
+
+	if strings.TrimSpace(recoveryCode) != "" {
+		err := db.NewRecoveryCodeQueries(ctx.DB).Consume(userID, utils.HashRecoveryCode(recoveryCode))
+		if err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				return false, nil
+			}
+			return false, err
+		}
+		ctx.Logger.Info("Recovery code used", "user_id", userID)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// replaceRecoveryCodes generates and stores a new set of recovery codes, writing an error response on failure
+func replaceRecoveryCodes(ctx *middlewares.AppContext, userID int) ([]string, bool) {
+	codes, hashes, err := utils.GenerateRecoveryCodes(crypt_utils.ConstRecoveryCodeCount)
+	if err != nil {
+		ctx.Logger.Error("failed to generate recovery codes", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return nil, false
+	}
+
+	if err := db.NewRecoveryCodeQueries(ctx.DB).Replace(userID, hashes); err != nil {
+		ctx.Logger.Error("failed to save recovery codes", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return nil, false
+	}
+
+	return codes, true
+}
+
+// getAuthenticatedUser loads the user behind the JWT validated by RequireJWT, writing an error response on failure
+func getAuthenticatedUser(ctx *middlewares.AppContext) (*db.User, bool) {
+	userIDStr := middlewares.GetUserID(ctx)
+	if userIDStr == "" {
+		ctx.SetJSONError(http.StatusUnauthorized, "User not authenticated")
+		return nil, false
+	}
+
+	userID, err := strconv.Atoi(userIDStr)
+	if err != nil {
+		ctx.Logger.Error("Invalid user ID from JWT", "user_id", userIDStr, "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return nil, false
+	}
+
+	user, err := db.NewUserQueries(ctx.DB).GetByID(userID)
+	if err != nil {
+		ctx.Logger.Error("Failed to get user", "user_id", userID, "err", err)
+		ctx.SetJSONError(http.StatusNotFound, "User not found")
+		return nil, false
+	}
+
+	return user, true
+}
@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// jwtBearerGrantType is the grant_type of the JWT bearer grant (RFC 7523 §2.1)
+const jwtBearerGrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+// hasClientAssertion reports whether the token request authenticates the client with a client assertion
+func hasClientAssertion(ctx *middlewares.AppContext) bool {
+	return ctx.Request.PostForm.Get("client_assertion") != "" || ctx.Request.PostForm.Get("client_assertion_type") != ""
+}
+
+// authenticateClientAssertion authenticates a private_key_jwt client by the assertion it signed with one of its
+// registered keys (RFC 7523 §2.2, §3). The assertion's iss and sub must both be the client_id, its aud the token
+// endpoint or the issuer, and each jti is accepted once.
+func authenticateClientAssertion(ctx *middlewares.AppContext) (*db.OAuthClient, bool) {
+	form := ctx.Request.PostForm
+	if _, _, basic := ctx.Request.BasicAuth(); basic || form.Get("client_secret") != "" {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_request", "Only one client authentication method may be used")
+		return nil, false
+	}
+	if form.Get("client_assertion_type") != crypt_utils.ClientAssertionType {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_request", "client_assertion_type must be "+crypt_utils.ClientAssertionType)
+		return nil, false
+	}
+
+	assertion, err := crypt_utils.ParseClientAssertion(form.Get("client_assertion"))
+	if err != nil {
+		ctx.Logger.Debug("Invalid client assertion", "err", err)
+		writeInvalidClient(ctx, false)
+		return nil, false
+	}
+
+	clientID := assertion.Claims.Issuer
+	if clientID == "" || assertion.Claims.Subject != clientID || (form.Get("client_id") != "" && form.Get("client_id") != clientID) {
+		ctx.Logger.Debug("Client assertion names another client", "iss", clientID, "sub", assertion.Claims.Subject)
+		writeInvalidClient(ctx, false)
+		return nil, false
+	}
+
+	client, err := db.NewOAuthClientQueries(ctx.DB).GetByClientID(clientID)
+	if err != nil || client.OrganizationID != ctx.Tenant.ID {
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			ctx.Logger.Error("failed to look up oauth client", "err", err)
+			writeOAuthError(ctx, http.StatusInternalServerError, "server_error", "Internal server error")
+			return nil, false
+		}
+		writeInvalidClient(ctx, false)
+		return nil, false
+	}
+
+	if client.TokenEndpointAuthMethod != db.AuthMethodPrivateKeyJWT || !verifyAssertion(ctx, client, assertion, db.ReplayPurposeClientAssertion) {
+		writeInvalidClient(ctx, false)
+		return nil, false
+	}
+
+	return client, true
+}
+
+// verifyAssertion checks an assertion against the client's registered keys and records its jti. Keys published at a
+// jwks_uri are fetched again once when the signature does not match, in case the client rotated them.
+func verifyAssertion(ctx *middlewares.AppContext, client *db.OAuthClient, assertion *crypt_utils.ClientAssertion, purpose string) bool {
+	// The endpoint the assertion was sent to is accepted as audience too, as some clients use the URL they post to.
+	audiences := []string{ctx.Issuer() + "/oauth/token", ctx.Issuer(), ctx.Issuer() + ctx.Request.URL.Path}
+
+	var verifyErr error
+	for _, refresh := range []bool{false, true} {
+		if refresh && client.JWKSURI == "" {
+			break
+		}
+		keys, err := utils.ClientKeys(ctx, client, refresh)
+		if err != nil {
+			ctx.Logger.Warn("failed to load client keys", "client_id", client.ClientID, "err", err)
+			return false
+		}
+		if verifyErr = assertion.Verify(keys, audiences); verifyErr == nil {
+			break
+		}
+	}
+	if verifyErr != nil {
+		ctx.Logger.Debug("Client assertion rejected", "client_id", client.ClientID, "err", verifyErr)
+		return false
+	}
+
+	key := utils.HashToken(client.ClientID + ":" + assertion.Claims.ID)
+	if err := db.NewReplayCacheQueries(ctx.DB).Record(purpose, key, assertion.Claims.Expiry.Time()); err != nil {
+		if !strings.Contains(err.Error(), "already used") {
+			ctx.Logger.Error("failed to record assertion", "err", err)
+		}
+		ctx.Logger.Debug("Client assertion replayed", "client_id", client.ClientID, "jti", assertion.Claims.ID)
+		return false
+	}
+
+	return true
+}
+
+// handleJWTBearerGrant issues an access token for an assertion a trusted service signed with its registered keys
+// (RFC 7523 §2.1). The issuer must be a client registered for the grant. An assertion whose subject is the client
+// itself gets a service token, as with client credentials. One whose subject is a user ID gets a token for that
+// user, but only for a user who approved the client: the scope is bounded by the client's registered scope and the
+// user's consent grant, so revoking the connected app stops the grant. No refresh token is issued; the service signs a
+// new assertion instead.
+func handleJWTBearerGrant(ctx *middlewares.AppContext) {
+	authenticated, ok := optionalClient(ctx)
+	if !ok {
+		return
+	}
+
+	invalidAssertion := func() {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "Invalid, expired or replayed assertion")
+	}
+
+	raw := ctx.Request.PostForm.Get("assertion")
+	if raw == "" {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_request", "assertion is required")
+		return
+	}
+	assertion, err := crypt_utils.ParseClientAssertion(raw)
+	if err != nil {
+		ctx.Logger.Debug("Invalid assertion", "err", err)
+		invalidAssertion()
+		return
+	}
+
+	client, err := db.NewOAuthClientQueries(ctx.DB).GetByClientID(assertion.Claims.Issuer)
+	if err != nil || client.OrganizationID != ctx.Tenant.ID {
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			ctx.Logger.Error("failed to look up oauth client", "err", err)
+			writeOAuthGrantError(ctx, errGrantInternal)
+			return
+		}
+		invalidAssertion()
+		return
+	}
+	if authenticated != nil && authenticated.ClientID != client.ClientID {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "The assertion was issued by another client")
+		return
+	}
+	if !checkClientGrantType(ctx, client, jwtBearerGrantType) {
+		return
+	}
+	if !verifyAssertion(ctx, client, assertion, db.ReplayPurposeJWTBearer) {
+		invalidAssertion()
+		return
+	}
+
+	scope := client.Scope
+	if requested := utils.ParseScope(ctx.Request.PostForm.Get("scope")); len(requested) > 0 {
+		if !utils.IsScopeSubset(requested, client.Scope) {
+			writeOAuthError(ctx, http.StatusBadRequest, "invalid_scope", "The requested scope exceeds the scope registered for the client")
+			return
+		}
+		scope = requested
+	}
+
+	if assertion.Claims.Subject == client.ClientID {
+		accessToken, scope, err := utils.GenerateServiceToken(ctx, client, scope)
+		if err != nil {
+			writeOAuthGrantError(ctx, serviceTokenError(ctx, client, err))
+			return
+		}
+
+		ctx.Logger.Info("Service token issued for assertion", "client_id", client.ClientID)
+		ctx.WriteJSON(http.StatusOK, tokenResponse{
+			AccessToken: accessToken,
+			TokenType:   tokenType(ctx),
+			ExpiresIn:   client.TokenLifetime,
+			Scope:       utils.FormatScope(scope),
+		})
+		return
+	}
+
+	user, scope, ok := assertionUser(ctx, client, assertion.Claims.Subject, scope)
+	if !ok {
+		return
+	}
+
+	expiresAt := time.Now().Add(client.TokenLifetimeDuration())
+	accessToken, err := utils.GenerateAccessToken(ctx, user, utils.AccessTokenOptions{Scope: scope, ClientID: client.ClientID, ExpiresAt: expiresAt})
+	if err != nil {
+		ctx.Logger.Error("failed to generate access token", "err", err)
+		writeOAuthGrantError(ctx, errGrantInternal)
+		return
+	}
+
+	ctx.Set("client_id", client.ClientID)
+	utils.RecordAudit(ctx, "token.jwt_bearer", "user", strconv.Itoa(user.ID), map[string]interface{}{
+		"client_id": client.ClientID,
+		"scope":     utils.FormatScope(scope),
+	})
+
+	ctx.WriteJSON(http.StatusOK, tokenResponse{
+		AccessToken: accessToken,
+		TokenType:   tokenType(ctx),
+		ExpiresIn:   client.TokenLifetime,
+		Scope:       utils.FormatScope(scope),
+	})
+}
+
+// assertionUser resolves the user an assertion names as its subject, narrowing the scope to what the user approved
+// for the client and still holds. It writes the error response when the grant is refused.
+func assertionUser(ctx *middlewares.AppContext, client *db.OAuthClient, subject string, scope []string) (*db.User, []string, bool) {
+	unknown := func() (*db.User, []string, bool) {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "Unknown subject")
+		return nil, nil, false
+	}
+
+	userID, err := strconv.Atoi(subject)
+	if err != nil {
+		return unknown()
+	}
+	user, err := db.NewUserQueries(ctx.DB).GetByID(userID)
+	if err != nil || user.OrganizationID != ctx.Tenant.ID {
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			ctx.Logger.Error("Failed to get user", "user_id", userID, "err", err)
+			writeOAuthGrantError(ctx, errGrantInternal)
+			return nil, nil, false
+		}
+		return unknown()
+	}
+	if grantErr := accountStatusError(ctx, user); grantErr != nil {
+		writeOAuthGrantError(ctx, grantErr)
+		return nil, nil, false
+	}
+
+	grant, err := db.NewConsentGrantQueries(ctx.DB).Get(user.ID, client.ClientID)
+	if err != nil {
+		if !strings.Contains(err.Error(), "not found") {
+			ctx.Logger.Error("failed to get consent grant", "err", err)
+			writeOAuthGrantError(ctx, errGrantInternal)
+			return nil, nil, false
+		}
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "The user has not approved the client")
+		return nil, nil, false
+	}
+	if !utils.IsScopeSubset(scope, grant.Scope) {
+		if ctx.Request.PostForm.Get("scope") != "" {
+			writeOAuthError(ctx, http.StatusBadRequest, "invalid_scope", "The requested scope exceeds the scope the user approved")
+			return nil, nil, false
+		}
+		scope = utils.IntersectScope(scope, grant.Scope)
+	}
+
+	allowed, err := utils.AllowedScopes(ctx, user.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to resolve scope", "err", err)
+		writeOAuthGrantError(ctx, errGrantInternal)
+		return nil, nil, false
+	}
+	granted := utils.IntersectScope(scope, allowed)
+	if len(granted) == 0 {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_scope", "The user holds none of the requested scope")
+		return nil, nil, false
+	}
+
+	return user, granted, true
+}
+
+// validateClientKeys checks the keys a client registers: jwks or jwks_uri, not both. A jwks must hold public keys
+// only, and a jwks_uri must be an https URL. private_key_jwt clients and clients of the JWT bearer grant must register
+// keys, and self_signed_tls_client_auth clients a jwks with their certificates.
+func validateClientKeys(client *db.OAuthClient) *clientMetadataError {
+	invalid := func(message string) *clientMetadataError {
+		return &clientMetadataError{Code: "invalid_client_metadata", Message: message}
+	}
+
+	if string(client.JWKS) == "null" {
+		client.JWKS = nil
+	}
+	if len(client.JWKS) > 0 && client.JWKSURI != "" {
+		return invalid("jwks and jwks_uri cannot both be set")
+	}
+
+	if client.JWKSURI != "" {
+		if err := validateWebURI(client.JWKSURI); err != nil {
+			return invalid("Invalid jwks_uri: " + err.Error())
+		}
+	}
+
+	var keys *jose.JSONWebKeySet
+	if len(client.JWKS) > 0 {
+		var err error
+		if keys, err = crypt_utils.ParseClientJWKS(client.JWKS); err != nil {
+			return invalid("Invalid jwks: " + err.Error())
+		}
+	}
+
+	hasKeys := keys != nil || client.JWKSURI != ""
+	switch {
+	case client.TokenEndpointAuthMethod == db.AuthMethodPrivateKeyJWT && !hasKeys:
+		return invalid("jwks or jwks_uri is required for private_key_jwt")
+	case client.AllowsGrantType(jwtBearerGrantType) && !hasKeys:
+		return invalid("jwks or jwks_uri is required for the " + jwtBearerGrantType + " grant")
+	case client.TokenEndpointAuthMethod == db.AuthMethodSelfSignedTLSClientAuth &&
+		(keys == nil || !slices.ContainsFunc(keys.Keys, func(key jose.JSONWebKey) bool { return len(key.Certificates) > 0 })):
+		return invalid("jwks with an x5c certificate is required for self_signed_tls_client_auth")
+	}
+
+	return nil
+}
@@ -0,0 +1,616 @@
+package handlers
+
+import (
+	"bytes"
+	"html/template"
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// authorizeParams are the authorization request parameters carried through the login form
+var authorizeParams = []string{"response_type", "client_id", "redirect_uri", "scope", "state", "nonce", "code_challenge", "code_challenge_method", "prompt", "login_hint"}
+
+// codeChallengePattern matches an S256 code challenge, the unpadded base64url encoding of a SHA-256 hash (RFC 7636 §4.2)
+var codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+// authorizeRequest is a validated authorization request (RFC 6749 §4.1.1)
+type authorizeRequest struct {
+	Client        *db.OAuthClient
+	RedirectURI   string // as sent, empty when the client omitted it
+	Scope         []string
+	State         string
+	Nonce         string
+	CodeChallenge string
+	params        url.Values
+}
+
+// hasPrompt reports whether the request's prompt parameter (OIDC Core §3.1.2.1) contains the given value
+func (r *authorizeRequest) hasPrompt(value string) bool {
+	return slices.Contains(strings.Fields(r.params.Get("prompt")), value)
+}
+
+// binding identifies the request by client, redirect URI and scope, so a sign-in started for it cannot be finished
+// for another
+func (r *authorizeRequest) binding() string {
+	return utils.HashToken(strings.Join([]string{"authorize", r.Client.ClientID, r.redirectTarget(), utils.FormatScope(r.Scope)}, "\n"))
+}
+
+// redirectTarget returns the URI the response is sent to: the one in the request, or the client's only registered URI
+func (r *authorizeRequest) redirectTarget() string {
+	if r.RedirectURI != "" {
+		return r.RedirectURI
+	}
+	return r.Client.RedirectURIs[0]
+}
+
+// HandleOAuthAuthorizeGET is the OAuth 2.0 authorization endpoint (RFC 6749 §3.1). It validates the request and
+// shows the login page; the user signs in with HandleOAuthAuthorizePOST.
+func HandleOAuthAuthorizeGET(ctx *middlewares.AppContext) {
+	request, ok := parseAuthorizeRequest(ctx, ctx.Request.URL.Query())
+	if !ok {
+		return
+	}
+
+	writeAuthorizePage(ctx, http.StatusOK, request, authorizePage{Email: request.params.Get("login_hint")})
+}
+
+// HandleOAuthAuthorizePOST handles the forms of the authorization endpoint. After the password, a TOTP or recovery
+// code for accounts that have one, and the user's consent, it redirects back to the client with a single-use
+// authorization code. Accounts that can only complete a second factor with a passkey must sign in elsewhere.
+func HandleOAuthAuthorizePOST(ctx *middlewares.AppContext) {
+	if err := ctx.Request.ParseForm(); err != nil {
+		writeAuthorizeError(ctx, http.StatusBadRequest, "The request body must be form encoded")
+		return
+	}
+
+	request, ok := parseAuthorizeRequest(ctx, ctx.Request.PostForm)
+	if !ok {
+		return
+	}
+
+	if consentToken := strings.TrimSpace(ctx.Request.PostForm.Get("consent_token")); consentToken != "" {
+		completeConsent(ctx, request, consentToken, ctx.Request.PostForm.Get("decision"))
+		return
+	}
+
+	if mfaToken := strings.TrimSpace(ctx.Request.PostForm.Get("mfa_token")); mfaToken != "" {
+		completeAuthorizeMFA(ctx, request, mfaToken, strings.TrimSpace(ctx.Request.PostForm.Get("code")))
+		return
+	}
+
+	email := strings.TrimSpace(ctx.Request.PostForm.Get("email"))
+	password := strings.TrimSpace(ctx.Request.PostForm.Get("password"))
+	if email == "" || password == "" {
+		writeAuthorizePage(ctx, http.StatusBadRequest, request, authorizePage{Email: email, Error: "Email and password are required"})
+		return
+	}
+
+	user, grantErr := checkPasswordLogin(ctx, email, password)
+	if grantErr == nil {
+		grantErr = accountStatusError(ctx, user)
+	}
+	if grantErr != nil {
+		if grantErr.RetryAfter > 0 {
+			ctx.Response.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(grantErr.RetryAfter.Seconds()))))
+		}
+		writeAuthorizePage(ctx, grantErr.Status, request, authorizePage{Email: email, Error: grantErr.Message})
+		return
+	}
+
+	scope, grantErr := resolveLoginScope(ctx, user.ID, request.Scope)
+	if grantErr != nil {
+		redirectAuthorizeError(ctx, request, grantErr.Code, grantErr.Message)
+		return
+	}
+
+	methods, err := secondFactorMethods(ctx, user.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to check mfa status", "err", err)
+		redirectAuthorizeError(ctx, request, "server_error", "Internal server error")
+		return
+	}
+
+	if len(methods) == 0 {
+		authorizeWithConsent(ctx, request, user, []string{"pwd"}, scope)
+		return
+	}
+
+	if !slices.Contains(methods, "totp") {
+		writeAuthorizePage(ctx, http.StatusForbidden, request, authorizePage{
+			Email: email,
+			Error: "This account requires a passkey, which cannot be used on this page",
+		})
+		return
+	}
+
+	token, hash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		redirectAuthorizeError(ctx, request, "server_error", "Internal server error")
+		return
+	}
+
+	_, err = db.NewMFAChallengeQueries(ctx.DB).CreateForRequest(user.ID, hash, []string{"pwd"}, scope, request.binding(), crypt_utils.ConstMFAChallengeValidityPeriod)
+	if err != nil {
+		ctx.Logger.Error("failed to save mfa challenge", "err", err)
+		redirectAuthorizeError(ctx, request, "server_error", "Internal server error")
+		return
+	}
+
+	writeAuthorizePage(ctx, http.StatusOK, request, authorizePage{MFAToken: token})
+}
+
+// completeAuthorizeMFA verifies the second factor of a login started on the authorization page. Six digit codes are
+// checked as TOTP codes, anything else as a recovery code. Only challenges created by the password form of the same
+// authorization request are accepted, and the code is limited to the client's registered scope.
+func completeAuthorizeMFA(ctx *middlewares.AppContext, request *authorizeRequest, mfaToken, code string) {
+	challenge, err := db.NewMFAChallengeQueries(ctx.DB).GetValidByHash(utils.HashToken(mfaToken))
+	if err != nil || challenge.Binding != request.binding() {
+		ctx.Logger.Debug("Invalid mfa challenge", "err", err)
+		writeAuthorizePage(ctx, http.StatusUnauthorized, request, authorizePage{Error: "Your sign-in has expired, please start again"})
+		return
+	}
+
+	if code == "" {
+		writeAuthorizePage(ctx, http.StatusBadRequest, request, authorizePage{MFAToken: mfaToken, Error: "A code is required"})
+		return
+	}
+
+	totpCode, recoveryCode := code, ""
+	if len(code) != crypt_utils.ConstTOTPDigits {
+		totpCode, recoveryCode = "", code
+	}
+
+	redeemed, err := redeemMFAChallenge(ctx, challenge, totpCode, recoveryCode)
+	if err != nil {
+		ctx.Logger.Error("failed to verify second factor", "err", err)
+		redirectAuthorizeError(ctx, request, "server_error", "Internal server error")
+		return
+	}
+
+	switch redeemed {
+	case mfaChallengeInvalidCode:
+		writeAuthorizePage(ctx, http.StatusUnauthorized, request, authorizePage{MFAToken: mfaToken, Error: "Invalid code"})
+		return
+	case mfaChallengeGone:
+		writeAuthorizePage(ctx, http.StatusUnauthorized, request, authorizePage{Error: "Your sign-in has expired, please start again"})
+		return
+	}
+
+	user, err := db.NewUserQueries(ctx.DB).GetByID(challenge.UserID)
+	if err != nil {
+		ctx.Logger.Error("Failed to get user", "user_id", challenge.UserID, "err", err)
+		redirectAuthorizeError(ctx, request, "server_error", "Internal server error")
+		return
+	}
+
+	scope := utils.IntersectScope(challenge.Scope, request.Client.Scope)
+	if len(scope) == 0 {
+		redirectAuthorizeError(ctx, request, "invalid_scope", "None of the requested scopes are allowed")
+		return
+	}
+
+	authorizeWithConsent(ctx, request, user, secondFactorAMR(challenge, totpCode), scope)
+}
+
+// authorizeWithConsent finishes a sign-in on the authorization page. The code is issued straight away when the user
+// has already approved every requested scope for the client; otherwise, or when the client sent prompt=consent, the
+// consent page is shown.
+func authorizeWithConsent(ctx *middlewares.AppContext, request *authorizeRequest, user *db.User, amr, scope []string) {
+	authTime := time.Now()
+
+	if !request.hasPrompt("consent") {
+		grant, err := db.NewConsentGrantQueries(ctx.DB).Get(user.ID, request.Client.ClientID)
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			ctx.Logger.Error("failed to get consent grant", "err", err)
+			redirectAuthorizeError(ctx, request, "server_error", "Internal server error")
+			return
+		}
+		if grant != nil && utils.IsScopeSubset(scope, grant.Scope) {
+			issueAuthorizationCode(ctx, request, user, amr, scope, authTime)
+			return
+		}
+	}
+
+	token, hash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		redirectAuthorizeError(ctx, request, "server_error", "Internal server error")
+		return
+	}
+
+	err = db.NewConsentRequestQueries(ctx.DB).Create(&db.ConsentRequest{
+		Hash:     hash,
+		UserID:   user.ID,
+		ClientID: request.Client.ClientID,
+		Scope:    scope,
+		AMR:      amr,
+		AuthTime: authTime,
+	}, crypt_utils.ConstConsentRequestValidityPeriod)
+	if err != nil {
+		ctx.Logger.Error("failed to save consent request", "err", err)
+		redirectAuthorizeError(ctx, request, "server_error", "Internal server error")
+		return
+	}
+
+	writeAuthorizePage(ctx, http.StatusOK, request, authorizePage{ConsentToken: token, Scopes: describeScopes(ctx, scope)})
+}
+
+// completeConsent records the user's answer on the consent page. Approved scopes are added to the user's grant for
+// the client, so later requests for them skip the page.
+func completeConsent(ctx *middlewares.AppContext, request *authorizeRequest, consentToken, decision string) {
+	consent, err := db.NewConsentRequestQueries(ctx.DB).Consume(utils.HashToken(consentToken))
+	if err != nil || consent.ClientID != request.Client.ClientID {
+		if err != nil && strings.HasPrefix(err.Error(), "failed to") {
+			ctx.Logger.Error("failed to load consent request", "err", err)
+		}
+		writeAuthorizePage(ctx, http.StatusUnauthorized, request, authorizePage{Error: "Your sign-in has expired, please start again"})
+		return
+	}
+
+	if decision != "allow" {
+		ctx.Logger.Info("Consent denied", "client_id", consent.ClientID, "user_id", consent.UserID)
+		redirectAuthorizeError(ctx, request, "access_denied", "The user denied the request")
+		return
+	}
+
+	if err := recordConsentGrant(ctx, consent); err != nil {
+		ctx.Logger.Error("failed to save consent grant", "err", err)
+		redirectAuthorizeError(ctx, request, "server_error", "Internal server error")
+		return
+	}
+
+	user, err := db.NewUserQueries(ctx.DB).GetByID(consent.UserID)
+	if err != nil {
+		ctx.Logger.Error("Failed to get user", "user_id", consent.UserID, "err", err)
+		redirectAuthorizeError(ctx, request, "server_error", "Internal server error")
+		return
+	}
+
+	issueAuthorizationCode(ctx, request, user, consent.AMR, consent.Scope, consent.AuthTime)
+}
+
+// recordConsentGrant adds the scopes of an approved consent request to the user's grant for the client
+func recordConsentGrant(ctx *middlewares.AppContext, consent *db.ConsentRequest) error {
+	grantQueries := db.NewConsentGrantQueries(ctx.DB)
+	scope := consent.Scope
+	grant, err := grantQueries.Get(consent.UserID, consent.ClientID)
+	if err != nil && !strings.Contains(err.Error(), "not found") {
+		return err
+	}
+	if grant != nil {
+		scope = utils.ParseScope(utils.FormatScope(slices.Concat(grant.Scope, consent.Scope)))
+	}
+
+	if err := grantQueries.Save(consent.UserID, consent.ClientID, scope); err != nil {
+		return err
+	}
+
+	ctx.Logger.Info("Consent granted", "client_id", consent.ClientID, "user_id", consent.UserID, "scope", utils.FormatScope(consent.Scope))
+	return nil
+}
+
+// describeScopes returns a line for each scope on the consent page: the permission's description, or the scope name
+// when it has none
+func describeScopes(ctx *middlewares.AppContext, scope []string) []string {
+	descriptions := map[string]string{
+		"openid":  "Sign you in with your account",
+		"profile": "See your name",
+		"email":   "See your email address",
+	}
+
+	permissions, err := db.NewPermissionQueries(ctx.DB).List()
+	if err != nil {
+		ctx.Logger.Error("failed to list permissions", "err", err)
+	}
+	for _, permission := range permissions {
+		if permission.Description != "" {
+			descriptions[permission.Name] = permission.Description
+		}
+	}
+
+	lines := make([]string, len(scope))
+	for i, s := range scope {
+		lines[i] = s
+		if description, ok := descriptions[s]; ok {
+			lines[i] = description
+		}
+	}
+	return lines
+}
+
+// issueAuthorizationCode redirects back to the client with a new authorization code (RFC 6749 §4.1.2). Only the
+// hash of the code is stored.
+func issueAuthorizationCode(ctx *middlewares.AppContext, request *authorizeRequest, user *db.User, amr, scope []string, authTime time.Time) {
+	code, hash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		redirectAuthorizeError(ctx, request, "server_error", "Internal server error")
+		return
+	}
+
+	err = db.NewAuthorizationCodeQueries(ctx.DB).Create(&db.AuthorizationCode{
+		CodeHash:      hash,
+		ClientID:      request.Client.ClientID,
+		UserID:        user.ID,
+		RedirectURI:   request.RedirectURI,
+		Scope:         scope,
+		AMR:           amr,
+		Nonce:         request.Nonce,
+		CodeChallenge: request.CodeChallenge,
+		AuthTime:      authTime,
+	}, crypt_utils.ConstAuthorizationCodeValidityPeriod)
+	if err != nil {
+		ctx.Logger.Error("failed to save authorization code", "err", err)
+		redirectAuthorizeError(ctx, request, "server_error", "Internal server error")
+		return
+	}
+
+	ctx.Logger.Info("Authorization code issued", "client_id", request.Client.ClientID, "user_id", user.ID)
+
+	redirectAuthorizeResponse(ctx, request, url.Values{"code": {code}})
+}
+
+// parseAuthorizeRequest validates an authorization request. Until the client and redirect URI are known to be valid
+// errors are shown to the user, as redirecting would make the server an open redirector (RFC 6749 §4.1.2.1); later
+// errors are sent back to the client.
+func parseAuthorizeRequest(ctx *middlewares.AppContext, values url.Values) (*authorizeRequest, bool) {
+	for _, name := range authorizeParams {
+		if len(values[name]) > 1 {
+			writeAuthorizeError(ctx, http.StatusBadRequest, "The "+name+" parameter was sent more than once")
+			return nil, false
+		}
+	}
+
+	clientID := values.Get("client_id")
+	if clientID == "" {
+		writeAuthorizeError(ctx, http.StatusBadRequest, "The request is missing a client_id")
+		return nil, false
+	}
+
+	client, err := db.NewOAuthClientQueries(ctx.DB).GetByClientID(clientID)
+	if err != nil || client.OrganizationID != ctx.Tenant.ID {
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			ctx.Logger.Error("failed to look up oauth client", "err", err)
+			writeAuthorizeError(ctx, http.StatusInternalServerError, "Internal server error")
+			return nil, false
+		}
+		writeAuthorizeError(ctx, http.StatusBadRequest, "Unknown client")
+		return nil, false
+	}
+
+	redirectURI := values.Get("redirect_uri")
+	if (redirectURI != "" && !slices.Contains(client.RedirectURIs, redirectURI)) || (redirectURI == "" && len(client.RedirectURIs) != 1) {
+		ctx.Logger.Debug("Invalid redirect uri", "client_id", clientID, "redirect_uri", redirectURI)
+		writeAuthorizeError(ctx, http.StatusBadRequest, "The redirect URI is not registered for this client")
+		return nil, false
+	}
+
+	request := &authorizeRequest{
+		Client:        client,
+		RedirectURI:   redirectURI,
+		State:         values.Get("state"),
+		Nonce:         values.Get("nonce"),
+		CodeChallenge: values.Get("code_challenge"),
+		params:        url.Values{},
+	}
+	for _, name := range authorizeParams {
+		if value := values.Get(name); value != "" {
+			request.params.Set(name, value)
+		}
+	}
+
+	switch responseType := values.Get("response_type"); responseType {
+	case "code":
+	case "":
+		redirectAuthorizeError(ctx, request, "invalid_request", "response_type is required")
+		return nil, false
+	default:
+		redirectAuthorizeError(ctx, request, "unsupported_response_type", "Unsupported response_type: "+responseType)
+		return nil, false
+	}
+
+	if !client.AllowsGrantType("authorization_code") {
+		redirectAuthorizeError(ctx, request, "unauthorized_client", "The client is not registered for the authorization_code grant")
+		return nil, false
+	}
+
+	request.Scope = utils.ParseScope(values.Get("scope"))
+	if len(request.Scope) == 0 {
+		request.Scope = client.Scope
+	} else if !utils.IsScopeSubset(request.Scope, client.Scope) {
+		redirectAuthorizeError(ctx, request, "invalid_scope", "The requested scope exceeds the scope registered for the client")
+		return nil, false
+	}
+
+	if slices.Contains(request.Scope, "openid") && redirectURI == "" {
+		redirectAuthorizeError(ctx, request, "invalid_request", "redirect_uri is required for OpenID Connect requests")
+		return nil, false
+	}
+
+	// There is no sign-in session to reuse, so a request that forbids showing the login page cannot succeed.
+	if request.hasPrompt("none") {
+		redirectAuthorizeError(ctx, request, "login_required", "The user must sign in")
+		return nil, false
+	}
+
+	// Only S256 is supported; plain would expose the verifier to anyone who can see the authorization request.
+	if request.CodeChallenge == "" {
+		if values.Get("code_challenge_method") != "" {
+			redirectAuthorizeError(ctx, request, "invalid_request", "code_challenge_method was sent without a code_challenge")
+			return nil, false
+		}
+		if client.IsPublic() {
+			redirectAuthorizeError(ctx, request, "invalid_request", "Public clients must use PKCE with code_challenge_method S256")
+			return nil, false
+		}
+	} else {
+		if values.Get("code_challenge_method") != "S256" {
+			redirectAuthorizeError(ctx, request, "invalid_request", "code_challenge_method must be S256")
+			return nil, false
+		}
+		if !codeChallengePattern.MatchString(request.CodeChallenge) {
+			redirectAuthorizeError(ctx, request, "invalid_request", "Invalid code_challenge")
+			return nil, false
+		}
+	}
+
+	return request, true
+}
+
+// redirectAuthorizeError sends an error back to the client (RFC 6749 §4.1.2.1)
+func redirectAuthorizeError(ctx *middlewares.AppContext, request *authorizeRequest, code, description string) {
+	redirectAuthorizeResponse(ctx, request, url.Values{"error": {code}, "error_description": {description}})
+}
+
+// redirectAuthorizeResponse redirects to the client's redirect URI with the given parameters and the request's state
+func redirectAuthorizeResponse(ctx *middlewares.AppContext, request *authorizeRequest, params url.Values) {
+	target, err := url.Parse(request.redirectTarget())
+	if err != nil {
+		ctx.Logger.Error("invalid registered redirect uri", "client_id", request.Client.ClientID, "err", err)
+		writeAuthorizeError(ctx, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	query := target.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	if request.State != "" {
+		query.Set("state", request.State)
+	}
+	target.RawQuery = query.Encode()
+
+	ctx.Response.Header().Set("Cache-Control", "no-store")
+	ctx.Redirect(target.String(), http.StatusFound)
+}
+
+// authorizePage is the data of the login page, which the device verification page shares
+type authorizePage struct {
+	Action        string
+	ClientName    string
+	Params        map[string]string
+	Email         string
+	MFAToken      string
+	ConsentToken  string
+	Scopes        []string // descriptions of the scopes the user is asked to approve
+	UserCodeEntry bool     // ask for the user code of a device authorization request
+	Notice        string   // the flow is finished and nothing is left to do on the page
+	Error         string
+	Fatal         bool // the request itself is invalid, so no form is shown
+}
+
+// writeAuthorizeError shows an error page for a request that cannot be sent back to the client
+func writeAuthorizeError(ctx *middlewares.AppContext, status int, message string) {
+	renderAuthorizePage(ctx, status, authorizePage{Error: message, Fatal: true})
+}
+
+// writeAuthorizePage shows the login form for an authorization request
+func writeAuthorizePage(ctx *middlewares.AppContext, status int, request *authorizeRequest, page authorizePage) {
+	page.Action = ctx.TenantPath + "/oauth/authorize"
+	page.ClientName = request.Client.Name
+	page.Params = make(map[string]string, len(request.params))
+	for name := range request.params {
+		page.Params[name] = request.params.Get(name)
+	}
+
+	renderAuthorizePage(ctx, status, page)
+}
+
+func renderAuthorizePage(ctx *middlewares.AppContext, status int, page authorizePage) {
+	var buf bytes.Buffer
+	if err := authorizePageTemplate.Execute(&buf, page); err != nil {
+		ctx.Logger.Error("failed to render authorization page", "err", err)
+		ctx.WriteText(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	header := ctx.Response.Header()
+	header.Set("Cache-Control", "no-store")
+	header.Set("X-Frame-Options", "DENY")
+	header.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	header.Set("Referrer-Policy", "no-referrer")
+	ctx.WriteBytes(status, "text/html; charset=utf-8", buf.Bytes())
+}
+
+var authorizePageTemplate = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in</title>
+<style>
+body { font-family: system-ui, sans-serif; background: #f4f4f5; margin: 0; display: flex; justify-content: center; padding-top: 10vh; }
+main { background: #fff; border-radius: 8px; box-shadow: 0 1px 3px rgba(0, 0, 0, .15); padding: 2rem; width: 20rem; }
+h1 { font-size: 1.25rem; margin-top: 0; }
+label { display: block; font-size: .875rem; margin-top: 1rem; }
+input { box-sizing: border-box; margin-top: .25rem; padding: .5rem; width: 100%; }
+button { margin-top: 1.5rem; padding: .6rem; width: 100%; }
+button.secondary { margin-top: .5rem; }
+ul { font-size: .875rem; padding-left: 1.25rem; }
+.error { color: #b91c1c; font-size: .875rem; }
+</style>
+</head>
+<body>
+<main>
+{{- if .Fatal}}
+<h1>Unable to sign in</h1>
+<p class="error">{{.Error}}</p>
+{{- else if .Notice}}
+<h1>Done</h1>
+<p>{{.Notice}}</p>
+{{- else if .UserCodeEntry}}
+<h1>Connect a device</h1>
+{{- if .Error}}
+<p class="error">{{.Error}}</p>
+{{- end}}
+<form method="post" action="{{.Action}}">
+<label>Enter the code shown on your device<input name="user_code" autocomplete="off" autocapitalize="characters" spellcheck="false" required autofocus></label>
+<button type="submit">Continue</button>
+</form>
+{{- else if .ConsentToken}}
+<h1>{{.ClientName}} wants to access your account</h1>
+<p>This will allow {{.ClientName}} to:</p>
+<ul>
+{{- range .Scopes}}
+<li>{{.}}</li>
+{{- end}}
+</ul>
+<form method="post" action="{{.Action}}">
+{{- range $name, $value := .Params}}
+<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{- end}}
+<input type="hidden" name="consent_token" value="{{.ConsentToken}}">
+<button type="submit" name="decision" value="allow">Allow</button>
+<button type="submit" name="decision" value="deny" class="secondary">Deny</button>
+</form>
+{{- else}}
+<h1>Sign in to continue to {{.ClientName}}</h1>
+{{- if .Error}}
+<p class="error">{{.Error}}</p>
+{{- end}}
+<form method="post" action="{{.Action}}">
+{{- range $name, $value := .Params}}
+<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{- end}}
+{{- if .MFAToken}}
+<input type="hidden" name="mfa_token" value="{{.MFAToken}}">
+<label>Authentication or recovery code<input name="code" autocomplete="one-time-code" required autofocus></label>
+{{- else}}
+<label>Email<input type="email" name="email" value="{{.Email}}" autocomplete="username" required autofocus></label>
+<label>Password<input type="password" name="password" autocomplete="current-password" required></label>
+{{- end}}
+<button type="submit">Continue</button>
+</form>
+{{- end}}
+</main>
+</body>
+</html>
+`))
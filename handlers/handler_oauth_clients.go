@@ -0,0 +1,546 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultClientTokenLifetime = 3600
+	minClientTokenLifetime     = 60
+
+	defaultSecretOverlap = 24 * 60 * 60
+	maxSecretOverlap     = 30 * 24 * 60 * 60
+)
+
+// supportedGrantTypes are the grants a client can be registered for
+var supportedGrantTypes = []string{"authorization_code", "refresh_token", "password", "client_credentials", deviceCodeGrantType,
+	tokenExchangeGrantType, jwtBearerGrantType}
+
+// defaultGrantTypes are the grants of a client registered without grant_types. Grants that hand out tokens without
+// a user's consent at the authorization endpoint must be asked for.
+var defaultGrantTypes = []string{"authorization_code", "refresh_token"}
+
+// supportedAuthMethods are the token endpoint authentication methods a client can be registered with
+var supportedAuthMethods = []string{
+	db.AuthMethodClientSecretBasic, db.AuthMethodClientSecretPost, db.AuthMethodNone,
+	db.AuthMethodTLSClientAuth, db.AuthMethodSelfSignedTLSClientAuth, db.AuthMethodPrivateKeyJWT,
+}
+
+// HandleOAuthClientsGET lists the organization's OAuth clients
+func HandleOAuthClientsGET(ctx *middlewares.AppContext) {
+	clients, err := db.NewOAuthClientQueries(ctx.DB).List(ctx.Tenant.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to list oauth clients", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve clients")
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"clients": clients,
+		"count":   len(clients),
+	})
+}
+
+// HandleOAuthClientsPOST registers an OAuth client owned by the caller. The client may only be given scopes the
+// caller's session holds, and the OpenID Connect identity scopes. Confidential clients receive a secret, which is
+// only returned in this response; public clients get none.
+func HandleOAuthClientsPOST(ctx *middlewares.AppContext) {
+	owner, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Name                    string   `json:"name"`
+		ClientType              string   `json:"client_type"`
+		Scope                   string   `json:"scope"`
+		RedirectURIs            []string `json:"redirect_uris"`
+		GrantTypes              []string `json:"grant_types"`
+		TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+		LogoURI                 string   `json:"logo_uri"`
+		PolicyURI               string   `json:"policy_uri"`
+		TokenExchangeAudiences  []string `json:"token_exchange_audiences"`
+		TokenLifetime           int      `json:"token_lifetime"`
+		db.TLSClientAuthMetadata
+		JWKS    json.RawMessage `json:"jwks"`
+		JWKSURI string          `json:"jwks_uri"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	method := request.TokenEndpointAuthMethod
+	switch request.ClientType {
+	case "", db.ClientTypeConfidential:
+		if method == "" {
+			method = db.AuthMethodClientSecretBasic
+		} else if method == db.AuthMethodNone && request.ClientType != "" {
+			ctx.SetJSONError(http.StatusBadRequest, "Confidential clients cannot use the none authentication method")
+			return
+		}
+	case db.ClientTypePublic:
+		if method == "" {
+			method = db.AuthMethodNone
+		} else if method != db.AuthMethodNone {
+			ctx.SetJSONError(http.StatusBadRequest, "Public clients must use the none authentication method")
+			return
+		}
+	default:
+		ctx.SetJSONError(http.StatusBadRequest, "client_type must be confidential or public")
+		return
+	}
+
+	client := &db.OAuthClient{
+		OrganizationID:          ctx.Tenant.ID,
+		Name:                    strings.TrimSpace(request.Name),
+		OwnerID:                 &owner.ID,
+		Scope:                   utils.ParseScope(request.Scope),
+		RedirectURIs:            request.RedirectURIs,
+		GrantTypes:              request.GrantTypes,
+		TokenEndpointAuthMethod: method,
+		LogoURI:                 request.LogoURI,
+		PolicyURI:               request.PolicyURI,
+		TokenExchangeAudiences:  request.TokenExchangeAudiences,
+		TokenLifetime:           request.TokenLifetime,
+		TLSClientAuthMetadata:   request.TLSClientAuthMetadata,
+		JWKS:                    request.JWKS,
+		JWKSURI:                 request.JWKSURI,
+	}
+	if metadataErr := validateClientMetadata(client); metadataErr != nil {
+		ctx.SetJSONError(http.StatusBadRequest, metadataErr.Message)
+		return
+	}
+	if !utils.IsScopeSubset(client.Scope, slices.Concat(middlewares.GetScopes(ctx), utils.IdentityScopes)) {
+		ctx.SetJSONError(http.StatusForbidden, "scope exceeds the scope of the current session")
+		return
+	}
+
+	secret, err := assignClientCredentials(client)
+	if err != nil {
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	client, err = db.NewOAuthClientQueries(ctx.DB).Create(client)
+	if err != nil {
+		ctx.Logger.Error("failed to create oauth client", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to create client")
+		return
+	}
+
+	utils.RecordAudit(ctx, "oauth_client.create", "oauth_client", strconv.Itoa(client.ID), map[string]interface{}{
+		"client_id":   client.ClientID,
+		"client_type": client.ClientType,
+		"name":        client.Name,
+		"scope":       utils.FormatScope(client.Scope),
+		"grant_types": client.GrantTypes,
+		"audiences":   client.TokenExchangeAudiences,
+	})
+
+	response := map[string]interface{}{
+		"client": client,
+	}
+	if secret != "" {
+		response["client_secret"] = secret
+	}
+	ctx.WriteJSON(http.StatusCreated, response)
+}
+
+// HandleOAuthClientGET retrieves an OAuth client
+func HandleOAuthClientGET(ctx *middlewares.AppContext) {
+	client, ok := oauthClientFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, client)
+}
+
+// HandleOAuthClientPUT updates an OAuth client's metadata. Only the fields sent are changed. A client cannot be
+// switched between confidential and public, and a new scope is bounded like at registration.
+func HandleOAuthClientPUT(ctx *middlewares.AppContext) {
+	client, ok := oauthClientFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Name                    *string   `json:"name"`
+		Scope                   *string   `json:"scope"`
+		RedirectURIs            *[]string `json:"redirect_uris"`
+		GrantTypes              *[]string `json:"grant_types"`
+		TokenEndpointAuthMethod *string   `json:"token_endpoint_auth_method"`
+		LogoURI                 *string   `json:"logo_uri"`
+		PolicyURI               *string   `json:"policy_uri"`
+		TokenExchangeAudiences  *[]string `json:"token_exchange_audiences"`
+		TokenLifetime           *int      `json:"token_lifetime"`
+		*db.TLSClientAuthMetadata
+		JWKS    *json.RawMessage `json:"jwks"`
+		JWKSURI *string          `json:"jwks_uri"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	updated := *client
+	if request.Name != nil {
+		updated.Name = strings.TrimSpace(*request.Name)
+	}
+	if request.Scope != nil {
+		updated.Scope = utils.ParseScope(*request.Scope)
+		if !utils.IsScopeSubset(updated.Scope, slices.Concat(middlewares.GetScopes(ctx), utils.IdentityScopes)) {
+			ctx.SetJSONError(http.StatusForbidden, "scope exceeds the scope of the current session")
+			return
+		}
+	}
+	if request.RedirectURIs != nil {
+		updated.RedirectURIs = *request.RedirectURIs
+	}
+	if request.GrantTypes != nil {
+		updated.GrantTypes = *request.GrantTypes
+	}
+	if request.TokenEndpointAuthMethod != nil {
+		updated.TokenEndpointAuthMethod = *request.TokenEndpointAuthMethod
+	}
+	if request.LogoURI != nil {
+		updated.LogoURI = *request.LogoURI
+	}
+	if request.PolicyURI != nil {
+		updated.PolicyURI = *request.PolicyURI
+	}
+	if request.TokenExchangeAudiences != nil {
+		updated.TokenExchangeAudiences = *request.TokenExchangeAudiences
+	}
+	if request.TokenLifetime != nil {
+		updated.TokenLifetime = *request.TokenLifetime
+	}
+	// Any tls_client_auth_* field replaces the registered name as a whole
+	if request.TLSClientAuthMetadata != nil {
+		updated.TLSClientAuthMetadata = *request.TLSClientAuthMetadata
+	}
+	// Keys registered one way replace those registered the other way
+	if request.JWKS != nil {
+		updated.JWKS = *request.JWKS
+		if request.JWKSURI == nil && len(updated.JWKS) > 0 && string(updated.JWKS) != "null" {
+			updated.JWKSURI = ""
+		}
+	}
+	if request.JWKSURI != nil {
+		updated.JWKSURI = *request.JWKSURI
+		if request.JWKS == nil && updated.JWKSURI != "" {
+			updated.JWKS = nil
+		}
+	}
+
+	if metadataErr := validateClientMetadata(&updated); metadataErr != nil {
+		ctx.SetJSONError(http.StatusBadRequest, metadataErr.Message)
+		return
+	}
+	if updated.ClientType != client.ClientType {
+		ctx.SetJSONError(http.StatusBadRequest, "A client cannot be switched between confidential and public")
+		return
+	}
+
+	saved, err := db.NewOAuthClientQueries(ctx.DB).Update(&updated)
+	if err != nil {
+		ctx.Logger.Error("failed to update oauth client", "err", err, "id", client.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to update client")
+		return
+	}
+
+	utils.RecordAudit(ctx, "oauth_client.update", "oauth_client", strconv.Itoa(saved.ID), map[string]interface{}{
+		"client_id":   saved.ClientID,
+		"name":        saved.Name,
+		"scope":       utils.FormatScope(saved.Scope),
+		"grant_types": saved.GrantTypes,
+		"audiences":   saved.TokenExchangeAudiences,
+	})
+
+	ctx.WriteJSON(http.StatusOK, saved)
+}
+
+// HandleOAuthClientSecretPOST issues a new secret to a client that authenticates with one. The current secret keeps
+// working for the requested overlap, in seconds, so deployments can switch over without downtime; an overlap of 0
+// revokes it at once. The new secret is only returned in this response. A client switched to a secret method gets its
+// first secret here.
+func HandleOAuthClientSecretPOST(ctx *middlewares.AppContext) {
+	client, ok := oauthClientFromPath(ctx)
+	if !ok {
+		return
+	}
+	if !client.UsesSecret() {
+		ctx.SetJSONError(http.StatusBadRequest, "Only clients authenticating with a client secret have one")
+		return
+	}
+
+	var request struct {
+		Overlap *int `json:"overlap"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	overlap := defaultSecretOverlap
+	if request.Overlap != nil {
+		overlap = *request.Overlap
+	}
+	if overlap < 0 || overlap > maxSecretOverlap {
+		ctx.SetJSONError(http.StatusBadRequest, "overlap must be between 0 and "+strconv.Itoa(maxSecretOverlap)+" seconds")
+		return
+	}
+
+	secret, secretHash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	rotated, err := db.NewOAuthClientQueries(ctx.DB).RotateSecret(client.ID, secretHash, time.Duration(overlap)*time.Second)
+	if err != nil {
+		ctx.Logger.Error("failed to rotate oauth client secret", "err", err, "id", client.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to rotate secret")
+		return
+	}
+
+	utils.RecordAudit(ctx, "oauth_client.rotate_secret", "oauth_client", strconv.Itoa(rotated.ID), map[string]interface{}{
+		"client_id": rotated.ClientID,
+		"overlap":   overlap,
+	})
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"client":        rotated,
+		"client_secret": secret,
+	})
+}
+
+// HandleOAuthClientDELETE removes an OAuth client. Service tokens already issued to it stop being accepted.
+func HandleOAuthClientDELETE(ctx *middlewares.AppContext) {
+	client, ok := oauthClientFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	if err := db.NewOAuthClientQueries(ctx.DB).Delete(ctx.Tenant.ID, client.ID); err != nil {
+		ctx.Logger.Error("failed to delete oauth client", "err", err, "id", client.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to delete client")
+		return
+	}
+
+	utils.RecordAudit(ctx, "oauth_client.delete", "oauth_client", strconv.Itoa(client.ID), map[string]interface{}{
+		"client_id": client.ClientID,
+		"name":      client.Name,
+	})
+
+	ctx.SetJSONStatus(http.StatusOK, "Client deleted")
+}
+
+// oauthClientFromPath loads the client in the {id} path value. Clients of other organizations are not found.
+func oauthClientFromPath(ctx *middlewares.AppContext) (*db.OAuthClient, bool) {
+	id, err := strconv.Atoi(ctx.Request.PathValue("id"))
+	if err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid client ID")
+		return nil, false
+	}
+
+	client, err := db.NewOAuthClientQueries(ctx.DB).GetByID(id)
+	if err != nil || client.OrganizationID != ctx.Tenant.ID {
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			ctx.Logger.Error("failed to get oauth client", "err", err, "id", id)
+			ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve client")
+			return nil, false
+		}
+		ctx.SetJSONError(http.StatusNotFound, "Client not found")
+		return nil, false
+	}
+
+	return client, true
+}
+
+// clientMetadataError is client metadata refused at registration or update, with its RFC 7591 §3.2.2 error code
+type clientMetadataError struct {
+	Code    string
+	Message string
+}
+
+// validateClientMetadata checks the metadata of a client being registered or updated. It derives the client type
+// from the token endpoint authentication method and fills in defaults: every grant the client can use, except token
+// exchange and the JWT bearer grant which must be asked for, and the default token lifetime. Bounding the scope is left to the caller.
+func validateClientMetadata(client *db.OAuthClient) *clientMetadataError {
+	invalid := func(message string) *clientMetadataError {
+		return &clientMetadataError{Code: "invalid_client_metadata", Message: message}
+	}
+
+	if client.Name == "" {
+		return invalid("name is required")
+	}
+
+	switch client.TokenEndpointAuthMethod {
+	case db.AuthMethodClientSecretBasic, db.AuthMethodClientSecretPost, db.AuthMethodTLSClientAuth, db.AuthMethodSelfSignedTLSClientAuth,
+		db.AuthMethodPrivateKeyJWT:
+		client.ClientType = db.ClientTypeConfidential
+	case db.AuthMethodNone:
+		client.ClientType = db.ClientTypePublic
+	default:
+		return invalid("token_endpoint_auth_method must be one of " + strings.Join(supportedAuthMethods, ", "))
+	}
+	if metadataErr := validateCertificateMetadata(client); metadataErr != nil {
+		return metadataErr
+	}
+
+	for _, redirectURI := range client.RedirectURIs {
+		if err := validateRedirectURI(redirectURI); err != nil {
+			return &clientMetadataError{Code: "invalid_redirect_uri", Message: "Invalid redirect URI " + strconv.Quote(redirectURI) + ": " + err.Error()}
+		}
+	}
+	if client.LogoURI != "" {
+		if err := validateWebURI(client.LogoURI); err != nil {
+			return invalid("Invalid logo_uri: " + err.Error())
+		}
+	}
+	if client.PolicyURI != "" {
+		if err := validateWebURI(client.PolicyURI); err != nil {
+			return invalid("Invalid policy_uri: " + err.Error())
+		}
+	}
+
+	if len(client.GrantTypes) == 0 {
+		client.GrantTypes = slices.Clone(defaultGrantTypes)
+	}
+	for i, grantType := range client.GrantTypes {
+		if !slices.Contains(supportedGrantTypes, grantType) {
+			return invalid("Unsupported grant type " + strconv.Quote(grantType) + ", must be one of " + strings.Join(supportedGrantTypes, ", "))
+		}
+		if slices.Contains(client.GrantTypes[:i], grantType) {
+			return invalid("Duplicate grant type " + strconv.Quote(grantType))
+		}
+	}
+	if client.AllowsGrantType("client_credentials") && client.ClientType == db.ClientTypePublic {
+		return invalid("Public clients cannot use the client_credentials grant")
+	}
+	if client.AllowsGrantType(tokenExchangeGrantType) && client.ClientType == db.ClientTypePublic {
+		return invalid("Public clients cannot use the token exchange grant")
+	}
+	if client.AllowsGrantType(jwtBearerGrantType) && client.ClientType == db.ClientTypePublic {
+		return invalid("Public clients cannot use the JWT bearer grant")
+	}
+	if metadataErr := validateClientKeys(client); metadataErr != nil {
+		return metadataErr
+	}
+	for i, audience := range client.TokenExchangeAudiences {
+		if audience == "" || strings.ContainsAny(audience, " \t\r\n") {
+			return invalid("token_exchange_audiences must not be empty or contain whitespace")
+		}
+		if slices.Contains(client.TokenExchangeAudiences[:i], audience) {
+			return invalid("Duplicate audience " + strconv.Quote(audience))
+		}
+	}
+	if client.AllowsGrantType("authorization_code") && len(client.RedirectURIs) == 0 {
+		return &clientMetadataError{Code: "invalid_redirect_uri", Message: "redirect_uris is required for the authorization_code grant"}
+	}
+
+	if len(client.Scope) == 0 {
+		return invalid("scope is required")
+	}
+
+	if client.TokenLifetime == 0 {
+		client.TokenLifetime = defaultClientTokenLifetime
+	}
+	if maxLifetime := int(crypt_utils.ConstAccessTokenValidityPeriod.Seconds()); client.TokenLifetime < minClientTokenLifetime || client.TokenLifetime > maxLifetime {
+		return invalid("token_lifetime must be between " + strconv.Itoa(minClientTokenLifetime) + " and " + strconv.Itoa(maxLifetime) + " seconds")
+	}
+
+	return nil
+}
+
+// assignClientCredentials gives a new client its client_id and, when it authenticates with a secret, a secret. The
+// secret is returned for the one response that shows it.
+func assignClientCredentials(client *db.OAuthClient) (string, error) {
+	clientID, secret, secretHash, err := utils.GenerateClientCredentials()
+	if err != nil {
+		return "", err
+	}
+
+	client.ClientID = clientID
+	if !client.UsesSecret() {
+		return "", nil
+	}
+
+	client.SecretHash = secretHash
+	return secret, nil
+}
+
+// validateWebURI checks a URI shown to users or fetched by the server, such as a client's logo or policy page or its
+// jwks_uri. It must be an absolute https URL.
+func validateWebURI(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Host == "" || strings.ContainsAny(raw, " \t\r\n") {
+		return errors.New("must be an absolute URL")
+	}
+	if parsed.Scheme != "https" {
+		return errors.New("must use https")
+	}
+
+	return nil
+}
+
+// validateRedirectURI checks a redirect URI for registration. It must be absolute and without a fragment (RFC 6749
+// §3.1.2). Plain http is only allowed for loopback addresses; native apps may also use a private-use scheme in
+// reverse domain form, such as com.example.app:/callback (RFC 8252 §7).
+func validateRedirectURI(raw string) error {
+	if raw == "" || strings.ContainsAny(raw, " \t\r\n") {
+		return errors.New("must not be empty or contain whitespace")
+	}
+
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Scheme == "" {
+		return errors.New("must be an absolute URI")
+	}
+	if parsed.Fragment != "" || strings.Contains(raw, "#") {
+		return errors.New("must not contain a fragment")
+	}
+
+	switch parsed.Scheme {
+	case "https":
+		if parsed.Host == "" {
+			return errors.New("must include a host")
+		}
+	case "http":
+		if !isLoopbackHost(parsed.Hostname()) {
+			return errors.New("http is only allowed for loopback addresses")
+		}
+	default:
+		if !strings.Contains(parsed.Scheme, ".") {
+			return errors.New("custom schemes must be in reverse domain form")
+		}
+	}
+
+	return nil
+}
+
+// isLoopbackHost reports whether a host name refers to the local machine
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,475 @@
+package handlers
+
+import (
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// deviceCodeGrantType is the grant_type of device access token requests (RFC 8628 §3.4)
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// deviceAuthorizationResponse is a successful device authorization response (RFC 8628 §3.2)
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// deviceRequest is a pending device authorization request being answered on the verification page
+type deviceRequest struct {
+	Code     *db.DeviceCode
+	Client   *db.OAuthClient
+	UserCode string // formatted for display
+}
+
+// binding identifies the device code, so a sign-in started for it cannot be finished for another
+func (r *deviceRequest) binding() string {
+	return utils.HashToken("device\n" + strconv.Itoa(r.Code.ID))
+}
+
+// HandleDeviceAuthorizationPOST is the device authorization endpoint (RFC 8628 §3.1). Clients authenticate as at the
+// token endpoint and must be registered for the device_code grant. The scope defaults to the client's registered
+// scope and cannot exceed it. Both codes are only stored as hashes.
+func HandleDeviceAuthorizationPOST(ctx *middlewares.AppContext) {
+	ctx.Response.Header().Set("Cache-Control", "no-store")
+	ctx.Response.Header().Set("Pragma", "no-cache")
+
+	if err := ctx.Request.ParseForm(); err != nil {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_request", "The request body must be form encoded")
+		return
+	}
+
+	client, ok := authenticateClient(ctx)
+	if !ok || !checkClientGrantType(ctx, client, deviceCodeGrantType) {
+		return
+	}
+
+	scope := client.Scope
+	if requested := utils.ParseScope(ctx.Request.PostForm.Get("scope")); len(requested) > 0 {
+		if !utils.IsScopeSubset(requested, client.Scope) {
+			writeOAuthError(ctx, http.StatusBadRequest, "invalid_scope", "The requested scope exceeds the scope registered for the client")
+			return
+		}
+		scope = requested
+	}
+
+	deviceCode, deviceCodeHash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		writeOAuthError(ctx, http.StatusInternalServerError, "server_error", "Internal server error")
+		return
+	}
+	userCode, userCodeHash, err := utils.GenerateUserCode()
+	if err != nil {
+		writeOAuthError(ctx, http.StatusInternalServerError, "server_error", "Internal server error")
+		return
+	}
+
+	interval := int(crypt_utils.ConstDevicePollInterval.Seconds())
+	err = db.NewDeviceCodeQueries(ctx.DB).Create(&db.DeviceCode{
+		DeviceCodeHash: deviceCodeHash,
+		UserCodeHash:   userCodeHash,
+		ClientID:       client.ClientID,
+		Scope:          scope,
+		PollInterval:   interval,
+	}, crypt_utils.ConstDeviceCodeValidityPeriod)
+	if err != nil {
+		ctx.Logger.Error("failed to save device code", "err", err)
+		writeOAuthError(ctx, http.StatusInternalServerError, "server_error", "Internal server error")
+		return
+	}
+
+	verificationURI := ctx.Issuer() + "/oauth/device"
+	ctx.WriteJSON(http.StatusOK, deviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?user_code=" + url.QueryEscape(userCode),
+		ExpiresIn:               int(crypt_utils.ConstDeviceCodeValidityPeriod.Seconds()),
+		Interval:                interval,
+	})
+}
+
+// HandleDeviceVerificationGET shows the verification page, where the user enters the code shown on the device. A
+// user_code in the query, as in verification_uri_complete, skips straight to the sign-in form.
+func HandleDeviceVerificationGET(ctx *middlewares.AppContext) {
+	userCode := ctx.Request.URL.Query().Get("user_code")
+	if userCode == "" {
+		writeDeviceCodeEntry(ctx, http.StatusOK, "")
+		return
+	}
+
+	request, ok := loadDeviceRequest(ctx, userCode)
+	if !ok {
+		return
+	}
+
+	writeDevicePage(ctx, http.StatusOK, request, authorizePage{})
+}
+
+// HandleDeviceVerificationPOST handles the forms of the verification page. The user enters the code, signs in with
+// the same steps as on the authorization page, and then approves or denies the device. Approval is always asked for,
+// so a code phished from another user's device cannot be approved silently.
+func HandleDeviceVerificationPOST(ctx *middlewares.AppContext) {
+	if err := ctx.Request.ParseForm(); err != nil {
+		writeAuthorizeError(ctx, http.StatusBadRequest, "The request body must be form encoded")
+		return
+	}
+
+	request, ok := loadDeviceRequest(ctx, ctx.Request.PostForm.Get("user_code"))
+	if !ok {
+		return
+	}
+
+	if consentToken := strings.TrimSpace(ctx.Request.PostForm.Get("consent_token")); consentToken != "" {
+		completeDeviceConsent(ctx, request, consentToken, ctx.Request.PostForm.Get("decision"))
+		return
+	}
+
+	if mfaToken := strings.TrimSpace(ctx.Request.PostForm.Get("mfa_token")); mfaToken != "" {
+		completeDeviceMFA(ctx, request, mfaToken, strings.TrimSpace(ctx.Request.PostForm.Get("code")))
+		return
+	}
+
+	email := strings.TrimSpace(ctx.Request.PostForm.Get("email"))
+	password := strings.TrimSpace(ctx.Request.PostForm.Get("password"))
+	if !ctx.Request.PostForm.Has("email") {
+		// The code entry form only sends the user code.
+		writeDevicePage(ctx, http.StatusOK, request, authorizePage{})
+		return
+	}
+	if email == "" || password == "" {
+		writeDevicePage(ctx, http.StatusBadRequest, request, authorizePage{Email: email, Error: "Email and password are required"})
+		return
+	}
+
+	user, grantErr := checkPasswordLogin(ctx, email, password)
+	if grantErr == nil {
+		grantErr = accountStatusError(ctx, user)
+	}
+	if grantErr != nil {
+		if grantErr.RetryAfter > 0 {
+			ctx.Response.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(grantErr.RetryAfter.Seconds()))))
+		}
+		writeDevicePage(ctx, grantErr.Status, request, authorizePage{Email: email, Error: grantErr.Message})
+		return
+	}
+
+	scope, grantErr := resolveLoginScope(ctx, user.ID, request.Code.Scope)
+	if grantErr != nil {
+		writeDevicePage(ctx, grantErr.Status, request, authorizePage{Email: email, Error: grantErr.Message})
+		return
+	}
+
+	methods, err := secondFactorMethods(ctx, user.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to check mfa status", "err", err)
+		writeDevicePage(ctx, http.StatusInternalServerError, request, authorizePage{Error: "Internal server error"})
+		return
+	}
+
+	if len(methods) == 0 {
+		askDeviceConsent(ctx, request, user, []string{"pwd"}, scope)
+		return
+	}
+
+	if !slices.Contains(methods, "totp") {
+		writeDevicePage(ctx, http.StatusForbidden, request, authorizePage{
+			Email: email,
+			Error: "This account requires a passkey, which cannot be used on this page",
+		})
+		return
+	}
+
+	token, hash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		writeDevicePage(ctx, http.StatusInternalServerError, request, authorizePage{Error: "Internal server error"})
+		return
+	}
+
+	_, err = db.NewMFAChallengeQueries(ctx.DB).CreateForRequest(user.ID, hash, []string{"pwd"}, scope, request.binding(), crypt_utils.ConstMFAChallengeValidityPeriod)
+	if err != nil {
+		ctx.Logger.Error("failed to save mfa challenge", "err", err)
+		writeDevicePage(ctx, http.StatusInternalServerError, request, authorizePage{Error: "Internal server error"})
+		return
+	}
+
+	writeDevicePage(ctx, http.StatusOK, request, authorizePage{MFAToken: token})
+}
+
+// completeDeviceMFA verifies the second factor of a sign-in on the verification page. Only challenges created by the
+// password form for the same device code are accepted.
+func completeDeviceMFA(ctx *middlewares.AppContext, request *deviceRequest, mfaToken, code string) {
+	challenge, err := db.NewMFAChallengeQueries(ctx.DB).GetValidByHash(utils.HashToken(mfaToken))
+	if err != nil || challenge.Binding != request.binding() {
+		ctx.Logger.Debug("Invalid mfa challenge", "err", err)
+		writeDevicePage(ctx, http.StatusUnauthorized, request, authorizePage{Error: "Your sign-in has expired, please start again"})
+		return
+	}
+
+	if code == "" {
+		writeDevicePage(ctx, http.StatusBadRequest, request, authorizePage{MFAToken: mfaToken, Error: "A code is required"})
+		return
+	}
+
+	totpCode, recoveryCode := code, ""
+	if len(code) != crypt_utils.ConstTOTPDigits {
+		totpCode, recoveryCode = "", code
+	}
+
+	redeemed, err := redeemMFAChallenge(ctx, challenge, totpCode, recoveryCode)
+	if err != nil {
+		ctx.Logger.Error("failed to verify second factor", "err", err)
+		writeDevicePage(ctx, http.StatusInternalServerError, request, authorizePage{Error: "Internal server error"})
+		return
+	}
+
+	switch redeemed {
+	case mfaChallengeInvalidCode:
+		writeDevicePage(ctx, http.StatusUnauthorized, request, authorizePage{MFAToken: mfaToken, Error: "Invalid code"})
+		return
+	case mfaChallengeGone:
+		writeDevicePage(ctx, http.StatusUnauthorized, request, authorizePage{Error: "Your sign-in has expired, please start again"})
+		return
+	}
+
+	user, err := db.NewUserQueries(ctx.DB).GetByID(challenge.UserID)
+	if err != nil {
+		ctx.Logger.Error("Failed to get user", "user_id", challenge.UserID, "err", err)
+		writeDevicePage(ctx, http.StatusInternalServerError, request, authorizePage{Error: "Internal server error"})
+		return
+	}
+
+	askDeviceConsent(ctx, request, user, secondFactorAMR(challenge, totpCode), challenge.Scope)
+}
+
+// askDeviceConsent shows the approval page once the user has signed in
+func askDeviceConsent(ctx *middlewares.AppContext, request *deviceRequest, user *db.User, amr, scope []string) {
+	token, hash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		writeDevicePage(ctx, http.StatusInternalServerError, request, authorizePage{Error: "Internal server error"})
+		return
+	}
+
+	err = db.NewConsentRequestQueries(ctx.DB).Create(&db.ConsentRequest{
+		Hash:     hash,
+		UserID:   user.ID,
+		ClientID: request.Client.ClientID,
+		Scope:    scope,
+		AMR:      amr,
+		AuthTime: time.Now(),
+	}, crypt_utils.ConstConsentRequestValidityPeriod)
+	if err != nil {
+		ctx.Logger.Error("failed to save consent request", "err", err)
+		writeDevicePage(ctx, http.StatusInternalServerError, request, authorizePage{Error: "Internal server error"})
+		return
+	}
+
+	writeDevicePage(ctx, http.StatusOK, request, authorizePage{ConsentToken: token, Scopes: describeScopes(ctx, scope)})
+}
+
+// completeDeviceConsent records the user's answer for the device. Approved scopes are added to the user's grant for
+// the client, so the device shows up among the user's connected apps.
+func completeDeviceConsent(ctx *middlewares.AppContext, request *deviceRequest, consentToken, decision string) {
+	consent, err := db.NewConsentRequestQueries(ctx.DB).Consume(utils.HashToken(consentToken))
+	if err != nil || consent.ClientID != request.Client.ClientID {
+		if err != nil && strings.HasPrefix(err.Error(), "failed to") {
+			ctx.Logger.Error("failed to load consent request", "err", err)
+		}
+		writeDevicePage(ctx, http.StatusUnauthorized, request, authorizePage{Error: "Your sign-in has expired, please start again"})
+		return
+	}
+
+	deviceCodeQueries := db.NewDeviceCodeQueries(ctx.DB)
+
+	if decision != "allow" {
+		if err := deviceCodeQueries.Deny(request.Code.ID); err != nil && strings.HasPrefix(err.Error(), "failed to") {
+			ctx.Logger.Error("failed to deny device code", "err", err)
+			writeDevicePage(ctx, http.StatusInternalServerError, request, authorizePage{Error: "Internal server error"})
+			return
+		}
+		ctx.Logger.Info("Device authorization denied", "client_id", consent.ClientID, "user_id", consent.UserID)
+		writeDevicePage(ctx, http.StatusOK, request, authorizePage{Notice: "The device was not connected. You can close this window."})
+		return
+	}
+
+	if err := recordConsentGrant(ctx, consent); err != nil {
+		ctx.Logger.Error("failed to save consent grant", "err", err)
+		writeDevicePage(ctx, http.StatusInternalServerError, request, authorizePage{Error: "Internal server error"})
+		return
+	}
+
+	if err := deviceCodeQueries.Approve(request.Code.ID, consent.UserID, consent.AMR, consent.Scope, consent.AuthTime); err != nil {
+		if strings.HasPrefix(err.Error(), "failed to") {
+			ctx.Logger.Error("failed to approve device code", "err", err)
+			writeDevicePage(ctx, http.StatusInternalServerError, request, authorizePage{Error: "Internal server error"})
+			return
+		}
+		writeDeviceCodeEntry(ctx, http.StatusBadRequest, "Invalid or expired code")
+		return
+	}
+
+	ctx.Logger.Info("Device authorized", "client_id", consent.ClientID, "user_id", consent.UserID)
+	writeDevicePage(ctx, http.StatusOK, request, authorizePage{Notice: request.Client.Name + " is now connected. You can return to your device."})
+}
+
+// handleDeviceCodeGrant answers a device polling the token endpoint (RFC 8628 §3.4). Until the user answers, the
+// device gets authorization_pending, or slow_down when it polls faster than its interval, which then grows by 5
+// seconds. An approved code is redeemed once.
+func handleDeviceCodeGrant(ctx *middlewares.AppContext) {
+	client, ok := authenticateClient(ctx)
+	if !ok || !checkClientGrantType(ctx, client, deviceCodeGrantType) {
+		return
+	}
+
+	rawCode := ctx.Request.PostForm.Get("device_code")
+	if rawCode == "" {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_request", "device_code is required")
+		return
+	}
+
+	deviceCodeQueries := db.NewDeviceCodeQueries(ctx.DB)
+	code, err := deviceCodeQueries.GetByDeviceCode(utils.HashToken(rawCode))
+	if err != nil || code.ClientID != client.ClientID {
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			ctx.Logger.Error("failed to get device code", "err", err)
+			writeOAuthGrantError(ctx, errGrantInternal)
+			return
+		}
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "Invalid device code")
+		return
+	}
+
+	if code.IsExpired() {
+		writeOAuthError(ctx, http.StatusBadRequest, "expired_token", "The device code has expired")
+		return
+	}
+
+	switch code.Status {
+	case db.DeviceCodeDenied:
+		writeOAuthError(ctx, http.StatusBadRequest, "access_denied", "The user denied the request")
+		return
+	case db.DeviceCodePending:
+		interval := time.Duration(code.PollInterval) * time.Second
+		slowDown := code.LastPolledAt != nil && time.Since(*code.LastPolledAt) < interval
+		if err := deviceCodeQueries.RecordPoll(code.ID, slowDown); err != nil {
+			ctx.Logger.Error("failed to record device code poll", "err", err)
+		}
+		if slowDown {
+			writeOAuthError(ctx, http.StatusBadRequest, "slow_down", "Wait "+strconv.Itoa(code.PollInterval+5)+" seconds between requests")
+			return
+		}
+		writeOAuthError(ctx, http.StatusBadRequest, "authorization_pending", "The user has not answered the request yet")
+		return
+	}
+
+	if err := deviceCodeQueries.Redeem(code.ID); err != nil {
+		if strings.HasPrefix(err.Error(), "failed to") {
+			ctx.Logger.Error("failed to redeem device code", "err", err)
+			writeOAuthGrantError(ctx, errGrantInternal)
+			return
+		}
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "Invalid device code")
+		return
+	}
+
+	user, err := db.NewUserQueries(ctx.DB).GetByID(*code.UserID)
+	if err != nil {
+		ctx.Logger.Error("Failed to get user", "user_id", *code.UserID, "err", err)
+		writeOAuthGrantError(ctx, errGrantInternal)
+		return
+	}
+	if user.OrganizationID != ctx.Tenant.ID {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "Invalid device code")
+		return
+	}
+	if grantErr := accountStatusError(ctx, user); grantErr != nil {
+		writeOAuthGrantError(ctx, grantErr)
+		return
+	}
+
+	session, grantErr := issueSession(ctx, user, code.AMR, code.Scope, client)
+	if grantErr != nil {
+		writeOAuthGrantError(ctx, grantErr)
+		return
+	}
+
+	var idToken string
+	if slices.Contains(session.Scope, "openid") {
+		idToken, err = utils.GenerateIDToken(ctx, user, utils.IDTokenOptions{
+			ClientID:    client.ClientID,
+			AuthTime:    *code.AuthTime,
+			AMR:         code.AMR,
+			Scope:       session.Scope,
+			AccessToken: session.AccessToken,
+		})
+		if err != nil {
+			ctx.Logger.Error("failed to generate id token", "err", err)
+			writeOAuthGrantError(ctx, errGrantInternal)
+			return
+		}
+	}
+
+	ctx.WriteJSON(http.StatusOK, tokenResponse{
+		AccessToken:  session.AccessToken,
+		TokenType:    tokenType(ctx),
+		ExpiresIn:    int(crypt_utils.ConstAccessTokenValidityPeriod.Seconds()),
+		RefreshToken: session.RefreshToken,
+		IDToken:      idToken,
+		Scope:        utils.FormatScope(session.Scope),
+	})
+}
+
+// loadDeviceRequest loads the pending request of a user code as typed, showing the code entry form again when there
+// is none
+func loadDeviceRequest(ctx *middlewares.AppContext, userCode string) (*deviceRequest, bool) {
+	if utils.NormalizeUserCode(userCode) == "" {
+		writeDeviceCodeEntry(ctx, http.StatusBadRequest, "Enter the code shown on your device")
+		return nil, false
+	}
+
+	code, err := db.NewDeviceCodeQueries(ctx.DB).GetPendingByUserCode(utils.HashUserCode(userCode))
+	if err != nil {
+		if !strings.Contains(err.Error(), "not found") {
+			ctx.Logger.Error("failed to get device code", "err", err)
+		}
+		writeDeviceCodeEntry(ctx, http.StatusBadRequest, "Invalid or expired code")
+		return nil, false
+	}
+
+	client, err := db.NewOAuthClientQueries(ctx.DB).GetByClientID(code.ClientID)
+	if err != nil || client.OrganizationID != ctx.Tenant.ID {
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			ctx.Logger.Error("failed to get oauth client", "err", err)
+		}
+		writeDeviceCodeEntry(ctx, http.StatusBadRequest, "Invalid or expired code")
+		return nil, false
+	}
+
+	return &deviceRequest{Code: code, Client: client, UserCode: utils.FormatUserCode(userCode)}, true
+}
+
+// writeDeviceCodeEntry shows the form asking for the code shown on the device
+func writeDeviceCodeEntry(ctx *middlewares.AppContext, status int, message string) {
+	renderAuthorizePage(ctx, status, authorizePage{Action: ctx.TenantPath + "/oauth/device", UserCodeEntry: true, Error: message})
+}
+
+// writeDevicePage shows the sign-in, approval or result form of the verification page for a device request
+func writeDevicePage(ctx *middlewares.AppContext, status int, request *deviceRequest, page authorizePage) {
+	page.Action = ctx.TenantPath + "/oauth/device"
+	page.ClientName = request.Client.Name
+	page.Params = map[string]string{"user_code": request.UserCode}
+
+	renderAuthorizePage(ctx, status, page)
+}
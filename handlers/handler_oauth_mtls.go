@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"crypto/x509"
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// verifyClientCertificate authenticates a client by the TLS client certificate of the request (RFC 8705 §2). A
+// tls_client_auth client's certificate must chain to a CA of TLS_CLIENT_CA_FILE and carry the registered subject or
+// subject alternative name. A self_signed_tls_client_auth client's certificate must be registered in its jwks; its
+// chain is not checked.
+func verifyClientCertificate(ctx *middlewares.AppContext, client *db.OAuthClient) bool {
+	cert := middlewares.ClientCertificate(ctx)
+	if cert == nil {
+		ctx.Logger.Debug("No client certificate presented", "client_id", client.ClientID)
+		return false
+	}
+
+	switch client.TokenEndpointAuthMethod {
+	case db.AuthMethodTLSClientAuth:
+		if ctx.Config.TLS.ClientCAs == nil {
+			ctx.Logger.Warn("tls_client_auth client cannot authenticate without TLS_CLIENT_CA_FILE", "client_id", client.ClientID)
+			return false
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, intermediate := range middlewares.ClientCertificateChain(ctx) {
+			intermediates.AddCert(intermediate)
+		}
+		_, err := cert.Verify(x509.VerifyOptions{
+			Roots:         ctx.Config.TLS.ClientCAs,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			ctx.Logger.Debug("Client certificate not trusted", "client_id", client.ClientID, "err", err)
+			return false
+		}
+
+		if !matchesTLSClientAuth(cert, client.TLSClientAuthMetadata) {
+			ctx.Logger.Debug("Client certificate issued to another subject", "client_id", client.ClientID, "subject", cert.Subject.String())
+			return false
+		}
+		return true
+
+	case db.AuthMethodSelfSignedTLSClientAuth:
+		keys, err := crypt_utils.ParseClientJWKS(client.JWKS)
+		if err != nil {
+			ctx.Logger.Error("failed to parse registered jwks", "client_id", client.ClientID, "err", err)
+			return false
+		}
+		if !crypt_utils.JWKSContainsCertificate(keys, cert) {
+			ctx.Logger.Debug("Client certificate not registered", "client_id", client.ClientID)
+			return false
+		}
+		return true
+	}
+
+	return false
+}
+
+// matchesTLSClientAuth reports whether a certificate carries the subject or subject alternative name registered for
+// a tls_client_auth client
+func matchesTLSClientAuth(cert *x509.Certificate, registered db.TLSClientAuthMetadata) bool {
+	switch {
+	case registered.SubjectDN != "":
+		return cert.Subject.String() == registered.SubjectDN
+	case registered.SANDNS != "":
+		return slices.ContainsFunc(cert.DNSNames, func(name string) bool { return strings.EqualFold(name, registered.SANDNS) })
+	case registered.SANURI != "":
+		return slices.ContainsFunc(cert.URIs, func(uri *url.URL) bool { return uri.String() == registered.SANURI })
+	case registered.SANIP != "":
+		ip := net.ParseIP(registered.SANIP)
+		return slices.ContainsFunc(cert.IPAddresses, ip.Equal)
+	case registered.SANEmail != "":
+		return slices.ContainsFunc(cert.EmailAddresses, func(email string) bool { return strings.EqualFold(email, registered.SANEmail) })
+	}
+	return false
+}
+
+// validateCertificateMetadata checks the certificate metadata of a client: a tls_client_auth client names exactly one
+// subject or subject alternative name. Other clients have their tls_client_auth names cleared. The jwks of
+// self_signed_tls_client_auth clients is checked by validateClientKeys.
+func validateCertificateMetadata(client *db.OAuthClient) *clientMetadataError {
+	invalid := func(message string) *clientMetadataError {
+		return &clientMetadataError{Code: "invalid_client_metadata", Message: message}
+	}
+
+	// Clients switched to another method drop the names they authenticated with
+	if client.TokenEndpointAuthMethod != db.AuthMethodTLSClientAuth {
+		client.TLSClientAuthMetadata = db.TLSClientAuthMetadata{}
+		return nil
+	}
+
+	registered := client.TLSClientAuthMetadata
+	set := 0
+	for _, value := range []string{registered.SubjectDN, registered.SANDNS, registered.SANURI, registered.SANIP, registered.SANEmail} {
+		if value != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return invalid("tls_client_auth clients must set exactly one of tls_client_auth_subject_dn, tls_client_auth_san_dns, " +
+			"tls_client_auth_san_uri, tls_client_auth_san_ip and tls_client_auth_san_email")
+	}
+	if registered.SANIP != "" && net.ParseIP(registered.SANIP) == nil {
+		return invalid("tls_client_auth_san_ip must be an IP address")
+	}
+
+	return nil
+}
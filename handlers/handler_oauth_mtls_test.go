@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"jwt-auth-poc/config"
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestCertificate issues a certificate from template with a fresh key, signed by parent, or self-signed when parent
+// is nil
+func newTestCertificate(t *testing.T, template, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(time.Hour)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// newTestCA creates a self-signed certificate authority
+func newTestCA(t *testing.T, name string) (*x509.Certificate, crypto.Signer) {
+	return newTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+}
+
+// clientCertificateTemplate describes a client certificate for CN=billing,O=Example
+func clientCertificateTemplate() *x509.Certificate {
+	return &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "billing", Organization: []string{"Example"}},
+		DNSNames:    []string{"billing.example.com"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+}
+
+// mtlsContext is the context of a token request over a TLS connection presenting chain, leaf first
+func mtlsContext(cfg *config.Config, chain ...*x509.Certificate) *middlewares.AppContext {
+	r := httptest.NewRequest(http.MethodPost, "https://localhost:8443/oauth/token", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: chain}
+	return &middlewares.AppContext{
+		Context:  context.Background(),
+		Logger:   slog.New(slog.DiscardHandler),
+		Config:   cfg,
+		Request:  r,
+		Response: httptest.NewRecorder(),
+	}
+}
+
+func TestVerifyClientCertificateTLSClientAuth(t *testing.T) {
+	ca, caKey := newTestCA(t, "Test CA")
+	intermediate, intermediateKey := newTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test Intermediate"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, ca, caKey)
+	otherCA, otherCAKey := newTestCA(t, "Other CA")
+
+	cfg := &config.Config{}
+	cfg.TLS.ClientCAs = x509.NewCertPool()
+	cfg.TLS.ClientCAs.AddCert(ca)
+
+	leaf, _ := newTestCertificate(t, clientCertificateTemplate(), ca, caKey)
+	viaIntermediate, _ := newTestCertificate(t, clientCertificateTemplate(), intermediate, intermediateKey)
+	untrusted, _ := newTestCertificate(t, clientCertificateTemplate(), otherCA, otherCAKey)
+	selfSigned, _ := newTestCertificate(t, clientCertificateTemplate(), nil, nil)
+
+	serverAuth := clientCertificateTemplate()
+	serverAuth.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	serverOnly, _ := newTestCertificate(t, serverAuth, ca, caKey)
+
+	expiredTemplate := clientCertificateTemplate()
+	expiredTemplate.NotBefore = time.Now().Add(-2 * time.Hour)
+	expiredTemplate.NotAfter = time.Now().Add(-time.Hour)
+	expired, _ := newTestCertificate(t, expiredTemplate, ca, caKey)
+
+	subjectDN := db.TLSClientAuthMetadata{SubjectDN: "CN=billing,O=Example"}
+
+	tests := []struct {
+		name       string
+		registered db.TLSClientAuthMetadata
+		chain      []*x509.Certificate
+		want       bool
+	}{
+		{name: "subject dn", registered: subjectDN, chain: []*x509.Certificate{leaf}, want: true},
+		{name: "san dns", registered: db.TLSClientAuthMetadata{SANDNS: "Billing.Example.com"}, chain: []*x509.Certificate{leaf}, want: true},
+		{name: "intermediate sent by client", registered: subjectDN, chain: []*x509.Certificate{viaIntermediate, intermediate}, want: true},
+		{name: "intermediate missing", registered: subjectDN, chain: []*x509.Certificate{viaIntermediate}},
+		{name: "other subject", registered: db.TLSClientAuthMetadata{SubjectDN: "CN=payroll,O=Example"}, chain: []*x509.Certificate{leaf}},
+		{name: "other san dns", registered: db.TLSClientAuthMetadata{SANDNS: "payroll.example.com"}, chain: []*x509.Certificate{leaf}},
+		{name: "untrusted ca", registered: subjectDN, chain: []*x509.Certificate{untrusted}},
+		{name: "untrusted ca with its root sent", registered: subjectDN, chain: []*x509.Certificate{untrusted, otherCA}},
+		{name: "self-signed", registered: subjectDN, chain: []*x509.Certificate{selfSigned}},
+		{name: "without client authentication usage", registered: subjectDN, chain: []*x509.Certificate{serverOnly}},
+		{name: "expired", registered: subjectDN, chain: []*x509.Certificate{expired}},
+		{name: "no certificate", registered: subjectDN},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &db.OAuthClient{
+				ClientID:                "billing",
+				TokenEndpointAuthMethod: db.AuthMethodTLSClientAuth,
+				TLSClientAuthMetadata:   tt.registered,
+			}
+			if got := verifyClientCertificate(mtlsContext(cfg, tt.chain...), client); got != tt.want {
+				t.Errorf("verifyClientCertificate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyClientCertificateTLSClientAuthWithoutCAs(t *testing.T) {
+	ca, caKey := newTestCA(t, "Test CA")
+	leaf, _ := newTestCertificate(t, clientCertificateTemplate(), ca, caKey)
+
+	client := &db.OAuthClient{
+		ClientID:                "billing",
+		TokenEndpointAuthMethod: db.AuthMethodTLSClientAuth,
+		TLSClientAuthMetadata:   db.TLSClientAuthMetadata{SubjectDN: "CN=billing,O=Example"},
+	}
+	if verifyClientCertificate(mtlsContext(&config.Config{}, leaf), client) {
+		t.Error("certificate accepted without TLS_CLIENT_CA_FILE")
+	}
+}
+
+func TestVerifyClientCertificateSelfSigned(t *testing.T) {
+	registered, _ := newTestCertificate(t, clientCertificateTemplate(), nil, nil)
+	jwks, err := crypt_utils.CertificateJWKS(registered)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The chain and validity of a registered certificate are not checked
+	expiredTemplate := clientCertificateTemplate()
+	expiredTemplate.NotBefore = time.Now().Add(-2 * time.Hour)
+	expiredTemplate.NotAfter = time.Now().Add(-time.Hour)
+	expired, _ := newTestCertificate(t, expiredTemplate, nil, nil)
+	expiredJWKS, err := crypt_utils.CertificateJWKS(expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A certificate with the registered subject, issued by a CA, is still not the registered certificate
+	ca, caKey := newTestCA(t, "Test CA")
+	sameSubject, _ := newTestCertificate(t, clientCertificateTemplate(), ca, caKey)
+	other, _ := newTestCertificate(t, clientCertificateTemplate(), nil, nil)
+
+	tests := []struct {
+		name  string
+		jwks  []byte
+		chain []*x509.Certificate
+		want  bool
+	}{
+		{name: "registered", jwks: jwks, chain: []*x509.Certificate{registered}, want: true},
+		{name: "registered and expired", jwks: expiredJWKS, chain: []*x509.Certificate{expired}, want: true},
+		{name: "other self-signed", jwks: jwks, chain: []*x509.Certificate{other}},
+		{name: "same subject from a ca", jwks: jwks, chain: []*x509.Certificate{sameSubject, ca}},
+		{name: "no certificate", jwks: jwks},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &db.OAuthClient{
+				ClientID:                "billing",
+				TokenEndpointAuthMethod: db.AuthMethodSelfSignedTLSClientAuth,
+				JWKS:                    tt.jwks,
+			}
+			if got := verifyClientCertificate(mtlsContext(&config.Config{}, tt.chain...), client); got != tt.want {
+				t.Errorf("verifyClientCertificate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,500 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// codeVerifierPattern matches a PKCE code_verifier (RFC 7636 §4.1)
+var codeVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+
+// tokenResponse is a successful token endpoint response (RFC 6749 §5.1)
+type tokenResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type,omitempty"` // token exchange only (RFC 8693 §2.2.1)
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int    `json:"expires_in"`
+	RefreshToken    string `json:"refresh_token,omitempty"`
+	IDToken         string `json:"id_token,omitempty"`
+	Scope           string `json:"scope,omitempty"`
+}
+
+// HandleOAuthTokenPOST is the OAuth 2.0 token endpoint (RFC 6749 §3.2). Requests are form encoded and the grant is
+// selected by grant_type. /api/login and /api/refresh remain as JSON equivalents of the password and refresh_token
+// grants.
+func HandleOAuthTokenPOST(ctx *middlewares.AppContext) {
+	// Token responses carry credentials and must not be cached (RFC 6749 §5.1).
+	ctx.Response.Header().Set("Cache-Control", "no-store")
+	ctx.Response.Header().Set("Pragma", "no-cache")
+
+	if err := ctx.Request.ParseForm(); err != nil {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_request", "The request body must be form encoded")
+		return
+	}
+
+	// A DPoP proof binds the issued tokens to the client's key (RFC 9449 §5). Without one, bearer tokens are issued.
+	if ctx.Request.Header.Get("DPoP") != "" {
+		if _, dpopErr := middlewares.VerifyDPoPProof(ctx, ""); dpopErr != nil {
+			if dpopErr.Code == middlewares.DPoPErrorUseNonce {
+				middlewares.SetDPoPNonce(ctx)
+			}
+			writeOAuthError(ctx, http.StatusBadRequest, dpopErr.Code, dpopErr.Message)
+			return
+		}
+		middlewares.SetDPoPNonce(ctx)
+	}
+
+	switch grantType := ctx.Request.PostForm.Get("grant_type"); grantType {
+	case "authorization_code":
+		handleAuthorizationCodeGrant(ctx)
+	case "password":
+		handlePasswordGrant(ctx)
+	case "refresh_token":
+		handleRefreshTokenGrant(ctx)
+	case "client_credentials":
+		handleClientCredentialsGrant(ctx)
+	case deviceCodeGrantType:
+		handleDeviceCodeGrant(ctx)
+	case tokenExchangeGrantType:
+		handleTokenExchangeGrant(ctx)
+	case jwtBearerGrantType:
+		handleJWTBearerGrant(ctx)
+	case "":
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_request", "grant_type is required")
+	default:
+		writeOAuthError(ctx, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant_type: "+grantType)
+	}
+}
+
+// tokenType is the token_type of issued access tokens: DPoP when bound to the key of the request's proof
+func tokenType(ctx *middlewares.AppContext) string {
+	if middlewares.GetDPoPProof(ctx) != nil {
+		return "DPoP"
+	}
+	return "Bearer"
+}
+
+// handleAuthorizationCodeGrant exchanges a code from the authorization endpoint for tokens (RFC 6749 §4.1.3). The
+// code can only be redeemed once, by the client it was issued to, with the same redirect_uri and, when the
+// authorization request carried a PKCE challenge, the matching code_verifier (RFC 7636 §4.5). Requests with the
+// openid scope also receive an ID token (OIDC Core §3.1.3.3).
+func handleAuthorizationCodeGrant(ctx *middlewares.AppContext) {
+	client, ok := authenticateClient(ctx)
+	if !ok || !checkClientGrantType(ctx, client, "authorization_code") {
+		return
+	}
+
+	rawCode := ctx.Request.PostForm.Get("code")
+	if rawCode == "" {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_request", "code is required")
+		return
+	}
+
+	codeQueries := db.NewAuthorizationCodeQueries(ctx.DB)
+	code, err := codeQueries.Consume(utils.HashToken(rawCode))
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "failed to") {
+			ctx.Logger.Error("failed to redeem authorization code", "err", err)
+			writeOAuthGrantError(ctx, errGrantInternal)
+			return
+		}
+		// A code presented twice may have been intercepted, so the tokens issued for it are revoked (RFC 6749 §4.1.2)
+		if reused, err := codeQueries.RevokeReused(utils.HashToken(rawCode)); err != nil {
+			ctx.Logger.Error("failed to revoke tokens of reused authorization code", "err", err)
+		} else if reused {
+			ctx.Logger.Warn("Authorization code reused; revoked the refresh token issued for it", "client_id", client.ClientID)
+		}
+		ctx.Logger.Debug("Invalid authorization code", "client_id", client.ClientID, "err", err)
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+
+	if code.ClientID != client.ClientID {
+		ctx.Logger.Debug("Authorization code presented by another client", "code_client_id", code.ClientID, "client_id", client.ClientID)
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+
+	if ctx.Request.PostForm.Get("redirect_uri") != code.RedirectURI {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match the authorization request")
+		return
+	}
+
+	verifier := ctx.Request.PostForm.Get("code_verifier")
+	if code.CodeChallenge == "" && verifier != "" {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "code_verifier was sent for an authorization request without PKCE")
+		return
+	}
+	if code.CodeChallenge != "" && !verifyCodeChallenge(verifier, code.CodeChallenge) {
+		ctx.Logger.Debug("PKCE verification failed", "client_id", client.ClientID)
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "Invalid code_verifier")
+		return
+	}
+
+	user, err := db.NewUserQueries(ctx.DB).GetByID(code.UserID)
+	if err != nil {
+		ctx.Logger.Error("Failed to get user", "user_id", code.UserID, "err", err)
+		writeOAuthGrantError(ctx, errGrantInternal)
+		return
+	}
+	if user.OrganizationID != ctx.Tenant.ID {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+	if grantErr := accountStatusError(ctx, user); grantErr != nil {
+		writeOAuthGrantError(ctx, grantErr)
+		return
+	}
+
+	session, grantErr := issueSession(ctx, user, code.AMR, code.Scope, client)
+	if grantErr != nil {
+		writeOAuthGrantError(ctx, grantErr)
+		return
+	}
+	if session.RefreshTokenID != 0 {
+		if err := codeQueries.RecordRefreshToken(code.ID, session.RefreshTokenID); err != nil {
+			if err := db.NewRefreshTokenQueries(ctx.DB).DeleteByID(session.RefreshTokenID); err != nil {
+				ctx.Logger.Error("failed to revoke refresh token of reused authorization code", "err", err)
+			}
+			if strings.HasPrefix(err.Error(), "failed to") {
+				ctx.Logger.Error("failed to record refresh token of authorization code", "err", err)
+				writeOAuthGrantError(ctx, errGrantInternal)
+				return
+			}
+			writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+			return
+		}
+	}
+
+	var idToken string
+	if slices.Contains(session.Scope, "openid") {
+		idToken, err = utils.GenerateIDToken(ctx, user, utils.IDTokenOptions{
+			ClientID:    client.ClientID,
+			Nonce:       code.Nonce,
+			AuthTime:    code.AuthTime,
+			AMR:         code.AMR,
+			Scope:       session.Scope,
+			AccessToken: session.AccessToken,
+		})
+		if err != nil {
+			ctx.Logger.Error("failed to generate id token", "err", err)
+			writeOAuthGrantError(ctx, errGrantInternal)
+			return
+		}
+	}
+
+	ctx.WriteJSON(http.StatusOK, tokenResponse{
+		AccessToken:  session.AccessToken,
+		TokenType:    tokenType(ctx),
+		ExpiresIn:    int(crypt_utils.ConstAccessTokenValidityPeriod.Seconds()),
+		RefreshToken: session.RefreshToken,
+		IDToken:      idToken,
+		Scope:        utils.FormatScope(session.Scope),
+	})
+}
+
+// handlePasswordGrant exchanges a user's email and password for tokens (RFC 6749 §4.3). Client authentication is
+// optional for first-party callers; an authenticated client binds the refresh token to itself and bounds the scope
+// by its registered scope. Accounts with a second factor must sign in through /api/login instead.
+func handlePasswordGrant(ctx *middlewares.AppContext) {
+	client, ok := optionalClient(ctx)
+	if !ok || (client != nil && !checkClientGrantType(ctx, client, "password")) {
+		return
+	}
+
+	username := strings.TrimSpace(ctx.Request.PostForm.Get("username"))
+	password := strings.TrimSpace(ctx.Request.PostForm.Get("password"))
+	if username == "" || password == "" {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_request", "username and password are required")
+		return
+	}
+
+	requested := utils.ParseScope(ctx.Request.PostForm.Get("scope"))
+	if client != nil {
+		if len(requested) == 0 {
+			requested = client.Scope
+		} else if !utils.IsScopeSubset(requested, client.Scope) {
+			writeOAuthError(ctx, http.StatusBadRequest, "invalid_scope", "The requested scope exceeds the scope registered for the client")
+			return
+		}
+	}
+
+	user, grantErr := checkPasswordLogin(ctx, username, password)
+	if grantErr == nil {
+		grantErr = accountStatusError(ctx, user)
+	}
+	if grantErr != nil {
+		writeOAuthGrantError(ctx, grantErr)
+		return
+	}
+
+	scope, grantErr := resolveLoginScope(ctx, user.ID, requested)
+	if grantErr != nil {
+		writeOAuthGrantError(ctx, grantErr)
+		return
+	}
+
+	methods, err := secondFactorMethods(ctx, user.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to check mfa status", "err", err)
+		writeOAuthGrantError(ctx, errGrantInternal)
+		return
+	}
+	if len(methods) > 0 {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "Multi-factor authentication is required for this account")
+		return
+	}
+
+	session, grantErr := issueSession(ctx, user, []string{"pwd"}, scope, client)
+	if grantErr != nil {
+		writeOAuthGrantError(ctx, grantErr)
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, tokenResponse{
+		AccessToken:  session.AccessToken,
+		TokenType:    tokenType(ctx),
+		ExpiresIn:    int(crypt_utils.ConstAccessTokenValidityPeriod.Seconds()),
+		RefreshToken: session.RefreshToken,
+		Scope:        utils.FormatScope(session.Scope),
+	})
+}
+
+// handleRefreshTokenGrant exchanges a refresh token for a new access token (RFC 6749 §6). A refresh token issued to
+// a client must be presented by that client; the refresh token itself is not rotated.
+func handleRefreshTokenGrant(ctx *middlewares.AppContext) {
+	client, ok := optionalClient(ctx)
+	if !ok || (client != nil && !checkClientGrantType(ctx, client, "refresh_token")) {
+		return
+	}
+
+	refreshToken := strings.TrimSpace(ctx.Request.PostForm.Get("refresh_token"))
+	if refreshToken == "" {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_request", "refresh_token is required")
+		return
+	}
+
+	clientID := ""
+	if client != nil {
+		clientID = client.ClientID
+	}
+
+	accessToken, granted, grantErr := refreshSession(ctx, refreshToken, utils.ParseScope(ctx.Request.PostForm.Get("scope")), clientID)
+	if grantErr != nil {
+		writeOAuthGrantError(ctx, grantErr)
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, tokenResponse{
+		AccessToken: accessToken,
+		TokenType:   tokenType(ctx),
+		ExpiresIn:   int(crypt_utils.ConstAccessTokenValidityPeriod.Seconds()),
+		Scope:       utils.FormatScope(granted),
+	})
+}
+
+// handleClientCredentialsGrant issues a service token to a confidential client acting on its own behalf (RFC 6749
+// §4.4). No refresh token is issued; the client authenticates again instead.
+func handleClientCredentialsGrant(ctx *middlewares.AppContext) {
+	client, ok := authenticateClient(ctx)
+	if !ok || !checkClientGrantType(ctx, client, "client_credentials") {
+		return
+	}
+
+	scope := client.Scope
+	if requested := utils.ParseScope(ctx.Request.PostForm.Get("scope")); len(requested) > 0 {
+		if !utils.IsScopeSubset(requested, client.Scope) {
+			writeOAuthError(ctx, http.StatusBadRequest, "invalid_scope", "The requested scope exceeds the scope registered for the client")
+			return
+		}
+		scope = requested
+	}
+
+	accessToken, scope, err := utils.GenerateServiceToken(ctx, client, scope)
+	if err != nil {
+		writeOAuthGrantError(ctx, serviceTokenError(ctx, client, err))
+		return
+	}
+
+	ctx.Logger.Info("Service token issued", "client_id", client.ClientID)
+
+	ctx.WriteJSON(http.StatusOK, tokenResponse{
+		AccessToken: accessToken,
+		TokenType:   tokenType(ctx),
+		ExpiresIn:   client.TokenLifetime,
+		Scope:       utils.FormatScope(scope),
+	})
+}
+
+// authenticateClient authenticates the client of a token request with client_secret_basic or client_secret_post
+// (RFC 6749 §2.3.1). Using both at once is refused. During a secret rotation's overlap the previous secret is
+// accepted as well. Public clients have no secret and are identified by their client_id alone; they must not send
+// one. Clients registered for tls_client_auth or self_signed_tls_client_auth send their client_id in the body and
+// authenticate with their TLS client certificate (RFC 8705 §2). private_key_jwt clients send a client_assertion
+// instead, see authenticateClientAssertion.
+func authenticateClient(ctx *middlewares.AppContext) (*db.OAuthClient, bool) {
+	if hasClientAssertion(ctx) {
+		client, ok := authenticateClientAssertion(ctx)
+		return client, ok && limitClient(ctx, client)
+	}
+
+	clientID, secret, basic := ctx.Request.BasicAuth()
+	if basic {
+		// The credentials are form-urlencoded before being placed in the header.
+		var errID, errSecret error
+		clientID, errID = url.QueryUnescape(clientID)
+		secret, errSecret = url.QueryUnescape(secret)
+		if errID != nil || errSecret != nil {
+			writeInvalidClient(ctx, basic)
+			return nil, false
+		}
+		if ctx.Request.PostForm.Get("client_secret") != "" {
+			writeOAuthError(ctx, http.StatusBadRequest, "invalid_request", "Only one client authentication method may be used")
+			return nil, false
+		}
+	} else {
+		clientID = ctx.Request.PostForm.Get("client_id")
+		secret = ctx.Request.PostForm.Get("client_secret")
+	}
+
+	if clientID == "" {
+		writeInvalidClient(ctx, basic)
+		return nil, false
+	}
+
+	client, err := db.NewOAuthClientQueries(ctx.DB).GetByClientID(clientID)
+	if err != nil || client.OrganizationID != ctx.Tenant.ID {
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			ctx.Logger.Error("failed to look up oauth client", "err", err)
+			writeOAuthError(ctx, http.StatusInternalServerError, "server_error", "Internal server error")
+			return nil, false
+		}
+		writeInvalidClient(ctx, basic)
+		return nil, false
+	}
+
+	if client.UsesCertificate() {
+		if basic || secret != "" || !verifyClientCertificate(ctx, client) {
+			writeInvalidClient(ctx, basic)
+			return nil, false
+		}
+		return client, limitClient(ctx, client)
+	}
+
+	if client.TokenEndpointAuthMethod == db.AuthMethodPrivateKeyJWT {
+		ctx.Logger.Debug("Client assertion missing", "client_id", clientID)
+		writeInvalidClient(ctx, basic)
+		return nil, false
+	}
+
+	if client.IsPublic() {
+		if secret != "" {
+			ctx.Logger.Debug("Secret sent for public client", "client_id", clientID)
+			writeInvalidClient(ctx, basic)
+			return nil, false
+		}
+		return client, true
+	}
+
+	secretHash := utils.HashToken(secret)
+	valid := subtle.ConstantTimeCompare([]byte(secretHash), []byte(client.SecretHash)) == 1
+	if !valid && client.PreviousSecretValid() {
+		valid = subtle.ConstantTimeCompare([]byte(secretHash), []byte(client.PreviousSecretHash)) == 1
+	}
+	if secret == "" || !valid {
+		ctx.Logger.Debug("Invalid client secret", "client_id", clientID)
+		writeInvalidClient(ctx, basic)
+		return nil, false
+	}
+
+	return client, limitClient(ctx, client)
+}
+
+// limitClient applies the token endpoint rate limit to an authenticated confidential client, on top of the limit per
+// IP address the route applies. Public clients only name themselves, so anyone could drain their bucket.
+func limitClient(ctx *middlewares.AppContext, client *db.OAuthClient) bool {
+	return middlewares.LimitRequest(ctx, ctx.Config.RateLimits.Refresh, "client:"+client.ClientID)
+}
+
+// serviceTokenError maps a failure to issue a service token to its token endpoint error
+func serviceTokenError(ctx *middlewares.AppContext, client *db.OAuthClient, err error) *grantError {
+	if errors.Is(err, utils.ErrClientOwnerInactive) {
+		return &grantError{Code: "unauthorized_client", Message: "The user responsible for the client is no longer active"}
+	}
+	ctx.Logger.Error("failed to generate service token", "client_id", client.ClientID, "err", err)
+	return errGrantInternal
+}
+
+// checkClientGrantType refuses a grant the client is not registered for with unauthorized_client (RFC 6749 §5.2)
+func checkClientGrantType(ctx *middlewares.AppContext, client *db.OAuthClient, grantType string) bool {
+	if !client.AllowsGrantType(grantType) {
+		writeOAuthError(ctx, http.StatusBadRequest, "unauthorized_client", "The client is not registered for the "+grantType+" grant")
+		return false
+	}
+	return true
+}
+
+// optionalClient authenticates the client when the request carries client credentials. It returns nil without
+// writing a response when there are none.
+func optionalClient(ctx *middlewares.AppContext) (*db.OAuthClient, bool) {
+	if _, _, basic := ctx.Request.BasicAuth(); !basic && ctx.Request.PostForm.Get("client_id") == "" && !hasClientAssertion(ctx) {
+		return nil, true
+	}
+	return authenticateClient(ctx)
+}
+
+// verifyCodeChallenge checks a PKCE code_verifier against an S256 code_challenge (RFC 7636 §4.6)
+func verifyCodeChallenge(verifier, challenge string) bool {
+	if !codeVerifierPattern.MatchString(verifier) {
+		return false
+	}
+	hash := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(hash[:])), []byte(challenge)) == 1
+}
+
+// writeInvalidClient answers a failed client authentication, with a Basic challenge when the client used the
+// Authorization header (RFC 6749 §5.2)
+func writeInvalidClient(ctx *middlewares.AppContext, basic bool) {
+	if basic {
+		ctx.Response.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	writeOAuthError(ctx, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+}
+
+// writeOAuthGrantError writes a grantError as an OAuth 2.0 error response. Errors other than invalid_client,
+// server errors and throttling use 400, as RFC 6749 §5.2 requires.
+func writeOAuthGrantError(ctx *middlewares.AppContext, grantErr *grantError) {
+	status := http.StatusBadRequest
+	switch {
+	case grantErr.Code == "invalid_client":
+		status = http.StatusUnauthorized
+	case grantErr.Status >= http.StatusInternalServerError:
+		status = http.StatusInternalServerError
+	case grantErr.RetryAfter > 0:
+		status = http.StatusTooManyRequests
+		ctx.Response.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(grantErr.RetryAfter.Seconds()))))
+	}
+
+	writeOAuthError(ctx, status, grantErr.Code, grantErr.Message)
+}
+
+// writeOAuthError writes an OAuth 2.0 error response (RFC 6749 §5.2)
+func writeOAuthError(ctx *middlewares.AppContext, status int, code, description string) {
+	ctx.WriteJSON(status, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
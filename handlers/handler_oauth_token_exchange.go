@@ -0,0 +1,323 @@
+package handlers
+
+import (
+	"errors"
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Token exchange grant type and token type identifiers (RFC 8693 §2.1, §3)
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+	jwtTokenType           = "urn:ietf:params:oauth:token-type:jwt"
+
+	// userIDTokenType names the impersonated user by ID rather than by a token of theirs. It is only accepted with
+	// an actor token of a user who may impersonate.
+	userIDTokenType = "urn:jwt-auth-poc:params:oauth:token-type:user_id"
+)
+
+// impersonatePermission lets a user act as other users of the organization through token exchange
+const impersonatePermission = "users:impersonate"
+
+// exchangeToken is a subject or actor token presented for exchange, after validation
+type exchangeToken struct {
+	Subject     string
+	Service     bool // a client's service token rather than a user's access token
+	Scope       []string
+	Permissions []string
+	AMR         []string
+	Audience    []string
+	Actor       *middlewares.ActorClaim
+	ExpiresAt   time.Time
+}
+
+// handleTokenExchangeGrant issues an access token for the user of a subject token, narrowed in scope and audience
+// (RFC 8693 §2). The client must be confidential and registered for the grant.
+//
+// Without an actor token, the client delegates: an API gateway swaps a user's token for one meant for a downstream
+// service. With one, the token carries an act claim naming the actor. The actor may be the client itself, through
+// its own service token, or a user holding users:impersonate. Such a user may also name the subject by user ID to
+// impersonate them, which is audited. The scope cannot exceed the client's registered scope nor the subject token's
+// scope, or for impersonation the actor token's, so nobody gains permissions by exchanging. Audiences must be
+// registered for the client, and a token already narrowed to audiences can only be narrowed further. The new token
+// never outlives the tokens it was exchanged for, and no refresh token is issued.
+func handleTokenExchangeGrant(ctx *middlewares.AppContext) {
+	client, ok := authenticateClient(ctx)
+	if !ok || !checkClientGrantType(ctx, client, tokenExchangeGrantType) {
+		return
+	}
+
+	form := ctx.Request.PostForm
+	if requested := form.Get("requested_token_type"); requested != "" && requested != accessTokenType && requested != jwtTokenType {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_request", "Only access tokens can be requested")
+		return
+	}
+
+	subjectToken, subjectTokenType := form.Get("subject_token"), form.Get("subject_token_type")
+	if subjectToken == "" || subjectTokenType == "" {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_request", "subject_token and subject_token_type are required")
+		return
+	}
+
+	actorToken, actorTokenType := form.Get("actor_token"), form.Get("actor_token_type")
+	if (actorToken == "") != (actorTokenType == "") {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_request", "actor_token and actor_token_type must be sent together")
+		return
+	}
+
+	var actor *exchangeToken
+	if actorToken != "" {
+		if actor, ok = validateExchangeToken(ctx, "actor_token", actorToken, actorTokenType); !ok {
+			return
+		}
+		if actor.Service && actor.Subject != client.ClientID {
+			writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "A service token may only act for the client it was issued to")
+			return
+		}
+		if !actor.Service && !slices.Contains(actor.Permissions, impersonatePermission) {
+			writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "The actor is not allowed to act for other users")
+			return
+		}
+	}
+
+	var subject *exchangeToken
+	impersonation := subjectTokenType == userIDTokenType
+	if impersonation {
+		if actor == nil || actor.Service {
+			writeOAuthError(ctx, http.StatusBadRequest, "invalid_request", "Naming the subject by user ID requires an actor_token of a user who may impersonate")
+			return
+		}
+		subject = &exchangeToken{Subject: subjectToken, Scope: actor.Scope, ExpiresAt: actor.ExpiresAt}
+	} else {
+		if subject, ok = validateExchangeToken(ctx, "subject_token", subjectToken, subjectTokenType); !ok {
+			return
+		}
+		if subject.Service {
+			writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "subject_token must be a user's access token")
+			return
+		}
+	}
+
+	userID, err := strconv.Atoi(subject.Subject)
+	if err != nil {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "Unknown subject")
+		return
+	}
+	user, err := db.NewUserQueries(ctx.DB).GetByID(userID)
+	if err != nil || user.OrganizationID != ctx.Tenant.ID {
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			ctx.Logger.Error("Failed to get user", "user_id", userID, "err", err)
+			writeOAuthGrantError(ctx, errGrantInternal)
+			return
+		}
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "Unknown subject")
+		return
+	}
+	if grantErr := accountStatusError(ctx, user); grantErr != nil {
+		writeOAuthGrantError(ctx, grantErr)
+		return
+	}
+
+	bound := utils.IntersectScope(subject.Scope, client.Scope)
+	scope := bound
+	if requested := utils.ParseScope(form.Get("scope")); len(requested) > 0 {
+		if !utils.IsScopeSubset(requested, bound) {
+			writeOAuthError(ctx, http.StatusBadRequest, "invalid_scope", "The requested scope exceeds the scope of the subject or the client")
+			return
+		}
+		scope = requested
+	}
+	// Scopes the user does not hold are dropped, so an impersonated user's token only carries scopes both users hold.
+	// What remains may be empty, which still lets a support user see the account as its owner does.
+	allowed, err := utils.AllowedScopes(ctx, user.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to load allowed scopes", "err", err)
+		writeOAuthGrantError(ctx, errGrantInternal)
+		return
+	}
+	scope = utils.IntersectScope(scope, allowed)
+
+	audience, ok := resolveExchangeAudience(ctx, client, subject.Audience)
+	if !ok {
+		return
+	}
+
+	// The new token names its actor, keeping earlier actors of the subject token nested inside. Without an actor
+	// token, an earlier act claim is kept as is.
+	act := subject.Actor
+	if actor != nil {
+		act = &middlewares.ActorClaim{Subject: actor.Subject, Actor: subject.Actor}
+		if actor.Service {
+			act.ClientID = client.ClientID
+		}
+	}
+
+	expiresAt := time.Now().Add(crypt_utils.ConstAccessTokenValidityPeriod)
+	for _, limit := range []time.Time{subject.ExpiresAt, actorExpiry(actor)} {
+		if !limit.IsZero() && limit.Before(expiresAt) {
+			expiresAt = limit
+		}
+	}
+
+	accessToken, err := utils.GenerateAccessToken(ctx, user, utils.AccessTokenOptions{
+		AMR:       subject.AMR,
+		Scope:     scope,
+		ClientID:  client.ClientID,
+		Audience:  audience,
+		Actor:     act,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		ctx.Logger.Error("failed to generate access token", "err", err)
+		writeOAuthGrantError(ctx, errGrantInternal)
+		return
+	}
+
+	// The actor, or else the client, is recorded as the caller.
+	if actor != nil && !actor.Service {
+		ctx.Set("user_id", actor.Subject)
+	} else {
+		ctx.Set("client_id", client.ClientID)
+	}
+	action := "token.exchange"
+	if impersonation || (actor != nil && !actor.Service && actor.Subject != subject.Subject) {
+		action = "user.impersonate"
+	}
+	utils.RecordAudit(ctx, action, "user", strconv.Itoa(user.ID), map[string]interface{}{
+		"client_id": client.ClientID,
+		"scope":     utils.FormatScope(scope),
+		"audience":  audience,
+	})
+
+	ctx.WriteJSON(http.StatusOK, tokenResponse{
+		AccessToken:     accessToken,
+		IssuedTokenType: accessTokenType,
+		TokenType:       tokenType(ctx),
+		ExpiresIn:       int(time.Until(expiresAt).Seconds()),
+		Scope:           utils.FormatScope(scope),
+	})
+}
+
+// validateExchangeToken validates a subject or actor token: an access token issued by this organization, checked
+// like RequireJWT checks bearer tokens. The token's audience is not checked, since the token endpoint is not the
+// service it was meant for. A token bound to a DPoP key or a client certificate is only accepted from a request that
+// proves possession of it, with a DPoP proof signed by the key or over a connection presenting the certificate.
+func validateExchangeToken(ctx *middlewares.AppContext, param, raw, tokenType string) (*exchangeToken, bool) {
+	if tokenType != accessTokenType && tokenType != jwtTokenType {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_request", "Unsupported "+param+"_type")
+		return nil, false
+	}
+
+	invalid := func() (*exchangeToken, bool) {
+		writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "Invalid or expired "+param)
+		return nil, false
+	}
+
+	claims, err := ctx.JWTProvider.ValidateToken(raw)
+	if err != nil {
+		ctx.Logger.Debug("Exchanged token validation failed", "param", param, "err", err)
+		return invalid()
+	}
+
+	subject, _ := claims["sub"].(string)
+	tenant, _ := claims["tenant"].(string)
+	if subject == "" || tenant != ctx.Tenant.Slug || claims["iss"] != ctx.Issuer() {
+		return invalid()
+	}
+
+	if jkt := middlewares.ClaimJKT(claims["cnf"]); jkt != "" {
+		proof := middlewares.GetDPoPProof(ctx)
+		if proof == nil || proof.Thumbprint != jkt {
+			writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "The "+param+" is bound to a DPoP key the request did not prove possession of")
+			return nil, false
+		}
+	}
+	if x5t := middlewares.ClaimCertificateThumbprint(claims["cnf"]); x5t != "" {
+		cert := middlewares.ClientCertificate(ctx)
+		if cert == nil || crypt_utils.CertificateThumbprint(cert) != x5t {
+			writeOAuthError(ctx, http.StatusBadRequest, "invalid_grant", "The "+param+" is bound to a client certificate that was not presented")
+			return nil, false
+		}
+	}
+
+	token := &exchangeToken{
+		Subject:     subject,
+		Service:     claims["token_use"] == middlewares.TokenUseService,
+		Permissions: middlewares.ClaimStrings(claims["permissions"]),
+		AMR:         middlewares.ClaimStrings(claims["amr"]),
+		Actor:       middlewares.ParseActorClaim(claims["act"]),
+	}
+	scope, _ := claims["scope"].(string)
+	token.Scope = strings.Fields(scope)
+	token.Audience = middlewares.ClaimAudience(claims["aud"])
+	if expiry, ok := claims["exp"].(float64); ok {
+		token.ExpiresAt = time.Unix(int64(expiry), 0)
+	}
+
+	if token.Service {
+		client, err := db.NewOAuthClientQueries(ctx.DB).GetByClientID(subject)
+		if err != nil || client.OrganizationID != ctx.Tenant.ID {
+			return invalid()
+		}
+		if token.Permissions, err = utils.ClientOwnerScope(ctx, client, token.Permissions); err != nil {
+			if !errors.Is(err, utils.ErrClientOwnerInactive) {
+				ctx.Logger.Error("failed to resolve client owner permissions", "client_id", subject, "err", err)
+			}
+			return invalid()
+		}
+	} else {
+		id, err := strconv.Atoi(subject)
+		if err != nil {
+			return invalid()
+		}
+		user, err := db.NewUserQueries(ctx.DB).GetByID(id)
+		if err != nil || user.OrganizationID != ctx.Tenant.ID || !user.IsActive() {
+			return invalid()
+		}
+	}
+
+	return token, true
+}
+
+// resolveExchangeAudience picks the audience of an exchanged token from the audience and resource parameters. Each
+// must be registered for the client, or be this issuer. A subject token already narrowed to audiences only lets the
+// new token keep some of them; without any requested, the subject token's audience carries over.
+func resolveExchangeAudience(ctx *middlewares.AppContext, client *db.OAuthClient, subjectAudience []string) ([]string, bool) {
+	requested := slices.Concat(ctx.Request.PostForm["audience"], ctx.Request.PostForm["resource"])
+	if len(requested) == 0 {
+		return subjectAudience, true
+	}
+
+	audience := []string{}
+	for _, value := range requested {
+		if !slices.Contains(client.TokenExchangeAudiences, value) && value != ctx.Issuer() {
+			writeOAuthError(ctx, http.StatusBadRequest, "invalid_target", "The client may not request the audience "+strconv.Quote(value))
+			return nil, false
+		}
+		if len(subjectAudience) > 0 && !slices.Contains(subjectAudience, value) {
+			writeOAuthError(ctx, http.StatusBadRequest, "invalid_target", "The audience "+strconv.Quote(value)+" is outside the subject token's audience")
+			return nil, false
+		}
+		if !slices.Contains(audience, value) {
+			audience = append(audience, value)
+		}
+	}
+
+	return audience, true
+}
+
+// actorExpiry returns when the actor token expires, or the zero time without one
+func actorExpiry(actor *exchangeToken) time.Time {
+	if actor == nil {
+		return time.Time{}
+	}
+	return actor.ExpiresAt
+}
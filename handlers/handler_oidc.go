@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"net/http"
+)
+
+// openIDConfiguration is the OpenID Provider metadata (OIDC Discovery §3)
+type openIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	RegistrationEndpoint              string   `json:"registration_endpoint"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	ResponseModesSupported            []string `json:"response_modes_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	TokenEndpointAuthSigningAlgValues []string `json:"token_endpoint_auth_signing_alg_values_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	DPoPSigningAlgValuesSupported     []string `json:"dpop_signing_alg_values_supported"`
+	TLSClientCertificateBoundTokens   bool     `json:"tls_client_certificate_bound_access_tokens"`
+	ACRValuesSupported                []string `json:"acr_values_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	ClaimsParameterSupported          bool     `json:"claims_parameter_supported"`
+	RequestParameterSupported         bool     `json:"request_parameter_supported"`
+	RequestURIParameterSupported      bool     `json:"request_uri_parameter_supported"`
+}
+
+// HandleOpenIDConfigurationGET serves the OpenID Provider metadata of the request's organization. Endpoint URLs are
+// built from the issuer, so each organization's document points at its own endpoints and signing key.
+func HandleOpenIDConfigurationGET(ctx *middlewares.AppContext) {
+	alg, err := signingAlgorithm(ctx.JWTProvider.PublicKey())
+	if err != nil {
+		ctx.Logger.Error("failed to determine signing algorithm", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	issuer := ctx.Issuer()
+
+	ctx.Response.Header().Set("Cache-Control", "public, max-age=3600")
+	ctx.WriteJSON(http.StatusOK, openIDConfiguration{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/oauth/authorize",
+		TokenEndpoint:                     issuer + "/oauth/token",
+		UserInfoEndpoint:                  issuer + "/userinfo",
+		RegistrationEndpoint:              issuer + "/oauth/register",
+		DeviceAuthorizationEndpoint:       issuer + "/oauth/device_authorization",
+		JWKSURI:                           issuer + "/api/jwks.json",
+		ScopesSupported:                   utils.IdentityScopes,
+		ResponseTypesSupported:            []string{"code"},
+		ResponseModesSupported:            []string{"query"},
+		GrantTypesSupported:               supportedGrantTypes,
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{alg},
+		TokenEndpointAuthMethodsSupported: supportedAuthMethods,
+		TokenEndpointAuthSigningAlgValues: crypt_utils.DPoPAlgorithmNames(), // client assertions accept the DPoP algorithms
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		DPoPSigningAlgValuesSupported:     crypt_utils.DPoPAlgorithmNames(),
+		TLSClientCertificateBoundTokens:   ctx.Config.TLS.Enabled(),
+		ACRValuesSupported:                []string{utils.ACRSingleFactor, utils.ACRMultiFactor},
+		ClaimsSupported: []string{
+			"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "acr", "amr", "at_hash", "azp",
+			"name", "updated_at", "email",
+		},
+	})
+}
+
+// HandleUserInfoGET is the OpenID Connect UserInfo endpoint (OIDC Core §5.3). It returns the claims about the
+// token's user that the granted identity scopes release, and requires an access token with the openid scope.
+func HandleUserInfoGET(ctx *middlewares.AppContext) {
+	user, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	claims := utils.IdentityClaims(user, middlewares.GetScopes(ctx))
+	claims["sub"] = middlewares.GetUserID(ctx)
+
+	ctx.Response.Header().Set("Cache-Control", "no-store")
+	ctx.WriteJSON(http.StatusOK, claims)
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"encoding/json"
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var organizationSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// HandleOrganizationsGET lists all organizations
+func HandleOrganizationsGET(ctx *middlewares.AppContext) {
+	if !requireDefaultOrganization(ctx, "Organizations") {
+		return
+	}
+
+	organizations, err := db.NewOrganizationQueries(ctx.DB).List()
+	if err != nil {
+		ctx.Logger.Error("failed to list organizations", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve organizations")
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"organizations": organizations,
+		"count":         len(organizations),
+	})
+}
+
+// HandleOrganizationsPOST creates an organization with its own signing key. When admin_email is given the
+// organization's first administrator is created as well.
+func HandleOrganizationsPOST(ctx *middlewares.AppContext) {
+	if !requireDefaultOrganization(ctx, "Organizations") {
+		return
+	}
+
+	var request struct {
+		Slug          string `json:"slug"`
+		Name          string `json:"name"`
+		Domain        string `json:"domain"`
+		Issuer        string `json:"issuer"`
+		AdminEmail    string `json:"admin_email"`
+		AdminName     string `json:"admin_name"`
+		AdminPassword string `json:"admin_password"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	if !organizationSlugPattern.MatchString(request.Slug) {
+		ctx.SetJSONError(http.StatusBadRequest, "slug must be 1-63 lowercase letters, digits or dashes")
+		return
+	}
+
+	if strings.TrimSpace(request.Name) == "" {
+		ctx.SetJSONError(http.StatusBadRequest, "name is required")
+		return
+	}
+
+	if request.AdminEmail != "" && request.AdminPassword == "" {
+		ctx.SetJSONError(http.StatusBadRequest, "admin_password is required with admin_email")
+		return
+	}
+
+	signingKey, err := crypt_utils.GenerateSigningKeyPEM()
+	if err != nil {
+		ctx.Logger.Error("failed to generate signing key", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	organization, err := db.NewOrganizationQueries(ctx.DB).Create(
+		request.Slug,
+		strings.TrimSpace(request.Name),
+		strings.ToLower(strings.TrimSpace(request.Domain)),
+		strings.TrimRight(strings.TrimSpace(request.Issuer), "/"),
+		signingKey,
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			ctx.SetJSONError(http.StatusConflict, "An organization with this slug or domain already exists")
+			return
+		}
+		ctx.Logger.Error("failed to create organization", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to create organization")
+		return
+	}
+
+	utils.RecordAudit(ctx, "organization.create", "organization", strconv.Itoa(organization.ID), map[string]interface{}{
+		"slug":   organization.Slug,
+		"domain": organization.Domain,
+	})
+
+	if request.AdminEmail != "" {
+		name := request.AdminName
+		if name == "" {
+			name = ctx.Config.Bootstrap.AdminName
+		}
+		if _, _, err := utils.BootstrapAdmin(ctx.DB, organization.ID, request.AdminEmail, name, request.AdminPassword); err != nil {
+			ctx.Logger.Error("failed to create organization admin", "err", err)
+			ctx.SetJSONError(http.StatusInternalServerError, "Organization created but its administrator could not be")
+			return
+		}
+	}
+
+	ctx.WriteJSON(http.StatusCreated, organization)
+}
+
+// HandleOrganizationGET retrieves a single organization by ID
+func HandleOrganizationGET(ctx *middlewares.AppContext) {
+	if !requireDefaultOrganization(ctx, "Organizations") {
+		return
+	}
+
+	id, err := strconv.Atoi(ctx.Request.PathValue("id"))
+	if err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid organization ID")
+		return
+	}
+
+	organization, err := db.NewOrganizationQueries(ctx.DB).GetByID(id)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "Organization not found")
+			return
+		}
+		ctx.Logger.Error("failed to get organization", "err", err, "id", id)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve organization")
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, organization)
+}
+
+// requireDefaultOrganization limits platform administration to administrators of the default organization. what
+// names the managed resources in the error.
+func requireDefaultOrganization(ctx *middlewares.AppContext, what string) bool {
+	if ctx.Tenant.ID != db.DefaultOrganizationID {
+		ctx.SetJSONError(http.StatusForbidden, what+" can only be managed from the default organization")
+		return false
+	}
+	return true
+}
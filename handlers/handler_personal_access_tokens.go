@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"encoding/json"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HandlePersonalAccessTokensGET lists the authenticated user's personal access tokens
+func HandlePersonalAccessTokensGET(ctx *middlewares.AppContext) {
+	user, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	tokens, err := db.NewPersonalAccessTokenQueries(ctx.DB).ListByUserID(user.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to list personal access tokens", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve tokens")
+		return
+	}
+
+	type tokenResponse struct {
+		db.PersonalAccessToken
+		Expired bool `json:"expired"`
+	}
+
+	response := make([]tokenResponse, len(tokens))
+	for i := range tokens {
+		response[i] = tokenResponse{PersonalAccessToken: tokens[i], Expired: tokens[i].IsExpired()}
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"tokens": response,
+		"count":  len(response),
+	})
+}
+
+// HandlePersonalAccessTokensPOST creates a personal access token. The scope is required and may only contain scopes
+// of the session creating it; the expiry defaults to PAT_DEFAULT_LIFETIME and is capped at PAT_MAX_LIFETIME. The
+// token is only returned in this response.
+func HandlePersonalAccessTokensPOST(ctx *middlewares.AppContext) {
+	user, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Name      string `json:"name"`
+		Scope     string `json:"scope"`
+		ExpiresAt string `json:"expires_at"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		ctx.SetJSONError(http.StatusBadRequest, "name is required")
+		return
+	}
+
+	scope := utils.ParseScope(request.Scope)
+	if len(scope) == 0 {
+		ctx.SetJSONError(http.StatusBadRequest, "scope is required")
+		return
+	}
+	if !utils.IsScopeSubset(scope, middlewares.GetScopes(ctx)) {
+		ctx.SetJSONError(http.StatusForbidden, "scope exceeds the scope of the current session")
+		return
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(ctx.Config.Tokens.DefaultLifetime)
+	if request.ExpiresAt != "" {
+		parsed, err := parseFilterTime(request.ExpiresAt)
+		if err != nil {
+			ctx.SetJSONError(http.StatusBadRequest, "expires_at must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+			return
+		}
+		expiresAt = parsed
+	}
+	if !expiresAt.After(now) {
+		ctx.SetJSONError(http.StatusBadRequest, "expires_at must be in the future")
+		return
+	}
+	if expiresAt.After(now.Add(ctx.Config.Tokens.MaxLifetime)) {
+		ctx.SetJSONError(http.StatusBadRequest, "expires_at is later than the maximum token lifetime of "+ctx.Config.Tokens.MaxLifetime.String())
+		return
+	}
+
+	value, hash, hint, err := utils.GeneratePersonalAccessToken()
+	if err != nil {
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	token, err := db.NewPersonalAccessTokenQueries(ctx.DB).Create(user.ID, name, hash, hint, scope, expiresAt)
+	if err != nil {
+		ctx.Logger.Error("failed to create personal access token", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to create token")
+		return
+	}
+
+	ctx.Logger.Info("Personal access token created", "user_id", user.ID, "token_id", token.ID)
+
+	ctx.WriteJSON(http.StatusCreated, map[string]interface{}{
+		"id":         token.ID,
+		"name":       token.Name,
+		"token":      value,
+		"scope":      utils.FormatScope(token.Scope),
+		"expires_at": token.ExpiresAt,
+		"created_at": token.CreatedAt,
+	})
+}
+
+// HandlePersonalAccessTokenDELETE revokes one of the authenticated user's personal access tokens
+func HandlePersonalAccessTokenDELETE(ctx *middlewares.AppContext) {
+	user, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(ctx.Request.PathValue("id"))
+	if err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid token ID")
+		return
+	}
+
+	if err := db.NewPersonalAccessTokenQueries(ctx.DB).Delete(user.ID, id); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "Token not found")
+			return
+		}
+		ctx.Logger.Error("failed to delete personal access token", "err", err, "id", id)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to revoke token")
+		return
+	}
+
+	ctx.Logger.Info("Personal access token revoked", "user_id", user.ID, "token_id", id)
+
+	ctx.SetJSONStatus(http.StatusOK, "Token revoked")
+}
@@ -7,8 +7,28 @@ import (
 	"strconv"
 )
 
-// HandleProtectedDataGET returns protected data for an authenticated user
+// HandleProtectedDataGET returns protected data for an authenticated user or service client
 func HandleProtectedDataGET(ctx *middlewares.AppContext) {
+	type DataStats struct {
+		ItemsProcessed int      `json:"items_processed"`
+		LastAccess     string   `json:"last_access"`
+		Permissions    []string `json:"permissions"`
+	}
+
+	// Service tokens act for an OAuth client rather than a user
+	if clientID := middlewares.GetClientID(ctx); clientID != "" {
+		ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+			"message":   "This is protected data",
+			"client_id": clientID,
+			"data": DataStats{
+				ItemsProcessed: 1234,
+				LastAccess:     "2024-01-15",
+				Permissions:    middlewares.GetPermissions(ctx),
+			},
+		})
+		return
+	}
+
 	// Get the authenticated user ID from context (set by middleware)
 	userIDStr := middlewares.GetUserID(ctx)
 	if userIDStr == "" {
@@ -31,12 +51,6 @@ func HandleProtectedDataGET(ctx *middlewares.AppContext) {
 		return
 	}
 
-	type DataStats struct {
-		ItemsProcessed int      `json:"items_processed"`
-		LastAccess     string   `json:"last_access"`
-		Permissions    []string `json:"permissions"`
-	}
-
 	type Response struct {
 		Message string    `json:"message"`
 		User    *db.User  `json:"user"`
@@ -49,7 +63,7 @@ func HandleProtectedDataGET(ctx *middlewares.AppContext) {
 		Data: DataStats{
 			ItemsProcessed: 1234,
 			LastAccess:     "2024-01-15",
-			Permissions:    []string{"read", "write", "delete"},
+			Permissions:    middlewares.GetPermissions(ctx),
 		},
 	}
 
@@ -10,10 +10,12 @@ import (
 	"strings"
 )
 
-// HandleRefreshTokenPost exchanges a refresh token for a new access token
+// HandleRefreshTokenPost exchanges a refresh token for a new access token. An optional scope narrows the
+// new access token; it can never exceed the scope the refresh token was issued with.
 func HandleRefreshTokenPost(ctx *middlewares.AppContext) {
 	var request struct {
 		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
 	}
 
 	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
@@ -26,44 +28,92 @@ func HandleRefreshTokenPost(ctx *middlewares.AppContext) {
 		return
 	}
 
-	tokenHash := utils.HashToken(strings.TrimSpace(request.RefreshToken))
+	newAccessToken, granted, grantErr := refreshSession(ctx, strings.TrimSpace(request.RefreshToken), utils.ParseScope(request.Scope), "")
+	if grantErr != nil {
+		grantErr.write(ctx)
+		return
+	}
+
+	type Response struct {
+		AccessToken string `json:"access_token"`
+		Scope       string `json:"scope"`
+	}
+
+	response := Response{
+		AccessToken: newAccessToken,
+		Scope:       utils.FormatScope(granted),
+	}
+
+	ctx.WriteJSON(http.StatusOK, response)
+}
+
+// refreshSession issues a new access token from a refresh token, returning it with its granted scope. A requested
+// scope may narrow the token but never exceed the scope the refresh token was issued with. clientID must be the
+// OAuth client the refresh token was issued to, or empty for first-party sessions. A refresh token bound to a DPoP key
+// is only accepted with a proof signed by that key, which /api/refresh never verifies.
+func refreshSession(ctx *middlewares.AppContext, rawToken string, requested []string, clientID string) (string, []string, *grantError) {
+	invalidToken := &grantError{Status: http.StatusUnauthorized, Code: "invalid_grant", Message: "Invalid or expired refresh token"}
 
 	refreshTokenQueries := db.NewRefreshTokenQueries(ctx.DB)
-	refreshToken, err := refreshTokenQueries.GetByHashAndValidate(tokenHash)
+	refreshToken, err := refreshTokenQueries.GetByHashAndValidate(utils.HashToken(rawToken))
 	if err != nil {
 		ctx.Logger.Debug("Invalid refresh token", "err", err)
-		ctx.SetJSONError(http.StatusUnauthorized, "Invalid or expired refresh token")
-		return
+		return "", nil, invalidToken
+	}
+
+	if refreshToken.ClientID != clientID {
+		ctx.Logger.Debug("Refresh token presented by another client", "token_client_id", refreshToken.ClientID, "client_id", clientID)
+		return "", nil, invalidToken
+	}
+
+	if refreshToken.DPoPJKT != "" {
+		if proof := middlewares.GetDPoPProof(ctx); proof == nil || proof.Thumbprint != refreshToken.DPoPJKT {
+			ctx.Logger.Debug("Refresh token presented without a proof of its DPoP key", "client_id", clientID)
+			return "", nil, &grantError{Status: http.StatusBadRequest, Code: "invalid_grant", Message: "The refresh token is bound to a DPoP key"}
+		}
 	}
 
 	userID, err := strconv.Atoi(refreshToken.OwnerId)
 	if err != nil {
 		ctx.Logger.Error("Invalid user ID in refresh token", "owner_id", refreshToken.OwnerId, "err", err)
-		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
-		return
+		return "", nil, errGrantInternal
 	}
 
 	userQueries := db.NewUserQueries(ctx.DB)
 	user, err := userQueries.GetByID(userID)
 	if err != nil {
 		ctx.Logger.Error("Failed to get user", "user_id", userID, "err", err)
-		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
-		return
+		return "", nil, errGrantInternal
+	}
+
+	if user.OrganizationID != ctx.Tenant.ID {
+		ctx.Logger.Debug("Refresh token presented to another organization", "user_id", userID)
+		return "", nil, invalidToken
 	}
 
-	newAccessToken, err := utils.GenerateAccessToken(ctx, user)
+	if !user.IsActive() {
+		ctx.Logger.Debug("Refresh token of inactive account", "user_id", userID, "status", user.Status)
+		return "", nil, &grantError{Status: http.StatusUnauthorized, Code: "invalid_grant", Message: "Account is not active"}
+	}
+
+	granted, err := utils.GrantedScope(ctx, user.ID, refreshToken.Scope)
 	if err != nil {
-		ctx.Logger.Error("Failed to generate access token", "err", err)
-		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
-		return
+		ctx.Logger.Error("Failed to resolve scope", "err", err)
+		return "", nil, errGrantInternal
 	}
-	type Response struct {
-		AccessToken string `json:"access_token"`
+
+	if len(requested) > 0 {
+		if !utils.IsScopeSubset(requested, granted) {
+			return "", nil, &grantError{Status: http.StatusBadRequest, Code: "invalid_scope", Message: "Requested scope exceeds the scope of the refresh token"}
+		}
+		granted = requested
 	}
 
-	response := Response{
-		AccessToken: newAccessToken,
+	newAccessToken, err := utils.GenerateAccessToken(ctx, user, utils.AccessTokenOptions{AMR: refreshToken.AMR, Scope: granted, ClientID: clientID})
+	if err != nil {
+		ctx.Logger.Error("Failed to generate access token", "err", err)
+		return "", nil, errGrantInternal
 	}
 
-	ctx.WriteJSON(http.StatusOK, response)
+	return newAccessToken, granted, nil
 }
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"net/http"
+	"strings"
+)
+
+// HandleRegisterPOST lets a visitor create their own account when self-service registration is enabled.
+// New accounts receive only the default role.
+func HandleRegisterPOST(ctx *middlewares.AppContext) {
+	if !ctx.Config.Registration.Enabled {
+		ctx.SetJSONError(http.StatusNotFound, "Registration is disabled")
+		return
+	}
+
+	var request struct {
+		Email    string `json:"email"`
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	email := strings.TrimSpace(request.Email)
+	name := strings.TrimSpace(request.Name)
+	if email == "" || name == "" || request.Password == "" {
+		ctx.SetJSONError(http.StatusBadRequest, "email, name, and password are required")
+		return
+	}
+
+	if !strings.Contains(email, "@") {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid email address")
+		return
+	}
+
+	if minLength := ctx.Config.Registration.MinPasswordLength; len(request.Password) < minLength {
+		ctx.SetJSONError(http.StatusBadRequest, fmt.Sprintf("Password must be at least %d characters", minLength))
+		return
+	}
+
+	hashedPassword, err := crypt_utils.HashPassword(request.Password)
+	if err != nil {
+		ctx.Logger.Error("failed to hash password", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	user, err := db.NewUserQueries(ctx.DB).Create(ctx.Tenant.ID, email, name, hashedPassword)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			ctx.SetJSONError(http.StatusConflict, "A user with this email already exists")
+			return
+		}
+		ctx.Logger.Error("failed to register user", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to create user")
+		return
+	}
+
+	ctx.Logger.Info("User registered", "user_id", user.ID)
+	ctx.WriteJSON(http.StatusCreated, user)
+}
@@ -0,0 +1,396 @@
+package handlers
+
+import (
+	"encoding/json"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HandleRolesGET lists all roles with their permissions
+func HandleRolesGET(ctx *middlewares.AppContext) {
+	roles, err := db.NewRoleQueries(ctx.DB).List()
+	if err != nil {
+		ctx.Logger.Error("failed to list roles", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve roles")
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"roles": roles,
+		"count": len(roles),
+	})
+}
+
+// HandleRolesPOST creates a new role, optionally granting it an initial set of permissions
+func HandleRolesPOST(ctx *middlewares.AppContext) {
+	if !requireDefaultOrganization(ctx, "Roles and permissions") {
+		return
+	}
+
+	var request struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		ctx.SetJSONError(http.StatusBadRequest, "name is required")
+		return
+	}
+
+	roleQueries := db.NewRoleQueries(ctx.DB)
+	role, err := roleQueries.Create(name, request.Description, request.Permissions)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			ctx.SetJSONError(http.StatusConflict, "Role already exists")
+			return
+		}
+		if permission, ok := strings.CutPrefix(err.Error(), "permission not found: "); ok {
+			ctx.SetJSONError(http.StatusBadRequest, "Unknown permission: "+permission)
+			return
+		}
+		ctx.Logger.Error("failed to create role", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to create role")
+		return
+	}
+
+	utils.RecordAudit(ctx, "role.create", "role", strconv.Itoa(role.ID), map[string]interface{}{
+		"name":        role.Name,
+		"permissions": role.Permissions,
+	})
+
+	ctx.WriteJSON(http.StatusCreated, role)
+}
+
+// HandleRoleGET retrieves a single role by ID
+func HandleRoleGET(ctx *middlewares.AppContext) {
+	id, ok := rolePathID(ctx)
+	if !ok {
+		return
+	}
+
+	role, err := db.NewRoleQueries(ctx.DB).GetByID(id)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "Role not found")
+			return
+		}
+		ctx.Logger.Error("failed to get role", "err", err, "id", id)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve role")
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, role)
+}
+
+// HandleRoleDELETE removes a role and all of its assignments
+func HandleRoleDELETE(ctx *middlewares.AppContext) {
+	if !requireDefaultOrganization(ctx, "Roles and permissions") {
+		return
+	}
+
+	id, ok := rolePathID(ctx)
+	if !ok {
+		return
+	}
+
+	roleQueries := db.NewRoleQueries(ctx.DB)
+	role, err := roleQueries.GetByID(id)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "Role not found")
+			return
+		}
+		ctx.Logger.Error("failed to get role", "err", err, "id", id)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to delete role")
+		return
+	}
+
+	if role.Name == db.DefaultRoleName || role.Name == db.AdminRoleName {
+		ctx.SetJSONError(http.StatusBadRequest, "Built-in roles cannot be deleted")
+		return
+	}
+
+	if err := roleQueries.Delete(id); err != nil {
+		ctx.Logger.Error("failed to delete role", "err", err, "id", id)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to delete role")
+		return
+	}
+
+	utils.RecordAudit(ctx, "role.delete", "role", strconv.Itoa(id), map[string]interface{}{"name": role.Name})
+
+	ctx.SetJSONStatus(http.StatusOK, "Role deleted successfully")
+}
+
+// HandleRolePermissionsPOST grants a permission to a role
+func HandleRolePermissionsPOST(ctx *middlewares.AppContext) {
+	if !requireDefaultOrganization(ctx, "Roles and permissions") {
+		return
+	}
+
+	id, ok := rolePathID(ctx)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Permission string `json:"permission"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	if request.Permission == "" {
+		ctx.SetJSONError(http.StatusBadRequest, "permission is required")
+		return
+	}
+
+	roleQueries := db.NewRoleQueries(ctx.DB)
+	if _, err := roleQueries.GetByID(id); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "Role not found")
+			return
+		}
+		ctx.Logger.Error("failed to get role", "err", err, "id", id)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to update role")
+		return
+	}
+
+	if err := roleQueries.AddPermission(id, request.Permission); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "Permission not found")
+			return
+		}
+		ctx.Logger.Error("failed to add permission to role", "err", err, "id", id)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to update role")
+		return
+	}
+
+	utils.RecordAudit(ctx, "role.permission.add", "role", strconv.Itoa(id), map[string]interface{}{"permission": request.Permission})
+
+	role, err := roleQueries.GetByID(id)
+	if err != nil {
+		ctx.Logger.Error("failed to get role", "err", err, "id", id)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to update role")
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, role)
+}
+
+// HandleRolePermissionDELETE revokes a permission from a role
+func HandleRolePermissionDELETE(ctx *middlewares.AppContext) {
+	if !requireDefaultOrganization(ctx, "Roles and permissions") {
+		return
+	}
+
+	id, ok := rolePathID(ctx)
+	if !ok {
+		return
+	}
+
+	permission := ctx.Request.PathValue("permission")
+	if err := db.NewRoleQueries(ctx.DB).RemovePermission(id, permission); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "Role permission not found")
+			return
+		}
+		ctx.Logger.Error("failed to remove permission from role", "err", err, "id", id)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to update role")
+		return
+	}
+
+	utils.RecordAudit(ctx, "role.permission.remove", "role", strconv.Itoa(id), map[string]interface{}{"permission": permission})
+
+	ctx.SetJSONStatus(http.StatusOK, "Permission removed from role")
+}
+
+// HandlePermissionsGET lists all permissions
+func HandlePermissionsGET(ctx *middlewares.AppContext) {
+	permissions, err := db.NewPermissionQueries(ctx.DB).List()
+	if err != nil {
+		ctx.Logger.Error("failed to list permissions", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve permissions")
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"permissions": permissions,
+		"count":       len(permissions),
+	})
+}
+
+// HandlePermissionsPOST creates a new permission
+func HandlePermissionsPOST(ctx *middlewares.AppContext) {
+	if !requireDefaultOrganization(ctx, "Roles and permissions") {
+		return
+	}
+
+	var request struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	name := strings.TrimSpace(request.Name)
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		ctx.SetJSONError(http.StatusBadRequest, "name is required and must not contain whitespace")
+		return
+	}
+
+	permission, err := db.NewPermissionQueries(ctx.DB).Create(name, request.Description)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			ctx.SetJSONError(http.StatusConflict, "Permission already exists")
+			return
+		}
+		ctx.Logger.Error("failed to create permission", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to create permission")
+		return
+	}
+
+	utils.RecordAudit(ctx, "permission.create", "permission", permission.Name, nil)
+
+	ctx.WriteJSON(http.StatusCreated, permission)
+}
+
+// HandlePermissionDELETE removes a permission and revokes it from every role
+func HandlePermissionDELETE(ctx *middlewares.AppContext) {
+	if !requireDefaultOrganization(ctx, "Roles and permissions") {
+		return
+	}
+
+	name := ctx.Request.PathValue("name")
+	if err := db.NewPermissionQueries(ctx.DB).DeleteByName(name); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "Permission not found")
+			return
+		}
+		ctx.Logger.Error("failed to delete permission", "err", err, "name", name)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to delete permission")
+		return
+	}
+
+	utils.RecordAudit(ctx, "permission.delete", "permission", name, nil)
+
+	ctx.SetJSONStatus(http.StatusOK, "Permission deleted successfully")
+}
+
+// HandleUserRolesGET lists the roles and effective permissions of a user
+func HandleUserRolesGET(ctx *middlewares.AppContext) {
+	user, ok := userFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	roleQueries := db.NewRoleQueries(ctx.DB)
+	roles, err := roleQueries.ListForUser(user.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to list user roles", "err", err, "id", user.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve roles")
+		return
+	}
+
+	permissions, err := roleQueries.ListPermissionsForUser(user.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to list user permissions", "err", err, "id", user.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve roles")
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"user_id":     user.ID,
+		"roles":       roles,
+		"permissions": permissions,
+	})
+}
+
+// HandleUserRolesPOST assigns a role to a user. The change is reflected in the user's next access token.
+func HandleUserRolesPOST(ctx *middlewares.AppContext) {
+	user, ok := userFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Role string `json:"role"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	if request.Role == "" {
+		ctx.SetJSONError(http.StatusBadRequest, "role is required")
+		return
+	}
+
+	if err := db.NewRoleQueries(ctx.DB).AssignToUser(user.ID, request.Role); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "Role not found")
+			return
+		}
+		ctx.Logger.Error("failed to assign role", "err", err, "id", user.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to assign role")
+		return
+	}
+
+	utils.RecordAudit(ctx, "user.role.assign", "user", strconv.Itoa(user.ID), map[string]interface{}{"role": request.Role})
+
+	ctx.SetJSONStatus(http.StatusOK, "Role assigned")
+}
+
+// HandleUserRoleDELETE removes a role from a user
+func HandleUserRoleDELETE(ctx *middlewares.AppContext) {
+	user, ok := userFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	role := ctx.Request.PathValue("role")
+	if role == db.AdminRoleName {
+		if ok := ensureNotLastAdmin(ctx, user); !ok {
+			return
+		}
+	}
+
+	if err := db.NewRoleQueries(ctx.DB).RemoveFromUser(user.ID, role); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "User role not found")
+			return
+		}
+		ctx.Logger.Error("failed to remove role", "err", err, "id", user.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to remove role")
+		return
+	}
+
+	utils.RecordAudit(ctx, "user.role.remove", "user", strconv.Itoa(user.ID), map[string]interface{}{"role": role})
+
+	ctx.SetJSONStatus(http.StatusOK, "Role removed")
+}
+
+func rolePathID(ctx *middlewares.AppContext) (int, bool) {
+	id, err := strconv.Atoi(ctx.Request.PathValue("id"))
+	if err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid role ID")
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,763 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SCIM 2.0 (RFC 7643 and RFC 7644) provisioning of users. Users map onto db.User: userName and the primary email are
+// the email address, name.formatted and displayName are the name, and active is the account status.
+
+const (
+	scimUserSchema         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListResponseSchema = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchOpSchema      = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+
+	scimDefaultCount = 100
+	scimMaxResults   = 200
+)
+
+type scimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+type scimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimUser struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	UserName    string      `json:"userName"`
+	Name        scimName    `json:"name"`
+	DisplayName string      `json:"displayName"`
+	Emails      []scimEmail `json:"emails"`
+	Active      bool        `json:"active"`
+	Meta        scimMeta    `json:"meta"`
+}
+
+// scimUserRequest is the body of user creation and replacement
+type scimUserRequest struct {
+	ExternalID  string          `json:"externalId"`
+	UserName    string          `json:"userName"`
+	Name        scimName        `json:"name"`
+	DisplayName string          `json:"displayName"`
+	Emails      []scimEmail     `json:"emails"`
+	Active      json.RawMessage `json:"active"`
+	Password    string          `json:"password"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string `json:"schemas"`
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+// scimUserState holds the attributes SCIM can change, so replace and patch share one path to the database
+type scimUserState struct {
+	Email      string
+	Name       string
+	ExternalID string
+	Active     bool
+	Password   string // only set when a new password was supplied
+}
+
+// scimFilterPattern matches the supported filter subset: a single `attribute operator "value"` comparison
+var scimFilterPattern = regexp.MustCompile(`^\s*([A-Za-z][A-Za-z0-9.]*)\s+(eq|co)\s+("(?:[^"\\]|\\.)*")\s*$`)
+
+// HandleSCIMServiceProviderConfigGET describes the SCIM features this server supports
+func HandleSCIMServiceProviderConfigGET(ctx *middlewares.AppContext) {
+	middlewares.WriteSCIM(ctx, http.StatusOK, map[string]interface{}{
+		"schemas":          []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+		"documentationUri": "https://datatracker.ietf.org/doc/html/rfc7644",
+		"patch":            map[string]bool{"supported": true},
+		"bulk":             map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":           map[string]interface{}{"supported": true, "maxResults": scimMaxResults},
+		"changePassword":   map[string]bool{"supported": true},
+		"sort":             map[string]bool{"supported": false},
+		"etag":             map[string]bool{"supported": false},
+		"authenticationSchemes": []map[string]interface{}{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer token",
+			"description": "A SCIM token issued through /api/scim/tokens",
+			"primary":     true,
+		}},
+		"meta": map[string]string{"resourceType": "ServiceProviderConfig", "location": scimLocation(ctx, "ServiceProviderConfig")},
+	})
+}
+
+// HandleSCIMResourceTypesGET lists the resource types served
+func HandleSCIMResourceTypesGET(ctx *middlewares.AppContext) {
+	resourceTypes := []map[string]interface{}{
+		{
+			"schemas":  []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"},
+			"id":       "User",
+			"name":     "User",
+			"endpoint": "/Users",
+			"schema":   scimUserSchema,
+			"meta":     map[string]string{"resourceType": "ResourceType", "location": scimLocation(ctx, "ResourceTypes/User")},
+		},
+		{
+			"schemas":  []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"},
+			"id":       "Group",
+			"name":     "Group",
+			"endpoint": "/Groups",
+			"schema":   scimGroupSchema,
+			"meta":     map[string]string{"resourceType": "ResourceType", "location": scimLocation(ctx, "ResourceTypes/Group")},
+		},
+	}
+
+	writeSCIMList(ctx, len(resourceTypes), 1, resourceTypes)
+}
+
+// HandleSCIMSchemasGET describes the attributes of the User and Group resources
+func HandleSCIMSchemasGET(ctx *middlewares.AppContext) {
+	attribute := func(name, kind string, required bool, mutability, uniqueness string) map[string]interface{} {
+		return map[string]interface{}{
+			"name": name, "type": kind, "multiValued": false, "required": required, "caseExact": false,
+			"mutability": mutability, "returned": "default", "uniqueness": uniqueness,
+		}
+	}
+
+	schemas := []map[string]interface{}{
+		{
+			"schemas":     []string{"urn:ietf:params:scim:schemas:core:2.0:Schema"},
+			"id":          scimUserSchema,
+			"name":        "User",
+			"description": "User account",
+			"attributes": []map[string]interface{}{
+				attribute("userName", "string", true, "readWrite", "server"),
+				{
+					"name": "name", "type": "complex", "multiValued": false, "required": false,
+					"mutability": "readWrite", "returned": "default",
+					"subAttributes": []map[string]interface{}{attribute("formatted", "string", false, "readWrite", "none")},
+				},
+				attribute("displayName", "string", false, "readWrite", "none"),
+				{
+					"name": "emails", "type": "complex", "multiValued": true, "required": false,
+					"mutability": "readWrite", "returned": "default",
+					"subAttributes": []map[string]interface{}{attribute("value", "string", false, "readWrite", "server")},
+				},
+				attribute("active", "boolean", false, "readWrite", "none"),
+				{
+					"name": "password", "type": "string", "multiValued": false, "required": false,
+					"mutability": "writeOnly", "returned": "never", "uniqueness": "none",
+				},
+			},
+			"meta": map[string]string{"resourceType": "Schema", "location": scimLocation(ctx, "Schemas/"+scimUserSchema)},
+		},
+		{
+			"schemas":     []string{"urn:ietf:params:scim:schemas:core:2.0:Schema"},
+			"id":          scimGroupSchema,
+			"name":        "Group",
+			"description": "Group of users",
+			"attributes": []map[string]interface{}{
+				attribute("displayName", "string", true, "readWrite", "server"),
+				{
+					"name": "members", "type": "complex", "multiValued": true, "required": false,
+					"mutability": "readWrite", "returned": "default",
+					"subAttributes": []map[string]interface{}{attribute("value", "string", false, "immutable", "none")},
+				},
+			},
+			"meta": map[string]string{"resourceType": "Schema", "location": scimLocation(ctx, "Schemas/"+scimGroupSchema)},
+		},
+	}
+
+	writeSCIMList(ctx, len(schemas), 1, schemas)
+}
+
+// HandleSCIMUsersGET lists users. Supports filter (userName eq, userName co, emails.value eq, emails.value co,
+// externalId eq), startIndex and count.
+func HandleSCIMUsersGET(ctx *middlewares.AppContext) {
+	startIndex, count, ok := scimPagination(ctx)
+	if !ok {
+		return
+	}
+
+	filter := db.UserFilter{OrganizationID: ctx.Tenant.ID}
+	if value := ctx.Request.URL.Query().Get("filter"); value != "" {
+		attribute, operator, operand, err := parseSCIMFilter(value)
+		if err != nil {
+			middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidFilter", err.Error())
+			return
+		}
+
+		switch {
+		case (attribute == "username" || attribute == "emails.value") && operator == "eq":
+			filter.Email = operand
+		case (attribute == "username" || attribute == "emails.value") && operator == "co":
+			filter.EmailContains = operand
+		case attribute == "externalid" && operator == "eq":
+			filter.ExternalID = operand
+		default:
+			middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidFilter", "Unsupported filter: "+value)
+			return
+		}
+	}
+
+	userQueries := db.NewUserQueries(ctx.DB)
+	total, err := userQueries.Count(filter)
+	if err != nil {
+		ctx.Logger.Error("failed to count users", "err", err)
+		middlewares.WriteSCIMError(ctx, http.StatusInternalServerError, "", "Failed to retrieve users")
+		return
+	}
+
+	resources := []scimUser{}
+	if count > 0 {
+		users, _, err := userQueries.List(db.UserListOptions{
+			Filter: filter,
+			SortBy: "created_at",
+			Limit:  count,
+			Offset: startIndex - 1,
+		})
+		if err != nil {
+			ctx.Logger.Error("failed to list users", "err", err)
+			middlewares.WriteSCIMError(ctx, http.StatusInternalServerError, "", "Failed to retrieve users")
+			return
+		}
+		for i := range users {
+			resources = append(resources, toSCIMUser(ctx, &users[i]))
+		}
+	}
+
+	writeSCIMList(ctx, total, startIndex, resources)
+}
+
+// HandleSCIMUserGET retrieves a user
+func HandleSCIMUserGET(ctx *middlewares.AppContext) {
+	user, ok := scimUserFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	middlewares.WriteSCIM(ctx, http.StatusOK, toSCIMUser(ctx, user))
+}
+
+// HandleSCIMUsersPOST provisions a user. Without a password the account can only sign in by other means, such as
+// a magic link or passkey, until one is set.
+func HandleSCIMUsersPOST(ctx *middlewares.AppContext) {
+	var request scimUserRequest
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidSyntax", "Invalid JSON")
+		return
+	}
+
+	state, err := request.state(scimUserState{Active: true})
+	if err != nil {
+		middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+
+	password := state.Password
+	if password == "" {
+		if password, _, err = utils.GenerateOpaqueToken(); err != nil {
+			middlewares.WriteSCIMError(ctx, http.StatusInternalServerError, "", "Internal server error")
+			return
+		}
+	}
+
+	hashedPassword, err := crypt_utils.HashPassword(password)
+	if err != nil {
+		ctx.Logger.Error("failed to hash password", "err", err)
+		middlewares.WriteSCIMError(ctx, http.StatusInternalServerError, "", "Internal server error")
+		return
+	}
+
+	status, reason := db.UserStatusActive, ""
+	if !state.Active {
+		status, reason = db.UserStatusDeactivated, "Deprovisioned by SCIM"
+	}
+
+	user, err := db.NewUserQueries(ctx.DB).CreateProvisioned(ctx.Tenant.ID, state.Email, state.Name, hashedPassword, state.ExternalID, status, reason)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			middlewares.WriteSCIMError(ctx, http.StatusConflict, "uniqueness", "A user with this userName already exists")
+			return
+		}
+		ctx.Logger.Error("failed to create user", "err", err)
+		middlewares.WriteSCIMError(ctx, http.StatusInternalServerError, "", "Failed to create user")
+		return
+	}
+
+	utils.RecordAudit(ctx, "scim.user.create", "user", strconv.Itoa(user.ID), map[string]interface{}{
+		"email":       user.Email,
+		"external_id": user.ExternalID,
+	})
+
+	ctx.Response.Header().Set("Location", scimLocation(ctx, "Users/"+strconv.Itoa(user.ID)))
+	middlewares.WriteSCIM(ctx, http.StatusCreated, toSCIMUser(ctx, user))
+}
+
+// HandleSCIMUserPUT replaces the attributes of a user
+func HandleSCIMUserPUT(ctx *middlewares.AppContext) {
+	user, ok := scimUserFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	var request scimUserRequest
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidSyntax", "Invalid JSON")
+		return
+	}
+
+	// A replacement that leaves out active keeps the current status rather than reactivating the account.
+	state, err := request.state(scimUserState{Active: user.Status == db.UserStatusActive})
+	if err != nil {
+		middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+
+	user, ok = saveSCIMUser(ctx, user, state)
+	if !ok {
+		return
+	}
+
+	utils.RecordAudit(ctx, "scim.user.replace", "user", strconv.Itoa(user.ID), map[string]interface{}{"email": user.Email})
+
+	middlewares.WriteSCIM(ctx, http.StatusOK, toSCIMUser(ctx, user))
+}
+
+// HandleSCIMUserPATCH applies SCIM patch operations to a user. Attributes this server does not store, such as
+// name.givenName or title, are accepted and ignored so that clients mapping them keep working.
+func HandleSCIMUserPATCH(ctx *middlewares.AppContext) {
+	user, ok := scimUserFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	var request scimPatchRequest
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidSyntax", "Invalid JSON")
+		return
+	}
+
+	state := scimUserState{
+		Email:      user.Email,
+		Name:       user.Name,
+		ExternalID: user.ExternalID,
+		Active:     user.Status == db.UserStatusActive,
+	}
+
+	for _, operation := range request.Operations {
+		path := strings.ToLower(strings.TrimSpace(operation.Path))
+
+		switch strings.ToLower(operation.Op) {
+		case "add", "replace":
+			var err error
+			if path == "" {
+				err = state.setAll(operation.Value)
+			} else {
+				err = state.set(path, operation.Value)
+			}
+			if err != nil {
+				middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidValue", err.Error())
+				return
+			}
+
+		case "remove":
+			switch path {
+			case "externalid":
+				state.ExternalID = ""
+			case "username", "emails", "active", "":
+				middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "mutability", "Attribute cannot be removed: "+operation.Path)
+				return
+			}
+
+		default:
+			middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidSyntax", "Unsupported patch operation: "+operation.Op)
+			return
+		}
+	}
+
+	user, ok = saveSCIMUser(ctx, user, state)
+	if !ok {
+		return
+	}
+
+	utils.RecordAudit(ctx, "scim.user.patch", "user", strconv.Itoa(user.ID), map[string]interface{}{"email": user.Email})
+
+	middlewares.WriteSCIM(ctx, http.StatusOK, toSCIMUser(ctx, user))
+}
+
+// HandleSCIMUserDELETE soft deletes a user, so it can still be restored by an administrator until it is purged
+func HandleSCIMUserDELETE(ctx *middlewares.AppContext) {
+	user, ok := scimUserFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	if !ensureSCIMNotLastAdmin(ctx, user) {
+		return
+	}
+
+	if err := db.NewUserQueries(ctx.DB).SoftDelete(user.ID); err != nil {
+		ctx.Logger.Error("failed to delete user", "err", err, "id", user.ID)
+		middlewares.WriteSCIMError(ctx, http.StatusInternalServerError, "", "Failed to delete user")
+		return
+	}
+
+	if err := utils.RevokeUserSessions(ctx.DB, user.ID); err != nil {
+		ctx.Logger.Error("failed to revoke sessions", "err", err, "id", user.ID)
+	}
+
+	utils.RecordAudit(ctx, "scim.user.delete", "user", strconv.Itoa(user.ID), map[string]interface{}{"email": user.Email})
+
+	ctx.Response.WriteHeader(http.StatusNoContent)
+}
+
+// state merges a create or replace request over the defaults
+func (r *scimUserRequest) state(defaults scimUserState) (scimUserState, error) {
+	state := defaults
+	state.Email = strings.TrimSpace(r.UserName)
+	state.ExternalID = r.ExternalID
+	state.Password = r.Password
+
+	if state.Email == "" {
+		state.Email = primarySCIMEmail(r.Emails)
+	}
+	if !strings.Contains(state.Email, "@") {
+		return state, fmt.Errorf("userName must be an email address")
+	}
+
+	state.Name = scimDisplayName(r.Name, r.DisplayName)
+	if state.Name == "" {
+		state.Name = state.Email
+	}
+
+	if len(r.Active) > 0 {
+		active, err := parseSCIMBool(r.Active)
+		if err != nil {
+			return state, err
+		}
+		state.Active = active
+	}
+
+	return state, nil
+}
+
+// set applies an add or replace operation on a single attribute path
+func (s *scimUserState) set(path string, value json.RawMessage) error {
+	switch {
+	case path == "username":
+		var email string
+		if err := json.Unmarshal(value, &email); err != nil || !strings.Contains(email, "@") {
+			return fmt.Errorf("userName must be an email address")
+		}
+		s.Email = strings.TrimSpace(email)
+
+	case path == "displayname" || path == "name.formatted":
+		var name string
+		if err := json.Unmarshal(value, &name); err != nil {
+			return fmt.Errorf("%s must be a string", path)
+		}
+		if name = strings.TrimSpace(name); name != "" {
+			s.Name = name
+		}
+
+	case path == "name":
+		var name scimName
+		if err := json.Unmarshal(value, &name); err != nil {
+			return fmt.Errorf("name must be an object")
+		}
+		if formatted := scimDisplayName(name, ""); formatted != "" {
+			s.Name = formatted
+		}
+
+	case path == "externalid":
+		if err := json.Unmarshal(value, &s.ExternalID); err != nil {
+			return fmt.Errorf("externalId must be a string")
+		}
+
+	case path == "active":
+		active, err := parseSCIMBool(value)
+		if err != nil {
+			return err
+		}
+		s.Active = active
+
+	case path == "password":
+		if err := json.Unmarshal(value, &s.Password); err != nil {
+			return fmt.Errorf("password must be a string")
+		}
+
+	// Clients address the email as "emails", "emails.value" or `emails[type eq "work"].value`.
+	case strings.HasPrefix(path, "emails"):
+		var email string
+		if err := json.Unmarshal(value, &email); err != nil {
+			var emails []scimEmail
+			if err := json.Unmarshal(value, &emails); err != nil {
+				return fmt.Errorf("emails must be a list of email objects")
+			}
+			email = primarySCIMEmail(emails)
+		}
+		if email = strings.TrimSpace(email); email != "" {
+			if !strings.Contains(email, "@") {
+				return fmt.Errorf("invalid email address")
+			}
+			s.Email = email
+		}
+	}
+
+	return nil
+}
+
+// setAll applies an add or replace operation without a path, whose value holds attributes by name
+func (s *scimUserState) setAll(value json.RawMessage) error {
+	var attributes map[string]json.RawMessage
+	if err := json.Unmarshal(value, &attributes); err != nil {
+		return fmt.Errorf("value must be an object when no path is given")
+	}
+
+	for name, attributeValue := range attributes {
+		if err := s.set(strings.ToLower(name), attributeValue); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// saveSCIMUser writes the differences between a user and the desired state
+func saveSCIMUser(ctx *middlewares.AppContext, user *db.User, state scimUserState) (*db.User, bool) {
+	// Checked before any attribute is written, so a refused deactivation leaves the user unchanged
+	if !state.Active && !ensureSCIMNotLastAdmin(ctx, user) {
+		return nil, false
+	}
+
+	userQueries := db.NewUserQueries(ctx.DB)
+
+	fail := func(err error) (*db.User, bool) {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			middlewares.WriteSCIMError(ctx, http.StatusConflict, "uniqueness", "A user with this userName already exists")
+			return nil, false
+		}
+		ctx.Logger.Error("failed to update user", "err", err, "id", user.ID)
+		middlewares.WriteSCIMError(ctx, http.StatusInternalServerError, "", "Failed to update user")
+		return nil, false
+	}
+
+	if state.Email != user.Email || state.Name != user.Name {
+		if _, err := userQueries.Update(user.ID, state.Email, state.Name); err != nil {
+			return fail(err)
+		}
+	}
+
+	if state.ExternalID != user.ExternalID {
+		if err := userQueries.SetExternalID(user.ID, state.ExternalID); err != nil {
+			return fail(err)
+		}
+	}
+
+	if state.Password != "" {
+		hashedPassword, err := crypt_utils.HashPassword(state.Password)
+		if err != nil {
+			return fail(err)
+		}
+		if err := userQueries.SetPassword(user.ID, hashedPassword); err != nil {
+			return fail(err)
+		}
+	}
+
+	// active=false deactivates the account. Reactivation only applies to accounts SCIM can have deactivated, so a
+	// replace that echoes active=true does not lift a suspension set by an administrator.
+	if !state.Active && user.Status == db.UserStatusActive {
+		if _, err := userQueries.SetStatus(user.ID, db.UserStatusDeactivated, "Deprovisioned by SCIM"); err != nil {
+			return fail(err)
+		}
+		if err := utils.RevokeUserSessions(ctx.DB, user.ID); err != nil {
+			ctx.Logger.Error("failed to revoke sessions", "err", err, "id", user.ID)
+		}
+	} else if state.Active && (user.Status == db.UserStatusDeactivated || user.Status == db.UserStatusPending) {
+		if _, err := userQueries.SetStatus(user.ID, db.UserStatusActive, "Provisioned by SCIM"); err != nil {
+			return fail(err)
+		}
+	}
+
+	updated, err := userQueries.GetByID(user.ID)
+	if err != nil {
+		return fail(err)
+	}
+
+	return updated, true
+}
+
+// ensureSCIMNotLastAdmin refuses to deprovision the only remaining active administrator
+func ensureSCIMNotLastAdmin(ctx *middlewares.AppContext, user *db.User) bool {
+	lastAdmin, err := isLastAdmin(ctx, user)
+	if err != nil {
+		ctx.Logger.Error("failed to check administrators", "err", err, "id", user.ID)
+		middlewares.WriteSCIMError(ctx, http.StatusInternalServerError, "", "Internal server error")
+		return false
+	}
+	if lastAdmin {
+		middlewares.WriteSCIMError(ctx, http.StatusConflict, "", "Cannot remove the last administrator")
+		return false
+	}
+
+	return true
+}
+
+func toSCIMUser(ctx *middlewares.AppContext, user *db.User) scimUser {
+	id := strconv.Itoa(user.ID)
+	return scimUser{
+		Schemas:     []string{scimUserSchema},
+		ID:          id,
+		ExternalID:  user.ExternalID,
+		UserName:    user.Email,
+		Name:        scimName{Formatted: user.Name},
+		DisplayName: user.Name,
+		Emails:      []scimEmail{{Value: user.Email, Type: "work", Primary: true}},
+		Active:      user.IsActive(),
+		Meta: scimMeta{
+			ResourceType: "User",
+			Created:      user.CreatedAt,
+			LastModified: user.UpdatedAt,
+			Location:     scimLocation(ctx, "Users/"+id),
+		},
+	}
+}
+
+// scimUserFromPath loads the user in the {id} path value. Soft deleted users and users of other organizations
+// are not found.
+func scimUserFromPath(ctx *middlewares.AppContext) (*db.User, bool) {
+	id, err := strconv.Atoi(ctx.Request.PathValue("id"))
+	if err != nil {
+		middlewares.WriteSCIMError(ctx, http.StatusNotFound, "", "User not found")
+		return nil, false
+	}
+
+	user, err := db.NewUserQueries(ctx.DB).GetByID(id)
+	if err != nil || user.OrganizationID != ctx.Tenant.ID || user.DeletedAt != nil {
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			ctx.Logger.Error("failed to get user", "err", err, "id", id)
+			middlewares.WriteSCIMError(ctx, http.StatusInternalServerError, "", "Failed to retrieve user")
+			return nil, false
+		}
+		middlewares.WriteSCIMError(ctx, http.StatusNotFound, "", "User not found")
+		return nil, false
+	}
+
+	return user, true
+}
+
+// parseSCIMFilter parses the supported filter subset. The attribute is returned lower-cased, since SCIM attribute
+// names are case-insensitive.
+func parseSCIMFilter(filter string) (attribute, operator, value string, err error) {
+	match := scimFilterPattern.FindStringSubmatch(filter)
+	if match == nil {
+		return "", "", "", fmt.Errorf("only filters of the form `attribute eq \"value\"` or `attribute co \"value\"` are supported")
+	}
+
+	if err := json.Unmarshal([]byte(match[3]), &value); err != nil {
+		return "", "", "", fmt.Errorf("invalid filter value")
+	}
+
+	return strings.ToLower(match[1]), match[2], value, nil
+}
+
+// scimPagination reads startIndex (1-based) and count, clamping them as RFC 7644 §3.4.2.4 asks
+func scimPagination(ctx *middlewares.AppContext) (startIndex, count int, ok bool) {
+	startIndex, count = 1, scimDefaultCount
+	query := ctx.Request.URL.Query()
+
+	if value := query.Get("startIndex"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidValue", "startIndex must be an integer")
+			return 0, 0, false
+		}
+		startIndex = max(parsed, 1)
+	}
+
+	if value := query.Get("count"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidValue", "count must be an integer")
+			return 0, 0, false
+		}
+		count = min(max(parsed, 0), scimMaxResults)
+	}
+
+	return startIndex, count, true
+}
+
+func writeSCIMList[T any](ctx *middlewares.AppContext, total, startIndex int, resources []T) {
+	middlewares.WriteSCIM(ctx, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimListResponseSchema},
+		"totalResults": total,
+		"startIndex":   startIndex,
+		"itemsPerPage": len(resources),
+		"Resources":    resources,
+	})
+}
+
+// scimLocation builds the absolute URL of a SCIM resource of the request's organization
+func scimLocation(ctx *middlewares.AppContext, path string) string {
+	return ctx.Issuer() + "/scim/v2/" + path
+}
+
+func primarySCIMEmail(emails []scimEmail) string {
+	for _, email := range emails {
+		if email.Primary {
+			return strings.TrimSpace(email.Value)
+		}
+	}
+	if len(emails) > 0 {
+		return strings.TrimSpace(emails[0].Value)
+	}
+	return ""
+}
+
+func scimDisplayName(name scimName, displayName string) string {
+	if formatted := strings.TrimSpace(name.Formatted); formatted != "" {
+		return formatted
+	}
+	if full := strings.TrimSpace(name.GivenName + " " + name.FamilyName); full != "" {
+		return full
+	}
+	return strings.TrimSpace(displayName)
+}
+
+// parseSCIMBool accepts JSON booleans and, as some clients send them, the strings "true" and "false"
+func parseSCIMBool(value json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		if parsed, err := strconv.ParseBool(s); err == nil {
+			return parsed, nil
+		}
+	}
+
+	return false, fmt.Errorf("active must be a boolean")
+}
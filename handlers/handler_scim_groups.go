@@ -0,0 +1,475 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SCIM provisioning of groups. Members are the direct user members of a group; nesting is managed through the
+// groups API and is not exposed here.
+
+type scimMember struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type scimGroup struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id"`
+	ExternalID  string       `json:"externalId,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members,omitempty"`
+	Meta        scimMeta     `json:"meta"`
+}
+
+type scimGroupRequest struct {
+	ExternalID  string       `json:"externalId"`
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members"`
+}
+
+// scimMemberPathPattern matches a patch path selecting one member, such as `members[value eq "42"]`
+var scimMemberPathPattern = regexp.MustCompile(`(?i)^members\[\s*value\s+eq\s+"([^"]*)"\s*\]$`)
+
+// HandleSCIMGroupsGET lists groups. Supports filter (displayName eq, externalId eq), startIndex, count and
+// excludedAttributes=members.
+func HandleSCIMGroupsGET(ctx *middlewares.AppContext) {
+	startIndex, count, ok := scimPagination(ctx)
+	if !ok {
+		return
+	}
+
+	var attribute, operand string
+	if value := ctx.Request.URL.Query().Get("filter"); value != "" {
+		var operator string
+		var err error
+		attribute, operator, operand, err = parseSCIMFilter(value)
+		if err != nil {
+			middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidFilter", err.Error())
+			return
+		}
+		if operator != "eq" || (attribute != "displayname" && attribute != "externalid") {
+			middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidFilter", "Unsupported filter: "+value)
+			return
+		}
+	}
+
+	groups, err := db.NewGroupQueries(ctx.DB).List(ctx.Tenant.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to list groups", "err", err)
+		middlewares.WriteSCIMError(ctx, http.StatusInternalServerError, "", "Failed to retrieve groups")
+		return
+	}
+
+	matched := []db.Group{}
+	for _, group := range groups {
+		switch {
+		case attribute == "displayname" && !strings.EqualFold(group.Name, operand):
+		case attribute == "externalid" && group.ExternalID != operand:
+		default:
+			matched = append(matched, group)
+		}
+	}
+
+	withMembers := !strings.Contains(strings.ToLower(ctx.Request.URL.Query().Get("excludedAttributes")), "members")
+
+	resources := []scimGroup{}
+	for i := startIndex - 1; i < len(matched) && len(resources) < count; i++ {
+		resource, ok := toSCIMGroup(ctx, &matched[i], withMembers)
+		if !ok {
+			return
+		}
+		resources = append(resources, resource)
+	}
+
+	writeSCIMList(ctx, len(matched), startIndex, resources)
+}
+
+// HandleSCIMGroupGET retrieves a group with its members
+func HandleSCIMGroupGET(ctx *middlewares.AppContext) {
+	group, ok := scimGroupFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	writeSCIMGroup(ctx, http.StatusOK, group)
+}
+
+// HandleSCIMGroupsPOST creates a group
+func HandleSCIMGroupsPOST(ctx *middlewares.AppContext) {
+	var request scimGroupRequest
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidSyntax", "Invalid JSON")
+		return
+	}
+
+	name := strings.TrimSpace(request.DisplayName)
+	if name == "" {
+		middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidValue", "displayName is required")
+		return
+	}
+
+	userIDs, ok := scimMemberIDs(ctx, request.Members)
+	if !ok {
+		return
+	}
+
+	groupQueries := db.NewGroupQueries(ctx.DB)
+	group, err := groupQueries.Create(ctx.Tenant.ID, name, "")
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			middlewares.WriteSCIMError(ctx, http.StatusConflict, "uniqueness", "A group with this displayName already exists")
+			return
+		}
+		ctx.Logger.Error("failed to create group", "err", err)
+		middlewares.WriteSCIMError(ctx, http.StatusInternalServerError, "", "Failed to create group")
+		return
+	}
+
+	if !saveSCIMGroup(ctx, group, name, request.ExternalID, userIDs) {
+		return
+	}
+
+	utils.RecordAudit(ctx, "scim.group.create", "group", strconv.Itoa(group.ID), map[string]interface{}{
+		"name":    name,
+		"members": len(userIDs),
+	})
+
+	ctx.Response.Header().Set("Location", scimLocation(ctx, "Groups/"+strconv.Itoa(group.ID)))
+	writeSCIMGroup(ctx, http.StatusCreated, group)
+}
+
+// HandleSCIMGroupPUT replaces the name, external ID and members of a group
+func HandleSCIMGroupPUT(ctx *middlewares.AppContext) {
+	group, ok := scimGroupFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	var request scimGroupRequest
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidSyntax", "Invalid JSON")
+		return
+	}
+
+	name := strings.TrimSpace(request.DisplayName)
+	if name == "" {
+		middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidValue", "displayName is required")
+		return
+	}
+
+	userIDs, ok := scimMemberIDs(ctx, request.Members)
+	if !ok {
+		return
+	}
+
+	if !saveSCIMGroup(ctx, group, name, request.ExternalID, userIDs) {
+		return
+	}
+
+	utils.RecordAudit(ctx, "scim.group.replace", "group", strconv.Itoa(group.ID), map[string]interface{}{
+		"name":    name,
+		"members": len(userIDs),
+	})
+
+	writeSCIMGroup(ctx, http.StatusOK, group)
+}
+
+// HandleSCIMGroupPATCH applies SCIM patch operations to a group: adding and removing members, replacing the member
+// list and renaming the group
+func HandleSCIMGroupPATCH(ctx *middlewares.AppContext) {
+	group, ok := scimGroupFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	var request scimPatchRequest
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidSyntax", "Invalid JSON")
+		return
+	}
+
+	members, err := db.NewGroupQueries(ctx.DB).ListMembers(group.ID, false)
+	if err != nil {
+		ctx.Logger.Error("failed to list group members", "err", err, "id", group.ID)
+		middlewares.WriteSCIMError(ctx, http.StatusInternalServerError, "", "Failed to retrieve group")
+		return
+	}
+
+	// Operations are applied to a copy of the group and written at the end, so a failing operation changes nothing.
+	name, externalID := group.Name, group.ExternalID
+	memberIDs := []int{}
+	for _, member := range members {
+		memberIDs = append(memberIDs, member.ID)
+	}
+
+	for _, operation := range request.Operations {
+		path := strings.TrimSpace(operation.Path)
+		op := strings.ToLower(operation.Op)
+
+		if op != "add" && op != "replace" && op != "remove" {
+			middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidSyntax", "Unsupported patch operation: "+operation.Op)
+			return
+		}
+
+		if match := scimMemberPathPattern.FindStringSubmatch(path); match != nil && op == "remove" {
+			memberIDs = removeIDs(memberIDs, match[1])
+			continue
+		}
+
+		switch strings.ToLower(path) {
+		case "members":
+			var values []scimMember
+			if len(operation.Value) > 0 {
+				if err := json.Unmarshal(operation.Value, &values); err != nil {
+					middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidValue", "members must be a list of member objects")
+					return
+				}
+			}
+
+			switch op {
+			case "remove":
+				// Without a value every member is removed (RFC 7644 §3.5.2.2).
+				if len(values) == 0 {
+					memberIDs = []int{}
+				}
+				for _, value := range values {
+					memberIDs = removeIDs(memberIDs, value.Value)
+				}
+			default:
+				userIDs, ok := scimMemberIDs(ctx, values)
+				if !ok {
+					return
+				}
+				if op == "replace" {
+					memberIDs = []int{}
+				}
+				memberIDs = append(memberIDs, userIDs...)
+			}
+
+		case "displayname", "externalid", "":
+			if op == "remove" {
+				if strings.EqualFold(path, "externalId") {
+					externalID = ""
+					continue
+				}
+				middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "mutability", "Attribute cannot be removed: "+operation.Path)
+				return
+			}
+
+			var attributes map[string]json.RawMessage
+			if path == "" {
+				if err := json.Unmarshal(operation.Value, &attributes); err != nil {
+					middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidValue", "value must be an object when no path is given")
+					return
+				}
+			} else {
+				attributes = map[string]json.RawMessage{path: operation.Value}
+			}
+
+			for attribute, value := range attributes {
+				var s string
+				switch strings.ToLower(attribute) {
+				case "displayname":
+					if err := json.Unmarshal(value, &s); err != nil || strings.TrimSpace(s) == "" {
+						middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidValue", "displayName must be a non-empty string")
+						return
+					}
+					name = strings.TrimSpace(s)
+				case "externalid":
+					if err := json.Unmarshal(value, &s); err != nil {
+						middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidValue", "externalId must be a string")
+						return
+					}
+					externalID = s
+				}
+			}
+
+		default:
+			middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidPath", "Unsupported path: "+operation.Path)
+			return
+		}
+	}
+
+	if !saveSCIMGroup(ctx, group, name, externalID, memberIDs) {
+		return
+	}
+
+	utils.RecordAudit(ctx, "scim.group.patch", "group", strconv.Itoa(group.ID), map[string]interface{}{
+		"name":       name,
+		"operations": len(request.Operations),
+	})
+
+	writeSCIMGroup(ctx, http.StatusOK, group)
+}
+
+// HandleSCIMGroupDELETE deletes a group
+func HandleSCIMGroupDELETE(ctx *middlewares.AppContext) {
+	group, ok := scimGroupFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	if err := db.NewGroupQueries(ctx.DB).Delete(group.ID); err != nil {
+		ctx.Logger.Error("failed to delete group", "err", err, "id", group.ID)
+		middlewares.WriteSCIMError(ctx, http.StatusInternalServerError, "", "Failed to delete group")
+		return
+	}
+
+	utils.RecordAudit(ctx, "scim.group.delete", "group", strconv.Itoa(group.ID), map[string]interface{}{"name": group.Name})
+
+	ctx.Response.WriteHeader(http.StatusNoContent)
+}
+
+// saveSCIMGroup writes the name, external ID and direct members of a group
+func saveSCIMGroup(ctx *middlewares.AppContext, group *db.Group, name, externalID string, userIDs []int) bool {
+	groupQueries := db.NewGroupQueries(ctx.DB)
+
+	fail := func(err error) bool {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			middlewares.WriteSCIMError(ctx, http.StatusConflict, "uniqueness", "A group with this displayName already exists")
+			return false
+		}
+		ctx.Logger.Error("failed to update group", "err", err, "id", group.ID)
+		middlewares.WriteSCIMError(ctx, http.StatusInternalServerError, "", "Failed to update group")
+		return false
+	}
+
+	if name != group.Name {
+		if _, err := groupQueries.Update(group.ID, name, group.Description); err != nil {
+			return fail(err)
+		}
+		group.Name = name
+	}
+
+	if externalID != group.ExternalID {
+		if err := groupQueries.SetExternalID(group.ID, externalID); err != nil {
+			return fail(err)
+		}
+		group.ExternalID = externalID
+	}
+
+	if err := groupQueries.ReplaceMembers(group.ID, userIDs); err != nil {
+		return fail(err)
+	}
+
+	return true
+}
+
+func writeSCIMGroup(ctx *middlewares.AppContext, status int, group *db.Group) {
+	resource, ok := toSCIMGroup(ctx, group, true)
+	if !ok {
+		return
+	}
+
+	middlewares.WriteSCIM(ctx, status, resource)
+}
+
+func toSCIMGroup(ctx *middlewares.AppContext, group *db.Group, withMembers bool) (scimGroup, bool) {
+	id := strconv.Itoa(group.ID)
+	resource := scimGroup{
+		Schemas:     []string{scimGroupSchema},
+		ID:          id,
+		ExternalID:  group.ExternalID,
+		DisplayName: group.Name,
+		Meta: scimMeta{
+			ResourceType: "Group",
+			Created:      group.CreatedAt,
+			LastModified: group.CreatedAt,
+			Location:     scimLocation(ctx, "Groups/"+id),
+		},
+	}
+
+	if withMembers {
+		members, err := db.NewGroupQueries(ctx.DB).ListMembers(group.ID, false)
+		if err != nil {
+			ctx.Logger.Error("failed to list group members", "err", err, "id", group.ID)
+			middlewares.WriteSCIMError(ctx, http.StatusInternalServerError, "", "Failed to retrieve group")
+			return resource, false
+		}
+		for _, member := range members {
+			memberID := strconv.Itoa(member.ID)
+			resource.Members = append(resource.Members, scimMember{
+				Value:   memberID,
+				Display: member.Email,
+				Ref:     scimLocation(ctx, "Users/"+memberID),
+			})
+		}
+	}
+
+	return resource, true
+}
+
+// scimGroupFromPath loads the group in the {id} path value. Groups of other organizations are not found.
+func scimGroupFromPath(ctx *middlewares.AppContext) (*db.Group, bool) {
+	id, err := strconv.Atoi(ctx.Request.PathValue("id"))
+	if err != nil {
+		middlewares.WriteSCIMError(ctx, http.StatusNotFound, "", "Group not found")
+		return nil, false
+	}
+
+	group, err := db.NewGroupQueries(ctx.DB).GetByID(id)
+	if err != nil || group.OrganizationID != ctx.Tenant.ID {
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			ctx.Logger.Error("failed to get group", "err", err, "id", id)
+			middlewares.WriteSCIMError(ctx, http.StatusInternalServerError, "", "Failed to retrieve group")
+			return nil, false
+		}
+		middlewares.WriteSCIMError(ctx, http.StatusNotFound, "", "Group not found")
+		return nil, false
+	}
+
+	return group, true
+}
+
+// scimMemberIDs resolves member values to the IDs of users in the request's organization
+func scimMemberIDs(ctx *middlewares.AppContext, members []scimMember) ([]int, bool) {
+	userQueries := db.NewUserQueries(ctx.DB)
+
+	userIDs := []int{}
+	for _, member := range members {
+		id, err := strconv.Atoi(member.Value)
+		if err == nil {
+			var user *db.User
+			user, err = userQueries.GetByID(id)
+			if err == nil && (user.OrganizationID != ctx.Tenant.ID || user.DeletedAt != nil) {
+				err = fmt.Errorf("user not found")
+			}
+		}
+		if err != nil {
+			if !strings.Contains(err.Error(), "not found") && !strings.Contains(err.Error(), "invalid syntax") {
+				ctx.Logger.Error("failed to get user", "err", err, "value", member.Value)
+				middlewares.WriteSCIMError(ctx, http.StatusInternalServerError, "", "Failed to resolve members")
+				return nil, false
+			}
+			middlewares.WriteSCIMError(ctx, http.StatusBadRequest, "invalidValue", "Unknown member: "+member.Value)
+			return nil, false
+		}
+		userIDs = append(userIDs, id)
+	}
+
+	return userIDs, true
+}
+
+func removeIDs(ids []int, value string) []int {
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return ids
+	}
+
+	kept := []int{}
+	for _, existing := range ids {
+		if existing != id {
+			kept = append(kept, existing)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"encoding/json"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HandleSCIMTokensGET lists the organization's SCIM provisioning tokens
+func HandleSCIMTokensGET(ctx *middlewares.AppContext) {
+	tokens, err := db.NewSCIMTokenQueries(ctx.DB).List(ctx.Tenant.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to list scim tokens", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve SCIM tokens")
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"tokens": tokens,
+		"count":  len(tokens),
+	})
+}
+
+// HandleSCIMTokensPOST issues a SCIM provisioning token. The token is only returned in this response.
+func HandleSCIMTokensPOST(ctx *middlewares.AppContext) {
+	var request struct {
+		Name string `json:"name"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		ctx.SetJSONError(http.StatusBadRequest, "name is required")
+		return
+	}
+
+	value, hash, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	token, err := db.NewSCIMTokenQueries(ctx.DB).Create(ctx.Tenant.ID, name, hash)
+	if err != nil {
+		ctx.Logger.Error("failed to create scim token", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to create SCIM token")
+		return
+	}
+
+	utils.RecordAudit(ctx, "scim_token.create", "scim_token", strconv.Itoa(token.ID), map[string]interface{}{"name": token.Name})
+
+	ctx.WriteJSON(http.StatusCreated, map[string]interface{}{
+		"id":         token.ID,
+		"name":       token.Name,
+		"token":      value,
+		"created_at": token.CreatedAt,
+	})
+}
+
+// HandleSCIMTokenDELETE revokes a SCIM provisioning token
+func HandleSCIMTokenDELETE(ctx *middlewares.AppContext) {
+	id, err := strconv.Atoi(ctx.Request.PathValue("id"))
+	if err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid token ID")
+		return
+	}
+
+	if err := db.NewSCIMTokenQueries(ctx.DB).Delete(ctx.Tenant.ID, id); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "SCIM token not found")
+			return
+		}
+		ctx.Logger.Error("failed to delete scim token", "err", err, "id", id)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to revoke SCIM token")
+		return
+	}
+
+	utils.RecordAudit(ctx, "scim_token.delete", "scim_token", strconv.Itoa(id), nil)
+
+	ctx.SetJSONStatus(http.StatusOK, "SCIM token revoked")
+}
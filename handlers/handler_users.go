@@ -1,30 +1,120 @@
 package handlers
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"jwt-auth-poc/crypt_utils"
 	"jwt-auth-poc/db"
 	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// HandleUsersGET lists all users - limit 100
+const (
+	defaultUserPageSize = 50
+	maxUserPageSize     = 200
+)
+
+// userListCursor is the decoded form of the opaque cursor returned as next_cursor. It records the sort it was
+// issued for, so it cannot be replayed against a different ordering.
+type userListCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+// HandleUsersGET lists the organization's users a page at a time.
+//
+// Query parameters: limit (1-200, default 50), cursor (next_cursor of the previous page), sort (created_at, email or
+// name, prefixed with "-" for descending; default -created_at), q (prefix of the email or name), email_domain, role,
+// status, created_after and created_before (RFC 3339 or YYYY-MM-DD), and deleted=true to list soft deleted users
+// instead. Filters must be repeated with every page.
 func HandleUsersGET(ctx *middlewares.AppContext) {
-	userQueries := db.NewUserQueries(ctx.DB)
+	query := ctx.Request.URL.Query()
+
+	opts := db.UserListOptions{Limit: defaultUserPageSize}
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxUserPageSize {
+			ctx.SetJSONError(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxUserPageSize))
+			return
+		}
+		opts.Limit = parsed
+	}
+
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = "-created_at"
+	}
+	opts.SortBy, opts.Descending = strings.TrimPrefix(sort, "-"), strings.HasPrefix(sort, "-")
+	if _, ok := db.UserSortFields[opts.SortBy]; !ok {
+		ctx.SetJSONError(http.StatusBadRequest, "sort must be one of created_at, email or name, optionally prefixed with -")
+		return
+	}
+
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := decodeUserListCursor(value)
+		if err != nil || cursor.Sort != sort {
+			ctx.SetJSONError(http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+		opts.After = &db.UserCursor{Value: cursor.Value, ID: cursor.ID}
+	}
+
+	opts.Filter = db.UserFilter{
+		OrganizationID: ctx.Tenant.ID,
+		EmailDomain:    strings.TrimPrefix(strings.TrimSpace(query.Get("email_domain")), "@"),
+		Role:           query.Get("role"),
+		Status:         query.Get("status"),
+		Search:         strings.TrimSpace(query.Get("q")),
+		Deleted:        query.Get("deleted") == "true",
+	}
+
+	if opts.Filter.Status != "" && !db.IsValidUserStatus(opts.Filter.Status) {
+		ctx.SetJSONError(http.StatusBadRequest, "status must be one of active, suspended, deactivated or pending")
+		return
+	}
 
-	users, err := userQueries.List(100, 0)
+	var err error
+	if opts.Filter.CreatedAfter, err = parseFilterTime(query.Get("created_after")); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "created_after must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+		return
+	}
+	if opts.Filter.CreatedBefore, err = parseFilterTime(query.Get("created_before")); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "created_before must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+		return
+	}
+
+	userQueries := db.NewUserQueries(ctx.DB)
+	users, next, err := userQueries.List(opts)
 	if err != nil {
 		ctx.Logger.Error("failed to list users", "err", err)
 		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve users")
 		return
 	}
 
-	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+	total, err := userQueries.Count(opts.Filter)
+	if err != nil {
+		ctx.Logger.Error("failed to count users", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve users")
+		return
+	}
+
+	response := map[string]interface{}{
 		"users": users,
 		"count": len(users),
-	})
+		"total": total,
+		"limit": opts.Limit,
+	}
+	if next != nil {
+		response["next_cursor"] = encodeUserListCursor(userListCursor{Sort: sort, Value: next.Value, ID: next.ID})
+	}
+
+	ctx.WriteJSON(http.StatusOK, response)
 }
 
 // HandleUsersPOST creates a new user
@@ -53,77 +143,289 @@ func HandleUsersPOST(ctx *middlewares.AppContext) {
 	}
 
 	userQueries := db.NewUserQueries(ctx.DB)
-	user, err := userQueries.Create(request.Email, request.Name, hashedPassword)
+	user, err := userQueries.Create(ctx.Tenant.ID, request.Email, request.Name, hashedPassword)
 	if err != nil {
 		ctx.Logger.Error("failed to create user", "err", err)
 		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
-			ctx.SetJSONError(http.StatusInternalServerError, "Failed to create user")
+			ctx.SetJSONError(http.StatusConflict, "A user with this email already exists")
 			return
 		}
 		ctx.SetJSONError(http.StatusInternalServerError, "Failed to create user")
 		return
 	}
 
+	utils.RecordAudit(ctx, "user.create", "user", strconv.Itoa(user.ID), map[string]interface{}{"email": user.Email})
+
 	ctx.WriteJSON(http.StatusCreated, user)
 }
 
 // HandleUserGET retrieves a single user by ID
 func HandleUserGET(ctx *middlewares.AppContext) {
-	idStr := ctx.Request.PathValue("id")
+	user, ok := userFromPath(ctx)
+	if !ok {
+		return
+	}
 
-	if idStr == "" {
-		ctx.Logger.Debug("Empty path value", "url", ctx.Request.URL.Path)
-		ctx.SetJSONError(http.StatusBadRequest, "User ID is required")
+	ctx.WriteJSON(http.StatusOK, user)
+}
+
+// HandleUserDELETE soft deletes a user. The account stops working immediately and can be restored until it is
+// purged after the retention period.
+func HandleUserDELETE(ctx *middlewares.AppContext) {
+	user, ok := userFromPath(ctx)
+	if !ok {
 		return
 	}
 
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		ctx.SetJSONError(http.StatusBadRequest, "Invalid user ID")
+	if ok := ensureNotLastAdmin(ctx, user); !ok {
 		return
 	}
 
 	userQueries := db.NewUserQueries(ctx.DB)
-	user, err := userQueries.GetByID(id)
-	if err != nil {
+	if err := userQueries.SoftDelete(user.ID); err != nil {
 		if strings.Contains(err.Error(), "not found") {
 			ctx.SetJSONError(http.StatusNotFound, "User not found")
 			return
 		}
-		ctx.Logger.Error("failed to get user", "err", err, "id", id)
-		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve user")
+		ctx.Logger.Error("failed to delete user", "err", err, "id", user.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to delete user")
 		return
 	}
 
-	ctx.WriteJSON(http.StatusOK, user)
+	if err := utils.RevokeUserSessions(ctx.DB, user.ID); err != nil {
+		ctx.Logger.Error("failed to revoke sessions", "err", err, "id", user.ID)
+	}
+
+	purgeAfter := time.Now().Add(ctx.Config.Users.DeletedRetention).UTC().Truncate(time.Second)
+	utils.RecordAudit(ctx, "user.delete", "user", strconv.Itoa(user.ID), map[string]interface{}{
+		"email":       user.Email,
+		"purge_after": purgeAfter,
+	})
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"status":      "User deleted successfully",
+		"purge_after": purgeAfter,
+	})
 }
 
-// HandleUserDELETE removes a user by ID
-func HandleUserDELETE(ctx *middlewares.AppContext) {
+// HandleUserRestorePOST undoes the soft delete of a user that has not been purged yet
+func HandleUserRestorePOST(ctx *middlewares.AppContext) {
+	user, ok := userFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	restored, err := db.NewUserQueries(ctx.DB).Restore(user.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusConflict, "User is not deleted")
+			return
+		}
+		ctx.Logger.Error("failed to restore user", "err", err, "id", user.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to restore user")
+		return
+	}
+
+	utils.RecordAudit(ctx, "user.restore", "user", strconv.Itoa(user.ID), nil)
+
+	ctx.WriteJSON(http.StatusOK, restored)
+}
+
+// HandleUserPurgePOST permanently removes a soft deleted user without waiting for the retention period
+func HandleUserPurgePOST(ctx *middlewares.AppContext) {
+	user, ok := userFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	if user.DeletedAt == nil {
+		ctx.SetJSONError(http.StatusConflict, "Only deleted users can be purged")
+		return
+	}
+
+	if err := db.NewUserQueries(ctx.DB).Delete(user.ID); err != nil {
+		ctx.Logger.Error("failed to purge user", "err", err, "id", user.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to purge user")
+		return
+	}
+
+	utils.RecordAudit(ctx, "user.purge", "user", strconv.Itoa(user.ID), map[string]interface{}{"email": user.Email})
+
+	ctx.SetJSONStatus(http.StatusOK, "User purged")
+}
+
+// HandleUserStatusPUT suspends, deactivates or reactivates a user. Leaving the active status revokes the user's
+// sessions and their access tokens stop working immediately.
+func HandleUserStatusPUT(ctx *middlewares.AppContext) {
+	user, ok := userFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	if !db.IsValidUserStatus(request.Status) {
+		ctx.SetJSONError(http.StatusBadRequest, "status must be one of active, suspended, deactivated or pending")
+		return
+	}
+
+	if user.DeletedAt != nil {
+		ctx.SetJSONError(http.StatusConflict, "Restore the user before changing its status")
+		return
+	}
+
+	if request.Status != db.UserStatusActive {
+		if ok := ensureNotLastAdmin(ctx, user); !ok {
+			return
+		}
+	}
+
+	updated, err := db.NewUserQueries(ctx.DB).SetStatus(user.ID, request.Status, strings.TrimSpace(request.Reason))
+	if err != nil {
+		ctx.Logger.Error("failed to set user status", "err", err, "id", user.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to update user status")
+		return
+	}
+
+	if !updated.IsActive() {
+		if err := utils.RevokeUserSessions(ctx.DB, user.ID); err != nil {
+			ctx.Logger.Error("failed to revoke sessions", "err", err, "id", user.ID)
+		}
+	}
+
+	utils.RecordAudit(ctx, "user.status", "user", strconv.Itoa(user.ID), map[string]interface{}{
+		"previous_status": user.Status,
+		"status":          updated.Status,
+		"reason":          updated.StatusReason,
+	})
+
+	ctx.WriteJSON(http.StatusOK, updated)
+}
+
+// HandleUserUnlockPOST clears the failed login counter for a user, lifting any lockout
+func HandleUserUnlockPOST(ctx *middlewares.AppContext) {
+	user, ok := userFromPath(ctx)
+	if !ok {
+		return
+	}
+
+	if err := utils.ResetLoginFailures(ctx, user.Email); err != nil {
+		ctx.Logger.Error("failed to unlock user", "err", err, "id", user.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to unlock user")
+		return
+	}
+
+	utils.RecordAudit(ctx, "user.unlock", "user", strconv.Itoa(user.ID), nil)
+	ctx.SetJSONStatus(http.StatusOK, "User unlocked successfully")
+}
+
+// userFromPath loads the user identified by the {id} path value, writing an error response if it cannot.
+// Users of other organizations are reported as not found.
+func userFromPath(ctx *middlewares.AppContext) (*db.User, bool) {
 	idStr := ctx.Request.PathValue("id")
 
 	if idStr == "" {
-		ctx.Logger.Debug("Empty path value for delete", "url", ctx.Request.URL.Path)
+		ctx.Logger.Debug("Empty path value", "url", ctx.Request.URL.Path)
 		ctx.SetJSONError(http.StatusBadRequest, "User ID is required")
-		return
+		return nil, false
 	}
 
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
 		ctx.SetJSONError(http.StatusBadRequest, "Invalid user ID")
-		return
+		return nil, false
 	}
 
-	userQueries := db.NewUserQueries(ctx.DB)
-	if err := userQueries.Delete(id); err != nil {
+	user, err := db.NewUserQueries(ctx.DB).GetByID(id)
+	if err == nil && user.OrganizationID != ctx.Tenant.ID {
+		err = fmt.Errorf("user not found")
+	}
+	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
 			ctx.SetJSONError(http.StatusNotFound, "User not found")
-			return
+			return nil, false
 		}
-		ctx.Logger.Error("failed to delete user", "err", err, "id", id)
-		ctx.SetJSONError(http.StatusInternalServerError, "Failed to delete user")
-		return
+		ctx.Logger.Error("failed to get user", "err", err, "id", id)
+		ctx.SetJSONError(http.StatusInternalServerError, "Failed to retrieve user")
+		return nil, false
+	}
+
+	return user, true
+}
+
+// ensureNotLastAdmin refuses changes that would remove the only remaining active administrator
+func ensureNotLastAdmin(ctx *middlewares.AppContext, user *db.User) bool {
+	lastAdmin, err := isLastAdmin(ctx, user)
+	if err != nil {
+		ctx.Logger.Error("failed to check administrators", "err", err, "id", user.ID)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return false
+	}
+	if lastAdmin {
+		ctx.SetJSONError(http.StatusConflict, "Cannot remove the last administrator")
+		return false
+	}
+
+	return true
+}
+
+// isLastAdmin reports whether a user is the only remaining active administrator of the organization
+func isLastAdmin(ctx *middlewares.AppContext, user *db.User) (bool, error) {
+	if !user.IsActive() {
+		return false, nil
+	}
+
+	roleQueries := db.NewRoleQueries(ctx.DB)
+
+	isAdmin, err := roleQueries.UserHasRole(user.ID, db.AdminRoleName)
+	if err != nil || !isAdmin {
+		return false, err
+	}
+
+	admins, err := roleQueries.CountUsersWithRole(ctx.Tenant.ID, db.AdminRoleName)
+	if err != nil {
+		return false, err
+	}
+
+	return admins <= 1, nil
+}
+
+func encodeUserListCursor(cursor userListCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeUserListCursor(value string) (*userListCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor userListCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+
+	return &cursor, nil
+}
+
+// parseFilterTime reads an optional RFC 3339 timestamp or calendar date (midnight UTC)
+func parseFilterTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
 	}
 
-	ctx.SetJSONStatus(http.StatusOK, "User deleted successfully")
+	return time.Parse(time.DateOnly, value)
 }
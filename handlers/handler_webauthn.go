@@ -0,0 +1,464 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	webAuthnCeremonyRegistration   = "registration"
+	webAuthnCeremonyAuthentication = "authentication"
+	webAuthnCeremonyMFA            = "mfa"
+)
+
+type webAuthnCredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+// webAuthnCredentialResponse is the JSON serialization of a PublicKeyCredential (WebAuthn Level 3 toJSON)
+type webAuthnCredentialResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"`
+		AuthenticatorData string   `json:"authenticatorData"`
+		Signature         string   `json:"signature"`
+		UserHandle        string   `json:"userHandle"`
+		Transports        []string `json:"transports"`
+	} `json:"response"`
+}
+
+// HandleWebAuthnRegisterBeginPOST starts registration of a passkey or security key for the authenticated user
+func HandleWebAuthnRegisterBeginPOST(ctx *middlewares.AppContext) {
+	user, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	existing, err := db.NewWebAuthnCredentialQueries(ctx.DB).ListByUserID(user.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to list webauthn credentials", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	challenge, ok := createWebAuthnSession(ctx, webAuthnCeremonyRegistration, &user.ID, "preferred")
+	if !ok {
+		return
+	}
+
+	exclude := []webAuthnCredentialDescriptor{}
+	for _, credential := range existing {
+		exclude = append(exclude, webAuthnCredentialDescriptor{Type: "public-key", ID: credential.CredentialID, Transports: credential.Transports})
+	}
+
+	rp := webAuthnRelyingParty(ctx)
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"publicKey": map[string]interface{}{
+			"rp": map[string]string{"id": rp.ID, "name": rp.Name},
+			"user": map[string]string{
+				"id":          webAuthnUserHandle(user.ID),
+				"name":        user.Email,
+				"displayName": user.Name,
+			},
+			"challenge": challenge,
+			"pubKeyCredParams": []map[string]interface{}{
+				{"type": "public-key", "alg": crypt_utils.COSEAlgES256},
+				{"type": "public-key", "alg": crypt_utils.COSEAlgEdDSA},
+				{"type": "public-key", "alg": crypt_utils.COSEAlgRS256},
+			},
+			"timeout":            crypt_utils.ConstWebAuthnCeremonyTimeout.Milliseconds(),
+			"excludeCredentials": exclude,
+			"authenticatorSelection": map[string]interface{}{
+				"residentKey":      "preferred",
+				"userVerification": "preferred",
+			},
+			"attestation": "none",
+		},
+	})
+}
+
+// HandleWebAuthnRegisterFinishPOST verifies a registration response and stores the new credential
+func HandleWebAuthnRegisterFinishPOST(ctx *middlewares.AppContext) {
+	user, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Name       string                     `json:"name"`
+		Credential webAuthnCredentialResponse `json:"credential"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	clientDataJSON, err1 := crypt_utils.DecodeWebAuthnBase64(request.Credential.Response.ClientDataJSON)
+	attestationObject, err2 := crypt_utils.DecodeWebAuthnBase64(request.Credential.Response.AttestationObject)
+	if err1 != nil || err2 != nil || len(clientDataJSON) == 0 || len(attestationObject) == 0 {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid credential encoding")
+		return
+	}
+
+	session, ok := consumeWebAuthnSession(ctx, clientDataJSON, webAuthnCeremonyRegistration)
+	if !ok {
+		return
+	}
+	if session.UserID == nil || *session.UserID != user.ID {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid or expired WebAuthn challenge")
+		return
+	}
+
+	rp := webAuthnRelyingParty(ctx)
+	verified, err := rp.VerifyRegistration(session.Challenge, clientDataJSON, attestationObject, false)
+	if err != nil {
+		ctx.Logger.Debug("WebAuthn registration failed", "user_id", user.ID, "err", err)
+		ctx.SetJSONError(http.StatusBadRequest, "WebAuthn registration failed")
+		return
+	}
+
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+
+	credentialQueries := db.NewWebAuthnCredentialQueries(ctx.DB)
+	credential, err := credentialQueries.Create(&db.WebAuthnCredential{
+		UserID:         user.ID,
+		CredentialID:   base64.RawURLEncoding.EncodeToString(verified.ID),
+		PublicKey:      verified.PublicKey,
+		SignCount:      verified.SignCount,
+		AAGUID:         verified.AAGUID,
+		Transports:     request.Credential.Response.Transports,
+		Name:           name,
+		BackupEligible: verified.BackupEligible,
+		BackupState:    verified.BackupState,
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			ctx.SetJSONError(http.StatusConflict, "Credential already registered")
+			return
+		}
+		ctx.Logger.Error("failed to save webauthn credential", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	ctx.Logger.Info("WebAuthn credential registered", "user_id", user.ID, "credential", credential.ID)
+	ctx.WriteJSON(http.StatusCreated, credential)
+}
+
+// HandleWebAuthnCredentialsGET lists the authenticated user's WebAuthn credentials
+func HandleWebAuthnCredentialsGET(ctx *middlewares.AppContext) {
+	user, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	credentials, err := db.NewWebAuthnCredentialQueries(ctx.DB).ListByUserID(user.ID)
+	if err != nil {
+		ctx.Logger.Error("failed to list webauthn credentials", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"credentials": credentials,
+		"count":       len(credentials),
+	})
+}
+
+// HandleWebAuthnCredentialDELETE removes one of the authenticated user's WebAuthn credentials
+func HandleWebAuthnCredentialDELETE(ctx *middlewares.AppContext) {
+	user, ok := getAuthenticatedUser(ctx)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(ctx.Request.PathValue("id"))
+	if err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid credential ID")
+		return
+	}
+
+	if err := db.NewWebAuthnCredentialQueries(ctx.DB).DeleteForUser(id, user.ID); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			ctx.SetJSONError(http.StatusNotFound, "Credential not found")
+			return
+		}
+		ctx.Logger.Error("failed to delete webauthn credential", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	ctx.SetJSONStatus(http.StatusOK, "Credential deleted successfully")
+}
+
+// HandleWebAuthnLoginBeginPOST starts a usernameless passkey login
+func HandleWebAuthnLoginBeginPOST(ctx *middlewares.AppContext) {
+	challenge, ok := createWebAuthnSession(ctx, webAuthnCeremonyAuthentication, nil, "required")
+	if !ok {
+		return
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"publicKey": map[string]interface{}{
+			"challenge":        challenge,
+			"rpId":             webAuthnRelyingParty(ctx).ID,
+			"timeout":          crypt_utils.ConstWebAuthnCeremonyTimeout.Milliseconds(),
+			"userVerification": "required",
+			"allowCredentials": []webAuthnCredentialDescriptor{},
+		},
+	})
+}
+
+// HandleWebAuthnLoginFinishPOST verifies a passkey assertion and issues tokens. User verification is
+// required, so the passkey alone satisfies multi-factor authentication.
+func HandleWebAuthnLoginFinishPOST(ctx *middlewares.AppContext) {
+	var request struct {
+		Credential webAuthnCredentialResponse `json:"credential"`
+		Scope      string                     `json:"scope"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	credential, ok := verifyWebAuthnAssertion(ctx, &request.Credential, webAuthnCeremonyAuthentication, nil)
+	if !ok {
+		return
+	}
+
+	user, err := db.NewUserQueries(ctx.DB).GetByID(credential.UserID)
+	if err != nil {
+		ctx.Logger.Error("Failed to get user", "user_id", credential.UserID, "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	scope, ok := narrowLoginScope(ctx, user.ID, utils.ParseScope(request.Scope))
+	if !ok {
+		return
+	}
+
+	writeLoginTokens(ctx, user, []string{"hwk", "mfa"}, scope)
+}
+
+// HandleWebAuthnMFABeginPOST starts a WebAuthn second factor check for a pending MFA challenge
+func HandleWebAuthnMFABeginPOST(ctx *middlewares.AppContext) {
+	var request struct {
+		MFAToken string `json:"mfa_token"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	challenge, err := db.NewMFAChallengeQueries(ctx.DB).GetValidByHash(utils.HashToken(strings.TrimSpace(request.MFAToken)))
+	if err != nil {
+		ctx.SetJSONError(http.StatusUnauthorized, "Invalid or expired MFA token")
+		return
+	}
+
+	credentials, err := db.NewWebAuthnCredentialQueries(ctx.DB).ListByUserID(challenge.UserID)
+	if err != nil {
+		ctx.Logger.Error("failed to list webauthn credentials", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if len(credentials) == 0 {
+		ctx.SetJSONError(http.StatusBadRequest, "No WebAuthn credentials registered")
+		return
+	}
+
+	webAuthnChallenge, ok := createWebAuthnSession(ctx, webAuthnCeremonyMFA, &challenge.UserID, "discouraged")
+	if !ok {
+		return
+	}
+
+	allow := []webAuthnCredentialDescriptor{}
+	for _, credential := range credentials {
+		allow = append(allow, webAuthnCredentialDescriptor{Type: "public-key", ID: credential.CredentialID, Transports: credential.Transports})
+	}
+
+	ctx.WriteJSON(http.StatusOK, map[string]interface{}{
+		"publicKey": map[string]interface{}{
+			"challenge":        webAuthnChallenge,
+			"rpId":             webAuthnRelyingParty(ctx).ID,
+			"timeout":          crypt_utils.ConstWebAuthnCeremonyTimeout.Milliseconds(),
+			"userVerification": "discouraged",
+			"allowCredentials": allow,
+		},
+	})
+}
+
+// HandleWebAuthnMFAFinishPOST verifies a WebAuthn assertion as the second factor and issues tokens
+func HandleWebAuthnMFAFinishPOST(ctx *middlewares.AppContext) {
+	var request struct {
+		MFAToken   string                     `json:"mfa_token"`
+		Credential webAuthnCredentialResponse `json:"credential"`
+	}
+
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&request); err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	challengeQueries := db.NewMFAChallengeQueries(ctx.DB)
+	challenge, err := challengeQueries.GetValidByHash(utils.HashToken(strings.TrimSpace(request.MFAToken)))
+	if err != nil {
+		ctx.SetJSONError(http.StatusUnauthorized, "Invalid or expired MFA token")
+		return
+	}
+
+	user, err := db.NewUserQueries(ctx.DB).GetByID(challenge.UserID)
+	if err != nil {
+		ctx.Logger.Error("Failed to get user", "user_id", challenge.UserID, "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	if locked, err := mfaAccountLocked(ctx, challenge, user); err != nil || locked {
+		if err != nil {
+			ctx.Logger.Error("failed to check login throttle", "err", err)
+			ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+			return
+		}
+		ctx.SetJSONError(http.StatusUnauthorized, "Invalid or expired MFA token")
+		return
+	}
+
+	if _, ok := verifyWebAuthnAssertion(ctx, &request.Credential, webAuthnCeremonyMFA, &challenge.UserID); !ok {
+		failMFAChallenge(ctx, challenge, user)
+		return
+	}
+
+	if err := challengeQueries.DeleteByID(challenge.ID); err != nil {
+		ctx.SetJSONError(http.StatusUnauthorized, "Invalid or expired MFA token")
+		return
+	}
+
+	if err := utils.ResetLoginFailures(ctx, user.Email); err != nil {
+		ctx.Logger.Error("failed to reset login failures", "err", err)
+	}
+
+	writeLoginTokens(ctx, user, append(challenge.AMR, "hwk"), challenge.Scope)
+}
+
+// verifyWebAuthnAssertion checks an assertion for the given ceremony and updates the credential's counter.
+// When expectedUserID is set the credential must belong to that user. On failure an error response is written.
+func verifyWebAuthnAssertion(ctx *middlewares.AppContext, response *webAuthnCredentialResponse, ceremony string, expectedUserID *int) (*db.WebAuthnCredential, bool) {
+	clientDataJSON, err1 := crypt_utils.DecodeWebAuthnBase64(response.Response.ClientDataJSON)
+	authenticatorData, err2 := crypt_utils.DecodeWebAuthnBase64(response.Response.AuthenticatorData)
+	signature, err3 := crypt_utils.DecodeWebAuthnBase64(response.Response.Signature)
+	rawID, err4 := crypt_utils.DecodeWebAuthnBase64(response.RawID)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || len(rawID) == 0 {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid credential encoding")
+		return nil, false
+	}
+
+	session, ok := consumeWebAuthnSession(ctx, clientDataJSON, ceremony)
+	if !ok {
+		return nil, false
+	}
+
+	credentialQueries := db.NewWebAuthnCredentialQueries(ctx.DB)
+	credential, err := credentialQueries.GetByCredentialID(base64.RawURLEncoding.EncodeToString(rawID))
+	if err != nil {
+		ctx.Logger.Debug("Unknown webauthn credential", "err", err)
+		ctx.SetJSONError(http.StatusUnauthorized, "WebAuthn authentication failed")
+		return nil, false
+	}
+
+	if expectedUserID != nil && credential.UserID != *expectedUserID {
+		ctx.SetJSONError(http.StatusUnauthorized, "WebAuthn authentication failed")
+		return nil, false
+	}
+
+	if response.Response.UserHandle != "" {
+		userHandle, err := crypt_utils.DecodeWebAuthnBase64(response.Response.UserHandle)
+		if err != nil || base64.RawURLEncoding.EncodeToString(userHandle) != webAuthnUserHandle(credential.UserID) {
+			ctx.SetJSONError(http.StatusUnauthorized, "WebAuthn authentication failed")
+			return nil, false
+		}
+	}
+
+	rp := webAuthnRelyingParty(ctx)
+	assertion, err := rp.VerifyAssertion(session.Challenge, clientDataJSON, authenticatorData, signature, credential.PublicKey, credential.SignCount, session.UserVerification == "required")
+	if err != nil {
+		ctx.Logger.Debug("WebAuthn assertion failed", "user_id", credential.UserID, "err", err)
+		ctx.SetJSONError(http.StatusUnauthorized, "WebAuthn authentication failed")
+		return nil, false
+	}
+
+	if err := credentialQueries.UpdateUsage(credential.ID, assertion.SignCount, assertion.BackupState); err != nil {
+		ctx.Logger.Error("failed to update webauthn credential", "err", err)
+	}
+
+	return credential, true
+}
+
+// createWebAuthnSession stores a new ceremony challenge, writing an error response on failure
+func createWebAuthnSession(ctx *middlewares.AppContext, ceremony string, userID *int, userVerification string) (string, bool) {
+	challenge, err := crypt_utils.GenerateWebAuthnChallenge()
+	if err != nil {
+		ctx.Logger.Error("failed to generate webauthn challenge", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return "", false
+	}
+
+	sessionQueries := db.NewWebAuthnSessionQueries(ctx.DB)
+	if err := sessionQueries.Create(challenge, ceremony, userID, userVerification, crypt_utils.ConstWebAuthnCeremonyTimeout); err != nil {
+		ctx.Logger.Error("failed to save webauthn session", "err", err)
+		ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+		return "", false
+	}
+
+	return challenge, true
+}
+
+// consumeWebAuthnSession finds the ceremony session for the challenge echoed in clientDataJSON
+func consumeWebAuthnSession(ctx *middlewares.AppContext, clientDataJSON []byte, ceremony string) (*db.WebAuthnSession, bool) {
+	clientData, err := crypt_utils.ParseClientData(clientDataJSON)
+	if err != nil {
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid client data")
+		return nil, false
+	}
+
+	session, err := db.NewWebAuthnSessionQueries(ctx.DB).Consume(strings.TrimRight(clientData.Challenge, "="), ceremony)
+	if err != nil {
+		ctx.Logger.Debug("Invalid webauthn session", "err", err)
+		ctx.SetJSONError(http.StatusBadRequest, "Invalid or expired WebAuthn challenge")
+		return nil, false
+	}
+
+	return session, true
+}
+
+func webAuthnRelyingParty(ctx *middlewares.AppContext) *crypt_utils.WebAuthnRelyingParty {
+	return &crypt_utils.WebAuthnRelyingParty{
+		ID:      ctx.Config.WebAuthn.RPID,
+		Name:    ctx.Config.WebAuthn.RPName,
+		Origins: ctx.Config.WebAuthn.Origins,
+	}
+}
+
+// webAuthnUserHandle returns the opaque user handle passkeys are registered under
+func webAuthnUserHandle(userID int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(userID)))
+}
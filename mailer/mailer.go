@@ -0,0 +1,99 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"jwt-auth-poc/config"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers email messages
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// New creates the Mailer selected by the configuration. Without a driver no email is sent, and the log driver is
+// only meant for development; both are announced at startup so neither is picked up unnoticed.
+func New(cfg config.MailConfig, logger *slog.Logger) (Mailer, error) {
+	switch cfg.Driver {
+	case "":
+		logger.Warn("MAIL_DRIVER is not set, emails such as sign-in links will not be sent")
+		return &DisabledMailer{}, nil
+	case "log":
+		logger.Warn("MAIL_DRIVER=log writes emails to the log instead of sending them; use it for development only")
+		return &LogMailer{logger: logger, logBody: cfg.LogBody}, nil
+	case "smtp":
+		if cfg.SMTPHost == "" || cfg.From == "" {
+			return nil, fmt.Errorf("smtp mailer requires MAIL_SMTP_HOST and MAIL_FROM")
+		}
+		return &SMTPMailer{cfg: cfg}, nil
+	}
+
+	return nil, fmt.Errorf("unknown mail driver %q", cfg.Driver)
+}
+
+// DisabledMailer refuses every message, for deployments that have not configured a mail driver
+type DisabledMailer struct{}
+
+func (m *DisabledMailer) Send(_ context.Context, _ Message) error {
+	return fmt.Errorf("no mail driver configured")
+}
+
+// LogMailer writes messages to the log instead of sending them. Intended for development. Bodies carry sign-in
+// links, so they are only written at debug level and with MAIL_LOG_BODY set.
+type LogMailer struct {
+	logger  *slog.Logger
+	logBody bool
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	m.logger.Info("Email", "to", msg.To, "subject", msg.Subject)
+	if m.logBody {
+		m.logger.DebugContext(ctx, "Email body", "to", msg.To, "body", msg.Body)
+	}
+	return nil
+}
+
+// SMTPMailer sends messages through an SMTP relay
+type SMTPMailer struct {
+	cfg config.MailConfig
+}
+
+func (m *SMTPMailer) Send(_ context.Context, msg Message) error {
+	if strings.ContainsAny(msg.To, "\r\n") || strings.ContainsAny(msg.Subject, "\r\n") {
+		return fmt.Errorf("invalid header value")
+	}
+
+	address := net.JoinHostPort(m.cfg.SMTPHost, strconv.Itoa(m.cfg.SMTPPort))
+
+	var auth smtp.Auth
+	if m.cfg.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", m.cfg.SMTPUsername, m.cfg.SMTPPassword, m.cfg.SMTPHost)
+	}
+
+	var body strings.Builder
+	body.WriteString("From: " + m.cfg.From + "\r\n")
+	body.WriteString("To: " + msg.To + "\r\n")
+	body.WriteString("Subject: " + msg.Subject + "\r\n")
+	body.WriteString("MIME-Version: 1.0\r\n")
+	body.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	body.WriteString("\r\n")
+	body.WriteString(msg.Body)
+
+	if err := smtp.SendMail(address, auth, m.cfg.From, []string{msg.To}, []byte(body.String())); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	return nil
+}
@@ -5,26 +5,40 @@ import (
 	"crypto/ecdsa"
 	"fmt"
 	"jwt-auth-poc/api"
+	"jwt-auth-poc/config"
 	"jwt-auth-poc/crypt_utils"
 	"jwt-auth-poc/db"
+	"jwt-auth-poc/mailer"
 	"jwt-auth-poc/middlewares"
+	"jwt-auth-poc/utils"
 	"log/slog"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func main() {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
 	slog.SetDefault(logger)
 
+	if len(os.Args) > 1 {
+		if run, ok := standaloneCommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				logger.Error("command failed", "command", os.Args[1], "err", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	jwtProvider := ReadOrGenerateJWTKeys(logger)
-	if jwtProvider == nil {
-		logger.Error("failed to initialize jwt provider")
+	cfg, err := config.Load()
+	if err != nil {
+		logger.Error("failed to load configuration", "err", err)
 		return
 	}
 
@@ -40,6 +54,25 @@ func main() {
 		return
 	}
 
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:], database, cfg); err != nil {
+			logger.Error("command failed", "command", os.Args[1], "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := bootstrapAdmin(database, cfg, logger); err != nil {
+		logger.Error("failed to bootstrap admin", "err", err)
+		return
+	}
+
+	jwtProvider := ReadOrGenerateJWTKeys(logger)
+	if jwtProvider == nil {
+		logger.Error("failed to initialize jwt provider")
+		return
+	}
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
@@ -49,7 +82,18 @@ func main() {
 		cancel()
 	}()
 
-	appCtx := middlewares.NewAppContext(ctx, logger, database, jwtProvider)
+	rateLimiter := middlewares.NewMemoryRateLimitStore()
+	rateLimiter.StartCleanup(ctx, time.Minute)
+
+	utils.StartUserPurge(ctx, database, cfg.Users.DeletedRetention, cfg.Users.PurgeInterval, logger)
+
+	mail, err := mailer.New(cfg.Mail, logger)
+	if err != nil {
+		logger.Error("failed to initialize mailer", "err", err)
+		return
+	}
+
+	appCtx := middlewares.NewAppContext(ctx, logger, database, jwtProvider, cfg, rateLimiter, mail)
 
 	err = api.StartServer(appCtx)
 	if err != nil {
@@ -3,19 +3,32 @@ package middlewares
 import (
 	"context"
 	"encoding/json"
+	"jwt-auth-poc/config"
 	"jwt-auth-poc/crypt_utils"
 	"jwt-auth-poc/db"
+	"jwt-auth-poc/mailer"
 	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type AppContext struct {
 	context.Context
 	Logger      *slog.Logger
 	DB          *db.DB
-	JWTProvider crypt_utils.JWTProvider
+	JWTProvider crypt_utils.JWTProvider // signing key of the request's organization
+	Keyring     *TenantKeyring
+	Config      *config.Config
+	RateLimiter RateLimitStore
+	Mailer      mailer.Mailer
+	Tenant      *db.Organization // organization the request was resolved to
+	TenantPath  string           // "/t/{slug}" when the organization was selected by path, otherwise empty
 	Request     *http.Request
 	Response    http.ResponseWriter
+
+	values map[string]interface{}
 }
 
 type contextKey string
@@ -28,14 +41,7 @@ type AppHandler func(*AppContext)
 func AppContextMiddleware(baseCtx *AppContext) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			requestCtx := &AppContext{
-				Context:     r.Context(),
-				Logger:      baseCtx.Logger,
-				DB:          baseCtx.DB,
-				JWTProvider: baseCtx.JWTProvider,
-				Request:     r,
-				Response:    w,
-			}
+			requestCtx := baseCtx.forRequest(r, w)
 			ctx := context.WithValue(r.Context(), appContextKey, requestCtx)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
@@ -55,23 +61,44 @@ func Wrap(handler AppHandler) http.HandlerFunc {
 }
 
 func GetOrCreateAppContext(r *http.Request, w http.ResponseWriter, baseCtx *AppContext) *AppContext {
-	return &AppContext{
+	return baseCtx.forRequest(r, w)
+}
+
+// forRequest copies the application wide dependencies into a new per-request context
+func (ctx *AppContext) forRequest(r *http.Request, w http.ResponseWriter) *AppContext {
+	requestCtx := &AppContext{
 		Context:     r.Context(),
-		Logger:      baseCtx.Logger,
-		DB:          baseCtx.DB,
-		JWTProvider: baseCtx.JWTProvider,
+		Logger:      ctx.Logger,
+		DB:          ctx.DB,
+		JWTProvider: ctx.JWTProvider,
+		Keyring:     ctx.Keyring,
+		Config:      ctx.Config,
+		RateLimiter: ctx.RateLimiter,
+		Mailer:      ctx.Mailer,
 		Request:     r,
 		Response:    w,
 	}
+
+	if tenant, ok := r.Context().Value(tenantContextKey).(*requestTenant); ok {
+		requestCtx.Tenant = tenant.organization
+		requestCtx.TenantPath = tenant.pathPrefix
+		requestCtx.JWTProvider = tenant.provider
+	}
+
+	return requestCtx
 }
 
 // NewAppContext creates a new AppContext
-func NewAppContext(ctx context.Context, logger *slog.Logger, database *db.DB, jwtProvider crypt_utils.JWTProvider) *AppContext {
+func NewAppContext(ctx context.Context, logger *slog.Logger, database *db.DB, jwtProvider crypt_utils.JWTProvider, cfg *config.Config, rateLimiter RateLimitStore, mail mailer.Mailer) *AppContext {
 	return &AppContext{
 		Context:     ctx,
 		Logger:      logger,
 		DB:          database,
 		JWTProvider: jwtProvider,
+		Keyring:     NewTenantKeyring(database, jwtProvider),
+		Config:      cfg,
+		RateLimiter: rateLimiter,
+		Mailer:      mail,
 	}
 }
 
@@ -121,3 +148,35 @@ func (ctx *AppContext) WriteBytes(status int, contentType string, bytes []byte)
 		ctx.Logger.Error("failed to write response", "err", err)
 	}
 }
+
+// SetTooManyRequests writes a 429 response with a Retry-After header rounded up to whole seconds
+func (ctx *AppContext) SetTooManyRequests(retryAfter time.Duration, message string) {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	ctx.Response.Header().Set("Retry-After", strconv.Itoa(seconds))
+	ctx.SetJSONError(http.StatusTooManyRequests, message)
+}
+
+// Set stores a request scoped value on the context
+func (ctx *AppContext) Set(key string, value interface{}) {
+	if ctx.values == nil {
+		ctx.values = make(map[string]interface{})
+	}
+	ctx.values[key] = value
+}
+
+// Get retrieves a request scoped value previously stored with Set
+func (ctx *AppContext) Get(key string) interface{} {
+	return ctx.values[key]
+}
+
+// ClientIP returns the IP address of the connected peer
+func (ctx *AppContext) ClientIP() string {
+	host, _, err := net.SplitHostPort(ctx.Request.RemoteAddr)
+	if err != nil {
+		return ctx.Request.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,119 @@
+package middlewares
+
+import (
+	"fmt"
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DPoP error codes (RFC 9449 §12.2)
+const (
+	DPoPErrorInvalidProof = "invalid_dpop_proof"
+	DPoPErrorUseNonce     = "use_dpop_nonce"
+)
+
+// DPoPError is a rejected DPoP proof
+type DPoPError struct {
+	Code    string
+	Message string
+}
+
+// VerifyDPoPProof checks the DPoP header of a request (RFC 9449 §4.3): a single proof, validly signed, for this
+// request's method and URL, issued recently, carrying the current server nonce when nonces are required, and not seen
+// before. A proof presented with an access token must carry the token's hash. The verified proof is stored on the
+// context for GetDPoPProof.
+func VerifyDPoPProof(ctx *AppContext, accessToken string) (*crypt_utils.DPoPProof, *DPoPError) {
+	invalid := func(message string) (*crypt_utils.DPoPProof, *DPoPError) {
+		return nil, &DPoPError{Code: DPoPErrorInvalidProof, Message: message}
+	}
+
+	values := ctx.Request.Header.Values("DPoP")
+	if len(values) != 1 {
+		return invalid("Exactly one DPoP proof is required")
+	}
+
+	proof, err := crypt_utils.ParseDPoPProof(values[0])
+	if err != nil {
+		ctx.Logger.Debug("Invalid DPoP proof", "err", err)
+		return invalid("Invalid DPoP proof")
+	}
+
+	if proof.HTM != ctx.Request.Method || !matchesRequestURL(ctx, proof.HTU) {
+		return invalid("DPoP proof was made for another request")
+	}
+
+	now := time.Now()
+	issuedAt := time.Unix(proof.IssuedAt, 0)
+	if issuedAt.Before(now.Add(-crypt_utils.ConstDPoPProofMaxAge)) || issuedAt.After(now.Add(crypt_utils.ConstDPoPClockSkew)) {
+		return invalid("DPoP proof is expired or not yet valid")
+	}
+
+	if accessToken != "" && proof.AccessTokenHash != crypt_utils.DPoPAccessTokenHash(accessToken) {
+		return invalid("DPoP proof was made for another access token")
+	}
+
+	if ctx.Config.DPoP.RequireNonce && !crypt_utils.ValidDPoPNonce(dpopNonceKey(ctx), proof.Nonce, now) {
+		return nil, &DPoPError{Code: DPoPErrorUseNonce, Message: "DPoP proof must carry the nonce from the DPoP-Nonce header"}
+	}
+
+	// Identifiers are recorded per key, so one client cannot burn another's.
+	expiresAt := issuedAt.Add(crypt_utils.ConstDPoPProofMaxAge)
+	if err := db.NewReplayCacheQueries(ctx.DB).Record(db.ReplayPurposeDPoP, hashBearerToken(proof.Thumbprint+":"+proof.JTI), expiresAt); err != nil {
+		if !strings.Contains(err.Error(), "already used") {
+			ctx.Logger.Error("failed to record dpop proof", "err", err)
+		}
+		return invalid("DPoP proof was already used")
+	}
+
+	ctx.Set("dpop_proof", proof)
+	return proof, nil
+}
+
+// GetDPoPProof retrieves the DPoP proof verified for the request, or nil
+func GetDPoPProof(ctx *AppContext) *crypt_utils.DPoPProof {
+	if proof, ok := ctx.Get("dpop_proof").(*crypt_utils.DPoPProof); ok {
+		return proof
+	}
+	return nil
+}
+
+// SetDPoPNonce sends the current server nonce for the client's next proof, when nonces are required
+func SetDPoPNonce(ctx *AppContext) {
+	if ctx.Config.DPoP.RequireNonce {
+		ctx.Response.Header().Set("DPoP-Nonce", crypt_utils.DPoPNonce(dpopNonceKey(ctx), time.Now()))
+	}
+}
+
+// writeDPoPChallenge rejects a request to a protected resource with the DPoP authentication scheme (RFC 9449 §7.1)
+func writeDPoPChallenge(ctx *AppContext, code, message string) {
+	if code == DPoPErrorUseNonce {
+		SetDPoPNonce(ctx)
+	}
+	ctx.Response.Header().Set("WWW-Authenticate",
+		fmt.Sprintf(`DPoP error="%s", algs="%s"`, code, strings.Join(crypt_utils.DPoPAlgorithmNames(), " ")))
+	ctx.SetJSONError(http.StatusUnauthorized, message)
+}
+
+// matchesRequestURL reports whether a proof's htu is the URL of the request, without query and fragment. The URL is
+// built from the organization's issuer, as the service may run behind a proxy.
+func matchesRequestURL(ctx *AppContext, htu string) bool {
+	parsed, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	expected, err := url.Parse(ctx.Issuer() + ctx.Request.URL.Path)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(parsed.Scheme, expected.Scheme) && strings.EqualFold(parsed.Host, expected.Host) &&
+		parsed.EscapedPath() == expected.EscapedPath()
+}
+
+func dpopNonceKey(ctx *AppContext) []byte {
+	return []byte(ctx.Config.DPoP.NonceKey)
+}
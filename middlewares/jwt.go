@@ -1,11 +1,43 @@
 package middlewares
 
 import (
+	"fmt"
 	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 )
 
+// TokenUseService is the token_use claim of access tokens issued to OAuth clients through the client credentials
+// grant. Their subject is the client_id rather than a user ID.
+const TokenUseService = "service"
+
+// ActorClaim is the act claim (RFC 8693 §4.1) of a token issued through token exchange. It names the party acting
+// for the token's subject; when that party was itself acting for someone, the earlier actor is nested inside.
+type ActorClaim struct {
+	Subject  string      `json:"sub"`
+	ClientID string      `json:"client_id,omitempty"` // set when the actor is an OAuth client rather than a user
+	Actor    *ActorClaim `json:"act,omitempty"`
+}
+
+// ParseActorClaim converts a decoded act claim into an ActorClaim, or nil when the token has none
+func ParseActorClaim(value interface{}) *ActorClaim {
+	claim, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	subject, _ := claim["sub"].(string)
+	if subject == "" {
+		return nil
+	}
+	clientID, _ := claim["client_id"].(string)
+
+	return &ActorClaim{Subject: subject, ClientID: clientID, Actor: ParseActorClaim(claim["act"])}
+}
+
 // RequireJWT is a middleware that validates JWT tokens
 func RequireJWT(next func(*AppContext)) func(*AppContext) {
 	return func(ctx *AppContext) {
@@ -16,9 +48,9 @@ func RequireJWT(next func(*AppContext)) func(*AppContext) {
 			return
 		}
 
-		// Check for Bearer prefix
+		// Check for the Bearer or DPoP scheme
 		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
+		if len(parts) != 2 || (parts[0] != "Bearer" && parts[0] != "DPoP") {
 			ctx.SetJSONError(http.StatusUnauthorized, "Invalid authorization header format")
 			return
 		}
@@ -40,14 +72,211 @@ func RequireJWT(next func(*AppContext)) func(*AppContext) {
 			return
 		}
 
-		// Store user ID in context for handler use
-		ctx.Set("user_id", userID)
+		// Tokens are only accepted by the organization that issued them
+		tenant, _ := claims["tenant"].(string)
+		if ctx.Tenant == nil || tenant != ctx.Tenant.Slug || claims["iss"] != ctx.Issuer() {
+			ctx.Logger.Debug("Token issued for a different organization", "tenant", tenant, "iss", claims["iss"])
+			ctx.SetJSONError(http.StatusUnauthorized, "Token was not issued for this organization")
+			return
+		}
+
+		// Tokens narrowed to other audiences through token exchange are meant for those services only
+		if audience := ClaimAudience(claims["aud"]); len(audience) > 0 && !slices.Contains(audience, ctx.Issuer()) {
+			ctx.Logger.Debug("Token issued for a different audience", "aud", audience)
+			ctx.SetJSONError(http.StatusUnauthorized, "Token was not issued for this audience")
+			return
+		}
+
+		// Tokens bound to a key (RFC 9449 §6) need a proof of possession of that key on every request
+		jkt := ClaimJKT(claims["cnf"])
+		if jkt != "" || parts[0] == "DPoP" {
+			if jkt == "" || parts[0] != "DPoP" {
+				writeDPoPChallenge(ctx, DPoPErrorInvalidProof, "DPoP-bound tokens must be sent with the DPoP scheme and a proof")
+				return
+			}
+			proof, dpopErr := VerifyDPoPProof(ctx, token)
+			if dpopErr != nil {
+				writeDPoPChallenge(ctx, dpopErr.Code, dpopErr.Message)
+				return
+			}
+			if proof.Thumbprint != jkt {
+				writeDPoPChallenge(ctx, DPoPErrorInvalidProof, "DPoP proof was signed with another key")
+				return
+			}
+		}
+
+		// Certificate-bound tokens (RFC 8705 §3) are only accepted over a connection authenticated with that certificate
+		if x5t := ClaimCertificateThumbprint(claims["cnf"]); x5t != "" {
+			cert := ClientCertificate(ctx)
+			if cert == nil || crypt_utils.CertificateThumbprint(cert) != x5t {
+				ctx.Response.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				ctx.SetJSONError(http.StatusUnauthorized, "Token is bound to a client certificate that was not presented")
+				return
+			}
+		}
+
+		roles := ClaimStrings(claims["roles"])
+		permissions := ClaimStrings(claims["permissions"])
+		if claims["token_use"] == TokenUseService {
+			// Service tokens have no user account to check. Removing the client revokes them instead.
+			client := registeredClient(ctx, userID)
+			if client == nil {
+				ctx.SetJSONError(http.StatusUnauthorized, "Client is no longer registered")
+				return
+			}
+
+			// The client acts with the permissions of the user responsible for it, so that user's deactivation or
+			// lost permissions apply to its tokens immediately as well
+			if client.OwnerID == nil || !isActiveUser(ctx, strconv.Itoa(*client.OwnerID)) {
+				ctx.SetJSONError(http.StatusUnauthorized, "Client owner is not active")
+				return
+			}
+			_, permissions, err = currentGrants(ctx, strconv.Itoa(*client.OwnerID), nil, permissions)
+			if err != nil {
+				ctx.Logger.Error("failed to load client owner permissions", "client_id", userID, "err", err)
+				ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+				return
+			}
+			ctx.Set("client_id", userID)
+		} else {
+			// Suspending, deactivating or deleting a user takes effect immediately rather than when their tokens expire
+			if !isActiveUser(ctx, userID) {
+				ctx.SetJSONError(http.StatusUnauthorized, "Account is not active")
+				return
+			}
+			ctx.Set("user_id", userID)
+			if clientID, _ := claims["client_id"].(string); clientID != "" {
+				ctx.Set("authorized_party", clientID)
+			}
+
+			// Roles and permissions removed since the token was issued stop applying immediately as well. The
+			// claims stay the upper bound, so scopes narrowed at issuance are kept.
+			roles, permissions, err = currentGrants(ctx, userID, roles, permissions)
+			if err != nil {
+				ctx.Logger.Error("failed to load current roles", "user_id", userID, "err", err)
+				ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+				return
+			}
+		}
+
+		// Store authorization claims in context for handler use
+		ctx.Set("roles", roles)
+		ctx.Set("permissions", permissions)
+		// Scopes naming a permission that was dropped above go with it; identity scopes such as openid stay
+		scope, _ := claims["scope"].(string)
+		ctx.Set("scopes", slices.DeleteFunc(strings.Fields(scope), func(name string) bool {
+			return slices.Contains(ClaimStrings(claims["permissions"]), name) && !slices.Contains(permissions, name)
+		}))
+		if actor := ParseActorClaim(claims["act"]); actor != nil {
+			ctx.Set("actor", actor)
+		}
 
 		// Call the next handler
 		next(ctx)
 	}
 }
 
+// RequireFirstParty only lets through user tokens of the user's own sessions, issued by /api/login, /api/refresh or
+// the token endpoint without a client. Tokens issued to an OAuth client, including through token exchange, and service
+// tokens are refused, so an application the user signed in to cannot register credentials or mint tokens for the
+// account. It must be composed inside RequireJWT.
+func RequireFirstParty(next func(*AppContext)) func(*AppContext) {
+	return func(ctx *AppContext) {
+		if GetUserID(ctx) == "" || GetAuthorizedParty(ctx) != "" || GetActor(ctx) != nil {
+			ctx.Logger.Debug("Token not issued to a first-party session", "user_id", GetUserID(ctx),
+				"client_id", GetAuthorizedParty(ctx))
+			ctx.SetJSONError(http.StatusForbidden, "This endpoint requires a token from a first-party sign-in")
+			return
+		}
+
+		next(ctx)
+	}
+}
+
+// isActiveUser reports whether the token subject is a user of the request's organization that may still sign in
+func isActiveUser(ctx *AppContext, subject string) bool {
+	id, err := strconv.Atoi(subject)
+	if err != nil {
+		return false
+	}
+
+	user, err := db.NewUserQueries(ctx.DB).GetByID(id)
+	if err != nil {
+		if !strings.Contains(err.Error(), "not found") {
+			ctx.Logger.Error("failed to load token subject", "user_id", id, "err", err)
+		}
+		return false
+	}
+
+	return user.OrganizationID == ctx.Tenant.ID && user.IsActive()
+}
+
+// currentGrants narrows the roles and permissions of a user token to those the user still holds
+func currentGrants(ctx *AppContext, subject string, roles, permissions []string) ([]string, []string, error) {
+	id, err := strconv.Atoi(subject)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid subject: %w", err)
+	}
+
+	roleQueries := db.NewRoleQueries(ctx.DB)
+	currentRoles, err := roleQueries.ListForUser(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	currentPermissions, err := roleQueries.ListPermissionsForUser(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notHeld := func(current []string) func(string) bool {
+		return func(name string) bool { return !slices.Contains(current, name) }
+	}
+	roles = slices.DeleteFunc(slices.Clone(roles), notHeld(currentRoles))
+	permissions = slices.DeleteFunc(slices.Clone(permissions), notHeld(currentPermissions))
+	return roles, permissions, nil
+}
+
+// registeredClient returns the client of the request's organization a service token was issued to, or nil
+func registeredClient(ctx *AppContext, clientID string) *db.OAuthClient {
+	client, err := db.NewOAuthClientQueries(ctx.DB).GetByClientID(clientID)
+	if err != nil {
+		if !strings.Contains(err.Error(), "not found") {
+			ctx.Logger.Error("failed to load token client", "client_id", clientID, "err", err)
+		}
+		return nil
+	}
+
+	if client.OrganizationID != ctx.Tenant.ID {
+		return nil
+	}
+	return client
+}
+
+// GetClientID retrieves the OAuth client authenticated by a service token, or an empty string for user tokens
+func GetClientID(ctx *AppContext) string {
+	if clientID, ok := ctx.Get("client_id").(string); ok {
+		return clientID
+	}
+	return ""
+}
+
+// GetAuthorizedParty retrieves the OAuth client a user token was issued to, or an empty string for first-party
+// sessions
+func GetAuthorizedParty(ctx *AppContext) string {
+	if clientID, ok := ctx.Get("authorized_party").(string); ok {
+		return clientID
+	}
+	return ""
+}
+
+// GetActor retrieves the act claim of a token issued through token exchange, or nil
+func GetActor(ctx *AppContext) *ActorClaim {
+	if actor, ok := ctx.Get("actor").(*ActorClaim); ok {
+		return actor
+	}
+	return nil
+}
+
 // GetUserID retrieves the authenticated user ID from the context
 func GetUserID(ctx *AppContext) string {
 	if userID, ok := ctx.Get("user_id").(string); ok {
@@ -55,3 +284,51 @@ func GetUserID(ctx *AppContext) string {
 	}
 	return ""
 }
+
+// ClaimJKT returns the key thumbprint of a decoded cnf claim (RFC 9449 §6.1), or an empty string for unbound tokens
+func ClaimJKT(value interface{}) string {
+	cnf, ok := value.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	jkt, _ := cnf["jkt"].(string)
+	return jkt
+}
+
+// ClaimCertificateThumbprint returns the certificate thumbprint of a decoded cnf claim (RFC 8705 §3.1), or an empty
+// string for tokens not bound to a certificate
+func ClaimCertificateThumbprint(value interface{}) string {
+	cnf, ok := value.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	x5t, _ := cnf["x5t#S256"].(string)
+	return x5t
+}
+
+// ClaimAudience converts a decoded aud claim, a single string or an array (RFC 7519 §4.1.3), into a string slice
+func ClaimAudience(value interface{}) []string {
+	if audience, ok := value.(string); ok {
+		if audience == "" {
+			return []string{}
+		}
+		return []string{audience}
+	}
+	return ClaimStrings(value)
+}
+
+// ClaimStrings converts a decoded JSON array claim into a string slice
+func ClaimStrings(value interface{}) []string {
+	items, ok := value.([]interface{})
+	if !ok {
+		return []string{}
+	}
+
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			values = append(values, s)
+		}
+	}
+	return values
+}
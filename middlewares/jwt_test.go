@@ -0,0 +1,209 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"jwt-auth-poc/config"
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const testIssuer = "http://localhost:8080"
+
+// newTestClientCertificate creates a self-signed client certificate; RequireJWT only compares thumbprints, so the
+// certificate does not need to be trusted
+func newTestClientCertificate(t *testing.T, commonName string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// newTestAppContext returns application wide dependencies backed by a migrated database in a temporary directory,
+// with an active user of the default organization
+func newTestAppContext(t *testing.T) (*AppContext, *db.User) {
+	t.Helper()
+
+	logger := slog.New(slog.DiscardHandler)
+	database, err := db.New(filepath.Join(t.TempDir(), "app.db"), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if err := database.RunMigrations(); err != nil {
+		t.Fatal(err)
+	}
+
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := crypt_utils.NewECDSAJWTProvider(signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant, err := db.NewOrganizationQueries(database).GetByID(db.DefaultOrganizationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := db.NewUserQueries(database).Create(db.DefaultOrganizationID, "billing@example.com", "Billing", "unused")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &AppContext{
+		Context:     context.Background(),
+		Logger:      logger,
+		DB:          database,
+		JWTProvider: provider,
+		Config:      &config.Config{IssuerURL: testIssuer},
+		Tenant:      tenant,
+	}, user
+}
+
+// signTestToken issues an access token for the user with the given claims besides the registered ones and tenant
+func signTestToken(t *testing.T, ctx *AppContext, user *db.User, extra map[string]interface{}) string {
+	t.Helper()
+
+	claims := map[string]interface{}{"tenant": ctx.Tenant.Slug}
+	for name, value := range extra {
+		claims[name] = value
+	}
+	token, err := ctx.JWTProvider.Sign(jwt.Claims{
+		Subject:  strconv.Itoa(user.ID),
+		Issuer:   testIssuer,
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestRequireJWTCertificateBoundToken(t *testing.T) {
+	base, user := newTestAppContext(t)
+	cert := newTestClientCertificate(t, "billing")
+	other := newTestClientCertificate(t, "billing")
+
+	tests := []struct {
+		name      string
+		boundTo   *x509.Certificate
+		presented *x509.Certificate
+		tls       bool
+		want      int
+	}{
+		{name: "bound certificate presented", boundTo: cert, presented: cert, tls: true, want: http.StatusOK},
+		{name: "other certificate presented", boundTo: cert, presented: other, tls: true, want: http.StatusUnauthorized},
+		{name: "no certificate presented", boundTo: cert, tls: true, want: http.StatusUnauthorized},
+		{name: "plain http", boundTo: cert, want: http.StatusUnauthorized},
+		{name: "unbound token with a certificate", presented: cert, tls: true, want: http.StatusOK},
+		{name: "unbound token over plain http", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, testIssuer+"/api/protected", nil)
+			var claims map[string]interface{}
+			if tt.boundTo != nil {
+				claims = map[string]interface{}{"cnf": map[string]interface{}{"x5t#S256": crypt_utils.CertificateThumbprint(tt.boundTo)}}
+			}
+			r.Header.Set("Authorization", "Bearer "+signTestToken(t, base, user, claims))
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+				if tt.presented != nil {
+					r.TLS.PeerCertificates = []*x509.Certificate{tt.presented}
+				}
+			}
+			w := httptest.NewRecorder()
+
+			ctx := base.forRequest(r, w)
+			ctx.Tenant = base.Tenant
+			RequireJWT(func(ctx *AppContext) {
+				ctx.WriteText(http.StatusOK, "ok")
+			})(ctx)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if challenge := w.Header().Get("WWW-Authenticate"); tt.want == http.StatusUnauthorized && challenge != `Bearer error="invalid_token"` {
+				t.Errorf("WWW-Authenticate = %q", challenge)
+			}
+		})
+	}
+}
+
+func TestRequireFirstParty(t *testing.T) {
+	base, user := newTestAppContext(t)
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   int
+	}{
+		{name: "first-party session", want: http.StatusOK},
+		{name: "issued to a client", claims: map[string]interface{}{"client_id": "photos"}, want: http.StatusForbidden},
+		{name: "issued through token exchange", claims: map[string]interface{}{"act": map[string]interface{}{"sub": "2"}}, want: http.StatusForbidden},
+		{
+			name:   "impersonation through a client",
+			claims: map[string]interface{}{"client_id": "support", "act": map[string]interface{}{"sub": "2"}},
+			want:   http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, testIssuer+"/api/account/webauthn/register/begin", nil)
+			r.Header.Set("Authorization", "Bearer "+signTestToken(t, base, user, tt.claims))
+			w := httptest.NewRecorder()
+
+			ctx := base.forRequest(r, w)
+			ctx.Tenant = base.Tenant
+			RequireJWT(RequireFirstParty(func(ctx *AppContext) {
+				ctx.WriteText(http.StatusOK, "ok")
+			}))(ctx)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
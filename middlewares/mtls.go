@@ -0,0 +1,22 @@
+package middlewares
+
+import (
+	"crypto/x509"
+)
+
+// ClientCertificate returns the certificate the client presented on the TLS connection, or nil. The HTTPS listener
+// requests a certificate without verifying it; handlers decide how to trust it.
+func ClientCertificate(ctx *AppContext) *x509.Certificate {
+	if ctx.Request.TLS == nil || len(ctx.Request.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return ctx.Request.TLS.PeerCertificates[0]
+}
+
+// ClientCertificateChain returns the intermediate certificates the client sent after its own certificate
+func ClientCertificateChain(ctx *AppContext) []*x509.Certificate {
+	if ctx.Request.TLS == nil || len(ctx.Request.TLS.PeerCertificates) < 2 {
+		return nil
+	}
+	return ctx.Request.TLS.PeerCertificates[1:]
+}
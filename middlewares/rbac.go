@@ -0,0 +1,77 @@
+package middlewares
+
+import (
+	"jwt-auth-poc/db"
+	"net/http"
+	"slices"
+)
+
+// RequireRole rejects requests whose access token does not carry the given role.
+// It must be composed inside RequireJWT, which populates the roles from the token.
+func RequireRole(role string, next func(*AppContext)) func(*AppContext) {
+	return func(ctx *AppContext) {
+		if !HasRole(ctx, role) {
+			ctx.Logger.Debug("Missing required role", "user_id", GetUserID(ctx), "role", role)
+			ctx.SetJSONError(http.StatusForbidden, "Insufficient permissions")
+			return
+		}
+
+		next(ctx)
+	}
+}
+
+// RequirePermission rejects requests whose access token does not grant the given permission.
+// It must be composed inside RequireJWT, which populates the permissions from the token.
+func RequirePermission(permission string, next func(*AppContext)) func(*AppContext) {
+	return func(ctx *AppContext) {
+		if !HasPermission(ctx, permission) {
+			ctx.Logger.Debug("Missing required permission", "user_id", GetUserID(ctx), "permission", permission)
+			ctx.SetJSONError(http.StatusForbidden, "Insufficient permissions")
+			return
+		}
+
+		next(ctx)
+	}
+}
+
+// GetRoles retrieves the roles of the authenticated user from the context
+func GetRoles(ctx *AppContext) []string {
+	if roles, ok := ctx.Get("roles").([]string); ok {
+		return roles
+	}
+	return []string{}
+}
+
+// GetPermissions retrieves the permissions of the authenticated user from the context
+func GetPermissions(ctx *AppContext) []string {
+	if permissions, ok := ctx.Get("permissions").([]string); ok {
+		return permissions
+	}
+	return []string{}
+}
+
+// HasRole reports whether the authenticated user holds the given role
+func HasRole(ctx *AppContext, role string) bool {
+	return slices.Contains(GetRoles(ctx), role)
+}
+
+// HasPermission reports whether the authenticated user holds the given permission
+func HasPermission(ctx *AppContext, permission string) bool {
+	return slices.Contains(GetPermissions(ctx), permission)
+}
+
+// ScopedRoles returns the roles whose permissions are all within scope. A role stands for everything it grants, so a
+// token scoped to part of a role's permissions must not carry the role.
+func ScopedRoles(ctx *AppContext, roles, scope []string) ([]string, error) {
+	scoped := []string{}
+	for _, name := range roles {
+		role, err := db.NewRoleQueries(ctx.DB).GetByName(name)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(role.Permissions, func(permission string) bool { return !slices.Contains(scope, permission) }) {
+			scoped = append(scoped, name)
+		}
+	}
+	return scoped, nil
+}
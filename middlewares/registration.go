@@ -0,0 +1,84 @@
+package middlewares
+
+import (
+	"crypto/subtle"
+	"jwt-auth-poc/db"
+	"net/http"
+	"strings"
+)
+
+// RequireInitialAccessToken authenticates dynamic client registration requests (RFC 7591 §3) by an initial access
+// token issued for the request's organization that has not expired or run out of uses
+func RequireInitialAccessToken(next func(*AppContext)) func(*AppContext) {
+	return func(ctx *AppContext) {
+		value, ok := strings.CutPrefix(ctx.Request.Header.Get("Authorization"), "Bearer ")
+		if !ok || value == "" {
+			writeInvalidRegistrationToken(ctx, "Missing initial access token")
+			return
+		}
+
+		token, err := db.NewInitialAccessTokenQueries(ctx.DB).GetByHash(hashBearerToken(value))
+		if err != nil || token.OrganizationID != ctx.Tenant.ID || !token.IsUsable() {
+			if err != nil && !strings.Contains(err.Error(), "not found") {
+				ctx.Logger.Error("failed to look up initial access token", "err", err)
+			}
+			writeInvalidRegistrationToken(ctx, "Invalid, expired or used up initial access token")
+			return
+		}
+
+		ctx.Set("initial_access_token", token)
+		next(ctx)
+	}
+}
+
+// GetInitialAccessToken retrieves the initial access token that authorized the request, or nil
+func GetInitialAccessToken(ctx *AppContext) *db.InitialAccessToken {
+	if token, ok := ctx.Get("initial_access_token").(*db.InitialAccessToken); ok {
+		return token
+	}
+	return nil
+}
+
+// RequireRegistrationToken authenticates client configuration requests (RFC 7592 §2) by the registration access
+// token of the client in the {client_id} path value. The client is recorded as the caller, like a service token's.
+func RequireRegistrationToken(next func(*AppContext)) func(*AppContext) {
+	return func(ctx *AppContext) {
+		value, ok := strings.CutPrefix(ctx.Request.Header.Get("Authorization"), "Bearer ")
+		if !ok || value == "" {
+			writeInvalidRegistrationToken(ctx, "Missing registration access token")
+			return
+		}
+
+		// An unknown client and a wrong token are answered alike, so the endpoint cannot be used to probe client IDs.
+		client, err := db.NewOAuthClientQueries(ctx.DB).GetByClientID(ctx.Request.PathValue("client_id"))
+		if err != nil || client.OrganizationID != ctx.Tenant.ID || client.RegistrationTokenHash == "" ||
+			subtle.ConstantTimeCompare([]byte(hashBearerToken(value)), []byte(client.RegistrationTokenHash)) != 1 {
+			if err != nil && !strings.Contains(err.Error(), "not found") {
+				ctx.Logger.Error("failed to look up oauth client", "err", err)
+			}
+			writeInvalidRegistrationToken(ctx, "Invalid registration access token")
+			return
+		}
+
+		ctx.Set("registered_client", client)
+		ctx.Set("client_id", client.ClientID)
+		next(ctx)
+	}
+}
+
+// GetRegisteredClient retrieves the client authenticated by its registration access token, or nil
+func GetRegisteredClient(ctx *AppContext) *db.OAuthClient {
+	if client, ok := ctx.Get("registered_client").(*db.OAuthClient); ok {
+		return client
+	}
+	return nil
+}
+
+// writeInvalidRegistrationToken answers a request with a missing or bad bearer token (RFC 6750 §3)
+func writeInvalidRegistrationToken(ctx *AppContext, description string) {
+	ctx.Response.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	ctx.WriteJSON(http.StatusUnauthorized, map[string]string{
+		"error":             "invalid_token",
+		"error_description": description,
+	})
+}
@@ -0,0 +1,77 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"jwt-auth-poc/db"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SCIMContentType is the media type of SCIM requests and responses (RFC 7644 §3.1)
+const SCIMContentType = "application/scim+json"
+
+// SCIMErrorSchema identifies SCIM error responses
+const SCIMErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+
+// RequireSCIMToken authenticates provisioning clients by a SCIM bearer token issued for the request's organization
+func RequireSCIMToken(next func(*AppContext)) func(*AppContext) {
+	return func(ctx *AppContext) {
+		authHeader := ctx.Request.Header.Get("Authorization")
+		value, ok := strings.CutPrefix(authHeader, "Bearer ")
+		if !ok || value == "" {
+			ctx.Response.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+			WriteSCIMError(ctx, http.StatusUnauthorized, "", "Missing bearer token")
+			return
+		}
+
+		tokenQueries := db.NewSCIMTokenQueries(ctx.DB)
+		token, err := tokenQueries.GetByHash(hashBearerToken(value))
+		if err != nil || token.OrganizationID != ctx.Tenant.ID {
+			if err != nil && !strings.Contains(err.Error(), "not found") {
+				ctx.Logger.Error("failed to look up scim token", "err", err)
+			}
+			ctx.Response.Header().Set("WWW-Authenticate", `Bearer realm="scim", error="invalid_token"`)
+			WriteSCIMError(ctx, http.StatusUnauthorized, "", "Invalid bearer token")
+			return
+		}
+
+		if err := tokenQueries.MarkUsed(token.ID); err != nil {
+			ctx.Logger.Error("failed to record scim token use", "err", err)
+		}
+
+		ctx.Set("scim_token_id", strconv.Itoa(token.ID))
+		next(ctx)
+	}
+}
+
+// GetSCIMTokenID retrieves the ID of the SCIM token that authenticated the request
+func GetSCIMTokenID(ctx *AppContext) string {
+	if id, ok := ctx.Get("scim_token_id").(string); ok {
+		return id
+	}
+	return ""
+}
+
+// WriteSCIM writes a SCIM resource or message
+func WriteSCIM(ctx *AppContext, status int, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		ctx.Logger.Error("failed to encode scim response", "err", err)
+		status, body = http.StatusInternalServerError, []byte(`{"schemas":["`+SCIMErrorSchema+`"],"status":"500"}`)
+	}
+	ctx.WriteBytes(status, SCIMContentType, body)
+}
+
+// WriteSCIMError writes a SCIM error response (RFC 7644 §3.12). scimType may be empty.
+func WriteSCIMError(ctx *AppContext, status int, scimType, detail string) {
+	response := map[string]interface{}{
+		"schemas": []string{SCIMErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		response["scimType"] = scimType
+	}
+	WriteSCIM(ctx, status, response)
+}
@@ -0,0 +1,35 @@
+package middlewares
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// RequireScope rejects requests whose access token was not granted the given scope (RFC 6750 §3.1).
+// It must be composed inside RequireJWT, which populates the scopes from the token.
+func RequireScope(scope string, next func(*AppContext)) func(*AppContext) {
+	return func(ctx *AppContext) {
+		if !HasScope(ctx, scope) {
+			ctx.Logger.Debug("Missing required scope", "user_id", GetUserID(ctx), "scope", scope)
+			ctx.Response.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+			ctx.SetJSONError(http.StatusForbidden, "Insufficient scope")
+			return
+		}
+
+		next(ctx)
+	}
+}
+
+// GetScopes retrieves the scopes granted to the access token from the context
+func GetScopes(ctx *AppContext) []string {
+	if scopes, ok := ctx.Get("scopes").([]string); ok {
+		return scopes
+	}
+	return []string{}
+}
+
+// HasScope reports whether the access token was granted the given scope
+func HasScope(ctx *AppContext, scope string) bool {
+	return slices.Contains(GetScopes(ctx), scope)
+}
@@ -0,0 +1,156 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const tenantContextKey contextKey = "tenant"
+
+// tenantPathPrefix selects an organization by slug, e.g. /t/acme/api/login
+const tenantPathPrefix = "/t/"
+
+type requestTenant struct {
+	organization *db.Organization
+	provider     crypt_utils.JWTProvider
+	pathPrefix   string
+}
+
+// TenantKeyring caches the JWT provider of each organization
+type TenantKeyring struct {
+	mu              sync.Mutex
+	db              *db.DB
+	defaultProvider crypt_utils.JWTProvider
+	providers       map[int]crypt_utils.JWTProvider
+}
+
+// NewTenantKeyring creates a keyring. The default organization signs with defaultProvider, the key file loaded at startup.
+func NewTenantKeyring(database *db.DB, defaultProvider crypt_utils.JWTProvider) *TenantKeyring {
+	return &TenantKeyring{
+		db:              database,
+		defaultProvider: defaultProvider,
+		providers:       make(map[int]crypt_utils.JWTProvider),
+	}
+}
+
+// Provider returns the JWT provider holding an organization's signing key
+func (k *TenantKeyring) Provider(organization *db.Organization) (crypt_utils.JWTProvider, error) {
+	if organization.SigningKey == "" {
+		if organization.ID == db.DefaultOrganizationID {
+			return k.defaultProvider, nil
+		}
+		return nil, fmt.Errorf("organization %q has no signing key", organization.Slug)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if provider, ok := k.providers[organization.ID]; ok {
+		return provider, nil
+	}
+
+	privateKey, err := crypt_utils.ParseECDSAPrivateKeyPEM([]byte(organization.SigningKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing key for organization %q: %w", organization.Slug, err)
+	}
+
+	provider, err := crypt_utils.NewECDSAJWTProvider(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	k.providers[organization.ID] = provider
+	return provider, nil
+}
+
+// TenantMiddleware resolves the organization a request belongs to. A /t/{slug} path prefix takes precedence and is
+// stripped before routing; otherwise the Host header is matched against organization domains, falling back to the
+// default organization.
+func TenantMiddleware(baseCtx *AppContext) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			organizations := db.NewOrganizationQueries(baseCtx.DB)
+
+			var organization *db.Organization
+			var pathPrefix string
+			var err error
+
+			if rest, ok := strings.CutPrefix(r.URL.Path, tenantPathPrefix); ok {
+				slug, path, _ := strings.Cut(rest, "/")
+				organization, err = organizations.GetBySlug(slug)
+				if err != nil {
+					writeTenantError(baseCtx, w, err)
+					return
+				}
+
+				pathPrefix = tenantPathPrefix + slug
+				r = stripPath(r, "/"+path)
+			} else {
+				host := r.Host
+				if h, _, splitErr := net.SplitHostPort(host); splitErr == nil {
+					host = h
+				}
+
+				organization, err = organizations.GetByDomain(strings.ToLower(host))
+				if err != nil && strings.Contains(err.Error(), "not found") {
+					organization, err = organizations.GetByID(db.DefaultOrganizationID)
+				}
+				if err != nil {
+					writeTenantError(baseCtx, w, err)
+					return
+				}
+			}
+
+			provider, err := baseCtx.Keyring.Provider(organization)
+			if err != nil {
+				writeTenantError(baseCtx, w, err)
+				return
+			}
+
+			tenant := &requestTenant{organization: organization, provider: provider, pathPrefix: pathPrefix}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey, tenant)))
+		})
+	}
+}
+
+// Issuer returns the issuer URL of the request's organization
+func (ctx *AppContext) Issuer() string {
+	if ctx.Tenant == nil {
+		return ctx.Config.IssuerURL
+	}
+	if ctx.Tenant.Issuer != "" {
+		return ctx.Tenant.Issuer
+	}
+	if ctx.Tenant.ID == db.DefaultOrganizationID {
+		return ctx.Config.IssuerURL
+	}
+	return ctx.Config.IssuerURL + tenantPathPrefix + ctx.Tenant.Slug
+}
+
+// stripPath returns a shallow copy of r routed to path, as http.StripPrefix does
+func stripPath(r *http.Request, path string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = path
+	r2.URL.RawPath = ""
+	return r2
+}
+
+func writeTenantError(baseCtx *AppContext, w http.ResponseWriter, err error) {
+	ctx := &AppContext{Logger: baseCtx.Logger, Response: w}
+	if strings.Contains(err.Error(), "not found") {
+		ctx.SetJSONError(http.StatusNotFound, "Organization not found")
+		return
+	}
+	baseCtx.Logger.Error("failed to resolve organization", "err", err)
+	ctx.SetJSONError(http.StatusInternalServerError, "Internal server error")
+}
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"fmt"
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"strconv"
+	"strings"
+)
+
+// BootstrapAdmin grants the admin role to the account with the given email in an organization, creating the
+// account first when it does not exist. It reports whether a new account was created.
+//
+// Nothing records whether an existing account was registered by the owner of the email address, so anyone could have
+// signed up with it ahead of the operator. Promoting an existing account therefore sets its password and removes the
+// other ways into it, see resetSignIn, and the password is required either way.
+func BootstrapAdmin(database *db.DB, organizationID int, email, name, password string) (*db.User, bool, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return nil, false, fmt.Errorf("admin email is required")
+	}
+	if password == "" {
+		return nil, false, fmt.Errorf("a password is required for the admin account")
+	}
+
+	hashedPassword, err := crypt_utils.HashPassword(password)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	userQueries := db.NewUserQueries(database)
+	created := false
+
+	user, err := userQueries.GetByEmail(organizationID, email)
+	if err != nil {
+		if !strings.Contains(err.Error(), "not found") {
+			return nil, false, fmt.Errorf("failed to look up admin account: %w", err)
+		}
+
+		user, err = userQueries.Create(organizationID, email, name, hashedPassword)
+		if err != nil {
+			return nil, false, err
+		}
+		created = true
+	} else if err := resetSignIn(database, user.ID, hashedPassword); err != nil {
+		return nil, false, err
+	}
+
+	if err := db.NewRoleQueries(database).AssignToUser(user.ID, db.AdminRoleName); err != nil {
+		return nil, false, err
+	}
+
+	// Bootstrapping is the way back in when every administrator has been locked out, so the account is reactivated.
+	if user.Status != db.UserStatusActive {
+		if user, err = userQueries.SetStatus(user.ID, db.UserStatusActive, "admin bootstrap"); err != nil {
+			return nil, false, err
+		}
+	}
+
+	err = db.NewAuditLogQueries(database).Create(&db.AuditEntry{
+		OrganizationID: organizationID,
+		Actor:          AuditActorSystem,
+		Action:         "admin.bootstrap",
+		TargetType:     "user",
+		TargetID:       strconv.Itoa(user.ID),
+		Details:        map[string]interface{}{"email": user.Email, "created": created},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return user, created, nil
+}
+
+// resetSignIn replaces the password of an account and removes its second factors, passkeys, magic-link sign-in and
+// sessions, so only whoever knows the new password can sign in to it
+func resetSignIn(database *db.DB, userID int, hashedPassword string) error {
+	if err := db.NewUserQueries(database).SetPassword(userID, hashedPassword); err != nil {
+		return err
+	}
+	if err := db.NewUserQueries(database).SetMagicLinkEnabled(userID, false); err != nil {
+		return err
+	}
+	if err := db.NewTOTPQueries(database).Delete(userID); err != nil {
+		return err
+	}
+	if err := db.NewRecoveryCodeQueries(database).DeleteByUserID(userID); err != nil {
+		return err
+	}
+	if err := db.NewWebAuthnCredentialQueries(database).DeleteByUserID(userID); err != nil {
+		return err
+	}
+	return db.NewRefreshTokenQueries(database).DeleteByOwner(strconv.Itoa(userID))
+}
@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"jwt-auth-poc/crypt_utils"
+	"jwt-auth-poc/db"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+const (
+	jwksCacheTTL         = 5 * time.Minute  // how long keys fetched from a jwks_uri are used before fetching again
+	jwksMinRefetchPeriod = 30 * time.Second // a key set is not refetched more often than this, even for unknown keys
+	jwksFailureTTL       = 10 * time.Second // how long a failed fetch is remembered before the jwks_uri is tried again
+	jwksCacheMaxEntries  = 1000
+	jwksMaxSize          = 64 << 10
+)
+
+// jwksHTTPClient fetches key sets from the URLs clients register. It only connects to public addresses, checked after
+// DNS resolution so a host name cannot point it at internal services, and does not follow redirects or use a proxy.
+var jwksHTTPClient = &http.Client{
+	Timeout: 5 * time.Second,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				addrPort, err := netip.ParseAddrPort(address)
+				if err != nil || !isPublicAddress(addrPort.Addr()) {
+					return fmt.Errorf("jwks_uri resolves to a non-public address %s", address)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// nonPublicPrefixes are special-purpose ranges (RFC 6890) not covered by the netip.Addr predicates that
+// isPublicAddress checks, including those that embed IPv4 addresses in IPv6 ones
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+}
+
+// isPublicAddress reports whether an address is a globally routable unicast address
+func isPublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+type cachedJWKS struct {
+	keys      *jose.JSONWebKeySet // nil until a fetch succeeds
+	fetchedAt time.Time
+	err       error // error of the last fetch, when it failed after fetchedAt
+	failedAt  time.Time
+}
+
+// updatedAt returns when the jwks_uri was last fetched, successfully or not
+func (c cachedJWKS) updatedAt() time.Time {
+	if c.failedAt.After(c.fetchedAt) {
+		return c.failedAt
+	}
+	return c.fetchedAt
+}
+
+var (
+	jwksCacheMu sync.Mutex
+	jwksCache   = map[string]cachedJWKS{}
+)
+
+// ClientKeys returns the public keys a client registered for private_key_jwt and the JWT bearer grant: its jwks, or
+// the key set published at its jwks_uri. Fetched key sets are cached; refresh asks for a new copy when a signature did
+// not match the cached keys, as happens after the client rotates its keys. A failed fetch is not retried for a few
+// seconds, and keys fetched before it stay in use until they expire.
+func ClientKeys(ctx context.Context, client *db.OAuthClient, refresh bool) (*jose.JSONWebKeySet, error) {
+	if len(client.JWKS) > 0 {
+		return crypt_utils.ParseClientJWKS(client.JWKS)
+	}
+	if client.JWKSURI == "" {
+		return nil, fmt.Errorf("client has no registered keys")
+	}
+
+	jwksCacheMu.Lock()
+	cached := jwksCache[client.JWKSURI]
+	jwksCacheMu.Unlock()
+
+	age := time.Since(cached.fetchedAt)
+	fresh := cached.keys != nil && age < jwksCacheTTL
+	if cached.err != nil && time.Since(cached.failedAt) < jwksFailureTTL {
+		if fresh {
+			return cached.keys, nil
+		}
+		return nil, cached.err
+	}
+	if fresh && (age < jwksMinRefetchPeriod || !refresh) {
+		return cached.keys, nil
+	}
+
+	keys, err := fetchJWKS(ctx, client.JWKSURI)
+	switch {
+	case err == nil:
+		cached = cachedJWKS{keys: keys, fetchedAt: time.Now()}
+		storeJWKS(client.JWKSURI, cached)
+	case ctx.Err() == nil:
+		// A request that gave up is no reason to stop fetching for others
+		cached.err, cached.failedAt = err, time.Now()
+		storeJWKS(client.JWKSURI, cached)
+	}
+
+	if err != nil && !fresh {
+		return nil, err
+	}
+	return cached.keys, nil
+}
+
+// storeJWKS caches the result of fetching a jwks_uri. When the cache is full, the entry updated longest ago makes room.
+func storeJWKS(uri string, entry cachedJWKS) {
+	jwksCacheMu.Lock()
+	defer jwksCacheMu.Unlock()
+
+	if _, ok := jwksCache[uri]; !ok && len(jwksCache) >= jwksCacheMaxEntries {
+		oldest := ""
+		for key, cached := range jwksCache {
+			if oldest == "" || cached.updatedAt().Before(jwksCache[oldest].updatedAt()) {
+				oldest = key
+			}
+		}
+		delete(jwksCache, oldest)
+	}
+	jwksCache[uri] = entry
+}
+
+func fetchJWKS(ctx context.Context, uri string) (*jose.JSONWebKeySet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create jwks request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := jwksHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch jwks: status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwks: %w", err)
+	}
+	if len(body) > jwksMaxSize {
+		return nil, fmt.Errorf("jwks exceeds %d bytes", jwksMaxSize)
+	}
+
+	return crypt_utils.ParseClientJWKS(body)
+}
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"context"
+	"jwt-auth-poc/db"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIsPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"255.255.255.255", false},
+		{"224.0.0.1", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+		{"2002:a00:1::", false},
+	}
+
+	for _, tt := range tests {
+		if got := isPublicAddress(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isPublicAddress(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestClientKeysRefusesNonPublicAddress(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(`{"keys":[]}`))
+	}))
+	defer server.Close()
+
+	client := &db.OAuthClient{ClientID: "internal", JWKSURI: server.URL + "/jwks"}
+	for _, refresh := range []bool{false, true} {
+		_, err := ClientKeys(context.Background(), client, refresh)
+		if err == nil || !strings.Contains(err.Error(), "non-public address") {
+			t.Fatalf("ClientKeys error = %v, want a non-public address error", err)
+		}
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("server received %d requests", n)
+	}
+}
@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"fmt"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"strings"
+	"time"
+)
+
+// throttlePolicy describes how failed login attempts for one kind of key are penalised.
+type throttlePolicy struct {
+	prefix           string
+	freeAttempts     int           // failures allowed before delays start
+	baseDelay        time.Duration // delay after the first penalised failure, doubled for each one after
+	maxDelay         time.Duration
+	lockoutThreshold int // failures after which the key is locked out
+	lockoutDuration  time.Duration
+	window           time.Duration // failures older than this are forgotten
+}
+
+var (
+	accountThrottlePolicy = throttlePolicy{
+		prefix:           "account:",
+		freeAttempts:     3,
+		baseDelay:        time.Second,
+		maxDelay:         5 * time.Minute,
+		lockoutThreshold: 10,
+		lockoutDuration:  30 * time.Minute,
+		window:           24 * time.Hour,
+	}
+	ipThrottlePolicy = throttlePolicy{
+		prefix:           "ip:",
+		freeAttempts:     10,
+		baseDelay:        time.Second,
+		maxDelay:         5 * time.Minute,
+		lockoutThreshold: 50,
+		lockoutDuration:  time.Hour,
+		window:           24 * time.Hour,
+	}
+)
+
+// penalty returns how long a key must wait after its nth consecutive failure.
+func (p throttlePolicy) penalty(failures int) time.Duration {
+	if failures >= p.lockoutThreshold {
+		return p.lockoutDuration
+	}
+	if failures <= p.freeAttempts {
+		return 0
+	}
+
+	delay := p.baseDelay
+	for i := p.freeAttempts + 1; i < failures && delay < p.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.maxDelay {
+		delay = p.maxDelay
+	}
+	return delay
+}
+
+// AccountThrottleKey returns the login throttling key for an email address within an organization.
+func AccountThrottleKey(organizationID int, email string) string {
+	return fmt.Sprintf("%s%d:%s", accountThrottlePolicy.prefix, organizationID, strings.ToLower(strings.TrimSpace(email)))
+}
+
+func ipThrottleKey(ip string) string {
+	return ipThrottlePolicy.prefix + ip
+}
+
+// LoginRetryAfter reports how long the caller must wait before another login attempt for the
+// given email from the current client IP is allowed. A zero duration means the attempt may proceed.
+func LoginRetryAfter(ctx *middlewares.AppContext, email string) (time.Duration, error) {
+	queries := db.NewLoginAttemptQueries(ctx.DB)
+	now := time.Now()
+
+	var retryAfter time.Duration
+	for _, key := range []string{AccountThrottleKey(ctx.Tenant.ID, email), ipThrottleKey(ctx.ClientIP())} {
+		attempt, err := queries.GetByKey(key)
+		if err != nil {
+			return 0, err
+		}
+		if attempt.LockedUntil != nil && attempt.LockedUntil.After(now) {
+			if wait := attempt.LockedUntil.Sub(now); wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+
+	return retryAfter, nil
+}
+
+// RecordLoginFailure counts a failed login against both the account and the client IP.
+func RecordLoginFailure(ctx *middlewares.AppContext, email string) error {
+	queries := db.NewLoginAttemptQueries(ctx.DB)
+	now := time.Now()
+
+	keys := []struct {
+		key    string
+		policy throttlePolicy
+	}{
+		{AccountThrottleKey(ctx.Tenant.ID, email), accountThrottlePolicy},
+		{ipThrottleKey(ctx.ClientIP()), ipThrottlePolicy},
+	}
+
+	for _, k := range keys {
+		// The count comes from a single upsert so concurrent failures cannot overwrite each other's increments
+		failures, err := queries.RecordFailure(k.key, now, k.policy.window)
+		if err != nil {
+			return err
+		}
+
+		var lockedUntil *time.Time
+		if penalty := k.policy.penalty(failures); penalty > 0 {
+			until := now.Add(penalty)
+			lockedUntil = &until
+		}
+
+		if failures == k.policy.lockoutThreshold {
+			ctx.Logger.Warn("login lockout triggered", "key", k.key, "failures", failures)
+		}
+
+		if err := queries.SetLockedUntil(k.key, failures, lockedUntil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ResetLoginFailures clears the failure counter for an account. The IP counter is left untouched so
+// that a single valid account cannot be used to launder failures against other accounts.
+func ResetLoginFailures(ctx *middlewares.AppContext, email string) error {
+	return db.NewLoginAttemptQueries(ctx.DB).DeleteByKey(AccountThrottleKey(ctx.Tenant.ID, email))
+}
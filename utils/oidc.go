@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"jwt-auth-poc/db"
+	"slices"
+)
+
+// IdentityScopes are the OpenID Connect scopes (OIDC Core §5.4). Every user may request them; they select the claims
+// of ID tokens and the UserInfo endpoint rather than granting permissions.
+var IdentityScopes = []string{"openid", "profile", "email"}
+
+// Authentication context class references reported in the acr claim of ID tokens (OIDC Core §2)
+const (
+	ACRSingleFactor = "1" // one authentication factor, e.g. a password or magic link
+	ACRMultiFactor  = "2" // two factors, or a passkey with user verification
+)
+
+// AuthenticationContextClass derives the acr claim from the authentication methods of a session
+func AuthenticationContextClass(amr []string) string {
+	if len(amr) > 1 || slices.Contains(amr, "mfa") {
+		return ACRMultiFactor
+	}
+	return ACRSingleFactor
+}
+
+// IdentityClaims returns the standard claims about a user released by the granted identity scopes (OIDC Core §5.1).
+// The sub claim is not included.
+func IdentityClaims(user *db.User, scope []string) map[string]interface{} {
+	claims := map[string]interface{}{}
+	if slices.Contains(scope, "profile") {
+		claims["name"] = user.Name
+		claims["updated_at"] = user.UpdatedAt.Unix()
+	}
+	if slices.Contains(scope, "email") {
+		claims["email"] = user.Email
+	}
+	return claims
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"jwt-auth-poc/db"
+	"jwt-auth-poc/middlewares"
+	"slices"
+	"strings"
+)
+
+// ParseScope splits a space-delimited scope parameter (RFC 6749 §3.3), dropping duplicates
+func ParseScope(scope string) []string {
+	var scopes []string
+	for _, s := range strings.Fields(scope) {
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// FormatScope joins scopes into the space-delimited form used in claims and responses
+func FormatScope(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+// IntersectScope returns the requested scopes that are also in allowed, preserving the requested order
+func IntersectScope(requested, allowed []string) []string {
+	scopes := []string{}
+	for _, s := range requested {
+		if slices.Contains(allowed, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// IsScopeSubset reports whether every requested scope is in allowed
+func IsScopeSubset(requested, allowed []string) bool {
+	for _, s := range requested {
+		if !slices.Contains(allowed, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowedScopes returns the scopes a user may request: the permissions granted by their roles and the OpenID
+// Connect identity scopes
+func AllowedScopes(ctx *middlewares.AppContext, userID int) ([]string, error) {
+	permissions, err := db.NewRoleQueries(ctx.DB).ListPermissionsForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	return append(permissions, IdentityScopes...), nil
+}
+
+// GrantedScope resolves the scope of a session against the user's current permissions. An empty session scope
+// grants all of the user's permissions; otherwise permissions removed since the session began are dropped.
+func GrantedScope(ctx *middlewares.AppContext, userID int, sessionScope []string) ([]string, error) {
+	if len(sessionScope) == 0 {
+		return db.NewRoleQueries(ctx.DB).ListPermissionsForUser(userID)
+	}
+
+	allowed, err := AllowedScopes(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return IntersectScope(sessionScope, allowed), nil
+}
+
+// ErrClientOwnerInactive is returned for a client whose owner was deactivated, suspended or deleted
+var ErrClientOwnerInactive = errors.New("client owner is not active")
+
+// ClientOwnerScope narrows the scope of a client acting on its own behalf to the current permissions of the user
+// responsible for it, so a client never holds more than its owner does now
+func ClientOwnerScope(ctx *middlewares.AppContext, client *db.OAuthClient, scope []string) ([]string, error) {
+	if client.OwnerID == nil {
+		return nil, ErrClientOwnerInactive
+	}
+
+	owner, err := db.NewUserQueries(ctx.DB).GetByID(*client.OwnerID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, ErrClientOwnerInactive
+		}
+		return nil, fmt.Errorf("failed to load client owner: %w", err)
+	}
+	if owner.OrganizationID != client.OrganizationID || !owner.IsActive() {
+		return nil, ErrClientOwnerInactive
+	}
+
+	permissions, err := db.NewRoleQueries(ctx.DB).ListPermissionsForUser(owner.ID)
+	if err != nil {
+		return nil, err
+	}
+	return IntersectScope(scope, permissions), nil
+}
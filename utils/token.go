@@ -3,13 +3,18 @@ package utils
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"hash/crc32"
 	"jwt-auth-poc/crypt_utils"
 	"jwt-auth-poc/db"
 	"jwt-auth-poc/middlewares"
+	"math/big"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/go-jose/go-jose/v4/jwt"
 )
@@ -20,6 +25,11 @@ func HashToken(token string) string {
 }
 
 func GenerateRefreshToken() (token, hash string, err error) {
+	return GenerateOpaqueToken()
+}
+
+// GenerateOpaqueToken returns a random bearer secret together with the hash to store for it
+func GenerateOpaqueToken() (token, hash string, err error) {
 	b := make([]byte, 64)
 	_, err = rand.Read(b)
 	if err != nil {
@@ -31,18 +41,303 @@ func GenerateRefreshToken() (token, hash string, err error) {
 	return token, HashToken(token), nil
 }
 
-func GenerateAccessToken(ctx *middlewares.AppContext, userDetails *db.User) (string, error) {
+// AccessTokenOptions carries the details of the session an access token is issued for
+type AccessTokenOptions struct {
+	AMR      []string // authentication methods references (RFC 8176), e.g. "pwd", "otp"
+	Scope    []string // granted scope, see GrantedScope
+	ClientID string   // OAuth client the token is issued to, empty for first-party logins
+
+	// Set by token exchange only
+	Audience  []string                // services the token is meant for, empty for any
+	Actor     *middlewares.ActorClaim // party acting for the user
+	ExpiresAt time.Time               // earlier expiry than the default, zero for none
+}
+
+type accessTokenClaims struct {
+	Tenant      string                  `json:"tenant"`
+	ClientID    string                  `json:"client_id,omitempty"`
+	AMR         []string                `json:"amr,omitempty"`
+	Act         *middlewares.ActorClaim `json:"act,omitempty"`
+	Cnf         *confirmationClaim      `json:"cnf,omitempty"`
+	Scope       string                  `json:"scope"`
+	Roles       []string                `json:"roles"`
+	Permissions []string                `json:"permissions"`
+}
+
+// confirmationClaim is the cnf claim (RFC 7800) binding a token to a key the client must prove possession of
+type confirmationClaim struct {
+	JKT string `json:"jkt,omitempty"`      // thumbprint of the DPoP key (RFC 9449 §6.1)
+	X5T string `json:"x5t#S256,omitempty"` // thumbprint of the TLS client certificate (RFC 8705 §3.1)
+}
+
+// tokenConfirmation binds a token to the key of the DPoP proof and to the TLS client certificate sent with the token
+// request, or returns nil for a bearer token
+func tokenConfirmation(ctx *middlewares.AppContext) *confirmationClaim {
+	var cnf confirmationClaim
+	if proof := middlewares.GetDPoPProof(ctx); proof != nil {
+		cnf.JKT = proof.Thumbprint
+	}
+	if cert := middlewares.ClientCertificate(ctx); cert != nil {
+		cnf.X5T = crypt_utils.CertificateThumbprint(cert)
+	}
+	if cnf == (confirmationClaim{}) {
+		return nil
+	}
+	return &cnf
+}
+
+// GenerateAccessToken issues an access token for a user. When the request carried a verified DPoP proof or came with a
+// TLS client certificate, the token is bound to the proof's key or the certificate.
+func GenerateAccessToken(ctx *middlewares.AppContext, userDetails *db.User, opts AccessTokenOptions) (string, error) {
+	expiry := time.Now().Add(crypt_utils.ConstAccessTokenValidityPeriod)
+	if !opts.ExpiresAt.IsZero() && opts.ExpiresAt.Before(expiry) {
+		expiry = opts.ExpiresAt
+	}
+
+	var claims = jwt.Claims{
+		Subject:  strconv.Itoa(userDetails.ID),
+		Audience: jwt.Audience(opts.Audience),
+		Expiry:   jwt.NewNumericDate(expiry),
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+		Issuer:   ctx.Issuer(),
+	}
+
+	// The roles and permissions in the token are an upper bound: RequireJWT drops those the user has lost since on
+	// every request, but never adds ones granted later.
+	roleQueries := db.NewRoleQueries(ctx.DB)
+	roles, err := roleQueries.ListForUser(userDetails.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to load roles: %w", err)
+	}
+	permissions, err := roleQueries.ListPermissionsForUser(userDetails.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to load permissions: %w", err)
+	}
+
+	// A token only carries the permissions its scope covers, and the roles whose permissions it covers entirely, so a
+	// narrowly scoped token cannot pass RequirePermission or RequireRole checks for anything outside its scope.
+	roles, err = middlewares.ScopedRoles(ctx, roles, opts.Scope)
+	if err != nil {
+		return "", fmt.Errorf("failed to load roles: %w", err)
+	}
+	extra := []interface{}{accessTokenClaims{
+		Tenant:      ctx.Tenant.Slug,
+		ClientID:    opts.ClientID,
+		AMR:         opts.AMR,
+		Act:         opts.Actor,
+		Cnf:         tokenConfirmation(ctx),
+		Scope:       FormatScope(opts.Scope),
+		Roles:       roles,
+		Permissions: IntersectScope(permissions, opts.Scope),
+	}}
+
+	if ctx.Config.Groups.ClaimEnabled {
+		groups, err := groupsClaim(ctx, userDetails.ID)
+		if err != nil {
+			return "", err
+		}
+		extra = append(extra, groups)
+	}
+
+	token, err := ctx.JWTProvider.Sign(claims, extra...)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %v", err)
+	}
+
+	return token, nil
+}
+
+// IDTokenOptions carries the details of the authentication an ID token describes
+type IDTokenOptions struct {
+	ClientID    string    // the relying party, which becomes the audience
+	Nonce       string    // nonce of the authorization request, echoed back
+	AuthTime    time.Time // when the user signed in
+	AMR         []string  // authentication methods references of the session
+	Scope       []string  // granted scope, which selects the identity claims
+	AccessToken string    // access token issued alongside, bound through at_hash
+}
+
+type idTokenClaims struct {
+	AuthTime        int64    `json:"auth_time"`
+	Nonce           string   `json:"nonce,omitempty"`
+	ACR             string   `json:"acr"`
+	AMR             []string `json:"amr,omitempty"`
+	AccessTokenHash string   `json:"at_hash,omitempty"`
+	AuthorizedParty string   `json:"azp"`
+}
+
+// GenerateIDToken issues an OpenID Connect ID token (OIDC Core §2) for a relying party. ID tokens carry no tenant
+// claim, so RequireJWT never accepts one as an access token.
+func GenerateIDToken(ctx *middlewares.AppContext, userDetails *db.User, opts IDTokenOptions) (string, error) {
 	var claims = jwt.Claims{
 		Subject:  strconv.Itoa(userDetails.ID),
-		Expiry:   jwt.NewNumericDate(time.Now().Add(crypt_utils.ConstAccessTokenValidityPeriod)),
+		Audience: jwt.Audience{opts.ClientID},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(crypt_utils.ConstIDTokenValidityPeriod)),
 		IssuedAt: jwt.NewNumericDate(time.Now()),
-		Issuer:   "http://localhost",
+		Issuer:   ctx.Issuer(),
 	}
 
-	token, err := ctx.JWTProvider.Sign(claims)
+	idClaims := idTokenClaims{
+		AuthTime:        opts.AuthTime.Unix(),
+		Nonce:           opts.Nonce,
+		ACR:             AuthenticationContextClass(opts.AMR),
+		AMR:             opts.AMR,
+		AuthorizedParty: opts.ClientID,
+	}
+	if opts.AccessToken != "" {
+		idClaims.AccessTokenHash = accessTokenHash(opts.AccessToken)
+	}
+
+	token, err := ctx.JWTProvider.Sign(claims, idClaims, IdentityClaims(userDetails, opts.Scope))
 	if err != nil {
 		return "", fmt.Errorf("failed to sign token: %v", err)
 	}
 
 	return token, nil
 }
+
+// accessTokenHash computes the at_hash claim: the left half of the SHA-256 hash of the access token, base64url
+// encoded (OIDC Core §3.1.3.6). SHA-256 matches the ES256 signing algorithm.
+func accessTokenHash(accessToken string) string {
+	hash := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(hash[:len(hash)/2])
+}
+
+type serviceTokenClaims struct {
+	Tenant      string             `json:"tenant"`
+	ClientID    string             `json:"client_id"`
+	TokenUse    string             `json:"token_use"`
+	Cnf         *confirmationClaim `json:"cnf,omitempty"`
+	Scope       string             `json:"scope"`
+	Permissions []string           `json:"permissions"`
+}
+
+// GenerateServiceToken issues an access token to an OAuth client acting on its own behalf. The subject is the
+// client_id and the token_use claim marks it as a service token, so resource servers can tell it from user tokens.
+// Like user tokens, it is bound to the key of a DPoP proof or the client certificate sent with the request. The
+// scope is narrowed to the current permissions of the client's owner and returned with the token; clients whose owner
+// is no longer active get ErrClientOwnerInactive.
+func GenerateServiceToken(ctx *middlewares.AppContext, client *db.OAuthClient, scope []string) (string, []string, error) {
+	scope, err := ClientOwnerScope(ctx, client, scope)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var claims = jwt.Claims{
+		Subject:  client.ClientID,
+		Expiry:   jwt.NewNumericDate(time.Now().Add(client.TokenLifetimeDuration())),
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+		Issuer:   ctx.Issuer(),
+	}
+
+	token, err := ctx.JWTProvider.Sign(claims, serviceTokenClaims{
+		Tenant:      ctx.Tenant.Slug,
+		ClientID:    client.ClientID,
+		TokenUse:    middlewares.TokenUseService,
+		Cnf:         tokenConfirmation(ctx),
+		Scope:       FormatScope(scope),
+		Permissions: scope,
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to sign token: %v", err)
+	}
+
+	return token, scope, nil
+}
+
+// GenerateClientCredentials returns a new client_id, a client secret and the hash to store for the secret
+func GenerateClientCredentials() (clientID, secret, secretHash string, err error) {
+	b := make([]byte, 12)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+
+	secret, secretHash, err = GenerateOpaqueToken()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return hex.EncodeToString(b), secret, secretHash, nil
+}
+
+// groupsClaim lists the user's groups, including those inherited through nesting, under the configured claim name.
+// Users in more groups than the configured limit get an OpenID Connect distributed claim pointing at the groups
+// endpoint instead, which keeps the token small enough for headers and cookies.
+func groupsClaim(ctx *middlewares.AppContext, userID int) (map[string]interface{}, error) {
+	groups, err := db.NewGroupQueries(ctx.DB).ListNamesForUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load groups: %w", err)
+	}
+
+	name := ctx.Config.Groups.ClaimName
+	if len(groups) <= ctx.Config.Groups.ClaimLimit {
+		return map[string]interface{}{name: groups}, nil
+	}
+
+	return map[string]interface{}{
+		"_claim_names": map[string]string{name: "groups"},
+		"_claim_sources": map[string]interface{}{
+			"groups": map[string]string{"endpoint": ctx.Issuer() + "/api/account/groups"},
+		},
+	}, nil
+}
+
+// GeneratePersonalAccessToken returns a new personal access token, the hash to store for it and a hint to show in
+// listings. Tokens are the prefix, 64 random hex characters and a CRC-32 checksum of those, so secret scanners can
+// match `jap_[0-9a-f]{72}` and discard false positives without calling the server.
+func GeneratePersonalAccessToken() (token, hash, hint string, err error) {
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+
+	random := hex.EncodeToString(b)
+	token = fmt.Sprintf("%s%s%08x", middlewares.PersonalAccessTokenPrefix, random, crc32.ChecksumIEEE([]byte(random)))
+
+	return token, HashToken(token), token[len(token)-4:], nil
+}
+
+// userCodeAlphabet holds the characters of device flow user codes: consonants only, so codes cannot spell words and
+// are easy to read and type (RFC 8628 §6.1)
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// GenerateUserCode returns a device flow user code in the form XXXX-XXXX, together with the hash to store for it
+func GenerateUserCode() (code, hash string, err error) {
+	b := make([]byte, 8)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", "", err
+		}
+		b[i] = userCodeAlphabet[n.Int64()]
+	}
+
+	code = string(b[:4]) + "-" + string(b[4:])
+	return code, HashUserCode(code), nil
+}
+
+// NormalizeUserCode uppercases a user code as typed and drops everything but its letters, so dashes, spaces and
+// lowercase are accepted
+func NormalizeUserCode(raw string) string {
+	return strings.Map(func(r rune) rune {
+		r = unicode.ToUpper(r)
+		if r < 'A' || r > 'Z' {
+			return -1
+		}
+		return r
+	}, raw)
+}
+
+// FormatUserCode formats a user code as typed for display, in the form XXXX-XXXX
+func FormatUserCode(raw string) string {
+	code := NormalizeUserCode(raw)
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// HashUserCode hashes a user code as typed, after normalizing it
+func HashUserCode(raw string) string {
+	return HashToken(NormalizeUserCode(raw))
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"context"
+	"jwt-auth-poc/db"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// RevokeUserSessions deletes a user's refresh tokens, so no new access tokens can be obtained without signing in.
+// Access tokens that are already issued are refused by RequireJWT once the user is no longer active.
+func RevokeUserSessions(database *db.DB, userID int) error {
+	return db.NewRefreshTokenQueries(database).DeleteByOwner(strconv.Itoa(userID))
+}
+
+// StartUserPurge permanently removes users soft deleted longer ago than retention, once at startup and then every
+// interval until ctx is cancelled
+func StartUserPurge(ctx context.Context, database *db.DB, retention, interval time.Duration, logger *slog.Logger) {
+	purge := func() {
+		purged, err := db.NewUserQueries(database).PurgeDeleted(retention)
+		if err != nil {
+			logger.Error("failed to purge deleted users", "err", err)
+			return
+		}
+		if purged > 0 {
+			logger.Info("Purged deleted users", "count", purged)
+		}
+	}
+
+	go func() {
+		purge()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				purge()
+			}
+		}
+	}()
+}